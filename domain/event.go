@@ -19,6 +19,29 @@ type Event interface {
 // mapping aliases to actual events
 type CapturedEvents map[string]Event
 
+// An EventList holds the events captured under a single alias by a Kleene closure, in the order they were captured.
+// It is itself an Event so that it may be held in CapturedEvents: its type is that of its first event and its
+// timestamp that of its last, but it has no attributes of its own (they must be accessed through its elements).
+type EventList []Event
+
+func (l EventList) Type() string {
+	if len(l) == 0 {
+		return ""
+	}
+	return l[0].Type()
+}
+
+func (l EventList) Attributes() map[string]interface{} {
+	return nil
+}
+
+func (l EventList) When() time.Time {
+	if len(l) == 0 {
+		return time.Time{}
+	}
+	return l[len(l)-1].When()
+}
+
 func DescribeCapturedEvents(evs CapturedEvents) string {
 	results := make([]string, 0, len(evs))
 
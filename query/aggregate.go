@@ -0,0 +1,451 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A listLookup looks up an attribute from each of the events captured under an alias by a Kleene closure (eg.
+// "a[].price"), in order. Its value is a []interface{}; an alias that was captured singly is treated as a list of one.
+type listLookup struct {
+	alias string
+	path  []string // If empty, the values are the events themselves
+}
+
+func (v *listLookup) QueryText() string {
+	if len(v.path) == 0 {
+		return quoteName(v.alias) + "[]"
+	}
+	return quoteName(v.alias) + "[]." + joinPath(v.path...)
+}
+
+// cancelCheckInterval is the number of list elements processed between checks for cancellation
+const cancelCheckInterval = 256
+
+func (v *listLookup) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.valueContext(context.Background(), evs)
+}
+
+func (v *listLookup) valueContext(ctx context.Context, evs domain.CapturedEvents) (interface{}, error) {
+	return v.values(ctx, evs, false)
+}
+
+// values looks up the attribute from each of the events. If skipMissing is set, events which don't have it (or any
+// part of its path) are left out, rather than being an error.
+func (v *listLookup) values(ctx context.Context, evs domain.CapturedEvents, skipMissing bool) ([]interface{}, error) {
+	ev, ok := evs[v.alias]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+	list, ok := ev.(domain.EventList)
+	if !ok {
+		list = domain.EventList{ev}
+	}
+
+	result := make([]interface{}, 0, len(list))
+	for i, e := range list {
+		if i%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if len(v.path) == 0 {
+			result = append(result, e)
+		} else if val, err := lookupEvent(v.QueryText(), e, v.path); err == nil {
+			result = append(result, val)
+		} else if !skipMissing || !isMissing(err) {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (v *listLookup) usedAliases() []string {
+	return []string{v.alias}
+}
+
+func (v *listLookup) Equal(other value) bool {
+	o, ok := other.(*listLookup)
+	return ok && v.alias == o.alias && samePath(v.path, o.path)
+}
+
+func (v *listLookup) Clone() Value {
+	return &listLookup{alias: v.alias, path: append([]string(nil), v.path...)}
+}
+
+func (v *listLookup) children() []interface{} {
+	return nil
+}
+
+// An indexLookup looks up an attribute from a single event captured under an alias by a Kleene closure, either by
+// absolute position (eg. "a[0].price") or relative to the current element (eg. "a[i].price" or "a[i-1].price").
+//
+// The current element is threaded through domain.CapturedEvents implicitly: it is always the last element of the
+// alias' EventList. When matching, the engine evaluates predicates each time it appends a candidate element to the
+// list, so at that point a[i] is the candidate and a[i-1] the element captured before it.
+//
+// Indices which are out of range resolve to ErrEventNotFound (the event hasn't been captured, or never will be).
+type indexLookup struct {
+	alias  string
+	index  value // The absolute index; nil if the index is relative to the current element
+	offset int   // The offset from the current element, if index is nil
+	path   []string
+}
+
+func (v *indexLookup) QueryText() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString(quoteName(v.alias))
+	buf.WriteRune('[')
+	if v.index == nil {
+		buf.WriteRune('i')
+		if v.offset != 0 {
+			buf.WriteString(fmt.Sprintf("%+d", v.offset))
+		}
+	} else if lit, ok := v.index.(literalValue); ok && isIntegral(lit.v) {
+		buf.WriteString(fmt.Sprintf("%d", int(lit.v.(float64))))
+	} else {
+		buf.WriteString(v.index.QueryText())
+	}
+	buf.WriteRune(']')
+	if len(v.path) > 0 {
+		buf.WriteRune('.')
+		buf.WriteString(joinPath(v.path...))
+	}
+	return buf.String()
+}
+
+// isIntegral reports whether v is a float64 holding a whole number
+func isIntegral(v interface{}) bool {
+	f, ok := v.(float64)
+	return ok && f == math.Trunc(f) && !math.IsInf(f, 0)
+}
+
+// wholeNumber returns a whole number of any numeric type (eg. an int attribute, or a float64 literal) as an int, for use
+// as an index. ok is false if v isn't one (see integerValue).
+func wholeNumber(v interface{}) (int, bool) {
+	i, ok := integerValue(v)
+	return int(i), ok && int64(int(i)) == i
+}
+
+func (v *indexLookup) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.valueContext(context.Background(), evs)
+}
+
+func (v *indexLookup) valueContext(ctx context.Context, evs domain.CapturedEvents) (interface{}, error) {
+	ev, ok := evs[v.alias]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+	list, ok := ev.(domain.EventList)
+	if !ok {
+		list = domain.EventList{ev}
+	}
+
+	idx := len(list) - 1 + v.offset
+	if v.index != nil {
+		if val, err := resolve(ctx, v.index, evs); err != nil {
+			return nil, err
+		} else if i, ok := wholeNumber(val); !ok {
+			return nil, fmt.Errorf("Index of %s must be a whole number, got %v", v.QueryText(), val)
+		} else {
+			idx = i
+		}
+	}
+	if idx < 0 || idx >= len(list) {
+		return nil, fmt.Errorf("%s is out of range: %w", v.QueryText(), ErrEventNotFound)
+	}
+
+	if len(v.path) == 0 {
+		return list[idx], nil
+	}
+	return lookupEvent(v.QueryText(), list[idx], v.path)
+}
+
+func (v *indexLookup) usedAliases() []string {
+	result := []string{v.alias}
+	if v.index != nil {
+		result = append(result, v.index.usedAliases()...)
+	}
+	return dedupeAliases(result)
+}
+
+func (v *indexLookup) Equal(other value) bool {
+	o, ok := other.(*indexLookup)
+	return ok && v.alias == o.alias && v.offset == o.offset && sameValue(v.index, o.index) && samePath(v.path, o.path)
+}
+
+func (v *indexLookup) Clone() Value {
+	return &indexLookup{
+		alias:  v.alias,
+		index:  cloneValue(v.index),
+		offset: v.offset,
+		path:   append([]string(nil), v.path...),
+	}
+}
+
+func (v *indexLookup) children() []interface{} {
+	return valueNodes(v.index)
+}
+
+// A boundaryLookup looks up an attribute from the first or last of the events captured under an alias by a Kleene
+// closure (eg. "first(a[]).price" or "last(a[]).price"), as a[0].price and a[a.LEN - 1].price would. If none have been
+// captured, it resolves to ErrEventNotFound.
+type boundaryLookup struct {
+	alias string
+	last  bool
+	path  []string // If empty, the value is the event itself
+}
+
+func (v *boundaryLookup) QueryText() string {
+	text := v.name() + "(" + quoteName(v.alias) + "[])"
+	if len(v.path) > 0 {
+		text += "." + joinPath(v.path...)
+	}
+	return text
+}
+
+// name returns the name by which the lookup is called in a query
+func (v *boundaryLookup) name() string {
+	if v.last {
+		return "last"
+	}
+	return "first"
+}
+
+func (v *boundaryLookup) Value(evs domain.CapturedEvents) (interface{}, error) {
+	ev, ok := evs[v.alias]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+	list, ok := ev.(domain.EventList)
+	if !ok {
+		list = domain.EventList{ev}
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("%s has no events: %w", v.QueryText(), ErrEventNotFound)
+	}
+
+	ev = list[0]
+	if v.last {
+		ev = list[len(list)-1]
+	}
+	if len(v.path) == 0 {
+		return ev, nil
+	}
+	return lookupEvent(v.QueryText(), ev, v.path)
+}
+
+func (v *boundaryLookup) usedAliases() []string {
+	return []string{v.alias}
+}
+
+func (v *boundaryLookup) Equal(other value) bool {
+	o, ok := other.(*boundaryLookup)
+	return ok && v.alias == o.alias && v.last == o.last && samePath(v.path, o.path)
+}
+
+func (v *boundaryLookup) Clone() Value {
+	return &boundaryLookup{alias: v.alias, last: v.last, path: append([]string(nil), v.path...)}
+}
+
+func (v *boundaryLookup) children() []interface{} {
+	return nil
+}
+
+// A lengthValue is the number of events captured under an alias by a Kleene closure (eg. "a.LEN")
+type lengthValue string // Holds the alias
+
+func (v lengthValue) QueryText() string {
+	return joinPath(string(v)) + ".LEN"
+}
+
+func (v lengthValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	ev, ok := evs[string(v)]
+	if !ok {
+		return nil, ErrEventNotFound
+	} else if list, ok := ev.(domain.EventList); ok {
+		return float64(len(list)), nil
+	}
+	return float64(1), nil // Captured singly
+}
+
+func (v lengthValue) usedAliases() []string {
+	return []string{string(v)}
+}
+
+func (v lengthValue) Equal(other value) bool {
+	o, ok := other.(lengthValue)
+	return ok && v == o
+}
+
+func (v lengthValue) Clone() Value {
+	return v
+}
+
+func (v lengthValue) children() []interface{} {
+	return nil
+}
+
+type aggregateFunc uint8
+
+const (
+	afSum   aggregateFunc = iota // sum of the values
+	afAvg                        // arithmetic mean of the values
+	afMin                        // smallest value
+	afMax                        // largest value
+	afCount                      // number of values (which need not be numeric)
+	afP50                        // median
+	afP90                        // 90th percentile
+	afP95                        // 95th percentile
+	afP99                        // 99th percentile
+)
+
+// aggregateFuncs maps the names by which aggregates are called in queries to their functions
+var aggregateFuncs = map[string]aggregateFunc{
+	"sum":   afSum,
+	"avg":   afAvg,
+	"min":   afMin,
+	"max":   afMax,
+	"count": afCount,
+	"p50":   afP50,
+	"p90":   afP90,
+	"p95":   afP95,
+	"p99":   afP99,
+}
+
+// percentiles maps the percentile aggregates to the percentile they compute
+var percentiles = map[aggregateFunc]float64{afP50: 50, afP90: 90, afP95: 95, afP99: 99}
+
+func (f aggregateFunc) String() string {
+	for name, candidate := range aggregateFuncs {
+		if candidate == f {
+			return name
+		}
+	}
+	return ""
+}
+
+// An aggregateValue computes an aggregate (sum, avg, etc.) over a list of values, typically from a listLookup
+type aggregateValue struct {
+	fn      aggregateFunc
+	operand value
+}
+
+func (v *aggregateValue) QueryText() string {
+	if v.operand == nil {
+		return v.fn.String() + "()"
+	}
+	return v.fn.String() + "(" + v.operand.QueryText() + ")"
+}
+
+func (v *aggregateValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.valueContext(context.Background(), evs)
+}
+
+func (v *aggregateValue) valueContext(ctx context.Context, evs domain.CapturedEvents) (interface{}, error) {
+	if v.operand == nil {
+		return nil, fmt.Errorf("Operand of %s must not be nil", v.QueryText())
+	}
+	val, err := resolve(ctx, v.operand, evs)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s requires a list of values (eg. a[].x), got %T", v.fn.String(), val)
+	}
+	if v.fn == afCount {
+		return float64(len(list)), nil
+	}
+
+	nums := make([]float64, len(list))
+	for i, item := range list {
+		if i%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if num, ok := numericValue(item); !ok {
+			return nil, fmt.Errorf("Cannot compute %s: %T is not numeric", v.QueryText(), item)
+		} else {
+			nums[i] = num
+		}
+	}
+	if len(nums) == 0 && v.fn != afSum {
+		if _, ok := v.operand.(*recentValue); ok { // Nothing has matched yet to aggregate (see recentValue)
+			return nil, fmt.Errorf("%s has no recent values: %w", v.QueryText(), ErrEventNotFound)
+		}
+		return nil, fmt.Errorf("Cannot compute %s of no values", v.QueryText())
+	}
+
+	switch v.fn {
+	case afSum, afAvg:
+		total := float64(0)
+		for _, num := range nums {
+			total += num
+		}
+		if v.fn == afAvg {
+			return total / float64(len(nums)), nil
+		}
+		return total, nil
+
+	case afMin, afMax:
+		result := nums[0]
+		for _, num := range nums[1:] {
+			if math.IsNaN(num) { // As with sum and avg, a NaN makes the whole aggregate NaN
+				return num, nil
+			} else if (v.fn == afMin && num < result) || (v.fn == afMax && num > result) {
+				result = num
+			}
+		}
+		return result, nil
+
+	case afP50, afP90, afP95, afP99:
+		return percentile(nums, percentiles[v.fn]), nil
+
+	default:
+		return nil, fmt.Errorf("Unhandled aggregate %v", v.fn)
+	}
+}
+
+// percentile computes the pth percentile of some numbers (which it sorts), interpolating linearly between the two
+// nearest to its rank where it falls between them. A NaN makes it NaN, as for the other aggregates.
+func percentile(nums []float64, p float64) float64 {
+	for _, num := range nums {
+		if math.IsNaN(num) {
+			return num
+		}
+	}
+	sort.Float64s(nums)
+	rank := p / 100 * float64(len(nums)-1)
+	low, high := int(math.Floor(rank)), int(math.Ceil(rank))
+	if low == high {
+		return nums[low]
+	}
+	return nums[low] + (nums[high]-nums[low])*(rank-float64(low))
+}
+
+func (v *aggregateValue) usedAliases() []string {
+	if v.operand == nil {
+		return []string{}
+	}
+	return v.operand.usedAliases()
+}
+
+func (v *aggregateValue) Equal(other value) bool {
+	o, ok := other.(*aggregateValue)
+	return ok && v.fn == o.fn && sameValue(v.operand, o.operand)
+}
+
+func (v *aggregateValue) Clone() Value {
+	return &aggregateValue{fn: v.fn, operand: cloneValue(v.operand)}
+}
+
+func (v *aggregateValue) children() []interface{} {
+	return valueNodes(v.operand)
+}
@@ -0,0 +1,372 @@
+package query
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func tStocks(prices ...interface{}) domain.EventList {
+	result := make(domain.EventList, len(prices))
+	for i, price := range prices {
+		result[i] = &tEventImpl{
+			typ: "stock",
+			attrs: map[string]interface{}{
+				"price":  price,
+				"symbol": "GOOG",
+			},
+			ts: time.Unix(int64(i), 0),
+		}
+	}
+	return result
+}
+
+func TestListLookup(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": tStocks(float64(1), int(2), "3"),
+		"b": tStocks(float64(4))[0], // Captured singly
+		"e": tStocks(),
+	}
+
+	v := &listLookup{alias: "a", path: []string{"price"}}
+	require.Equal(t, "a[].price", v.QueryText())
+	require.Equal(t, []string{"a"}, v.usedAliases())
+	result, err := v.Value(evs)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{float64(1), int(2), "3"}, result)
+
+	result, err = (&listLookup{alias: "b", path: []string{"price"}}).Value(evs)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{float64(4)}, result)
+
+	result, err = (&listLookup{alias: "e", path: []string{"price"}}).Value(evs)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{}, result)
+
+	v = &listLookup{alias: "a"}
+	require.Equal(t, "a[]", v.QueryText())
+	result, err = v.Value(evs)
+	require.NoError(t, err)
+	require.Len(t, result, 3)
+
+	_, err = (&listLookup{alias: "a", path: []string{"volume"}}).Value(evs)
+	require.Error(t, err)
+	_, err = (&listLookup{alias: "c", path: []string{"price"}}).Value(evs)
+	require.Equal(t, ErrEventNotFound, err)
+}
+
+func TestIndexLookup(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": tStocks(float64(1), float64(2), float64(3)),
+		"b": tStocks(float64(4))[0], // Captured singly
+		"n": &tEventImpl{
+			typ: "n",
+			attrs: map[string]interface{}{
+				"one":  float64(1),
+				"half": float64(0.5),
+				"two":  int(2),
+			},
+		},
+	}
+	price := []string{"price"}
+
+	cases := map[*indexLookup]interface{}{
+		&indexLookup{alias: "a", path: price}:                                          float64(3), // a[i] is the last
+		&indexLookup{alias: "a", offset: -1, path: price}:                              float64(2),
+		&indexLookup{alias: "a", offset: -2, path: price}:                              float64(1),
+		&indexLookup{alias: "a", offset: -3, path: price}:                              ErrEventNotFound,
+		&indexLookup{alias: "a", offset: 1, path: price}:                               ErrEventNotFound,
+		&indexLookup{alias: "a", index: literalValue{float64(0)}, path: price}:         float64(1),
+		&indexLookup{alias: "a", index: literalValue{float64(2)}, path: price}:         float64(3),
+		&indexLookup{alias: "a", index: literalValue{float64(3)}, path: price}:         ErrEventNotFound,
+		&indexLookup{alias: "a", index: literalValue{float64(-1)}, path: price}:        ErrEventNotFound,
+		&indexLookup{alias: "a", index: attributeLookup("n.one"), path: price}:         float64(2),
+		&indexLookup{alias: "a", index: attributeLookup("n.two"), path: price}:         float64(3),
+		&indexLookup{alias: "a", index: attributeLookup("m.one"), path: price}:         ErrEventNotFound,
+		&indexLookup{alias: "b", path: price}:                                          float64(4),
+		&indexLookup{alias: "b", index: literalValue{float64(0)}, path: price}:         float64(4),
+		&indexLookup{alias: "b", offset: -1, path: price}:                              ErrEventNotFound,
+		&indexLookup{alias: "c", path: price}:                                          ErrEventNotFound,
+		&indexLookup{alias: "a", index: attributeLookup("n.half"), path: price}:        nil, // Not a whole number
+		&indexLookup{alias: "a", index: literalValue{float64(0)}, path: []string{"x"}}: nil,
+	}
+
+	for v, expected := range cases {
+		result, err := v.Value(evs)
+		switch expected {
+		case ErrEventNotFound:
+			require.True(t, errors.Is(err, ErrEventNotFound), v.QueryText())
+		case nil:
+			require.Error(t, err, v.QueryText())
+			require.False(t, errors.Is(err, ErrEventNotFound), v.QueryText())
+		default:
+			require.NoError(t, err, v.QueryText())
+			require.Equal(t, expected, result, v.QueryText())
+		}
+	}
+
+	queryTexts := map[string]*indexLookup{
+		"a[i].price":        {alias: "a", path: price},
+		"a[i-1].price":      {alias: "a", offset: -1, path: price},
+		"a[i+2].price":      {alias: "a", offset: 2, path: price},
+		"a[0].price":        {alias: "a", index: literalValue{float64(0)}, path: price},
+		"a[n.one].price":    {alias: "a", index: attributeLookup("n.one"), path: price},
+		"a[i]":              {alias: "a"},
+		"a[1.500000].price": {alias: "a", index: literalValue{float64(1.5)}, path: price},
+	}
+	for queryText, v := range queryTexts {
+		require.Equal(t, queryText, v.QueryText())
+	}
+	require.Equal(t, []string{"a", "n"}, (&indexLookup{alias: "a", index: attributeLookup("n.one")}).usedAliases())
+}
+
+func TestBoundaryLookup(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": tStocks(float64(10), float64(12), float64(15)),
+		"b": tStocks(float64(4))[0], // Captured singly
+		"e": tStocks(),
+	}
+	const capture = "EVENT SEQ(stock+ a[], stock b, stock+ c[], stock+ e[]) WHERE "
+	for expr, expected := range map[string]float64{
+		"first(a[]).price":                   10,
+		"last(a[]).price":                    15,
+		"FIRST(b[]).price":                   4,
+		"last(b[]).price":                    4,
+		"last(a[].price) - first(a[]).price": 5,
+	} {
+		q, err := Parse(capture + expr + " == null")
+		require.NoError(t, err, expr)
+		result, err := q.predicate.(*operatorPredicate).left.Value(evs)
+		require.NoError(t, err, expr)
+		require.Equal(t, expected, result, expr)
+	}
+	for expr, expected := range map[string]Result{
+		"first(a[]).price < last(a[]).price":                   Positive,
+		"last(a[]).price - first(a[]).price > 5":               Negative,
+		"last(a[]).price == a[a.LEN - 1].price":                Positive,
+		"first(e[]).price > 1":                                 Positive, // As for any other missing event
+		"first(e[]).price IN (1, 2) OR last(c[]).price IN (1)": Uncertain,
+	} {
+		q, err := Parse(capture + expr)
+		require.NoError(t, err, expr)
+		result, err := q.predicate.EvaluateErr(evs)
+		require.NoError(t, err, expr)
+		require.Equal(t, expected, result, expr)
+	}
+
+	v := &boundaryLookup{alias: "e", path: []string{"price"}}
+	_, err := v.Value(evs)
+	require.True(t, errors.Is(err, ErrEventNotFound))
+	require.Contains(t, err.Error(), "first(e[]).price has no events")
+	_, err = (&boundaryLookup{alias: "c", last: true}).Value(evs)
+	require.Equal(t, ErrEventNotFound, err)
+	ev, err := (&boundaryLookup{alias: "a", last: true}).Value(evs)
+	require.NoError(t, err)
+	require.Equal(t, evs["a"].(domain.EventList)[2], ev)
+
+	// The path may be selected from the lookup, or from the list it looks through
+	for text, expected := range map[string]string{
+		"first(a[]).price < last(a[]).price":    "first(a[]).price < last(a[]).price",
+		"first(a[].price) < last(a[].m.x)":      "first(a[]).price < last(a[]).m.x",
+		"last(a[]).m.x * 2 >= first(a[]).price": "last(a[]).m.x * 2.000000 >= first(a[]).price",
+		"first(a[]) == last(a[])":               "first(a[]) == last(a[])",
+	} {
+		q, err := Parse("EVENT stock+ a[] WHERE " + text)
+		require.NoError(t, err, text)
+		require.Equal(t, expected, q.predicate.QueryText(), text)
+		reparsed, err := Parse("EVENT stock+ a[] WHERE " + q.predicate.QueryText())
+		require.NoError(t, err, text)
+		require.True(t, q.predicate.Equal(reparsed.predicate), text)
+	}
+
+	for text, msg := range map[string]string{
+		"first(a.price) > 1":       "first takes the events captured under an alias, eg. first(a[]).x",
+		"last(a[], a[]).price > 1": "last takes the events captured under an alias, eg. last(a[]).x",
+		"first().price > 1":        "first takes the events captured under an alias",
+		"abs(a.price).x > 1":       "Cannot select .x from abs(), which is not an event",
+	} {
+		_, err := Parse("EVENT stock+ a[] WHERE " + text)
+		require.Error(t, err, text)
+		require.Contains(t, err.Error(), msg, text)
+	}
+	require.Panics(t, func() { RegisterFunction("last", Function{Arity: 1, Apply: fnLength}) })
+}
+
+func TestLengthValue(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": tStocks(float64(1), float64(2), float64(3)),
+		"b": tStocks(float64(4))[0], // Captured singly
+		"e": tStocks(),
+	}
+
+	cases := map[lengthValue]interface{}{
+		"a": float64(3),
+		"b": float64(1),
+		"e": float64(0),
+	}
+	for v, expected := range cases {
+		result, err := v.Value(evs)
+		require.NoError(t, err, v.QueryText())
+		require.Equal(t, expected, result, v.QueryText())
+		require.Equal(t, []string{string(v)}, v.usedAliases())
+	}
+	_, err := lengthValue("c").Value(evs)
+	require.Equal(t, ErrEventNotFound, err)
+	require.Equal(t, "a.LEN", lengthValue("a").QueryText())
+
+	// Composes with indexing and arithmetic
+	last := &indexLookup{
+		alias: "a",
+		index: &arithmeticValue{left: lengthValue("a"), right: literalValue{float64(1)}, op: aoSubtract},
+		path:  []string{"price"},
+	}
+	require.Equal(t, "a[a.LEN - 1.000000].price", last.QueryText())
+	result, err := last.Value(evs)
+	require.NoError(t, err)
+	require.Equal(t, float64(3), result)
+	_, err = (&indexLookup{alias: "a", index: lengthValue("a"), path: []string{"price"}}).Value(evs)
+	require.True(t, errors.Is(err, ErrEventNotFound)) // Beyond the end
+}
+
+func TestAggregateValue(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": tStocks(float64(1), int(5), uint8(3)),
+		"s": tStocks(float64(7))[0], // Captured singly
+		"e": tStocks(),
+		"x": tStocks("foo", "bar"),
+	}
+
+	cases := map[aggregateFunc]map[string]interface{}{
+		afSum: {
+			"a": float64(9),
+			"s": float64(7),
+			"e": float64(0),
+			"x": nil, // Not numeric
+		},
+		afAvg: {
+			"a": float64(3),
+			"s": float64(7),
+			"e": nil, // No values to average
+			"x": nil,
+		},
+		afMin: {
+			"a": float64(1),
+			"s": float64(7),
+			"e": nil,
+			"x": nil,
+		},
+		afMax: {
+			"a": float64(5),
+			"s": float64(7),
+			"e": nil,
+			"x": nil,
+		},
+		afCount: {
+			"a": float64(3),
+			"s": float64(1),
+			"e": float64(0),
+			"x": float64(2), // Need not be numeric
+		},
+		afP50: {
+			"a": float64(3),
+			"s": float64(7),
+			"e": nil,
+			"x": nil,
+		},
+		afP90: {
+			"a": 4.6, // Between the two nearest ranks
+			"s": float64(7),
+			"e": nil,
+			"x": nil,
+		},
+	}
+
+	for fn, fnCases := range cases {
+		for alias, expected := range fnCases {
+			v := &aggregateValue{fn: fn, operand: &listLookup{alias: alias, path: []string{"price"}}}
+			result, err := v.Value(evs)
+			if expected == nil {
+				require.Error(t, err, v.QueryText())
+			} else {
+				require.NoError(t, err, v.QueryText())
+				require.Equal(t, expected, result, v.QueryText())
+			}
+		}
+
+		// Uncaptured aliases are Uncertain
+		v := &aggregateValue{fn: fn, operand: &listLookup{alias: "z", path: []string{"price"}}}
+		_, err := v.Value(evs)
+		require.Equal(t, ErrEventNotFound, err, v.QueryText())
+		require.Equal(t, []string{"z"}, v.usedAliases())
+	}
+
+	// Percentiles interpolate between the values nearest their rank
+	list := listLiteralValue{}
+	for i := 100; i >= 1; i-- {
+		list = append(list, literalValue{float64(i)})
+	}
+	for fn, expected := range map[aggregateFunc]float64{afP50: 50.5, afP90: 90.1, afP95: 95.05, afP99: 99.01} {
+		result, err := (&aggregateValue{fn: fn, operand: list}).Value(evs)
+		require.NoError(t, err)
+		require.InDelta(t, expected, result, 1e-9, fn.String())
+	}
+
+	// Aggregates only operate on lists
+	_, err := (&aggregateValue{fn: afSum, operand: literalValue{float64(1)}}).Value(evs)
+	require.Error(t, err)
+
+	p := &operatorPredicate{
+		left:  &aggregateValue{fn: afAvg, operand: &listLookup{alias: "a", path: []string{"price"}}},
+		right: attributeLookup("s.price"),
+		op:    opLt,
+	}
+	require.Equal(t, "avg(a[].price) < s.price", p.QueryText())
+	require.Equal(t, Positive, p.Evaluate(evs))
+}
+
+func TestAggregateOperands(t *testing.T) {
+	b := func(threshold interface{}) *tEventImpl {
+		return &tEventImpl{typ: "b", attrs: map[string]interface{}{"threshold": threshold}}
+	}
+	cases := []struct {
+		left, op, right string
+		evs             domain.CapturedEvents
+		expected        Result
+		err             bool
+	}{
+		{"count(a[])", ">", "b.threshold", domain.CapturedEvents{"a": tStocks(1, 3), "b": b(1)}, Positive, false},
+		{"count(a[])", ">", "b.threshold", domain.CapturedEvents{"a": tStocks(1, 3), "b": b(2)}, Negative, false},
+		{"count(a[])", ">", "b.threshold", domain.CapturedEvents{"a": tStocks(), "b": b(0)}, Negative, false},
+		{"count(a[])", "==", "b.threshold", domain.CapturedEvents{"a": tStocks(), "b": b(0)}, Positive, false},
+		{"sum(a[].price)", ">=", "b.threshold", domain.CapturedEvents{"a": tStocks(1, 3), "b": b(4)}, Positive, false},
+		{"avg(a[].price)", "==", "b.threshold", domain.CapturedEvents{"a": tStocks(1, 3), "b": b(2)}, Positive, false},
+		{"max(a[].price)", ">", "min(a[].price)", domain.CapturedEvents{"a": tStocks(1, 3)}, Positive, false},
+		{"max(a[].price)", "<", "b.threshold * 2", domain.CapturedEvents{"a": tStocks(1, 3), "b": b(1)}, Negative, false},
+		{"avg(a[].price)", "<", "b.threshold", domain.CapturedEvents{"a": tStocks(1, 3), "b": b("x")}, Negative, true},
+
+		// An aggregate of a closure not yet captured, or compared to an event not yet captured, is undecided
+		{"count(a[])", ">", "b.threshold", domain.CapturedEvents{"b": b(1)}, Positive, false},
+		{"count(a[])", ">", "b.threshold", domain.CapturedEvents{"a": tStocks(1)}, Positive, false},
+		// ...even if the aggregate can't be computed: whichever side it is on, the missing event decides it
+		{"avg(a[].price)", ">", "b.threshold", domain.CapturedEvents{"a": tStocks()}, Positive, false},
+		{"avg(a[].price)", ">", "b.threshold", domain.CapturedEvents{"a": tStocks(), "b": b(1)}, Negative, true},
+	}
+	converse := map[string]string{">": "<", "<": ">", ">=": "<=", "<=": ">=", "==": "=="}
+	for _, c := range cases {
+		// The aggregate is on the left as written, and on the right when reversed: both must agree
+		for _, text := range []string{c.left + " " + c.op + " " + c.right, c.right + " " + converse[c.op] + " " + c.left} {
+			q, err := Parse("EVENT SEQ(A+ a[], B b) WHERE " + text)
+			require.NoError(t, err, text)
+			result, err := q.predicate.EvaluateErr(c.evs)
+			require.Equal(t, c.err, err != nil, "%s: %v", text, err)
+			require.Equal(t, c.expected, result, text)
+			result, err = compilePredicate(q.predicate)(c.evs)
+			require.Equal(t, c.err, err != nil, "%s (compiled): %v", text, err)
+			require.Equal(t, c.expected, result, "%s (compiled)", text)
+		}
+	}
+}
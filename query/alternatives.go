@@ -0,0 +1,122 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// alternatives returns a query for each of the alternatives of the event clause (eg. "SEQ(A a, B b) OR SEQ(A a, C c)"),
+// or nil if it has none. Each is matched separately, and the query matches whenever any of them does.
+//
+// The WHERE clause is shared by the alternatives, but each is only held to the conditions on the events it captures:
+// conditions which refer to any other alias are left out of it, so that within AND they don't apply and within OR they
+// can't be satisfied (eg. for the second alternative above, "a.x > 1 AND (b.y > 1 OR a.y > 1)" is "a.x > 1 AND
+// a.y > 1"). The rest of the query (its partitioning, window and so on) applies to each alternative as it is.
+func (q *Query) alternatives() []*Query {
+	return q.alts
+}
+
+// updateAlternatives rebuilds the queries returned by alternatives, which must be done whenever anything they copy from
+// the query changes
+func (q *Query) updateAlternatives() {
+	alts, ok := q.capture.(orEventCapture)
+	if !ok {
+		q.alts = nil
+		return
+	}
+	result := make([]*Query, len(alts))
+	for i, alt := range alts {
+		altQuery := *q
+		altQuery.capture, altQuery.alts = alt, nil
+		if q.predicate != nil {
+			altQuery.predicate = restrictPredicate(q.predicate, alt.Names())
+		}
+		result[i] = &altQuery
+	}
+	q.alts = result
+}
+
+// restrictPredicate returns the part of a predicate which refers only to the given aliases (see alternatives), or nil
+// if no part of it does
+func restrictPredicate(p Predicate, aliases map[string]string) Predicate {
+	switch p := unwrapCondition(p).(type) {
+	case conjunction:
+		if kept := restrictPredicates(p, aliases); len(kept) > 1 {
+			return conjunction(kept)
+		} else if len(kept) == 1 {
+			return kept[0]
+		}
+		return nil
+
+	case disjunction:
+		if kept := restrictPredicates(p, aliases); len(kept) > 1 {
+			return disjunction(kept)
+		} else if len(kept) == 1 {
+			return kept[0]
+		}
+		return nil
+
+	case *negationPredicate:
+		if inner := restrictPredicate(p.Predicate, aliases); inner != nil {
+			return &negationPredicate{inner}
+		}
+		return nil
+
+	default:
+		for _, alias := range p.usedAliases() {
+			if _, ok := aliases[alias]; !ok {
+				return nil
+			}
+		}
+		return p
+	}
+}
+
+func restrictPredicates(ps []Predicate, aliases map[string]string) []Predicate {
+	var kept []Predicate
+	for _, p := range ps {
+		if r := restrictPredicate(p, aliases); r != nil {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// evaluateAlternatives evaluates each of the alternatives which could have captured the events, combining their results
+func evaluateAlternatives(ctx context.Context, alts []*Query, evs domain.CapturedEvents) (Result, error) {
+	result := Negative
+	for _, alt := range alts {
+		if !capturesAll(alt.capture, evs) {
+			continue
+		}
+		r, err := alt.EvaluateContext(ctx, evs)
+		if err != nil {
+			return Negative, err
+		}
+		result = result.Or(r)
+	}
+	return result, nil
+}
+
+// validateAlternatives checks that alternatives which share an alias all capture it in the same way
+func validateAlternatives(alts orEventCapture) error {
+	signatures := make(map[string]string)
+	for _, alt := range alts {
+		aliases := make([]string, 0)
+		for alias := range alt.Names() {
+			aliases = append(aliases, alias)
+		}
+		sort.Strings(aliases)
+		for _, alias := range aliases {
+			sig := captureSignature(alt, alias)
+			if existing, ok := signatures[alias]; ok && existing != sig {
+				return fmt.Errorf("Alternatives capture %s differently, as %s and %s", alias, existing, sig)
+			}
+			signatures[alias] = sig
+		}
+	}
+	return nil
+}
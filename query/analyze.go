@@ -0,0 +1,308 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Severity is how serious a Diagnostic is
+type Severity uint8
+
+const (
+	SeverityError   Severity = iota // the predicate can't be evaluated as intended (eg. it will fail to evaluate)
+	SeverityWarning                 // the predicate can be evaluated, but probably isn't what was meant
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return ""
+	}
+}
+
+// A Diagnostic is a problem Analyze found with a predicate
+type Diagnostic struct {
+	Severity Severity
+	Message  string
+	// Node is the predicate or value the problem is with, and Location its query text (which locates it within the
+	// predicate's)
+	Node     interface{}
+	Location string
+}
+
+func (d Diagnostic) String() string {
+	return d.Severity.String() + ": " + d.Message
+}
+
+// AnalyzeOptions configure which checks Analyze makes
+type AnalyzeOptions struct {
+	// Captures are the events which may be referred to, as (alias: type) (see Query.Captures). If nil, references
+	// aren't checked.
+	Captures map[string]string
+	// Schema, if there is one, is what the types of operands are checked against (see Query.CheckTypes)
+	Schema Schema
+}
+
+// Analyze checks a predicate for every problem it can find without evaluating it, eg. to lint queries before they are
+// deployed. Unlike Validate and CheckTypes, which stop at the first problem, it reports them all, in the order they
+// appear in the query text:
+//
+//   - references to events which aren't captured (each alias once, where it's first referred to)
+//   - comparisons and arithmetic whose operands have the wrong types, according to the schema
+//   - calls to functions which aren't registered, or with the wrong number of arguments
+//   - division by a constant zero
+//   - conditions which don't refer to any events, so are constant: either they can never be met, or a branch of the
+//     query which depends on them can never be reached (these are warnings)
+//   - ANDs of conditions on the same attribute which contradict one another, so can never all be met (eg. "a.x > 5
+//     AND a.x < 3", or "a.x == 1 AND a.x != 1"). Only comparisons of the attribute with constant numbers (and BETWEEN
+//     constant numbers) are considered, and only in pairs: this is a warning, like a condition which can never be met.
+//     Those beneath a NOT aren't reported, as a condition which can never be met is a way to say one always is.
+func Analyze(p Predicate, opts AnalyzeOptions) []Diagnostic {
+	a := &analyzer{opts: opts, reported: make(map[string]bool)}
+	Walk(p, a.analyze)
+	return a.diagnostics
+}
+
+// Analyze analyses the query's predicate (see Analyze). Where opts doesn't set them, the query's captures and schema
+// are used.
+func (q *Query) Analyze(opts AnalyzeOptions) []Diagnostic {
+	if opts.Captures == nil {
+		opts.Captures = q.Captures()
+	}
+	if opts.Schema == nil {
+		opts.Schema = q.schema
+	}
+	a := &analyzer{opts: opts, reported: make(map[string]bool), comparators: q.comparators}
+	Walk(q.predicate, a.analyze)
+	return a.diagnostics
+}
+
+type analyzer struct {
+	opts        AnalyzeOptions
+	reported    map[string]bool // Undeclared aliases which have been reported
+	settled     bool            // Whether the predicates being analysed are already known to be constant
+	negated     bool            // Whether they are beneath a NOT, so may be meant never to hold
+	comparators comparators     // Those of the query, if it has any, which change how constants compare
+	diagnostics []Diagnostic
+}
+
+func (a *analyzer) report(severity Severity, node interface{}, format string, args ...interface{}) {
+	a.diagnostics = append(a.diagnostics, Diagnostic{
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+		Node:     node,
+		Location: nodeText(node),
+	})
+}
+
+// analyze analyses a node as it is walked, returning whether its children should be walked too
+func (a *analyzer) analyze(node interface{}) bool {
+	if a.opts.Captures != nil {
+		a.checkAliases(node)
+	}
+	if a.opts.Schema != nil {
+		if err := a.opts.Schema.check(node); err != nil {
+			a.report(SeverityError, node, "%s", err.Error())
+		}
+	}
+
+	switch n := node.(type) {
+	case *functionValue:
+		if fn, ok := lookupFunction(n.name); !ok {
+			a.report(SeverityError, n, "Unknown function %s", n.name)
+		} else if fn.Arity >= 0 && len(n.args) != fn.Arity {
+			a.report(SeverityError, n, "%s takes %d argument(s), got %d", n.name, fn.Arity, len(n.args))
+		}
+
+	case *arithmeticValue:
+		if n.op != aoDivide && n.op != aoModulo && n.op != aoIntDivide || n.right == nil || !isConstant(n.right) {
+			break
+		} else if divisor, err := n.right.Value(nil); err == nil && valuesEqual(divisor, float64(0)) {
+			a.report(SeverityError, n, "Division by zero in %s", n.QueryText())
+		}
+
+	case *conditionalValue:
+		if n.condition == nil || !isConstant(n.condition) {
+			break
+		} else if result, err := n.condition.EvaluateErr(nil); err == nil && result == Positive {
+			a.report(SeverityWarning, n, "The condition of %s always holds, so its else value is unreachable",
+				n.QueryText())
+		} else if err == nil {
+			a.report(SeverityWarning, n, "The condition of %s never holds, so its then value is unreachable",
+				n.QueryText())
+		}
+		// The condition has been reported as constant already, so needn't be again
+		a.settled = true
+		walk(n.condition, a.analyze)
+		a.settled = false
+		for _, child := range valueNodes(n.then, n.otherwise) {
+			walk(child, a.analyze)
+		}
+		return false
+
+	case conjunction:
+		if len(a.comparators) == 0 && !a.negated {
+			a.checkContradictions(n)
+		}
+
+	case *negationPredicate: // Constant operands are reported themselves
+		negated := a.negated
+		a.negated = true
+		walk(n.Predicate, a.analyze)
+		a.negated = negated
+		return false
+
+	case disjunction:
+
+	case Predicate:
+		if a.settled || !isConstant(n) {
+			break
+		} else if result, err := n.EvaluateErr(nil); err == nil && result == Positive {
+			a.report(SeverityWarning, n, "%s always holds, as it doesn't refer to any events", n.QueryText())
+		} else if err == nil {
+			a.report(SeverityWarning, n, "%s never holds, as it doesn't refer to any events", n.QueryText())
+		}
+	}
+	return true
+}
+
+// checkAliases reports references the node makes to events which aren't captured. An alias referred to several
+// times is only reported once, where it is first referred to.
+func (a *analyzer) checkAliases(node interface{}) {
+	var used []string
+	switch n := node.(type) {
+	case conjunction, disjunction, *negationPredicate: // Reported where their operands refer to them
+	case Predicate:
+		used = n.usedAliases()
+	case value:
+		used = n.usedAliases()
+	}
+	undeclared := make([]string, 0)
+	for _, alias := range used {
+		if _, ok := a.opts.Captures[alias]; !ok && !a.reported[alias] {
+			a.reported[alias] = true
+			undeclared = append(undeclared, alias)
+		}
+	}
+	if len(undeclared) > 0 {
+		sort.Strings(undeclared)
+		a.report(SeverityError, node, "Reference to nonexistent capture %s: %s", strings.Join(undeclared, ", "),
+			nodeText(node))
+	}
+}
+
+// A bound is a constraint on a numeric attribute: a condition of an AND which holds only if the attribute is equal to
+// (or not equal to) a number, or on one side of it
+type bound struct {
+	p  Predicate // The condition
+	op op        // How the attribute compares with n for the condition to hold
+	n  float64
+}
+
+// bounds returns the bounds a condition places on an attribute, if it is a comparison of the attribute with a
+// constant number (or it is between two), keyed by the attribute's query text
+func bounds(p Predicate) (attribute string, result []bound) {
+	constantNumber := func(v value) (float64, bool) {
+		if v == nil || !isConstant(v) {
+			return 0, false
+		} else if resolved, err := v.Value(nil); err == nil {
+			return numericValue(resolved) // Durations compare as numbers of seconds
+		}
+		return 0, false
+	}
+	switch p := unwrapCondition(p).(type) {
+	case *operatorPredicate:
+		left, right, o := p.left, p.right, p.op
+		if _, ok := right.(attributeLookup); ok {
+			left, right, o = right, left, o.converse()
+		}
+		if attr, ok := left.(attributeLookup); !ok || o == opIEq {
+			return "", nil
+		} else if n, ok := constantNumber(right); ok {
+			return string(attr), []bound{{p: p, op: o, n: n}}
+		}
+
+	case *betweenPredicate:
+		attr, ok := p.operand.(attributeLookup)
+		low, lowOk := constantNumber(p.low)
+		high, highOk := constantNumber(p.high)
+		if ok && lowOk && highOk {
+			return string(attr), []bound{{p: p, op: opGe, n: low}, {p: p, op: opLe, n: high}}
+		}
+	}
+	return "", nil
+}
+
+// contradicts reports whether two bounds on the same attribute can't both hold
+func (b bound) contradicts(other bound) bool {
+	below := func(o op) bool { return o == opLt || o == opLe }
+	above := func(o op) bool { return o == opGt || o == opGe }
+	switch {
+	case b.op == opEq && other.op == opEq:
+		return b.n != other.n
+	case b.op == opEq && other.op == opNe, b.op == opNe && other.op == opEq:
+		return b.n == other.n
+	case b.op == opNe || other.op == opNe:
+		return false
+	case above(b.op) && above(other.op), below(b.op) && below(other.op):
+		return false
+	case above(other.op) || other.op == opEq && below(b.op):
+		b, other = other, b
+	}
+	// Now b is a lower bound (or an ==), and other an upper bound (or an ==)
+	if b.n != other.n {
+		return b.n > other.n
+	}
+	return b.op == opGt || other.op == opLt
+}
+
+// checkContradictions reports the first pair of conditions of an AND which contradict one another, if any
+func (a *analyzer) checkContradictions(c conjunction) {
+	attributes := make(map[string][]bound)
+	for _, operand := range c {
+		attribute, bs := bounds(operand)
+		for _, b := range bs {
+			for _, other := range attributes[attribute] {
+				if b.contradicts(other) {
+					a.report(SeverityWarning, c, "%s contradicts %s: they can't both hold", other.p.QueryText(),
+						b.p.QueryText())
+					return
+				}
+			}
+		}
+		if attribute != "" {
+			attributes[attribute] = append(attributes[attribute], bs...)
+		}
+	}
+}
+
+// isConstant reports whether a node resolves the same way whatever the events: it doesn't refer to any, nor to any
+// parameters, variables, functions (which may not be deterministic) or earlier matches
+func isConstant(node interface{}) bool {
+	constant := true
+	walk(node, func(node interface{}) bool {
+		switch n := node.(type) {
+		case parameterValue, variableValue, *functionValue, *equivalencePredicate, *recentValue:
+			constant = false
+		case Predicate:
+			constant = constant && len(n.usedAliases()) == 0
+		case value:
+			constant = constant && len(n.usedAliases()) == 0
+		}
+		return constant
+	})
+	return constant
+}
+
+// nodeText returns the query text of a predicate or value
+func nodeText(node interface{}) string {
+	if r, ok := node.(Representable); ok {
+		return r.QueryText()
+	}
+	return ""
+}
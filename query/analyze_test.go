@@ -0,0 +1,119 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyze(t *testing.T) {
+	schema := Schema{
+		"a.price":  TypeNumber,
+		"a.symbol": TypeString,
+		"b.price":  TypeNumber,
+	}
+	cases := []struct {
+		where    string
+		expected []string
+	}{
+		{"a.price > b.price AND a.symbol == 'x'", nil},
+		// Every problem is reported, in the order they appear in the query text
+		{"a.price > 'foo' OR a.symbol < b.price", []string{
+			`error: Cannot compare a.price (number) with "foo" (string): a.price > "foo"`,
+			"error: Cannot compare a.symbol (string) with b.price (number): a.symbol < b.price",
+		}},
+		{"a.price / 0 > 1 AND b.price % (2 - 2) == 0 AND b.price / 2 > 1", []string{
+			"error: Division by zero in a.price / 0.000000",
+			"error: Division by zero in b.price % (2.000000 - 2.000000)",
+		}},
+		// References to events which aren't captured, each alias reported once
+		{"c.price > a.price AND c.symbol == d.symbol", []string{
+			"error: Reference to nonexistent capture c: c.price > a.price",
+			"error: Reference to nonexistent capture d: c.symbol == d.symbol",
+		}},
+		{"1 > 2 OR a.price > 1 AND NOT ('x' == 'x')", []string{
+			"warning: 1.000000 > 2.000000 never holds, as it doesn't refer to any events",
+			`warning: "x" == "x" always holds, as it doesn't refer to any events`,
+		}},
+		{"(1 < 2 ? a.price : b.price) > 1 AND (1 > 2 ? a.price : b.price) > 1", []string{
+			"warning: The condition of (1.000000 < 2.000000 ? a.price : b.price) always holds, so its else value is " +
+				"unreachable",
+			"warning: The condition of (1.000000 > 2.000000 ? a.price : b.price) never holds, so its then value is " +
+				"unreachable",
+		}},
+		// Parameters aren't known until they are bound
+		{"a.price > :low AND :low < 5", nil},
+		// Conditions on the same attribute which contradict one another
+		{"a.price > 5 AND a.price < 3", []string{
+			"warning: a.price > 5.000000 contradicts a.price < 3.000000: they can't both hold",
+		}},
+		{"a.price == 1 AND b.price > 0 AND a.price != 1", []string{
+			"warning: a.price == 1.000000 contradicts a.price != 1.000000: they can't both hold",
+		}},
+		{"3 > a.price AND a.price >= 1 + 2", []string{
+			"warning: 3.000000 > a.price contradicts a.price >= 1.000000 + 2.000000: they can't both hold",
+		}},
+		{"a.price BETWEEN 1 AND 5 AND a.price > 5", []string{
+			"warning: a.price BETWEEN 1.000000 AND 5.000000 contradicts a.price > 5.000000: they can't both hold",
+		}},
+		{"b.price < 1m AND b.price == 90", []string{
+			"warning: b.price < 1m contradicts b.price == 90.000000: they can't both hold",
+		}},
+		{"a.price BETWEEN 1 AND 5 AND a.price >= 5 AND a.price > 1 AND a.price <= 10 AND a.price != 3", nil},
+		{"a.price > 5 AND b.price < 3", nil},
+		{"a.price > 5 OR a.price < 3", nil},
+		{"(a.price > 5 OR b.price > 5) AND a.price < 3", nil},
+		// but not beneath a NOT, where they make it always hold
+		{"NOT (a.price > 5 AND a.price < 3)", nil},
+		{"NOT (b.price > 0 OR (a.price == 1 AND a.price != 1)) AND a.price > 5 AND a.price < 3", []string{
+			"warning: a.price > 5.000000 contradicts a.price < 3.000000: they can't both hold",
+		}},
+	}
+	for _, c := range cases {
+		q, err := Parse("EVENT SEQ(A a, B b, C c, D d) WHERE " + c.where)
+		require.NoError(t, err, c.where)
+		diagnostics := Analyze(q.predicate, AnalyzeOptions{
+			Captures: map[string]string{"a": "A", "b": "B"},
+			Schema:   schema,
+		})
+		messages := make([]string, 0, len(diagnostics))
+		for _, d := range diagnostics {
+			messages = append(messages, d.String())
+		}
+		if c.expected == nil {
+			c.expected = []string{}
+		}
+		require.Equal(t, c.expected, messages, c.where)
+	}
+
+	// Diagnostics locate the node the problem is with
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE a.price > 1 AND a.symbol > b.price / 0")
+	require.NoError(t, err)
+	diagnostics := q.Analyze(AnalyzeOptions{Schema: schema})
+	require.Len(t, diagnostics, 2)
+	require.Equal(t, SeverityError, diagnostics[0].Severity)
+	require.Equal(t, "a.symbol > b.price / 0.000000", diagnostics[0].Location)
+	require.Equal(t, "b.price / 0.000000", diagnostics[1].Location)
+	require.IsType(t, &arithmeticValue{}, diagnostics[1].Node)
+
+	// Constants may compare differently with the query's comparators, which aren't considered
+	q, err = Parse("EVENT SEQ(A a, B b) WHERE a.price > 5 AND a.price < 3")
+	require.NoError(t, err)
+	require.Len(t, q.Analyze(AnalyzeOptions{}), 1)
+	q.SetComparator(reflect.TypeOf(0.0), func(left, right interface{}) (int, bool) { return 0, false })
+	require.Empty(t, q.Analyze(AnalyzeOptions{}))
+
+	// Without captures or a schema, only the other checks are made
+	q, err = Parse("EVENT SEQ(A a, B b) WHERE a.price > 'x' AND z.price > 1")
+	require.Error(t, err) // Parsing validates references itself
+	require.Empty(t, Analyze(Attr("a", "price").Gt(Lit("x")).And(Attr("z", "price").Gt(Lit(1))), AnalyzeOptions{}))
+
+	// Functions which aren't registered
+	fn := &functionValue{name: "nosuch", args: []value{attributeLookup("a.price")}}
+	p := &operatorPredicate{left: fn, right: literalValue{v: 1.0}, op: opEq}
+	diagnostics = Analyze(p, AnalyzeOptions{})
+	require.Len(t, diagnostics, 1)
+	require.Equal(t, "error: Unknown function nosuch", diagnostics[0].String())
+	require.Equal(t, "nosuch(a.price)", diagnostics[0].Location)
+}
@@ -0,0 +1,337 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A parameterValue is a named placeholder for a literal (eg. ":threshold"). It must be bound to a value (see Bind)
+// before the predicate is evaluated, so that a query may be parsed once and evaluated with different values.
+type parameterValue string // Holds the name
+
+func (v parameterValue) QueryText() string {
+	return ":" + string(v)
+}
+
+func (v parameterValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return nil, fmt.Errorf("Parameter %s is not bound", v.QueryText())
+}
+
+func (v parameterValue) usedAliases() []string {
+	return []string{}
+}
+
+func (v parameterValue) Equal(other value) bool {
+	o, ok := other.(parameterValue)
+	return ok && v == o
+}
+
+func (v parameterValue) Clone() Value {
+	return v
+}
+
+func (v parameterValue) children() []interface{} {
+	return nil
+}
+
+// Parameters returns the names of the parameters in a predicate (without their ":"), sorted
+func Parameters(p Predicate) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	Walk(p, func(node interface{}) bool {
+		if v, ok := node.(parameterValue); ok && !seen[string(v)] {
+			seen[string(v)] = true
+			result = append(result, string(v))
+		}
+		return true
+	})
+	sort.Strings(result)
+	return result
+}
+
+// Bind returns a copy of a predicate with its parameters replaced by literals of the given values (keyed by name,
+// without the ":"). Each value must be one NewLiteral accepts. It is an error for any parameter to be missing, or for a
+// value not to suit the way its parameter is used (eg. a string added to a number); values which aren't used are
+// ignored.
+func Bind(p Predicate, params map[string]interface{}) (Predicate, error) {
+	if p == nil {
+		return nil, nil
+	}
+	var missing []string
+	for _, name := range Parameters(p) {
+		if _, ok := params[name]; !ok {
+			missing = append(missing, ":"+name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Missing parameter(s) %s", strings.Join(missing, ", "))
+	}
+
+	b := binder(params)
+	bound, err := b.predicate(unwrapCondition(p))
+	if err != nil {
+		return nil, err
+	}
+	// Now that their types are known, check the values are used sensibly
+	var typeErr error
+	Walk(bound, func(node interface{}) bool {
+		if typeErr == nil {
+			typeErr = Schema(nil).check(node)
+		}
+		return typeErr == nil
+	})
+	if typeErr != nil {
+		return nil, fmt.Errorf("Cannot bind parameters: %w", typeErr)
+	}
+	return bound, nil
+}
+
+// Bind returns a copy of the query with the parameters of its predicate bound (see Bind)
+func (q *Query) Bind(params map[string]interface{}) (*Query, error) {
+	p, err := Bind(q.predicate, params)
+	if err != nil {
+		return nil, err
+	}
+	result := *q
+	result.predicate = p
+	result.updateAlternatives()
+	return &result, nil
+}
+
+// A binder rebuilds predicates and values with their parameters bound
+type binder map[string]interface{}
+
+func (b binder) literal(name string) (value, error) {
+	v := b[name]
+	switch v.(type) {
+	case string, bool, nil, time.Duration:
+		return NewLiteral(v), nil
+	}
+	if f, ok := numericValue(v); ok {
+		return literalValue{f}, nil
+	}
+	return nil, fmt.Errorf("Cannot bind :%s to %T: it must be a number, time.Duration, string, bool or nil", name, v)
+}
+
+// nonArithmetic reports whether v is a parameter bound to a value of a type arithmetic can't be applied to
+func nonArithmetic(v value, t AttributeType) bool {
+	_, ok := v.(parameterValue)
+	return ok && (t == TypeString || t == TypeBool)
+}
+
+func (b binder) value(v value) (value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch v := v.(type) {
+	case parameterValue:
+		return b.literal(string(v))
+
+	case *arithmeticValue:
+		left, err := b.value(v.left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := b.value(v.right)
+		if err != nil {
+			return nil, err
+		}
+		// The schema allows arithmetic on unknown types, but a parameter's type is known once it is bound
+		leftType, rightType := Schema(nil).typeOf(left), Schema(nil).typeOf(right)
+		if nonArithmetic(v.left, leftType) || nonArithmetic(v.right, rightType) {
+			return nil, fmt.Errorf("Cannot bind parameters: Cannot apply %s to %s (%s) and %s (%s)", v.op.String(),
+				left.QueryText(), leftType, right.QueryText(), rightType)
+		}
+		return &arithmeticValue{left: left, right: right, op: v.op}, nil
+
+	case *indexLookup:
+		index, err := b.value(v.index)
+		if err != nil {
+			return nil, err
+		}
+		result := *v
+		result.index = index
+		return &result, nil
+
+	case *subscriptLookup:
+		vs, err := b.values([]value{v.operand, v.key})
+		if err != nil {
+			return nil, err
+		}
+		return &subscriptLookup{operand: vs[0], key: vs[1], path: v.path}, nil
+
+	case *aggregateValue:
+		operand, err := b.value(v.operand)
+		if err != nil {
+			return nil, err
+		}
+		return &aggregateValue{fn: v.fn, operand: operand}, nil
+
+	case *recentValue:
+		operand, err := b.value(v.operand)
+		if err != nil {
+			return nil, err
+		}
+		return &recentValue{operand: operand, window: v.window, count: v.count}, nil
+
+	case *functionValue:
+		args, err := b.values(v.args)
+		if err != nil {
+			return nil, err
+		}
+		return &functionValue{name: v.name, fn: v.fn, args: args}, nil
+
+	case coalesceValue:
+		args, err := b.values(v)
+		if err != nil {
+			return nil, err
+		}
+		return coalesceValue(args), nil
+
+	case listLiteralValue:
+		members, err := b.values(v)
+		if err != nil {
+			return nil, err
+		}
+		return listLiteralValue(members), nil
+
+	case *castValue:
+		operand, err := b.value(v.operand)
+		if err != nil {
+			return nil, err
+		}
+		return &castValue{to: v.to, operand: operand}, nil
+
+	case *bitwiseNotValue:
+		operand, err := b.value(v.operand)
+		if err != nil {
+			return nil, err
+		}
+		return &bitwiseNotValue{operand}, nil
+
+	case *conditionalValue:
+		condition, err := b.predicate(unwrapCondition(v.condition))
+		if err != nil {
+			return nil, err
+		}
+		branches, err := b.values([]value{v.then, v.otherwise})
+		if err != nil {
+			return nil, err
+		}
+		return &conditionalValue{condition: condition, then: branches[0], otherwise: branches[1]}, nil
+	}
+	return v, nil // It has no parameters within it
+}
+
+func (b binder) values(vs []value) ([]value, error) {
+	result := make([]value, len(vs))
+	for i, v := range vs {
+		var err error
+		if result[i], err = b.value(v); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (b binder) predicate(p Predicate) (Predicate, error) {
+	switch p := p.(type) {
+	case *operatorPredicate:
+		left, err := b.value(p.left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := b.value(p.right)
+		if err != nil {
+			return nil, err
+		}
+		return &operatorPredicate{left: left, right: right, op: p.op}, nil
+
+	case *betweenPredicate:
+		vs, err := b.values([]value{p.operand, p.low, p.high})
+		if err != nil {
+			return nil, err
+		}
+		return &betweenPredicate{operand: vs[0], low: vs[1], high: vs[2]}, nil
+
+	case *inPredicate:
+		left, err := b.value(p.left)
+		if err != nil {
+			return nil, err
+		}
+		set, err := b.values(p.set)
+		if err != nil {
+			return nil, err
+		}
+		return &inPredicate{left: left, set: set}, nil
+
+	case *quantifiedPredicate:
+		vs, err := b.values([]value{p.left, p.list})
+		if err != nil {
+			return nil, err
+		}
+		return &quantifiedPredicate{left: vs[0], op: p.op, all: p.all, list: vs[1]}, nil
+
+	case *nullCheckPredicate:
+		operand, err := b.value(p.operand)
+		if err != nil {
+			return nil, err
+		}
+		return &nullCheckPredicate{operand: operand, negated: p.negated}, nil
+
+	case *regexPredicate:
+		left, err := b.value(p.left)
+		if err != nil {
+			return nil, err
+		}
+		return &regexPredicate{left: left, pattern: p.pattern}, nil
+
+	case *stringMatchPredicate:
+		left, err := b.value(p.left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := b.value(p.right)
+		if err != nil {
+			return nil, err
+		}
+		return &stringMatchPredicate{left: left, right: right, match: p.match}, nil
+
+	case conjunction:
+		children, err := b.predicates(p)
+		if err != nil {
+			return nil, err
+		}
+		return conjunction(children), nil
+
+	case disjunction:
+		children, err := b.predicates(p)
+		if err != nil {
+			return nil, err
+		}
+		return disjunction(children), nil
+
+	case *negationPredicate:
+		inner, err := b.predicate(unwrapCondition(p.Predicate))
+		if err != nil {
+			return nil, err
+		}
+		return &negationPredicate{inner}, nil
+	}
+	return p, nil // It has no parameters within it
+}
+
+func (b binder) predicates(ps []Predicate) ([]Predicate, error) {
+	result := make([]Predicate, len(ps))
+	for i, p := range ps {
+		var err error
+		if result[i], err = b.predicate(unwrapCondition(p)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
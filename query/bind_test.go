@@ -0,0 +1,79 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestBind(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE b.x > a.x * :factor AND b.s IN (:s, 'other') AND b.TS - a.TS < :gap " +
+		"AND NOT (b.y BETWEEN :low AND :high) AND lower(b.s) == lower(:s)")
+	require.NoError(t, err)
+	require.Equal(t, []string{"factor", "gap", "high", "low", "s"}, Parameters(q.predicate))
+	stream := tStream("A1 x=2", "B1 x=5 y=10 s=FOO")
+	evs := domain.CapturedEvents{"a": stream[0], "b": stream[1]}
+
+	// Unbound, the predicate can't be evaluated
+	require.Equal(t, Negative, q.Evaluate(evs))
+
+	params := map[string]interface{}{"factor": 2, "s": "FOO", "gap": time.Minute, "low": 1, "high": int64(5), "x": 1}
+	bound, err := q.Bind(params)
+	require.NoError(t, err)
+	require.Equal(t, Positive, bound.Evaluate(evs))
+	require.Equal(t, "EVENT SEQ(A a, B b) WHERE (b.x > a.x * 2.000000 AND b.s IN (\"FOO\", \"other\") AND "+
+		"b.TS - a.TS < 1m AND NOT (b.y BETWEEN 1.000000 AND 5.000000) AND lower(b.s) == lower(\"FOO\"))",
+		bound.QueryText())
+	require.Empty(t, Parameters(bound.predicate))
+	require.Equal(t, 5, len(Parameters(q.predicate)), "The original is unchanged")
+
+	params["factor"] = 3
+	bound, err = q.Bind(params)
+	require.NoError(t, err)
+	require.Equal(t, Negative, bound.Evaluate(evs))
+
+	// Every parameter must be bound
+	_, err = q.Bind(map[string]interface{}{"factor": 2, "s": "x"})
+	require.EqualError(t, err, "Missing parameter(s) :gap, :high, :low")
+
+	// ...to a value which suits its use
+	params["factor"] = "two"
+	_, err = q.Bind(params)
+	require.EqualError(t, err, `Cannot bind parameters: Cannot apply * to a.x (unknown) and "two" (string)`)
+	params["factor"] = struct{}{}
+	_, err = q.Bind(params)
+	require.EqualError(t, err, "Cannot bind :factor to struct {}: it must be a number, time.Duration, string, bool or nil")
+	q, err = Parse("EVENT a b WHERE b.x STARTSWITH :prefix")
+	require.NoError(t, err)
+	_, err = q.Bind(map[string]interface{}{"prefix": true})
+	require.EqualError(t, err, "Cannot bind parameters: Expected a string, but true is a bool: b.x STARTSWITH true")
+
+	// Predicates built programmatically may be bound too
+	p, err := Bind(Attr("a", "x").Gt(ExprOf(parameterValue("n"))), map[string]interface{}{"n": 1})
+	require.NoError(t, err)
+	require.Equal(t, "a.x > 1.000000", p.QueryText())
+	p, err = Bind(nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, p)
+}
+
+func TestParameterValue(t *testing.T) {
+	q, err := Parse("EVENT a b WHERE b.x == :x AND b[:i].y > :Y_2")
+	require.NoError(t, err)
+	require.Equal(t, "EVENT a b WHERE (b.x == :x AND b[:i].y > :Y_2)", q.QueryText())
+
+	data, err := json.Marshal(q.predicate)
+	require.NoError(t, err)
+	p, err := UnmarshalPredicate(data)
+	require.NoError(t, err)
+	require.True(t, q.predicate.Equal(p))
+
+	for _, bad := range []string{"EVENT a b WHERE b.x == :", "EVENT a b WHERE b.x == : x", "EVENT a b WHERE b.x MATCHES :re"} {
+		_, err := Parse(bad)
+		require.Error(t, err, bad)
+	}
+}
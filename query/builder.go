@@ -0,0 +1,147 @@
+package query
+
+import "encoding/json"
+
+// An Expr is a value which may be compared when building a predicate programmatically, eg.
+//
+//	Attr("a", "price").Gt(Lit(100)).And(Attr("a", "symbol").Eq(AttrOf("b", "symbol")))
+type Expr struct {
+	v value
+}
+
+// Attr refers to an attribute (or, with a longer path, a nested attribute) of the event captured as alias
+func Attr(alias string, path ...string) Expr {
+	return Expr{NewAttribute(alias, path...)}
+}
+
+// AttrOf is the same as Attr; it may read better on the right of a comparison
+func AttrOf(alias string, path ...string) Expr {
+	return Attr(alias, path...)
+}
+
+// Lit is a literal value (see NewLiteral)
+func Lit(v interface{}) Expr {
+	return Expr{NewLiteral(v)}
+}
+
+// Var refers to a variable, which is supplied with each evaluation (see WithVariables)
+func Var(name string) Expr {
+	return Expr{variableValue(name)}
+}
+
+// ExprOf wraps a Value for use with the builder
+func ExprOf(v Value) Expr {
+	return Expr{v}
+}
+
+// Value returns the wrapped value
+func (e Expr) Value() Value {
+	return e.v
+}
+
+func (e Expr) compare(o op, other Expr) Condition {
+	return Condition{NewComparison(e.v, other.v, o)}
+}
+
+// QueryText returns the value as it would be written in a query
+func (e Expr) QueryText() string {
+	return e.v.QueryText()
+}
+
+func (e Expr) Eq(other Expr) Condition  { return e.compare(opEq, other) }
+func (e Expr) Ne(other Expr) Condition  { return e.compare(opNe, other) }
+func (e Expr) Gt(other Expr) Condition  { return e.compare(opGt, other) }
+func (e Expr) Lt(other Expr) Condition  { return e.compare(opLt, other) }
+func (e Expr) Ge(other Expr) Condition  { return e.compare(opGe, other) }
+func (e Expr) Le(other Expr) Condition  { return e.compare(opLe, other) }
+func (e Expr) IEq(other Expr) Condition { return e.compare(opIEq, other) }
+
+// A Condition is a predicate under construction, which may be combined with others. It is itself a Predicate; the
+// predicate it has built is also available (unwrapped) as its Predicate field.
+type Condition struct {
+	Predicate
+}
+
+func (c Condition) And(others ...Predicate) Condition {
+	return And(append([]Predicate{c}, others...)...)
+}
+
+func (c Condition) Or(others ...Predicate) Condition {
+	return Or(append([]Predicate{c}, others...)...)
+}
+
+func (c Condition) Not() Condition {
+	return Not(c)
+}
+
+// Equal reports whether the built predicate is equal to another (which may also be a Condition)
+func (c Condition) Equal(other Predicate) bool {
+	return c.Predicate.Equal(unwrapCondition(other))
+}
+
+// Clone clones the built predicate, keeping it wrapped
+func (c Condition) Clone() Predicate {
+	return Condition{c.Predicate.Clone()}
+}
+
+// MarshalJSON encodes the built predicate, as if it were not wrapped
+func (c Condition) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Predicate)
+}
+
+func unwrapCondition(p Predicate) Predicate {
+	for {
+		c, ok := p.(Condition)
+		if !ok {
+			return p
+		}
+		p = c.Predicate
+	}
+}
+
+// And combines predicates, all of which must match. Nested conjunctions are flattened, as they would be if written
+// without parentheses. It panics if there are no predicates.
+func And(ps ...Predicate) Condition {
+	result := make(conjunction, 0, len(ps))
+	for _, p := range ps {
+		p = unwrapCondition(p)
+		if c, ok := p.(conjunction); ok {
+			result = append(result, c...)
+		} else {
+			result = append(result, p)
+		}
+	}
+	switch len(result) {
+	case 0:
+		panic("sase: And needs at least one predicate")
+	case 1:
+		return Condition{result[0]}
+	}
+	return Condition{result}
+}
+
+// Or combines predicates, any of which must match. Nested disjunctions are flattened, as they would be if written
+// without parentheses. It panics if there are no predicates.
+func Or(ps ...Predicate) Condition {
+	result := make(disjunction, 0, len(ps))
+	for _, p := range ps {
+		p = unwrapCondition(p)
+		if d, ok := p.(disjunction); ok {
+			result = append(result, d...)
+		} else {
+			result = append(result, p)
+		}
+	}
+	switch len(result) {
+	case 0:
+		panic("sase: Or needs at least one predicate")
+	case 1:
+		return Condition{result[0]}
+	}
+	return Condition{result}
+}
+
+// Not inverts a predicate
+func Not(p Predicate) Condition {
+	return Condition{&negationPredicate{unwrapCondition(p)}}
+}
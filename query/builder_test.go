@@ -0,0 +1,70 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestBuilder(t *testing.T) {
+	cases := map[string]Condition{
+		`(a.price > 100.000000 AND a.symbol == b.symbol)`: Attr("a", "price").Gt(Lit(100)).
+			And(Attr("a", "symbol").Eq(AttrOf("b", "symbol"))),
+		`(a.x != "foo" AND a.x <= 2.500000 AND b.y >= a.y)`: Attr("a", "x").Ne(Lit("foo")).
+			And(Attr("a", "x").Le(Lit(float32(2.5)))).
+			And(Attr("b", "y").Ge(Attr("a", "y"))),
+		`((a.x < 1.000000 OR b.x < 1.000000) AND NOT (a.m.z == true))`: Or(Attr("a", "x").Lt(Lit(uint8(1))), Attr("b", "x").Lt(Lit(1))).
+			And(Attr("a", "m", "z").Eq(Lit(true)).Not()),
+		`(a.x == null OR b.x ~= "FOO" OR b.y == "bar")`: Attr("a", "x").Eq(Lit(nil)).
+			Or(Attr("b", "x").IEq(Lit("FOO")), Attr("b", "y").Eq(Lit("bar"))),
+		`NOT (a.x > b.x AND a.y > b.y)`: Not(And(Attr("a", "x").Gt(Attr("b", "x")), Attr("a", "y").Gt(Attr("b", "y")))),
+		`a.x == 1.000000`:               And(Attr("a", "x").Eq(Lit(1))),
+	}
+	for expected, c := range cases {
+		require.Equal(t, expected, c.QueryText())
+		q, err := Parse("EVENT SEQ(t a, t b) WHERE " + c.QueryText())
+		require.NoError(t, err, expected)
+		require.True(t, q.predicate.Equal(c.Predicate), expected)
+		require.True(t, c.Equal(q.predicate), expected)
+		require.True(t, c.Equal(Condition{q.predicate}), expected)
+	}
+
+	require.Panics(t, func() { Lit(struct{}{}) })
+	require.Panics(t, func() { Attr("a") })
+	require.Panics(t, func() { And() })
+	require.Panics(t, func() { Or() })
+}
+
+func TestBuilderEvaluate(t *testing.T) {
+	p := Attr("a", "price").Gt(Lit(100)).And(Attr("a", "symbol").Eq(AttrOf("b", "symbol")))
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{typ: "stock", attrs: map[string]interface{}{"price": 101, "symbol": "GOOG"}},
+		"b": &tEventImpl{typ: "stock", attrs: map[string]interface{}{"price": 99, "symbol": "GOOG"}},
+	}
+	require.Equal(t, Positive, p.Evaluate(evs))
+	require.Equal(t, Positive, Compile(p)(evs))
+	require.Equal(t, Negative, p.Not().Evaluate(evs))
+	require.NoError(t, p.Validate(map[string]struct{}{"a": {}, "b": {}}))
+	require.Error(t, p.Validate(map[string]struct{}{"a": {}}))
+
+	// It is not visible as a wrapper
+	nodes := 0
+	Walk(p, func(node interface{}) bool {
+		_, ok := node.(Condition)
+		require.False(t, ok)
+		nodes++
+		return true
+	})
+	require.Equal(t, 7, nodes)
+	_, ok := ReorderByCost(p).(conjunction)
+	require.True(t, ok)
+
+	data, err := json.Marshal(p)
+	require.NoError(t, err)
+	unmarshalled, err := UnmarshalPredicate(data)
+	require.NoError(t, err)
+	require.True(t, p.Equal(unmarshalled))
+}
@@ -0,0 +1,75 @@
+package query
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A valueCache remembers the values resolved during a single evaluation of a predicate, so a value referenced more
+// than once (eg. a.price in "a.price * a.qty > a.price") is only looked up once. It is carried in the evaluation's
+// context, and is only consulted when evaluating against the same CapturedEvents it was created for.
+type valueCache struct {
+	evs     uintptr // Identifies the CapturedEvents map
+	entries map[interface{}]cachedValue
+}
+
+type cachedValue struct {
+	v   interface{}
+	err error
+}
+
+type valueCacheKey struct{}
+
+// valueCacheEnabled may be switched off to compare performance with and without caching
+var valueCacheEnabled = true
+
+// withValueCache returns a context carrying a cache for evaluation against evs (which is ctx itself if it already
+// carries one)
+func withValueCache(ctx context.Context, evs domain.CapturedEvents) context.Context {
+	if !valueCacheEnabled || valueCacheFor(ctx, evs) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, valueCacheKey{}, &valueCache{evs: reflect.ValueOf(evs).Pointer()})
+}
+
+// valueCacheFor returns the context's cache, if it has one for evs
+func valueCacheFor(ctx context.Context, evs domain.CapturedEvents) *valueCache {
+	if cache, ok := ctx.Value(valueCacheKey{}).(*valueCache); ok && cache.evs == reflect.ValueOf(evs).Pointer() {
+		return cache
+	}
+	return nil
+}
+
+// cacheKey returns the key under which v's result is cached. Literals aren't worth caching, and values which aren't
+// comparable can't be (though their operands may still be).
+func cacheKey(v value) (interface{}, bool) {
+	switch v.(type) {
+	case literalValue, durationLiteralValue, parameterValue, variableValue, coalesceValue:
+		return nil, false
+	case attributeLookup, lengthValue, timestampValue:
+		return v, true
+	}
+	if reflect.TypeOf(v).Kind() == reflect.Ptr {
+		return v, true
+	}
+	return nil, false
+}
+
+// BatchEvaluate evaluates several predicates against the same events, returning their results in order. They share a
+// single cache of resolved values, so a value several predicates reference (eg. a.price) is resolved only once for the
+// batch rather than once for each. As within a single evaluation, the cache is keyed by the value (attributes by their
+// key path, and other values by their node) and is only used for these events.
+func BatchEvaluate(predicates []Predicate, evs domain.CapturedEvents) []PredicateResult {
+	ctx := withValueCache(context.Background(), evs)
+	results := make([]PredicateResult, len(predicates))
+	for i, p := range predicates {
+		if p == nil {
+			results[i].Result = Positive
+			continue
+		}
+		results[i].Result, results[i].Err = evaluateObserved(ctx, p, evs)
+	}
+	return results
+}
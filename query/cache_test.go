@@ -0,0 +1,167 @@
+package query
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A tCountingValue counts how many times it is resolved
+type tCountingValue struct {
+	tValue
+	count int
+}
+
+func (v *tCountingValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	v.count++
+	return v.tValue.Value(evs)
+}
+
+func TestValueCache(t *testing.T) {
+	v := &tCountingValue{tValue: tValue{v: float64(1)}}
+	p := conjunction{
+		&operatorPredicate{left: v, right: literalValue{float64(1)}, op: opEq},
+		&operatorPredicate{left: &arithmeticValue{left: v, right: v, op: aoAdd}, right: v, op: opGt},
+		&betweenPredicate{operand: v, low: v, high: v},
+	}
+	evs := domain.CapturedEvents{}
+
+	require.Equal(t, Positive, p.Evaluate(evs))
+	require.Equal(t, 1, v.count)
+	require.Equal(t, Positive, p.Evaluate(evs)) // Nothing is remembered between evaluations
+	require.Equal(t, 2, v.count)
+
+	// Reusing a context does not reuse its cache for different events
+	ctx := withValueCache(context.Background(), evs)
+	_, err := p.EvaluateContext(ctx, evs)
+	require.NoError(t, err)
+	require.Equal(t, 3, v.count)
+	_, err = p.EvaluateContext(ctx, domain.CapturedEvents{})
+	require.NoError(t, err)
+	require.Equal(t, 4, v.count)
+	_, err = p.EvaluateContext(ctx, evs)
+	require.NoError(t, err)
+	require.Equal(t, 4, v.count)
+
+	// Errors are remembered too
+	missing := &tCountingValue{tValue: tValue{err: ErrEventNotFound}}
+	p2 := conjunction{
+		&nullCheckPredicate{operand: missing},
+		&operatorPredicate{left: missing, right: missing, op: opEq},
+	}
+	require.Equal(t, Uncertain, p2.Evaluate(evs))
+	require.Equal(t, 1, missing.count)
+}
+
+// A tCountingEvent counts the attributes looked up from it
+type tCountingEvent struct {
+	tEventImpl
+	lookups int
+}
+
+func (e *tCountingEvent) Get(path string) (interface{}, bool) {
+	e.lookups++
+	return MapAttributes(e.attrs).Get(path)
+}
+
+func TestBatchEvaluate(t *testing.T) {
+	ev := &tCountingEvent{tEventImpl: tEventImpl{typ: "a", attrs: map[string]interface{}{"price": 10.0, "qty": 3.0}}}
+	evs := domain.CapturedEvents{"a": ev}
+	v := &tCountingValue{tValue: tValue{v: float64(1)}}
+	var predicates []Predicate
+	for _, text := range []string{"a.price > 5", "a.price * a.qty == 30", "a.price < a.qty", "a.missing > 1"} {
+		q, err := Parse("EVENT SEQ(A a) WHERE " + text)
+		require.NoError(t, err, text)
+		predicates = append(predicates, q.predicate)
+	}
+	predicates = append(predicates, nil, &operatorPredicate{left: v, right: v, op: opEq},
+		&operatorPredicate{left: v, right: literalValue{float64(1)}, op: opEq})
+
+	results := BatchEvaluate(predicates, evs)
+	require.Len(t, results, len(predicates))
+	for i, expected := range []Result{Positive, Positive, Negative, Negative, Positive, Positive, Positive} {
+		require.Equal(t, expected, results[i].Result, predicates[i])
+	}
+	for i, result := range results {
+		require.Equal(t, i == 3, result.Err != nil, "%d: %v", i, result.Err)
+	}
+	require.Equal(t, 3, ev.lookups) // a.price, a.qty and a.missing, once each
+	require.Equal(t, 1, v.count)
+
+	// The results are those of evaluating each predicate separately
+	for i, p := range predicates {
+		if p != nil {
+			r, err := p.EvaluateErr(evs)
+			require.Equal(t, r, results[i].Result)
+			require.Equal(t, err, results[i].Err)
+		}
+	}
+	require.Equal(t, 0, len(BatchEvaluate(nil, evs)))
+}
+
+func benchmarkValueCache(b *testing.B, enabled bool) {
+	valueCacheEnabled = enabled
+	defer func() { valueCacheEnabled = true }()
+
+	q, err := Parse("EVENT a b WHERE b.m.price * b.m.qty > b.m.price AND b.m.price < 100 AND b.m.qty != b.m.price")
+	require.NoError(b, err)
+	evs := domain.CapturedEvents{"b": &tEventImpl{
+		typ: "a",
+		attrs: map[string]interface{}{"m": map[string]interface{}{
+			"price": float64(10),
+			"qty":   float64(3),
+		}},
+	}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if q.Evaluate(evs) != Positive {
+			b.Fatal("Expected a positive result")
+		}
+	}
+}
+
+func BenchmarkEvaluateUncached(b *testing.B) {
+	benchmarkValueCache(b, false)
+}
+
+func BenchmarkEvaluateCached(b *testing.B) {
+	benchmarkValueCache(b, true)
+}
+
+func benchmarkBatchEvaluate(b *testing.B, batched bool) {
+	ev := &tCountingEvent{tEventImpl: tEventImpl{typ: "a", attrs: map[string]interface{}{"price": 10.0, "qty": 3.0}}}
+	evs := domain.CapturedEvents{"a": ev}
+	var predicates []Predicate
+	for _, text := range []string{"a.price > 5", "a.price < 100", "a.price * a.qty >= 30", "a.price != a.qty",
+		"a.price BETWEEN 1 AND 20", "a.price IN (5, 10, 15)"} {
+		q, err := Parse("EVENT SEQ(A a) WHERE " + text)
+		require.NoError(b, err, text)
+		predicates = append(predicates, q.predicate)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batched {
+			BatchEvaluate(predicates, evs)
+		} else {
+			for _, p := range predicates {
+				p.Evaluate(evs)
+			}
+		}
+	}
+	b.ReportMetric(float64(ev.lookups)/float64(b.N), "lookups/op")
+}
+
+func BenchmarkEvaluateSeparately(b *testing.B) {
+	benchmarkBatchEvaluate(b, false)
+}
+
+func BenchmarkBatchEvaluate(b *testing.B) {
+	benchmarkBatchEvaluate(b, true)
+}
@@ -0,0 +1,104 @@
+package query
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A Comparator orders two values, at least one of which is of the type it is registered for (see Query.SetComparator),
+// returning a negative number, zero or a positive number as left is less than, equal to or greater than right. ok is
+// false if it can't compare them, in which case they are compared as they would be without it.
+type Comparator func(left, right interface{}) (cmp int, ok bool)
+
+// comparators are the comparators registered on a query, by the type of value each compares
+type comparators map[reflect.Type]Comparator
+
+type comparatorsKey struct{}
+
+// withComparators returns a context carrying the comparators to use in evaluation (or ctx itself, if there are none)
+func withComparators(ctx context.Context, cs comparators) context.Context {
+	if len(cs) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, comparatorsKey{}, cs)
+}
+
+// comparatorsFor returns the comparators the context carries, if any
+func comparatorsFor(ctx context.Context) comparators {
+	cs, _ := ctx.Value(comparatorsKey{}).(comparators)
+	return cs
+}
+
+// compare orders two values with the comparator registered for the type of left or, failing that, of right. ok is false
+// if neither has one which can compare them.
+func (cs comparators) compare(left, right interface{}) (cmp int, ok bool) {
+	if len(cs) == 0 {
+		return 0, false
+	}
+	leftType, rightType := reflect.TypeOf(left), reflect.TypeOf(right)
+	if c, found := cs[leftType]; found {
+		if cmp, ok := c(left, right); ok {
+			return cmp, true
+		}
+	}
+	if c, found := cs[rightType]; found && rightType != leftType {
+		return c(left, right)
+	}
+	return 0, false
+}
+
+// equal is valuesEqual, consulting the comparators first
+func (cs comparators) equal(left, right interface{}) bool {
+	if cmp, ok := cs.compare(left, right); ok {
+		return cmp == 0
+	}
+	return valuesEqual(left, right)
+}
+
+// order is compareValues, consulting the comparators first
+func (cs comparators) order(left, right interface{}) (cmp int, ok bool) {
+	if cmp, ok := cs.compare(left, right); ok {
+		return cmp, true
+	}
+	return compareValues(left, right)
+}
+
+// Comparator returns the comparator registered for values of type t (see SetComparator), or nil if there is none
+func (q *Query) Comparator(t reflect.Type) Comparator {
+	return q.comparators[t]
+}
+
+// SetComparator registers a comparator for values of type t (or, if c is nil, removes it), which ==, !=, the ordering
+// operators, BETWEEN and IN consult whenever either of the values they compare is of that type before falling back to
+// the defaults. For example, a version type may be ordered semantically, or compared with the strings it is written as.
+// If both values have a comparator, left's is consulted first.
+//
+// Comparators belong to the query, so different queries may compare the same types differently; they are used however
+// it is evaluated (including when compiled or matched against a stream), but not when its predicate is evaluated alone.
+func (q *Query) SetComparator(t reflect.Type, c Comparator) {
+	cs := make(comparators, len(q.comparators)+1)
+	for k, v := range q.comparators { // Copied, so that copies of the query (eg. when binding) aren't changed too
+		cs[k] = v
+	}
+	if c == nil {
+		delete(cs, t)
+	} else {
+		cs[t] = c
+	}
+	q.comparators = cs
+	q.updateAlternatives()
+}
+
+// compilePredicate compiles p for evaluation as part of the query. A compiled predicate fixes how it compares values
+// when it is built, so if the query has comparators p is evaluated with them instead.
+func (q *Query) compilePredicate(p Predicate) compiledPredicate {
+	if p == nil || len(q.comparators) == 0 {
+		return compilePredicate(p)
+	}
+	cs := q.comparators
+	return func(evs domain.CapturedEvents) (Result, error) {
+		return evaluateObserved(withComparators(context.Background(), cs), p, evs)
+	}
+}
@@ -0,0 +1,148 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// tVersion is a dotted version number (eg. 1.10.2), which should be ordered by its parts
+type tVersion []int
+
+func tParseVersion(s string) (tVersion, bool) {
+	parts := strings.Split(s, ".")
+	result := make(tVersion, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		result[i] = n
+	}
+	return result, true
+}
+
+// tCompareVersions orders versions, and the strings they are written as, semantically
+func tCompareVersions(left, right interface{}) (int, bool) {
+	versions := [2]tVersion{}
+	for i, v := range [...]interface{}{left, right} {
+		switch v := v.(type) {
+		case tVersion:
+			versions[i] = v
+		case string:
+			parsed, ok := tParseVersion(v)
+			if !ok {
+				return 0, false
+			}
+			versions[i] = parsed
+		default:
+			return 0, false
+		}
+	}
+	l, r := versions[0], versions[1]
+	for i := 0; i < len(l) || i < len(r); i++ {
+		var lp, rp int // Missing parts are 0, so 1.2 == 1.2.0
+		if i < len(l) {
+			lp = l[i]
+		}
+		if i < len(r) {
+			rp = r[i]
+		}
+		if lp != rp {
+			if lp < rp {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+func TestComparator(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{typ: "A", attrs: map[string]interface{}{"v": tVersion{1, 10}, "s": "1.10", "n": 3.0}},
+		"b": &tEventImpl{typ: "B", attrs: map[string]interface{}{"v": tVersion{1, 9, 4}, "s": "1.9.4"}},
+	}
+	cases := []struct {
+		where             string
+		without, expected Result // Without and with the comparators
+		withoutErr        string // Versions can't be ordered without the comparator
+	}{
+		{"a.v > b.v", Negative, Positive, "Could not order query.tVersion and query.tVersion: a.v > b.v"},
+		{"a.v == '1.10.0'", Negative, Positive, ""},
+		{"'1.10.0' == a.v", Negative, Positive, ""},
+		{"a.v != '1.10'", Positive, Negative, ""},
+		{"b.v BETWEEN '1.9' AND a.v", Negative, Positive,
+			`Could not order query.tVersion between string and query.tVersion: b.v BETWEEN "1.9" AND a.v`},
+		{"a.v IN ('1.9', '1.10.0')", Negative, Positive, ""},
+		{"a.v IN b[].v", Negative, Negative, ""},
+		// Overriding the default ordering of strings
+		{"a.s > b.s", Negative, Positive, ""},
+		// Falling back to the defaults where the comparator can't compare the values
+		{"a.s == 'foo'", Negative, Negative, ""},
+		{"a.n == 3", Positive, Positive, ""},
+	}
+	for _, c := range cases {
+		without, err := Parse("EVENT SEQ(A a, B b) WHERE " + c.where)
+		require.NoError(t, err, c.where)
+		with, err := Parse("EVENT SEQ(A a, B b) WHERE " + c.where)
+		require.NoError(t, err, c.where)
+		with.SetComparator(reflect.TypeOf(tVersion{}), tCompareVersions)
+		with.SetComparator(reflect.TypeOf(""), tCompareVersions)
+
+		r, err := without.EvaluateErr(evs)
+		if c.withoutErr != "" {
+			require.EqualError(t, err, c.withoutErr, c.where)
+		} else {
+			require.NoError(t, err, c.where)
+		}
+		require.Equal(t, c.without, r, c.where)
+		r, err = with.EvaluateErr(evs)
+		require.NoError(t, err, c.where)
+		require.Equal(t, c.expected, r, c.where)
+		require.Equal(t, c.expected, with.Compile()(evs), c.where)
+	}
+
+	// Comparators belong to the query; copies made before they are set aren't affected
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE a.v > '1.9'")
+	require.NoError(t, err)
+	other := *q
+	q.SetComparator(reflect.TypeOf(tVersion{}), tCompareVersions)
+	require.NotNil(t, q.Comparator(reflect.TypeOf(tVersion{})))
+	require.Nil(t, other.Comparator(reflect.TypeOf(tVersion{})))
+	r, err := q.EvaluateErr(evs)
+	require.NoError(t, err)
+	require.Equal(t, Positive, r)
+	_, err = other.EvaluateErr(evs)
+	require.Error(t, err)
+	q.SetComparator(reflect.TypeOf(tVersion{}), nil)
+	require.Nil(t, q.Comparator(reflect.TypeOf(tVersion{})))
+	_, err = q.EvaluateErr(evs)
+	require.Error(t, err)
+}
+
+func TestComparatorMatcher(t *testing.T) {
+	q, err := Parse("EVENT SEQ(Release a, Release b) WHERE b.version < a.version")
+	require.NoError(t, err)
+	q.SetComparator(reflect.TypeOf(""), tCompareVersions)
+
+	var matches []string
+	m := NewMatcher(q)
+	start := time.Now()
+	for i, v := range []string{"1.9", "1.10", "1.2"} {
+		ev := &tEventImpl{typ: "Release", attrs: map[string]interface{}{"version": v},
+			ts: start.Add(time.Duration(i) * time.Second)}
+		for _, match := range m.Feed(ev) {
+			matches = append(matches, fmt.Sprintf("%v -> %v", match["a"].Attributes()["version"],
+				match["b"].Attributes()["version"]))
+		}
+	}
+	require.Equal(t, []string{"1.9 -> 1.2", "1.10 -> 1.2"}, matches) // As strings, "1.2" > "1.10"
+}
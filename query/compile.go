@@ -0,0 +1,269 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A compiledPredicate evaluates a predicate which has been compiled; it behaves exactly as EvaluateErr. Anything it
+// refers to is fixed when it is built, so it is safe for concurrent use.
+type compiledPredicate func(domain.CapturedEvents) (Result, error)
+
+// A compiledValue resolves a value which has been compiled, as Value
+type compiledValue func(domain.CapturedEvents) (interface{}, error)
+
+// Compile builds a function equivalent to p.Evaluate, but which does as much of the work as it can up-front (eg.
+// deciding how to apply operators and splitting attribute paths) rather than each time it is called. This is worth
+// doing when a predicate is evaluated many times. The function is safe for concurrent use.
+func Compile(p Predicate) func(domain.CapturedEvents) Result {
+	compiled := compilePredicate(p)
+	return func(evs domain.CapturedEvents) Result {
+		result, err := compiled(evs)
+		if err != nil {
+			logger.Errorf("[sase:Compile] %s", err.Error())
+			return Negative // Terminate this match
+		}
+		return result
+	}
+}
+
+// Compile builds a function equivalent to q.Evaluate (see Compile)
+func (q *Query) Compile() func(domain.CapturedEvents) Result {
+	if alts := q.alternatives(); alts != nil {
+		compiledAlts := make([]func(domain.CapturedEvents) Result, len(alts))
+		for i, alt := range alts {
+			compiledAlts[i] = alt.Compile()
+		}
+		return func(evs domain.CapturedEvents) Result {
+			result := Negative
+			for i, alt := range alts {
+				if capturesAll(alt.capture, evs) {
+					result = result.Or(compiledAlts[i](evs))
+				}
+			}
+			return result
+		}
+	}
+	compiled := q.compilePredicate(q.predicate)
+	var satisfied compiledPredicate // Once complete without the negated events (see Query.negationsSatisfied)
+	if q.predicate != nil && len(q.capture.Negations()) > 0 {
+		satisfied = q.compilePredicate(q.negationsSatisfied())
+	}
+	return func(evs domain.CapturedEvents) Result {
+		r, err := compiled(evs)
+		if err == nil && r == Uncertain && satisfied != nil && q.completeWithoutNegations(evs) {
+			r, err = satisfied(evs)
+		}
+		if err != nil {
+			logger.Errorf("[sase:Query] %s", err.Error())
+			return Negative // Terminate this match
+		}
+		return q.result(evs, r)
+	}
+}
+
+func compilePredicate(p Predicate) compiledPredicate {
+	if p == nil {
+		return func(domain.CapturedEvents) (Result, error) {
+			return Positive, nil
+		}
+	}
+	return observeCompiled(p, p.compile())
+}
+
+// uncompiled adapts a predicate with no specialised compiled form
+func uncompiled(p Predicate) compiledPredicate {
+	return func(evs domain.CapturedEvents) (Result, error) {
+		return p.EvaluateContext(context.Background(), evs)
+	}
+}
+
+// compileValue compiles the value types which benefit from it; any others are resolved as usual
+func compileValue(v value) compiledValue {
+	switch v := v.(type) {
+	case literalValue:
+		val := v.v
+		return func(domain.CapturedEvents) (interface{}, error) {
+			return val, nil
+		}
+
+	case durationLiteralValue:
+		val := time.Duration(v)
+		return func(domain.CapturedEvents) (interface{}, error) {
+			return val, nil
+		}
+
+	case attributeLookup:
+		parts := splitPath(string(v))
+		if len(parts) < 2 {
+			break
+		}
+		alias, path, desc := parts[0], parts[1:], string(v)
+		return func(evs domain.CapturedEvents) (interface{}, error) {
+			if ev, ok := evs[alias]; !ok {
+				return nil, ErrEventNotFound
+			} else {
+				return lookupEvent(desc, ev, path)
+			}
+		}
+
+	case *arithmeticValue:
+		if v.left == nil || v.right == nil {
+			break
+		}
+		left, right := compileValue(v.left), compileValue(v.right)
+		return func(evs domain.CapturedEvents) (interface{}, error) {
+			if leftVal, err := left(evs); err != nil {
+				return nil, eitherMissing(err, func() error {
+					_, err := right(evs)
+					return err
+				})
+			} else if rightVal, err := right(evs); err != nil {
+				return nil, err
+			} else {
+				return v.apply(leftVal, rightVal)
+			}
+		}
+	}
+
+	return func(evs domain.CapturedEvents) (interface{}, error) {
+		return v.Value(evs)
+	}
+}
+
+func (p *operatorPredicate) compile() compiledPredicate {
+	compare := p.op.comparator(nil)
+	if p.left == nil || p.right == nil || compare == nil {
+		return uncompiled(p) // It's broken; let EvaluateContext explain how
+	}
+	left, right := compileValue(p.left), compileValue(p.right)
+
+	return func(evs domain.CapturedEvents) (Result, error) {
+		leftVal, err := left(evs)
+		if err != nil {
+			err = eitherMissing(err, func() error {
+				_, err := right(evs)
+				return err
+			})
+		} else {
+			var rightVal interface{}
+			if rightVal, err = right(evs); err == nil {
+				if matched, ok := compare(leftVal, rightVal); !ok {
+					return Negative, fmt.Errorf("Could not order %T and %T: %s", leftVal, rightVal, p.QueryText())
+				} else if matched {
+					return Positive, nil
+				}
+				return Negative, nil
+			}
+		}
+		if errors.Is(err, ErrAttributeNotFound) {
+			return Uncertain, nil
+		} else if errors.Is(err, ErrEventNotFound) {
+			return Positive, nil
+		}
+		return Negative, fmt.Errorf("Could not evaluate %s left/right: %w", p.QueryText(), err)
+	}
+}
+
+func (p *betweenPredicate) compile() compiledPredicate {
+	return uncompiled(p)
+}
+
+func (p *inPredicate) compile() compiledPredicate {
+	return uncompiled(p)
+}
+
+func (p *quantifiedPredicate) compile() compiledPredicate {
+	return uncompiled(p)
+}
+
+func (p *nullCheckPredicate) compile() compiledPredicate {
+	return uncompiled(p)
+}
+
+func (p *equivalencePredicate) compile() compiledPredicate {
+	return uncompiled(p)
+}
+
+func (p *regexPredicate) compile() compiledPredicate {
+	return uncompiled(p) // The pattern is compiled already
+}
+
+func (p *stringMatchPredicate) compile() compiledPredicate {
+	return uncompiled(p)
+}
+
+func (c conjunction) compile() compiledPredicate {
+	children := make([]compiledPredicate, len(c))
+	for i, child := range c {
+		children[i] = compilePredicate(child)
+	}
+
+	return func(evs domain.CapturedEvents) (Result, error) {
+		result := Positive
+		for _, child := range children {
+			r, err := child(evs)
+			if err != nil {
+				return Negative, err
+			}
+			result = result.And(r)
+			if result == Negative || result == Invalid { // Nothing can make this positive again
+				return result, nil
+			}
+		}
+		return result, nil
+	}
+}
+
+func (d disjunction) compile() compiledPredicate {
+	children := make([]compiledPredicate, len(d))
+	for i, child := range d {
+		children[i] = compilePredicate(child)
+	}
+
+	return func(evs domain.CapturedEvents) (Result, error) {
+		var (
+			result   = Negative
+			firstErr error
+		)
+		for i, child := range children {
+			r, err := child(evs)
+			if err != nil {
+				if firstErr == nil { // A later predicate may still match, which makes the error moot
+					firstErr = err
+				}
+				r = Negative
+			}
+			if i == 0 {
+				result = r
+			} else {
+				result = result.Or(r)
+			}
+			if result == Positive {
+				return result, nil
+			}
+		}
+		if firstErr != nil {
+			return Negative, firstErr
+		}
+		return result, nil
+	}
+}
+
+func (p *negationPredicate) compile() compiledPredicate {
+	child, aliases := compilePredicate(p.Predicate), p.Predicate.usedAliases()
+	return func(evs domain.CapturedEvents) (Result, error) {
+		if !allCaptured(aliases, evs) { // Which of its operands are settled matters (see negationPredicate)
+			return p.EvaluateContext(context.Background(), evs)
+		}
+		r, err := child(evs)
+		if err != nil { // An error is not a negative result, so must not be inverted into a positive one
+			return Negative, err
+		}
+		return negate(r), nil
+	}
+}
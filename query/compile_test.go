@@ -0,0 +1,145 @@
+package query
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func (g tGenerator) attribute() interface{} {
+	switch g.pick(4) {
+	case 0:
+		return float64(g.pick(5))
+	case 1:
+		return tGenStrings[g.pick(len(tGenStrings))]
+	case 2:
+		return nil
+	default:
+		return map[string]interface{}{"z": float64(g.pick(5))}
+	}
+}
+
+func (g tGenerator) events() domain.CapturedEvents {
+	evs := domain.CapturedEvents{}
+	for _, alias := range []string{"a", "b"} {
+		list := make(domain.EventList, g.pick(3)+1)
+		for i := range list {
+			list[i] = &tEventImpl{
+				typ:   "t",
+				attrs: map[string]interface{}{"x": g.attribute(), "y": g.attribute(), "m": g.attribute()},
+				ts:    time.Unix(int64(i), 0),
+			}
+		}
+		switch g.pick(3) {
+		case 0: // Not captured yet
+		case 1:
+			evs[alias] = list[0]
+		default:
+			evs[alias] = list
+		}
+	}
+	return evs
+}
+
+// Compiled predicates must behave exactly as their uncompiled counterparts
+func TestCompile(t *testing.T) {
+	g := tGenerator{rand.New(rand.NewSource(1))}
+	for i := 0; i < 2000; i++ {
+		p := g.predicate(3)
+		compiled := compilePredicate(p)
+		for j := 0; j < 5; j++ {
+			evs := g.events()
+			expected, expectedErr := p.EvaluateErr(evs)
+			result, err := compiled(evs)
+			require.Equal(t, expected, result, p.QueryText())
+			require.Equal(t, expectedErr != nil, err != nil, p.QueryText()) // Messages may name captures in any order
+			require.Equal(t, p.Evaluate(evs), Compile(p)(evs), p.QueryText())
+		}
+	}
+
+	q, err := Parse("EVENT SEQ(t a, t b) WHERE a.x < b.x WITHIN 1s")
+	require.NoError(t, err)
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{typ: "t", attrs: map[string]interface{}{"x": float64(1)}, ts: time.Unix(0, 0)},
+		"b": &tEventImpl{typ: "t", attrs: map[string]interface{}{"x": float64(2)}, ts: time.Unix(0, 0)},
+	}
+	compiled := q.Compile()
+	require.Equal(t, Positive, compiled(evs))
+	evs["b"].(*tEventImpl).ts = time.Unix(2, 0) // Outside the window
+	require.Equal(t, q.Evaluate(evs), compiled(evs))
+	evs["b"].(*tEventImpl).attrs["x"] = "x" // Incomparable
+	require.Equal(t, Negative, compiled(evs))
+}
+
+func TestCompileConcurrent(t *testing.T) {
+	q, err := Parse("EVENT SEQ(t a, t b) WHERE a.x * 2 < b.x AND (b.y == 'foo' OR NOT (a.m.z > 1))")
+	require.NoError(t, err)
+	compiled := q.Compile()
+
+	g := tGenerator{rand.New(rand.NewSource(1))}
+	sets := make([]domain.CapturedEvents, 100)
+	expected := make([]Result, len(sets))
+	for i := range sets {
+		sets[i] = g.events()
+		expected[i] = q.Evaluate(sets[i])
+	}
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, evs := range sets {
+				if compiled(evs) != expected[i] {
+					t.Errorf("Unexpected result for set %d", i)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func benchmarkCompile(b *testing.B, compile bool) {
+	q, err := Parse("EVENT SEQ(stock a, stock b) WHERE a.symbol == b.symbol AND b.price > a.price * 1.1 AND " +
+		"b.volume >= 1000 WITHIN 1h")
+	require.NoError(b, err)
+	g := rand.New(rand.NewSource(1))
+	sets := make([]domain.CapturedEvents, 100000)
+	for i := range sets {
+		sets[i] = domain.CapturedEvents{}
+		for _, alias := range []string{"a", "b"} {
+			sets[i][alias] = &tEventImpl{
+				typ: "stock",
+				attrs: map[string]interface{}{
+					"symbol": []string{"GOOG", "AAPL"}[g.Intn(2)],
+					"price":  g.Float64() * 100,
+					"volume": g.Intn(2000),
+				},
+				ts: time.Unix(int64(g.Intn(7200)), 0),
+			}
+		}
+	}
+
+	evaluate := q.Evaluate
+	if compile {
+		evaluate = q.Compile()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		evaluate(sets[i%len(sets)])
+	}
+}
+
+func BenchmarkEvaluateQuery(b *testing.B) {
+	benchmarkCompile(b, false)
+}
+
+func BenchmarkEvaluateCompiledQuery(b *testing.B) {
+	benchmarkCompile(b, true)
+}
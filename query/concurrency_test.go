@@ -0,0 +1,84 @@
+package query
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// TestConcurrentEvaluate hammers one query from many goroutines, each against its own events (and some shared ones),
+// checking every result is what evaluating serially gives. Run it with -race to check for shared mutable state.
+func TestConcurrentEvaluate(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, B+ b[], C c) WHERE a.price * 2 > c.price AND lower(a.sym) MATCHES 'go+g' AND " +
+		"(sum(b[].qty) BETWEEN 1 AND 100 OR b[1].qty IN (1, 2, 3)) AND coalesce(c.tags[\"env\"], a.sym) != 'test' " +
+		"AND a.x == a.x AND c.TS - a.TS < 1h")
+	require.NoError(t, err)
+	compiled := q.Compile()
+	compiledPredicate := Compile(q.predicate)
+	predicates := []Predicate{q.predicate, q.predicate.Clone(), conjunction{q.predicate, q.predicate}}
+
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	event := func(typ string, i int, attrs map[string]interface{}) domain.Event {
+		return &tEventImpl{typ: typ, attrs: attrs, ts: start.Add(time.Duration(i) * time.Minute)}
+	}
+	sets := make([]domain.CapturedEvents, 64)
+	for i := range sets {
+		sets[i] = domain.CapturedEvents{
+			"a": event("A", 0, map[string]interface{}{"price": float64(i), "sym": []string{"GOOG", "goooG", "MSFT"}[i%3],
+				"x": i}),
+			"b": domain.EventList{event("B", 1, map[string]interface{}{"qty": float64(i % 5)}),
+				event("B", 2, map[string]interface{}{"qty": float64(i % 7)})},
+			"c": event("C", 3+i%90, map[string]interface{}{"price": float64(64 - i),
+				"tags": map[string]interface{}{"env": []interface{}{"test", nil, "prod"}[i%3]}}),
+		}
+		if i%4 == 0 {
+			delete(sets[i], "c")
+		}
+	}
+
+	type results struct {
+		query, compiled, predicate, compiledPredicate Result
+		err                                           error
+		batch                                         []PredicateResult
+	}
+	evaluate := func(evs domain.CapturedEvents) results {
+		r := results{query: q.Evaluate(evs), compiled: compiled(evs), compiledPredicate: compiledPredicate(evs)}
+		r.predicate, r.err = q.predicate.EvaluateErr(evs)
+		r.batch = BatchEvaluate(predicates, evs)
+		return r
+	}
+	expected := make([]results, len(sets))
+	seen := make(map[Result]bool)
+	for i, evs := range sets {
+		expected[i] = evaluate(evs)
+		require.NoError(t, expected[i].err)
+		seen[expected[i].predicate] = true
+	}
+	require.True(t, seen[Positive] && seen[Negative], "The events should exercise both results")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for g := 0; g < cap(errs); g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				i := (g*7 + n) % len(sets)
+				if actual := evaluate(sets[i]); fmt.Sprint(actual) != fmt.Sprint(expected[i]) {
+					errs <- fmt.Errorf("Goroutine %d: events %d evaluated to %v, not %v", g, i, actual, expected[i])
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
@@ -1,6 +1,8 @@
 package query
 
 import (
+	"context"
+	"fmt"
 	"strings"
 
 	"github.com/obeattie/sase/domain"
@@ -10,15 +12,30 @@ import (
 type conjunction []Predicate
 
 func (c conjunction) Evaluate(evs domain.CapturedEvents) Result {
+	return evaluateOrLog("conjunction", c, evs)
+}
+
+func (c conjunction) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return evaluateObserved(context.Background(), c, evs)
+}
+
+func (c conjunction) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	ctx = withValueCache(ctx, evs)
+	result := Positive
 	for _, p := range c {
-		switch p.Evaluate(evs) {
-		case Uncertain:
-			return Uncertain
-		case Negative:
-			return Negative
+		if err := ctx.Err(); err != nil {
+			return Negative, err
+		}
+		r, err := evaluateObserved(ctx, p, evs)
+		if err != nil {
+			return Negative, err
+		}
+		result = result.And(r)
+		if result == Negative || result == Invalid { // Nothing can make this positive again
+			return result, nil
 		}
 	}
-	return Positive
+	return result, nil
 }
 
 func (c conjunction) QueryText() string {
@@ -26,7 +43,7 @@ func (c conjunction) QueryText() string {
 	for i, p := range c {
 		results[i] = p.QueryText()
 	}
-	return strings.Join(results, " AND ")
+	return "(" + strings.Join(results, " AND ") + ")"
 }
 
 func (c conjunction) usedAliases() []string {
@@ -34,22 +51,79 @@ func (c conjunction) usedAliases() []string {
 	for _, p := range c {
 		result = append(result, p.usedAliases()...)
 	}
+	return dedupeAliases(result)
+}
+
+func (c conjunction) Equal(other Predicate) bool {
+	o, ok := other.(conjunction)
+	return ok && sameOperands(c, o)
+}
+
+func (c conjunction) Hash() uint64 {
+	return hashPredicate(c)
+}
+
+func clonePredicates(ps []Predicate) []Predicate {
+	result := make([]Predicate, len(ps))
+	for i, p := range ps {
+		result[i] = p.Clone()
+	}
 	return result
 }
 
+func (c conjunction) Clone() Predicate {
+	return conjunction(clonePredicates(c))
+}
+
+func (c conjunction) children() []interface{} {
+	return predicateNodes(c...)
+}
+
+func (c conjunction) Validate(declared map[string]struct{}) error {
+	return validateAliases(c, declared)
+}
+
 // A disunction represents an array of OR'd predicates
 type disjunction []Predicate
 
 func (d disjunction) Evaluate(evs domain.CapturedEvents) Result {
-	for _, p := range d {
-		switch p.Evaluate(evs) {
-		case Uncertain:
-			return Uncertain
-		case Positive:
-			return Positive
+	return evaluateOrLog("disjunction", d, evs)
+}
+
+func (d disjunction) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return evaluateObserved(context.Background(), d, evs)
+}
+
+func (d disjunction) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	ctx = withValueCache(ctx, evs)
+	var (
+		result   = Negative
+		firstErr error
+	)
+	for i, p := range d {
+		if err := ctx.Err(); err != nil { // Unlike an evaluation error, no later predicate can make this moot
+			return Negative, err
+		}
+		r, err := evaluateObserved(ctx, p, evs)
+		if err != nil {
+			if firstErr == nil { // A later predicate may still match, which makes the error moot
+				firstErr = err
+			}
+			r = Negative
+		}
+		if i == 0 {
+			result = r
+		} else {
+			result = result.Or(r)
+		}
+		if result == Positive {
+			return result, nil
 		}
 	}
-	return Negative
+	if firstErr != nil {
+		return Negative, firstErr
+	}
+	return result, nil
 }
 
 func (d disjunction) QueryText() string {
@@ -57,7 +131,7 @@ func (d disjunction) QueryText() string {
 	for i, p := range d {
 		results[i] = p.QueryText()
 	}
-	return strings.Join(results, " OR ")
+	return "(" + strings.Join(results, " OR ") + ")"
 }
 
 func (d disjunction) usedAliases() []string {
@@ -65,5 +139,102 @@ func (d disjunction) usedAliases() []string {
 	for _, p := range d {
 		result = append(result, p.usedAliases()...)
 	}
-	return result
+	return dedupeAliases(result)
+}
+
+func (d disjunction) Equal(other Predicate) bool {
+	o, ok := other.(disjunction)
+	return ok && sameOperands(d, o)
+}
+
+func (d disjunction) Hash() uint64 {
+	return hashPredicate(d)
+}
+
+func (d disjunction) Clone() Predicate {
+	return disjunction(clonePredicates(d))
+}
+
+func (d disjunction) children() []interface{} {
+	return predicateNodes(d...)
+}
+
+func (d disjunction) Validate(declared map[string]struct{}) error {
+	return validateAliases(d, declared)
+}
+
+// A negationPredicate inverts the result of the predicate it wraps. Uncertain results are passed through unchanged:
+// the negation of an unknown is still unknown. So is a Positive result which isn't settled while some of the events the
+// predicate refers to are missing (see EvaluatePartial), since a comparison with a missing event is Positive (see
+// operatorPredicate) until it arrives.
+type negationPredicate struct {
+	Predicate
+}
+
+func (p *negationPredicate) Evaluate(evs domain.CapturedEvents) Result {
+	return evaluateOrLog("negationPredicate", p, evs)
+}
+
+func (p *negationPredicate) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return evaluateObserved(context.Background(), p, evs)
+}
+
+func (p *negationPredicate) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	ctx = withValueCache(ctx, evs)
+	if !allCaptured(p.Predicate.usedAliases(), evs) {
+		r := negationResult(evaluatePartial(ctx, p.Predicate, evs))
+		return r.Result, r.Err
+	}
+	r, err := evaluateObserved(ctx, p.Predicate, evs)
+	if err != nil { // An error is not a negative result, so must not be inverted into a positive one
+		return Negative, err
+	}
+	return negate(r), nil
+}
+
+// allCaptured reports whether all of the aliases have been captured
+func allCaptured(aliases []string, evs domain.CapturedEvents) bool {
+	for _, alias := range aliases {
+		if _, ok := evs[alias]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func negate(r Result) Result {
+	switch r {
+	case Positive:
+		return Negative
+	case Negative:
+		return Positive
+	default:
+		return r
+	}
+}
+
+func (p *negationPredicate) QueryText() string {
+	switch p.Predicate.(type) {
+	case conjunction, disjunction: // Already parenthesised
+		return fmt.Sprintf("NOT %s", p.Predicate.QueryText())
+	default:
+		return fmt.Sprintf("NOT (%s)", p.Predicate.QueryText())
+	}
+}
+
+func (p *negationPredicate) Equal(other Predicate) bool {
+	o, ok := other.(*negationPredicate)
+	return ok && samePredicate(p.Predicate, o.Predicate)
+}
+
+func (p *negationPredicate) Hash() uint64 {
+	return hashPredicate(p)
+}
+
+func (p *negationPredicate) Clone() Predicate {
+	return &negationPredicate{p.Predicate.Clone()}
+}
+
+func (p *negationPredicate) children() []interface{} {
+	return predicateNodes(p.Predicate)
 }
@@ -0,0 +1,148 @@
+package query
+
+import (
+	"context"
+	"sort"
+)
+
+// Relative costs of evaluating each kind of node. These are rough: what matters is their order of magnitude.
+const (
+	costCheap     = 1  // eg. a literal, an attribute lookup, or a comparison
+	costFunction  = 3  // a scalar function call
+	costList      = 10 // anything which visits every event captured by a Kleene closure
+	costRegexp    = 20 // a regular expression match
+	costUnvisited = 0  // connectives cost nothing beyond their children
+)
+
+func nodeCost(node interface{}) int {
+	switch node.(type) {
+	case conjunction, disjunction, *negationPredicate:
+		return costUnvisited
+	case *regexPredicate:
+		return costRegexp
+	case *listLookup, *aggregateValue, *quantifiedPredicate, *recentValue:
+		return costList
+	case *functionValue, *castValue:
+		return costFunction
+	default:
+		return costCheap
+	}
+}
+
+// Cost estimates how expensive p is to evaluate, relative to other predicates
+func Cost(p Predicate) int {
+	total := 0
+	Walk(p, func(node interface{}) bool {
+		total += nodeCost(node)
+		return true
+	})
+	return total
+}
+
+// Rough estimates of the fraction of candidates which satisfy each kind of condition. Without any knowledge of the
+// events, these are the guesses query planners traditionally make.
+const (
+	selectivityEq      = 0.1  // an equality
+	selectivityRange   = 0.33 // an inequality, eg. "a.x > 1"
+	selectivityBetween = 0.25
+	selectivityMatch   = 0.25 // a regular expression or substring match
+	selectivityOther   = 0.5
+)
+
+// selectivity estimates the fraction of candidates which satisfy p, from 0 (none) to 1 (all). Operands of AND and OR
+// are assumed to be independent.
+func selectivity(p Predicate) float64 {
+	if r, ok := (optimizer{context.Background()}).constant(p); ok && r == Positive {
+		return 1
+	} else if ok {
+		return 0
+	}
+
+	switch p := unwrapCondition(p).(type) {
+	case conjunction:
+		result := 1.0
+		for _, operand := range p {
+			result *= selectivity(operand)
+		}
+		return result
+	case disjunction:
+		none := 1.0
+		for _, operand := range p {
+			none *= 1 - selectivity(operand)
+		}
+		return 1 - none
+	case *negationPredicate:
+		return 1 - selectivity(p.Predicate)
+	case *operatorPredicate:
+		return opSelectivity(p.op)
+	case *quantifiedPredicate:
+		return opSelectivity(p.op)
+	case *inPredicate:
+		if s := float64(len(p.set)) * selectivityEq; s < 1 {
+			return s
+		}
+		return 1
+	case *nullCheckPredicate:
+		if p.negated {
+			return 1 - selectivityEq
+		}
+		return selectivityEq
+	case *equivalencePredicate:
+		return selectivityEq
+	case *betweenPredicate:
+		return selectivityBetween
+	case *regexPredicate, *stringMatchPredicate:
+		return selectivityMatch
+	default:
+		return selectivityOther
+	}
+}
+
+func opSelectivity(o op) float64 {
+	switch o {
+	case opEq, opIEq:
+		return selectivityEq
+	case opNe:
+		return 1 - selectivityEq
+	default:
+		return selectivityRange
+	}
+}
+
+// ReorderByCost returns a copy of p in which the operands of every AND are sorted so that the cheapest are evaluated
+// first, so the expensive ones are skipped as often as possible. (Operands of equal cost keep their order.)
+//
+// This does not change whether a match succeeds, but it may change which of several failing operands determines the
+// result: evaluation stops at the first that is Negative (or Invalid), or which errors.
+func ReorderByCost(p Predicate) Predicate {
+	switch p := unwrapCondition(p).(type) {
+	case conjunction:
+		type costed struct {
+			p    Predicate
+			cost int
+		}
+		children := make([]costed, len(p))
+		for i, child := range p {
+			child = ReorderByCost(child)
+			children[i] = costed{child, Cost(child)}
+		}
+		sort.SliceStable(children, func(i, j int) bool {
+			return children[i].cost < children[j].cost
+		})
+		result := make(conjunction, len(children))
+		for i, child := range children {
+			result[i] = child.p
+		}
+		return result
+	case disjunction:
+		result := make(disjunction, len(p))
+		for i, child := range p {
+			result[i] = ReorderByCost(child)
+		}
+		return result
+	case *negationPredicate:
+		return &negationPredicate{ReorderByCost(p.Predicate)}
+	default:
+		return p
+	}
+}
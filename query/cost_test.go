@@ -0,0 +1,81 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestCost(t *testing.T) {
+	cost := func(where string) int {
+		q, err := Parse("EVENT SEQ(a b, a c) WHERE " + where)
+		require.NoError(t, err, where)
+		return Cost(q.predicate)
+	}
+
+	require.True(t, cost("b.x == 1") < cost("b.x + 1 == 1"))
+	require.True(t, cost("b.x == 1") < cost("lower(b.x) == 'a'"))
+	require.True(t, cost("lower(b.x) == 'a'") < cost("b.x MATCHES 'a'"))
+	require.True(t, cost("b.x == 1") < cost("avg(b[].x) > 1"))
+	require.Equal(t, cost("b.x == 1")+cost("c.x == 1"), cost("b.x == 1 AND c.x == 1"))
+	require.Equal(t, cost("b.x == 1"), cost("NOT (b.x == 1)"))
+	require.Equal(t, 0, Cost(nil))
+}
+
+func TestReorderByCost(t *testing.T) {
+	q, err := Parse("EVENT a b WHERE b.s MATCHES '^x' AND sum(b[].n) > 1 AND b.n == 1 AND " +
+		"(b.s MATCHES 'y' OR (avg(b[].n) > 2 AND b.n == 2)) AND NOT (b.s CONTAINS 'z' AND b.s MATCHES 'z')")
+	require.NoError(t, err)
+	original := q.predicate.QueryText()
+
+	reordered := ReorderByCost(q.predicate)
+	require.Equal(t, "(b.n == 1.000000 AND b.s MATCHES \"^x\" AND sum(b[].n) > 1.000000 AND "+
+		"NOT (b.s CONTAINS \"z\" AND b.s MATCHES \"z\") AND (b.s MATCHES \"y\" OR (b.n == 2.000000 AND avg(b[].n) > 2.000000)))",
+		reordered.QueryText())
+	require.Equal(t, original, q.predicate.QueryText()) // The original is untouched
+	require.Equal(t, Cost(q.predicate), Cost(reordered))
+
+	evs := domain.CapturedEvents{"b": &tEventImpl{
+		typ:   "a",
+		attrs: map[string]interface{}{"s": "xyz", "n": float64(1)},
+	}}
+	require.Equal(t, q.predicate.Evaluate(evs), reordered.Evaluate(evs))
+	evs["b"].(*tEventImpl).attrs["n"] = float64(5)
+	require.Equal(t, q.predicate.Evaluate(evs), reordered.Evaluate(evs))
+
+	q.ReorderByCost()
+	require.True(t, reordered.Equal(q.predicate))
+
+	// Leaves are returned as they are
+	p := &operatorPredicate{left: attributeLookup("b.n"), right: literalValue{float64(1)}, op: opEq}
+	require.True(t, p == ReorderByCost(p))
+}
+
+func benchmarkReorder(b *testing.B, reorder bool) {
+	q, err := Parse("EVENT a b WHERE b.s MATCHES '^(foo|bar)+[0-9]*baz$' AND b.n == 2")
+	require.NoError(b, err)
+	if reorder {
+		q.ReorderByCost()
+	}
+	evs := domain.CapturedEvents{"b": &tEventImpl{
+		typ:   "a",
+		attrs: map[string]interface{}{"s": "foobarfoobarfoo123baz", "n": float64(1)},
+	}}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if q.Evaluate(evs) != Negative {
+			b.Fatal("Expected a negative result")
+		}
+	}
+}
+
+func BenchmarkEvaluateInQueryOrder(b *testing.B) {
+	benchmarkReorder(b, false)
+}
+
+func BenchmarkEvaluateReorderedByCost(b *testing.B) {
+	benchmarkReorder(b, true)
+}
@@ -0,0 +1,70 @@
+package query
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/shopspring/decimal"
+)
+
+// Decimal attributes (eg. monetary amounts) are compared and operated on exactly. When a decimal meets any other kind
+// of number, that number is converted to a decimal first; elsewhere (eg. in aggregates) decimals are treated as
+// float64s.
+
+// decimalOperands converts left and right to decimals if either of them is one. ok is false if neither is a decimal,
+// or if the other operand is not a finite number.
+func decimalOperands(left, right interface{}) (l, r decimal.Decimal, ok bool) {
+	_, leftDec := left.(decimal.Decimal)
+	_, rightDec := right.(decimal.Decimal)
+	if !leftDec && !rightDec {
+		return l, r, false
+	}
+	l, leftOk := toDecimal(left)
+	r, rightOk := toDecimal(right)
+	return l, r, leftOk && rightOk
+}
+
+func toDecimal(v interface{}) (decimal.Decimal, bool) {
+	if d, ok := v.(decimal.Decimal); ok {
+		return d, true
+	} else if f, ok := numericValue(v); ok && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return decimal.NewFromFloat(f), true
+	}
+	return decimal.Decimal{}, false
+}
+
+func (v *arithmeticValue) applyDecimal(left, right decimal.Decimal) (interface{}, error) {
+	switch v.op {
+	case aoAdd:
+		return left.Add(right), nil
+	case aoSubtract:
+		return left.Sub(right), nil
+	case aoMultiply:
+		return left.Mul(right), nil
+	case aoDivide:
+		if right.IsZero() {
+			return nil, fmt.Errorf("Division by zero in %s", v.QueryText())
+		}
+		return left.Div(right), nil
+	case aoModulo, aoIntDivide, aoBitAnd, aoBitOr, aoBitXor: // As for other numbers (see applyInteger)
+		if !left.IsInteger() || !right.IsInteger() {
+			return nil, fmt.Errorf("Cannot apply %s to %s and %s, which must be whole numbers: %s", v.op.String(),
+				left.String(), right.String(), v.QueryText())
+		} else if v.op.bitwise() {
+			result, err := v.applyInteger(left, right)
+			if err != nil {
+				return nil, err
+			}
+			return decimal.NewFromInt(result.(int64)), nil
+		} else if right.IsZero() {
+			return nil, fmt.Errorf("Division by zero in %s", v.QueryText())
+		}
+		quotient, remainder := left.QuoRem(right, 0)
+		if v.op == aoModulo {
+			return remainder, nil
+		}
+		return quotient, nil
+	default:
+		return nil, fmt.Errorf("Unhandled arithmetic op %v", v.op)
+	}
+}
@@ -0,0 +1,64 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestDecimal(t *testing.T) {
+	dec := decimal.RequireFromString
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{typ: "payment", attrs: map[string]interface{}{
+			"amount": dec("19.99"),
+			"x":      dec("0.1"),
+			"y":      dec("0.2"),
+			"fx":     0.1,
+			"fy":     0.2,
+			"zero":   dec("0"),
+		}},
+		"b": &tEventImpl{typ: "payment", attrs: map[string]interface{}{"amount": dec("19.990")}},
+	}
+	cases := map[string]Result{
+		"a.amount == 19.99":                  Positive,
+		"a.amount == b.amount":               Positive,
+		"a.amount != 19.98":                  Positive,
+		"a.amount > 19.98":                   Positive,
+		"a.amount <= 19.989":                 Negative,
+		"a.amount BETWEEN 19.99 AND 20":      Positive,
+		"a.amount IN (1, 19.99)":             Positive,
+		"a.x + a.y == 0.3":                   Positive,
+		"a.x + 0.2 == 0.3":                   Positive,
+		"0.1 + a.y == 0.3":                   Positive,
+		"a.fx + a.fy == 0.3":                 Negative, // float64 rounding, for comparison
+		"a.x * 3 == 0.3":                     Positive,
+		"a.amount - b.amount == 0":           Positive,
+		"a.x / a.y == 0.5":                   Positive,
+		"a.amount * 100 == 1999":             Positive,
+		"a.x == a.fx":                        Positive,
+		"round(a.amount) == 20":              Positive, // Functions see a float64
+		"a.amount == 'nineteen ninety-nine'": Negative,
+	}
+	for query, expected := range cases {
+		q, err := Parse("EVENT SEQ(payment a, payment b) WHERE " + query)
+		require.NoError(t, err, query)
+		result, err := q.predicate.EvaluateErr(evs)
+		require.NoError(t, err, query)
+		require.Equal(t, expected, result, query)
+		require.Equal(t, expected, Compile(q.predicate)(evs), query)
+	}
+
+	sum, err := (&arithmeticValue{left: attributeLookup("a.x"), right: attributeLookup("a.y"), op: aoAdd}).Value(evs)
+	require.NoError(t, err)
+	require.Equal(t, "0.3", sum.(decimal.Decimal).String())
+
+	for _, query := range []string{"a.x / a.zero > 1", "a.amount > 'a'"} {
+		q, err := Parse("EVENT SEQ(payment a, payment b) WHERE " + query)
+		require.NoError(t, err, query)
+		_, err = q.predicate.EvaluateErr(evs)
+		require.Error(t, err, query)
+	}
+}
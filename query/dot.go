@@ -0,0 +1,152 @@
+package query
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DOT renders the tree of a predicate in the Graphviz DOT language, for debugging (eg. by piping it through
+// "dot -Tpng"). Each predicate and value is a node, labelled with what it does; the edges to its children are
+// labelled with their role (eg. left and right), or otherwise their position.
+func DOT(p Predicate) string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("digraph predicate {\n")
+	buf.WriteString("\tnode [shape=box, fontname=\"Helvetica\"];\n")
+	if p != nil {
+		n := 0
+		writeDOTNode(buf, unwrapCondition(p), &n)
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// writeDOTNode writes a node and (recursively) its children, returning its id
+func writeDOTNode(buf *bytes.Buffer, node interface{}, n *int) string {
+	id := "n" + strconv.Itoa(*n)
+	*n++
+	shape := ""
+	if _, ok := node.(Predicate); !ok {
+		shape = ", shape=ellipse" // Values are distinguished from predicates
+	}
+	fmt.Fprintf(buf, "\t%s [label=%s%s];\n", id, dotQuote(dotLabel(node)), shape)
+
+	children := nodeChildren(node)
+	roles := dotRoles(node, len(children))
+	for i, child := range children {
+		childID := writeDOTNode(buf, child, n)
+		fmt.Fprintf(buf, "\t%s -> %s [label=%s];\n", id, childID, dotQuote(roles[i]))
+	}
+	return id
+}
+
+// dotLabel describes a node by itself (its children are described by their own nodes)
+func dotLabel(node interface{}) string {
+	switch n := node.(type) {
+	case conjunction:
+		return "AND"
+	case disjunction:
+		return "OR"
+	case *negationPredicate:
+		return "NOT"
+	case *operatorPredicate:
+		return n.op.symbol()
+	case *betweenPredicate:
+		return "BETWEEN"
+	case *inPredicate:
+		return "IN"
+	case *quantifiedPredicate:
+		return n.op.symbol() + " " + n.quantifier()
+	case *nullCheckPredicate:
+		if n.negated {
+			return "IS NOT NULL"
+		}
+		return "IS NULL"
+	case *regexPredicate:
+		if n.pattern == nil {
+			return "MATCHES"
+		}
+		return "MATCHES " + quoteString(n.pattern.String())
+	case *stringMatchPredicate:
+		return n.match.keyword()
+	case *arithmeticValue:
+		return n.op.String()
+	case *aggregateValue:
+		return n.fn.String()
+	case *recentValue:
+		return "recent " + n.windowText()
+	case *functionValue:
+		return n.name
+	case coalesceValue:
+		return "coalesce"
+	case listLiteralValue:
+		return "[]"
+	case *castValue:
+		return n.to.String()
+	case *bitwiseNotValue:
+		return "~"
+	case *conditionalValue:
+		return "?:"
+	case *indexLookup:
+		label := quoteName(n.alias) + "[]" // The index is a child
+		if n.index == nil && n.offset != 0 {
+			label = fmt.Sprintf("%s[i%+d]", quoteName(n.alias), n.offset)
+		} else if n.index == nil {
+			label = quoteName(n.alias) + "[i]"
+		}
+		if len(n.path) > 0 {
+			label += "." + joinPath(n.path...)
+		}
+		return label
+	case *subscriptLookup:
+		label := "[]" // The operand and key are children
+		if len(n.path) > 0 {
+			label += "." + joinPath(n.path...)
+		}
+		return label
+	case Representable: // Leaves (eg. literals and attributes) are described by their query text
+		return n.QueryText()
+	}
+	return fmt.Sprintf("%T", node)
+}
+
+// dotRoles labels the edges to a node's children
+func dotRoles(node interface{}, count int) []string {
+	var roles []string
+	switch n := node.(type) {
+	case *operatorPredicate, *arithmeticValue, *stringMatchPredicate:
+		roles = []string{"left", "right"}
+	case *quantifiedPredicate:
+		roles = []string{"left", "list"}
+	case *betweenPredicate:
+		roles = []string{"operand", "low", "high"}
+	case *inPredicate:
+		if n.left != nil {
+			roles = []string{"left"}
+			for i := 1; i < count; i++ {
+				roles = append(roles, strconv.Itoa(i-1))
+			}
+		}
+	case *indexLookup:
+		roles = []string{"index"}
+	case *subscriptLookup:
+		roles = []string{"operand", "key"}
+	case *conditionalValue:
+		roles = []string{"condition", "then", "else"}
+	}
+	if len(roles) == count { // If any operands are missing, it's not clear which are which
+		return roles
+	}
+	roles = make([]string, count)
+	for i := range roles {
+		roles[i] = strconv.Itoa(i)
+	}
+	return roles
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
@@ -0,0 +1,65 @@
+package query
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDOT(t *testing.T) {
+	q, err := Parse(`EVENT SEQ(A a, B b) WHERE a.x > b.x + 1 AND NOT (b.y BETWEEN 1 AND 2 OR b.s STARTSWITH "q\"")`)
+	require.NoError(t, err)
+	require.Equal(t, `digraph predicate {
+	node [shape=box, fontname="Helvetica"];
+	n0 [label="AND"];
+	n1 [label=">"];
+	n2 [label="a.x", shape=ellipse];
+	n1 -> n2 [label="left"];
+	n3 [label="+", shape=ellipse];
+	n4 [label="b.x", shape=ellipse];
+	n3 -> n4 [label="left"];
+	n5 [label="1.000000", shape=ellipse];
+	n3 -> n5 [label="right"];
+	n1 -> n3 [label="right"];
+	n0 -> n1 [label="0"];
+	n6 [label="NOT"];
+	n7 [label="OR"];
+	n8 [label="BETWEEN"];
+	n9 [label="b.y", shape=ellipse];
+	n8 -> n9 [label="operand"];
+	n10 [label="1.000000", shape=ellipse];
+	n8 -> n10 [label="low"];
+	n11 [label="2.000000", shape=ellipse];
+	n8 -> n11 [label="high"];
+	n7 -> n8 [label="0"];
+	n12 [label="STARTSWITH"];
+	n13 [label="b.s", shape=ellipse];
+	n12 -> n13 [label="left"];
+	n14 [label="\"q\\\"\"", shape=ellipse];
+	n12 -> n14 [label="right"];
+	n7 -> n12 [label="1"];
+	n6 -> n7 [label="0"];
+	n0 -> n6 [label="1"];
+}
+`, DOT(q.predicate))
+
+	// Every node in the tree is rendered
+	q, err = Parse("EVENT SEQ(A a, B+ b[]) WHERE avg(b[].x) > b[i-1].x AND b[b.LEN - 1].y IN (1, a.y) AND " +
+		"coalesce(a.z, lower(a.s)) MATCHES '^x' AND a.n IS NOT NULL AND [sym] AND b.TS - a.TS < 1m")
+	require.NoError(t, err)
+	nodes := 0
+	Walk(q.predicate, func(interface{}) bool {
+		nodes++
+		return true
+	})
+	dot := DOT(q.predicate)
+	require.Equal(t, nodes, strings.Count(dot, "[label=")-strings.Count(dot, "->"))
+	require.Equal(t, nodes-1, strings.Count(dot, "->"))
+	for _, label := range []string{`"avg"`, `"b[i-1].x"`, `"b[].y"`, `"index"`, `"coalesce"`, `"lower"`,
+		`"MATCHES \"^x\""`, `"IS NOT NULL"`, `"[sym]"`, `"1m"`} {
+		require.Contains(t, dot, "label="+label)
+	}
+
+	require.Equal(t, "digraph predicate {\n\tnode [shape=box, fontname=\"Helvetica\"];\n}\n", DOT(nil))
+}
@@ -156,11 +156,37 @@ func TestE2E(t *testing.T) {
 		`EVENT SEQ(t0 e0, t1 e1) WHERE [string] AND e0.decimal == e1.decimal`:  true,
 		`EVENT SEQ(t0 e0, t1 e1) WHERE [e1] AND e0.decimal == e1.decimal`:      false,
 		`EVENT SEQ(t0 e0, t1 e1) WHERE [e1] OR e0.decimal == e1.decimal`:       true,
+		// …grouped
+		`EVENT SEQ(t0 e0, t1 e1) WHERE ([e1] OR e0.decimal == e1.decimal) AND [string]`:     true,
+		`EVENT t0 e0 WHERE e0.string == "astring" OR e0.decimal == 1 AND e0.decimal == 2`:   true,  // AND binds first
+		`EVENT t0 e0 WHERE (e0.string == "astring" OR e0.decimal == 1) AND e0.decimal == 2`: false,
+		`EVENT t0 e0 WHERE NOT (e0.string == "bstring")`:                                    true,
+		`EVENT t0 e0 WHERE NOT (e0.string == "astring" OR e0.decimal == 1)`:                 false,
+		`EVENT t0 e0 WHERE e0.decimal BETWEEN 0 AND e0.decimal`:                             true,
+		`EVENT t0 e0 WHERE e0.decimal BETWEEN 101 AND 200`:                                  false,
+		`EVENT t0 e0 WHERE e0.string IN ("bstring", "astring")`:                             true,
+		`EVENT t0 e0 WHERE e0.decimal IN (1, 2, 3)`:                                         false,
+		`EVENT t0 e0 WHERE e0.string MATCHES "^a.+g$"`:                                      true,
+		`EVENT t0 e0 WHERE e0.decimal MATCHES "100"`:                                        false, // Not a string
+		`EVENT t0 e0 WHERE e0.string ~= "ASTRING"`:                                          true,
+		`EVENT t0 e0 WHERE e0.string STARTSWITH "a" AND e0.string ENDSWITH "string"`:        true,
+		`EVENT t0 e0 WHERE e0.string CONTAINS "bstr"`:                                       false,
+		`EVENT t0 e0 WHERE e0.string IS NOT NULL AND e0.map.key IS NOT NULL`:                true,
+		`EVENT t0 e0 WHERE e0.string IS NULL`:                                               false,
+		`EVENT SEQ(t0 e0, t1 e1) WHERE (e0.decimal + e1.decimal) * 2 == 400`:                true,
+		`EVENT t0 e0 WHERE e0.decimal / 0 > 1`:                                              false, // Division by zero
+		`EVENT t0 e0 WHERE e0.string != null AND e0.decimal != true`:                        true,
 		// …on optional events
 		`EVENT SEQ(t0 e0, ANY(t1 e1, foo bar)) WHERE [string]`:              true,  // foo not present
 		`EVENT SEQ(t0 e0, ANY(t1 e1)) WHERE [ue0]`:                          false, // ue0 not present on e1
 		`EVENT SEQ(t0 e0, !(foo bar), t1 e1) WHERE [string]`:                true,  // foo not present
 		`EVENT SEQ(t0 e0, !(foo bar), t1 e1) WHERE e0.string == bar.string`: true,
+		`EVENT SEQ(t0 e0, !(t1 e1), t2 e2) WHERE e1.ue1 == 1`:               false, // Negated event satisfies the predicate
+		`EVENT SEQ(t0 e0, !(t1 e1), t2 e2) WHERE e1.ue1 == 2`:               true,  // Negated event doesn't
+		`EVENT SEQ(t0 e0, !(t1 e1), t2 e2) WHERE e1.ue1 == e2.ue2`:          false,
+		`EVENT SEQ(t0 e0, !(t1 e1), t2 e2) WHERE e1.ue1 != e0.ue0`:          true,
+		`EVENT SEQ(t1 e1, !(t0 e0), t2 e2)`:                                 true, // Negated event is earlier
+		`EVENT SEQ(t0 e0, !(t2 e2), t1 e1)`:                                 true, // Negated event is later
 
 		// Window tests
 		`EVENT SEQ(t0 e0, t10 e10) WITHIN 1m`:    false, // e0 and e10 are 10 minutes apart
@@ -190,6 +216,24 @@ func TestE2E(t *testing.T) {
 	}
 }
 
+// Candidates which exceed the window are pruned as soon as they do so
+func TestE2EWindowPruning(t *testing.T) {
+	events := genEvents(20)
+	q, err := Parse(`EVENT SEQ(t0 e0, t10 e10) WITHIN 9m59s`)
+	require.NoError(t, err)
+	for _, stack := range genStacks(events, q) {
+		require.Len(t, stack, 1, domain.DescribeCapturedEvents(stack))
+	}
+
+	q, err = Parse(`EVENT SEQ(t0 e0, t10 e10) WITHIN 10m`)
+	require.NoError(t, err)
+	found := false
+	for _, stack := range genStacks(events, q) {
+		found = found || len(stack) == 2
+	}
+	require.True(t, found)
+}
+
 func TestE2EDuplicateTypes(t *testing.T) {
 	events := []domain.Event{
 		&tEventImpl{
@@ -0,0 +1,575 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EPL translates the query into an equivalent Esper EPL statement, as far as that's possible, eg.
+//
+//	EVENT SEQ(A a, B b) WHERE a.x > b.x PARTITION BY symbol WITHIN 10s
+//
+// becomes
+//
+//	select * from pattern [every a=A -> b=B(a.x > x and symbol = a.symbol) where timer:within(10 seconds)]
+//
+// Each operand of the top-level AND of the predicate becomes a filter on the latest event it refers to (or on the
+// negated event it refers to), where the attributes of that event are unqualified. The selection strategy determines
+// which events the pattern restarts from. Where a construct has no EPL equivalent (eg. a Kleene closure, a.TS or a
+// registered function), an error identifies it.
+func (q *Query) EPL() (string, error) {
+	if q.capture == nil {
+		return "", fmt.Errorf("Cannot translate a query which captures no events to EPL")
+	} else if q.windowCount != 0 {
+		return "", fmt.Errorf("Cannot translate a window of %d events to EPL", q.windowCount)
+	}
+	t := &eplTranslator{
+		q:       q,
+		order:   make(map[string]int),
+		negated: make(map[string]bool),
+		filters: make(map[string][]string),
+	}
+	for i, alias := range q.capture.aliases() {
+		t.order[alias] = i
+		t.aliases = append(t.aliases, alias)
+	}
+	for _, alias := range q.capture.Negations() {
+		t.negated[alias] = true
+	}
+
+	var conditions []Predicate
+	if c, ok := unwrapCondition(q.predicate).(conjunction); ok {
+		conditions = flattenChildren(c)
+	} else if q.predicate != nil {
+		conditions = []Predicate{unwrapCondition(q.predicate)}
+	}
+	if q.partition != "" { // Partitioning is equivalent to requiring the events to share the key
+		conditions = append(conditions, newEquivalencePredicate(q.partition))
+	}
+	for _, p := range conditions {
+		if err := t.addCondition(p); err != nil {
+			return "", err
+		}
+	}
+
+	pattern, err := t.pattern()
+	if err != nil {
+		return "", err
+	}
+	return "select * from pattern [" + pattern + "]", nil
+}
+
+// An eplTranslator gathers the filters to apply to each event of a query's pattern
+type eplTranslator struct {
+	q       *Query
+	aliases []string // In the order they are captured
+	order   map[string]int
+	negated map[string]bool
+	filters map[string][]string
+}
+
+// addCondition adds a condition to the filter of the event it should apply to
+func (t *eplTranslator) addCondition(p Predicate) error {
+	if eq, ok := p.(*equivalencePredicate); ok { // Each event must share the key with the one before
+		if _, ok := t.q.capture.(seqEventCapture); !ok {
+			return nil // Only one event is captured, so it holds trivially
+		}
+		prev := ""
+		for _, alias := range t.aliases {
+			if prev != "" {
+				eq := &operatorPredicate{
+					left:  attributeLookup(joinPath(alias) + "." + eq.key),
+					right: attributeLookup(joinPath(prev) + "." + eq.key),
+					op:    opEq}
+				if err := t.addFilter(alias, eq); err != nil {
+					return err
+				}
+			}
+			if !t.negated[alias] { // A negated event isn't bound, so can't be referred to by those after it
+				prev = alias
+			}
+		}
+		return nil
+	}
+
+	var target string
+	used := p.usedAliases()
+	if _, ok := t.q.capture.(anyEventCapture); ok && len(used) > 1 {
+		return fmt.Errorf("Cannot translate %s to EPL: only one of its events is captured", p.QueryText())
+	}
+	for _, alias := range used {
+		if t.negated[alias] {
+			if target != "" && t.negated[target] {
+				return fmt.Errorf("Cannot translate %s to EPL: it refers to more than one negated event", p.QueryText())
+			}
+			target = alias
+		} else if target == "" || (!t.negated[target] && t.order[alias] > t.order[target]) {
+			target = alias
+		}
+	}
+	if t.negated[target] { // Its filter can only refer to the events before it
+		for _, alias := range used {
+			if t.order[alias] > t.order[target] {
+				return fmt.Errorf("Cannot translate %s to EPL: it refers to an event after negated event %s",
+					p.QueryText(), target)
+			}
+		}
+	} else if target == "" { // It refers to no event, so apply it to the first
+		target = t.aliases[0]
+	}
+	return t.addFilter(target, p)
+}
+
+func (t *eplTranslator) addFilter(alias string, p Predicate) error {
+	s, err := t.predicate(p, alias)
+	if err != nil {
+		return err
+	}
+	t.filters[alias] = append(t.filters[alias], s)
+	return nil
+}
+
+// pattern renders the pattern of events: only single events, a sequence of them (where negated events must be between
+// others), or alternatives between them are supported
+func (t *eplTranslator) pattern() (string, error) {
+	switch c := t.q.capture.(type) {
+	case *basicEventCapture:
+		return "every " + t.event(c), nil
+
+	case anyEventCapture:
+		alternatives := make([]string, len(c))
+		for i, subCap := range c {
+			basic, ok := subCap.(*basicEventCapture)
+			if !ok {
+				return "", fmt.Errorf("Cannot translate %s to EPL: only single events are supported within ANY",
+					subCap.QueryText())
+			}
+			alternatives[i] = t.event(basic)
+		}
+		return "every (" + strings.Join(alternatives, " or ") + ")", nil
+
+	case seqEventCapture:
+		var (
+			steps     []string
+			negations []string // Those awaiting the next event
+		)
+		for i, subCap := range c {
+			switch subCap := subCap.(type) {
+			case *basicEventCapture:
+				step := t.event(subCap)
+				if len(negations) > 0 {
+					step = "(" + step + " and " + strings.Join(negations, " and ") + ")"
+					negations = nil
+				}
+				if i == 0 || t.q.strategy == SkipTillAnyMatch {
+					step = "every " + step
+				}
+				steps = append(steps, step)
+
+			case *negatedEventCapture:
+				basic, ok := subCap.EventCapture.(*basicEventCapture)
+				if !ok {
+					return "", fmt.Errorf("Cannot translate %s to EPL: only single events may be negated",
+						subCap.QueryText())
+				} else if i == 0 {
+					return "", fmt.Errorf("Cannot translate %s to EPL: a negated event must follow another",
+						subCap.QueryText())
+				} else if t.q.strategy == SkipTillAnyMatch {
+					return "", fmt.Errorf("Cannot translate %s to EPL with %s", subCap.QueryText(), t.q.strategy)
+				}
+				negations = append(negations, "not "+t.event(basic))
+
+			default:
+				return "", fmt.Errorf("Cannot translate %s to EPL: only single events are supported within SEQ",
+					subCap.QueryText())
+			}
+		}
+		if len(negations) > 0 {
+			return "", fmt.Errorf("Cannot translate %s to EPL: a negated event must be followed by another",
+				c.QueryText())
+		}
+
+		if len(steps) == 1 || t.q.window == 0 {
+			return strings.Join(steps, " -> "), nil
+		}
+		within, err := eplTimePeriod(t.q.window)
+		if err != nil {
+			return "", err
+		}
+		// The window starts from the first event, so applies to the rest of the sequence
+		rest := strings.Join(steps[1:], " -> ")
+		if len(steps) > 2 {
+			rest = "(" + rest + ")"
+		}
+		return steps[0] + " -> " + rest + " where timer:within(" + within + ")", nil
+
+	default:
+		return "", fmt.Errorf("Cannot translate %s to EPL", c.QueryText())
+	}
+}
+
+// event renders a single event, with its filter
+func (t *eplTranslator) event(c *basicEventCapture) string {
+	s := quoteName(c.name) + "=" + c.eventType
+	if filters := t.filters[c.name]; len(filters) > 0 {
+		s += "(" + strings.Join(filters, " and ") + ")"
+	}
+	return s
+}
+
+// eplTimePeriod renders a duration as an EPL time period, eg. "1 hour 30 minutes"
+func eplTimePeriod(d time.Duration) (string, error) {
+	if d%time.Microsecond != 0 {
+		return "", fmt.Errorf("Cannot translate WITHIN %s to EPL: it is more precise than microseconds", formatDuration(d))
+	}
+	var parts []string
+	for _, unit := range []struct {
+		d    time.Duration
+		name string
+	}{
+		{time.Hour, "hour"},
+		{time.Minute, "minute"},
+		{time.Second, "second"},
+		{time.Millisecond, "millisecond"},
+		{time.Microsecond, "microsecond"},
+	} {
+		if n := d / unit.d; n == 1 {
+			parts = append(parts, "1 "+unit.name)
+		} else if n > 1 {
+			parts = append(parts, strconv.FormatInt(int64(n), 10)+" "+unit.name+"s")
+		}
+		d %= unit.d
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// predicate renders a predicate as an EPL expression, within the filter of the event captured as self
+func (t *eplTranslator) predicate(p Predicate, self string) (string, error) {
+	switch p := unwrapCondition(p).(type) {
+	case conjunction, disjunction:
+		var (
+			children = flattenChildren(p)
+			sep      = " and "
+		)
+		if _, ok := p.(disjunction); ok {
+			sep = " or "
+		}
+		results := make([]string, len(children))
+		for i, child := range children {
+			var err error
+			if results[i], err = t.predicate(child, self); err != nil {
+				return "", err
+			}
+		}
+		return "(" + strings.Join(results, sep) + ")", nil
+
+	case *negationPredicate:
+		inner, err := t.predicate(p.Predicate, self)
+		if err != nil {
+			return "", err
+		}
+		switch unwrapCondition(p.Predicate).(type) {
+		case conjunction, disjunction: // Already parenthesised
+			return "not " + inner, nil
+		default:
+			return "not (" + inner + ")", nil
+		}
+
+	case *operatorPredicate:
+		var symbol string
+		switch p.op {
+		case opEq:
+			symbol = "="
+		case opNe, opGt, opLt, opGe, opLe:
+			symbol = p.op.symbol()
+		default:
+			return "", fmt.Errorf("No EPL equivalent for %s", p.QueryText())
+		}
+		// Null never equals anything in EPL, so comparisons with it must test for it instead
+		if isNullLiteral(p.left) || isNullLiteral(p.right) {
+			if p.op == opEq {
+				symbol = "is"
+			} else if p.op == opNe {
+				symbol = "is not"
+			}
+		}
+		vs, err := t.values(self, p.left, p.right)
+		if err != nil {
+			return "", err
+		}
+		return vs[0] + " " + symbol + " " + vs[1], nil
+
+	case *betweenPredicate:
+		vs, err := t.values(self, p.operand, p.low, p.high)
+		if err != nil {
+			return "", err
+		}
+		return vs[0] + " between " + vs[1] + " and " + vs[2], nil
+
+	case *inPredicate:
+		vs, err := t.values(self, append([]value{p.left}, p.set...)...)
+		if err != nil {
+			return "", err
+		}
+		return vs[0] + " in (" + strings.Join(vs[1:], ", ") + ")", nil
+
+	case *quantifiedPredicate: // EPL only quantifies over a list of expressions, which may not be empty
+		list, ok := p.list.(listLiteralValue)
+		if !ok || len(list) == 0 {
+			return "", fmt.Errorf("No EPL equivalent for %s", p.QueryText())
+		}
+		symbol := p.op.symbol()
+		switch p.op {
+		case opEq:
+			symbol = "="
+		case opNe, opGt, opLt, opGe, opLe:
+		default:
+			return "", fmt.Errorf("No EPL equivalent for %s", p.QueryText())
+		}
+		vs, err := t.values(self, append([]value{p.left}, list...)...)
+		if err != nil {
+			return "", err
+		}
+		return vs[0] + " " + symbol + " " + p.quantifier() + " (" + strings.Join(vs[1:], ", ") + ")", nil
+
+	case *nullCheckPredicate:
+		operand, err := t.value(p.operand, self)
+		if err != nil {
+			return "", err
+		} else if p.negated {
+			return operand + " is not null", nil
+		}
+		return operand + " is null", nil
+
+	case *regexPredicate:
+		left, err := t.value(p.left, self)
+		if err != nil {
+			return "", err
+		} else if p.pattern == nil {
+			return "", fmt.Errorf("No EPL equivalent for %s", p.QueryText())
+		}
+		// EPL's regexp must match the whole string, whereas MATCHES may match any part of it
+		return left + " regexp " + quoteString("(?s).*(?:"+p.pattern.String()+").*"), nil
+
+	case *stringMatchPredicate:
+		left, err := t.value(p.left, self)
+		if err != nil {
+			return "", err
+		}
+		right, ok := p.right.(literalValue)
+		s, isString := right.v.(string)
+		if !ok || !isString {
+			return "", fmt.Errorf("No EPL equivalent for %s: only a string literal can be matched", p.QueryText())
+		}
+		s = eplLikeEscaper.Replace(s)
+		switch p.match {
+		case smPrefix:
+			s += "%"
+		case smSuffix:
+			s = "%" + s
+		case smContains:
+			s = "%" + s + "%"
+		default:
+			return "", fmt.Errorf("No EPL equivalent for %s", p.QueryText())
+		}
+		return left + " like " + quoteString(s), nil
+
+	default:
+		return "", fmt.Errorf("No EPL equivalent for %s", p.QueryText())
+	}
+}
+
+// flattenChildren returns the operands of an AND or OR, flattening any nested within it of the same kind
+func flattenChildren(p Predicate) []Predicate {
+	var result []Predicate
+	switch p := p.(type) {
+	case conjunction:
+		for _, child := range p {
+			if c, ok := unwrapCondition(child).(conjunction); ok {
+				result = append(result, flattenChildren(c)...)
+			} else {
+				result = append(result, child)
+			}
+		}
+	case disjunction:
+		for _, child := range p {
+			if d, ok := unwrapCondition(child).(disjunction); ok {
+				result = append(result, flattenChildren(d)...)
+			} else {
+				result = append(result, child)
+			}
+		}
+	}
+	return result
+}
+
+var eplLikeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func isNullLiteral(v value) bool {
+	l, ok := v.(literalValue)
+	return ok && l.v == nil
+}
+
+func (t *eplTranslator) values(self string, vs ...value) ([]string, error) {
+	result := make([]string, len(vs))
+	for i, v := range vs {
+		var err error
+		if result[i], err = t.value(v, self); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// value renders a value as an EPL expression, within the filter of the event captured as self
+func (t *eplTranslator) value(v value, self string) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", fmt.Errorf("Cannot translate a missing operand to EPL")
+
+	case literalValue:
+		if f, ok := v.v.(float64); ok {
+			return eplNumber(f)
+		}
+		return v.QueryText(), nil
+
+	case durationLiteralValue: // Used as a number of seconds
+		return eplNumber(time.Duration(v).Seconds())
+
+	case attributeLookup:
+		if alias, path := splitAlias(string(v)); alias == self {
+			return path, nil // The event being filtered
+		}
+		return string(v), nil
+
+	case parameterValue:
+		return "?:" + string(v), nil
+
+	case eventValue: // A tag stands for the event it is attached to
+		if string(v) == self {
+			return "", fmt.Errorf("No EPL equivalent for %s: an event can't refer to itself in its own filter", v)
+		}
+		return v.QueryText(), nil
+
+	case *subscriptLookup: // As a mapped or indexed property, eg. tags('env') or items[0]
+		if _, ok := v.operand.(*indexLookup); ok {
+			return "", fmt.Errorf("No EPL equivalent for %s", v.QueryText())
+		}
+		operand, err := t.value(v.operand, self)
+		if err != nil {
+			return "", err
+		}
+		lit, _ := v.key.(literalValue)
+		if s, ok := lit.v.(string); ok {
+			operand += "(" + quoteString(s) + ")"
+		} else if isIntegral(lit.v) {
+			operand += fmt.Sprintf("[%d]", int(lit.v.(float64)))
+		} else {
+			return "", fmt.Errorf("No EPL equivalent for %s: only a literal key can be looked up", v.QueryText())
+		}
+		if len(v.path) > 0 {
+			operand += "." + joinPath(v.path...)
+		}
+		return operand, nil
+
+	case *arithmeticValue:
+		if v.op == aoIntDivide { // EPL has no integer division operator
+			return "", fmt.Errorf("No EPL equivalent for %s", v.QueryText())
+		}
+		vs, err := t.values(self, v.left, v.right)
+		if err != nil {
+			return "", err
+		}
+		if v.op.bitwise() { // EPL's bitwise operators bind less tightly than its comparisons, so are always grouped
+			return "(" + vs[0] + " " + v.op.String() + " " + vs[1] + ")", nil
+		}
+		if left, ok := v.left.(*arithmeticValue); ok && !left.op.bitwise() && left.op.precedence() < v.op.precedence() {
+			vs[0] = "(" + vs[0] + ")"
+		}
+		if right, ok := v.right.(*arithmeticValue); ok && !right.op.bitwise() &&
+			right.op.precedence() <= v.op.precedence() {
+			vs[1] = "(" + vs[1] + ")"
+		}
+		return vs[0] + " " + v.op.String() + " " + vs[1], nil
+
+	case coalesceValue:
+		args, err := t.values(self, v...)
+		if err != nil {
+			return "", err
+		}
+		return "coalesce(" + strings.Join(args, ", ") + ")", nil
+
+	case *castValue: // The nearest equivalent, though Esper does not convert exactly as castValue does
+		operand, err := t.value(v.operand, self)
+		if err != nil {
+			return "", err
+		}
+		return "cast(" + operand + ", " + eplCastTypes[v.to] + ")", nil
+
+	case *conditionalValue:
+		if v.condition == nil {
+			return "", fmt.Errorf("Cannot translate a missing condition to EPL")
+		}
+		condition, err := t.predicate(v.condition, self)
+		if err != nil {
+			return "", err
+		}
+		vs, err := t.values(self, v.then, v.otherwise)
+		if err != nil {
+			return "", err
+		}
+		return "case when " + condition + " then " + vs[0] + " else " + vs[1] + " end", nil
+
+	case *functionValue:
+		args, err := t.values(self, v.args...)
+		if err != nil {
+			return "", err
+		}
+		switch v.name {
+		case "abs", "floor", "ceil", "sqrt", "pow": // java.lang.Math is imported by default
+			return "Math." + v.name + "(" + strings.Join(args, ", ") + ")", nil
+		case "concat":
+			return "(" + strings.Join(args, " || ") + ")", nil
+		case "lower", "upper", "trim", "length": // String methods, which may only be called on a property
+			if _, ok := v.args[0].(attributeLookup); ok {
+				return args[0] + "." + eplStringMethods[v.name] + "()", nil
+			}
+		}
+		return "", fmt.Errorf("No EPL equivalent for %s", v.QueryText())
+
+	default:
+		return "", fmt.Errorf("No EPL equivalent for %s", v.QueryText())
+	}
+}
+
+var eplCastTypes = map[AttributeType]string{
+	TypeNumber: "double",
+	TypeString: "string",
+	TypeBool:   "boolean",
+}
+
+var eplStringMethods = map[string]string{
+	"lower":  "toLowerCase",
+	"upper":  "toUpperCase",
+	"trim":   "trim",
+	"length": "length",
+}
+
+// eplNumber renders a number literal, which (unlike in a query) needn't be written with decimal places
+func eplNumber(f float64) (string, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("No EPL equivalent for %s", formatNumber(f))
+	} else if math.Abs(f) >= 1e21 {
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), nil
+}
+
+// splitAlias splits an attribute lookup into its alias and the path within the event
+func splitAlias(lookup string) (alias, path string) {
+	names := splitPath(lookup)
+	return names[0], joinPath(names[1:]...)
+}
@@ -0,0 +1,93 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Functions are registered once, as they can't be registered again if the tests are run more than once
+func init() {
+	RegisterFunction("tUntranslatable", Function{Arity: 1, Apply: fnLength})
+}
+
+func TestEPL(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{`EVENT A a`, `select * from pattern [every a=A]`},
+		{`EVENT A a WHERE a.x == 1 AND a.y != "q"`, `select * from pattern [every a=A(x = 1 and y != "q")]`},
+		{`EVENT SEQ(A a, B b) WHERE a.x > b.x PARTITION BY symbol WITHIN 10s`,
+			`select * from pattern [every a=A -> b=B(a.x > x and symbol = a.symbol) where timer:within(10 seconds)]`},
+		{`EVENT SEQ(A a, B b, C c) WHERE a.x >= 1.5 AND c.y <= a.y + b.y * 2 WITHIN 1h30m`,
+			`select * from pattern [every a=A(x >= 1.5) -> (b=B -> c=C(y <= a.y + b.y * 2)) where timer:within(1 hour 30 minutes)]`},
+		{`EVENT SEQ(A a, B b) WHERE (a.x < 1 OR NOT (a.y BETWEEN 1 AND 2)) AND b.s IN ("p", "q") AND b.t IS NOT NULL`,
+			`select * from pattern [every a=A((x < 1 or not (y between 1 and 2))) -> b=B(s in ("p", "q") and t is not null)]`},
+		{`EVENT SEQ(A a, B b) WHERE NOT (a.x == b.x OR a.y == null) AND b.z != null`,
+			`select * from pattern [every a=A -> b=B(not (a.x = x or a.y is null) and z is not null)]`},
+		{`EVENT A a WHERE a.s STARTSWITH "50%" AND a.s ENDSWITH "_x" AND a.s CONTAINS "\\" AND a.s MATCHES "^a+"`,
+			`select * from pattern [every a=A(s like "50\\%%" and s like "%\\_x" and s like "%\\\\%" and s regexp "(?s).*(?:^a+).*")]`},
+		{`EVENT A a WHERE abs(a.x) > pow(a.y, 2) AND lower(a.s) == concat(a.t, "!") AND coalesce(a.u, :default) == 1`,
+			`select * from pattern [every a=A(Math.abs(x) > Math.pow(y, 2) and s.toLowerCase() = (t || "!") and coalesce(u, ?:default) = 1)]`},
+		{`EVENT SEQ(A a, B b) WHERE (a.vip ? a.x * 0.9 : a.x) < b.budget`,
+			`select * from pattern [every a=A -> b=B(case when a.vip = true then a.x * 0.9 else a.x end < budget)]`},
+		{`EVENT A a WHERE number(a.code) == 1 AND string(a.n) != "1" AND bool(a.flag) == true`,
+			`select * from pattern [every a=A(cast(code, double) = 1 and cast(n, string) != "1" and cast(flag, boolean) = true)]`},
+		{`EVENT A a WHERE a.flags & 0x4 != 0 AND (a.x | a.y) ^ a.z + 1 == a.n`,
+			`select * from pattern [every a=A((flags & 4) != 0 and ((x | y) ^ z + 1) = n)]`},
+		{`EVENT SEQ(A a, B b) WHERE b.parent == a`, `select * from pattern [every a=A -> b=B(parent = a)]`},
+		{`EVENT SEQ(A a, B b) WHERE a.x > all([1, a.y]) AND b.s == any(["p", a.s])`,
+			`select * from pattern [every a=A(x > all (1, y)) -> b=B(s = any ("p", a.s))]`},
+		{`EVENT ANY(A a, B b) WHERE a.x > 1 AND b.y < 2 PARTITION BY symbol`,
+			`select * from pattern [every (a=A(x > 1) or b=B(y < 2))]`},
+		// Negated events are filtered by the conditions which refer to them
+		{`EVENT SEQ(A a, !(C c), B b) WHERE c.x == a.x AND b.y > a.y AND [symbol] WITHIN 1s500ms`,
+			`select * from pattern [every a=A -> (b=B(y > a.y and symbol = a.symbol) and not c=C(x = a.x and symbol = a.symbol)) where timer:within(1 second 500 milliseconds)]`},
+	}
+	for _, c := range cases {
+		q, err := Parse(c.query)
+		require.NoError(t, err, c.query)
+		epl, err := q.EPL()
+		require.NoError(t, err, c.query)
+		require.Equal(t, c.expected, epl, c.query)
+	}
+
+	q, err := Parse(`EVENT SEQ(A a, B b, C c) WHERE a.x < b.x WITHIN 2m`)
+	require.NoError(t, err)
+	q.SetStrategy(SkipTillAnyMatch)
+	epl, err := q.EPL()
+	require.NoError(t, err)
+	require.Equal(t, `select * from pattern [every a=A -> (every b=B(a.x < x) -> every c=C) where timer:within(2 minutes)]`, epl)
+
+	errors := []struct {
+		query string
+		err   string
+	}{
+		{`EVENT A a WHERE a.s ~= "x"`, `No EPL equivalent for a.s ~= "x"`},
+		{`EVENT A a WHERE tuntranslatable(a.s) > 1`, `No EPL equivalent for tuntranslatable(a.s)`},
+		{`EVENT A a WHERE round(a.x) > 1`, `No EPL equivalent for round(a.x)`},
+		{`EVENT A a WHERE ~a.flags > 1`, `No EPL equivalent for ~a.flags`},
+		{`EVENT A a WHERE a.parent == a`, `No EPL equivalent for a: an event can't refer to itself in its own filter`},
+		{`EVENT A a WHERE lower(concat(a.s, a.t)) == "x"`, `No EPL equivalent for lower(concat(a.s, a.t))`},
+		{`EVENT SEQ(A a, B b) WHERE b.TS - a.TS < 5`, `No EPL equivalent for b.TS`},
+		{`EVENT A a WHERE a.s CONTAINS a.t`, `No EPL equivalent for a.s CONTAINS a.t: only a string literal can be matched`},
+		{`EVENT A a WHERE a.region == $region`, `No EPL equivalent for $region`},
+		{`EVENT A a WHERE a.x == any(a.tags)`, `No EPL equivalent for a.x == any(a.tags)`},
+		{`EVENT A a WHERE a.x < all([])`, `No EPL equivalent for a.x < all([])`},
+		{`EVENT SEQ(A a, B+ b[])`, `Cannot translate B+ b[] to EPL`},
+		{`EVENT SEQ(A a, B+ b[]) WHERE b[i].x > a.x`, `No EPL equivalent for b[i].x`},
+		{`EVENT SEQ(A a, !(B b))`, `Cannot translate SEQ(A a, !(B b)) to EPL: a negated event must be followed by another`},
+		{`EVENT SEQ(A a, !(C c), B b) WHERE c.x == b.x`, `it refers to an event after negated event c`},
+		{`EVENT ANY(A a, B b) WHERE a.x == b.x`, `only one of its events is captured`},
+		{`EVENT SEQ(A a, B b) WITHIN 1ns`, `Cannot translate WITHIN 1ns to EPL`},
+		{`EVENT SEQ(A a, B b) WITHIN 1m AND 10 EVENTS`, `Cannot translate a window of 10 events to EPL`},
+	}
+	for _, c := range errors {
+		q, err := Parse(c.query)
+		require.NoError(t, err, c.query)
+		_, err = q.EPL()
+		require.Error(t, err, c.query)
+		require.Contains(t, err.Error(), c.err, c.query)
+	}
+}
@@ -0,0 +1,102 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// An equivalencePredicate is the equivalence test "[key]": it holds if every captured event (each of those of a Kleene
+// closure, too) has the same value for the key. It is Negative as soon as any two differ, and otherwise Uncertain until
+// each of its aliases is captured. Its aliases are those the query must capture to match (so not negated events, nor
+// those which are alternatives to others); any other events which are captured must have the same value all the same.
+// Without aliases, it holds of whichever events are captured.
+type equivalencePredicate struct {
+	key     string   // The key path
+	aliases []string // Sorted
+}
+
+// newEquivalencePredicate returns the equivalence test of a key over the given aliases (in any order)
+func newEquivalencePredicate(key string, aliases ...string) *equivalencePredicate {
+	aliases = dedupeAliases(aliases)
+	sort.Strings(aliases)
+	return &equivalencePredicate{key: key, aliases: aliases}
+}
+
+func (p *equivalencePredicate) Evaluate(evs domain.CapturedEvents) Result {
+	return evaluateOrLog("equivalencePredicate", p, evs)
+}
+
+func (p *equivalencePredicate) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return evaluateObserved(context.Background(), p, evs)
+}
+
+func (p *equivalencePredicate) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	captured := make([]string, 0, len(evs))
+	for alias := range evs {
+		captured = append(captured, alias)
+	}
+	sort.Strings(captured) // So that the first error is always the same one
+
+	var (
+		path  = splitPath(p.key)
+		first interface{}
+		seen  bool
+	)
+	for _, alias := range captured {
+		list, ok := evs[alias].(domain.EventList)
+		if !ok {
+			list = domain.EventList{evs[alias]}
+		}
+		for _, ev := range list {
+			val, err := lookupEvent(joinPath(alias)+"."+p.key, ev, path)
+			if errors.Is(err, ErrEventNotFound) {
+				continue
+			} else if err != nil {
+				return Negative, fmt.Errorf("Could not evaluate %s: %w", p.QueryText(), err)
+			} else if !seen {
+				first, seen = val, true
+			} else if !valuesEqual(first, val) {
+				return Negative, nil
+			}
+		}
+	}
+	for _, alias := range p.aliases {
+		if _, ok := evs[alias]; !ok {
+			return Uncertain, nil
+		}
+	}
+	return Positive, nil
+}
+
+func (p *equivalencePredicate) QueryText() string {
+	return "[" + p.key + "]"
+}
+
+func (p *equivalencePredicate) usedAliases() []string {
+	return append([]string{}, p.aliases...)
+}
+
+func (p *equivalencePredicate) Equal(other Predicate) bool {
+	o, ok := other.(*equivalencePredicate)
+	return ok && p.key == o.key && samePath(p.aliases, o.aliases)
+}
+
+func (p *equivalencePredicate) Hash() uint64 {
+	return hashPredicate(p)
+}
+
+func (p *equivalencePredicate) Clone() Predicate {
+	return &equivalencePredicate{key: p.key, aliases: append([]string(nil), p.aliases...)}
+}
+
+func (p *equivalencePredicate) children() []interface{} {
+	return nil
+}
+
+func (p *equivalencePredicate) Validate(declared map[string]struct{}) error {
+	return validateAliases(p, declared)
+}
@@ -0,0 +1,67 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestEquivalencePredicate(t *testing.T) {
+	ev := func(sym interface{}) domain.Event {
+		return &tEventImpl{typ: "t", attrs: map[string]interface{}{"sym": sym}}
+	}
+	p := newEquivalencePredicate("sym", "c", "a", "b")
+	require.Equal(t, "[sym]", p.QueryText())
+	require.Equal(t, []string{"a", "b", "c"}, p.usedAliases())
+
+	cases := []struct {
+		evs      domain.CapturedEvents
+		expected Result
+	}{
+		{domain.CapturedEvents{"a": ev("x"), "b": ev("x"), "c": ev("x")}, Positive},
+		{domain.CapturedEvents{"a": ev(1), "b": ev(1.0), "c": ev(int64(1))}, Positive},
+		{domain.CapturedEvents{"a": ev("x"), "b": ev("x")}, Uncertain},
+		{domain.CapturedEvents{}, Uncertain},
+		{domain.CapturedEvents{"a": ev("x"), "b": ev("y")}, Negative}, // No need to wait for c
+		{domain.CapturedEvents{"a": ev("x"), "b": ev("x"), "c": ev("x"), "d": ev("y")}, Negative},
+		{domain.CapturedEvents{"a": ev("x"), "b": domain.EventList{ev("x"), ev("x")}, "c": ev("x")}, Positive},
+		{domain.CapturedEvents{"a": ev("x"), "b": domain.EventList{ev("x"), ev("y")}, "c": ev("x")}, Negative},
+	}
+	for _, c := range cases {
+		r, err := p.EvaluateErr(c.evs)
+		require.NoError(t, err, domain.DescribeCapturedEvents(c.evs))
+		require.Equal(t, c.expected, r, domain.DescribeCapturedEvents(c.evs))
+	}
+	_, err := p.EvaluateErr(domain.CapturedEvents{"a": &tEventImpl{typ: "t", attrs: map[string]interface{}{}}})
+	require.Error(t, err)
+
+	// Without aliases, it holds of whichever events are captured
+	r, err := newEquivalencePredicate("sym").EvaluateErr(domain.CapturedEvents{"a": ev("x")})
+	require.NoError(t, err)
+	require.Equal(t, Positive, r)
+
+	// Parsed, it is over the events the query must capture
+	queries := map[string][]string{
+		"EVENT SEQ(A a, B+ b[], C c) WHERE [sym]":          {"a", "b", "c"},
+		"EVENT SEQ(A a, !(N n), C c) WHERE [sym]":          {"a", "c"},
+		"EVENT SEQ(A a, ANY(B b, C c)) WHERE [sym]":        {"a"},
+		"EVENT SEQ(A a, B b) OR SEQ(A a, C c) WHERE [sym]": {"a"},
+	}
+	for queryText, expected := range queries {
+		q, err := Parse(queryText)
+		require.NoError(t, err, queryText)
+		require.Equal(t, expected, q.predicate.usedAliases(), queryText)
+	}
+
+	// Equivalence tests marshalled before they had aliases are over whichever events are captured
+	decoded, err := UnmarshalPredicate([]byte(`{"type":"equivalence","key":"sym"}`))
+	require.NoError(t, err)
+	require.True(t, newEquivalencePredicate("sym").Equal(decoded))
+	data, err := json.Marshal(p)
+	require.NoError(t, err)
+	require.Equal(t, `{"aliases":["a","b","c"],"key":"sym","type":"equivalence"}`, string(data))
+	require.False(t, p.Equal(newEquivalencePredicate("sym", "a")))
+}
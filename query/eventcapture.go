@@ -18,6 +18,8 @@ type EventCapture interface {
 	Negations() []string
 	// aliases returns just the event aliases used (including duplicates)
 	aliases() []string
+	// closures returns the aliases captured by Kleene closures, mapped to whether the closure is greedy
+	closures() map[string]bool
 	// evaluate allows the capture to participate in the matching phase, primarily so it may veto a match
 	evaluate(domain.CapturedEvents) Result
 }
@@ -37,7 +39,7 @@ func (c *basicEventCapture) Matches(e domain.Event) []string {
 }
 
 func (c *basicEventCapture) QueryText() string {
-	return fmt.Sprintf("%s %s", c.eventType, c.name)
+	return fmt.Sprintf("%s %s", c.eventType, quoteName(c.name))
 }
 
 func (c *basicEventCapture) Negations() []string {
@@ -54,6 +56,10 @@ func (c *basicEventCapture) aliases() []string {
 	return []string{c.name}
 }
 
+func (c *basicEventCapture) closures() map[string]bool {
+	return nil
+}
+
 func (c *basicEventCapture) evaluate(evs domain.CapturedEvents) Result {
 	if e, ok := evs[c.name]; !ok { // Not yet matched
 		return Uncertain
@@ -64,6 +70,68 @@ func (c *basicEventCapture) evaluate(evs domain.CapturedEvents) Result {
 	}
 }
 
+// A kleeneEventCapture captures one or more events of a type under a single alias (eg. "Stock+ a[]"), as a
+// domain.EventList in the order they occurred. When matching, each event appended to the list is checked against the
+// predicate (so a[i] refers to it, and a[i-1] to the one before). A greedy closure keeps capturing events for as long as
+// it can; a reluctant one ("Stock+? a[]") is reported as a match as soon as it is one.
+type kleeneEventCapture struct {
+	eventType string
+	name      string
+	reluctant bool
+}
+
+func (c *kleeneEventCapture) Matches(e domain.Event) []string {
+	if c.eventType == e.Type() {
+		return []string{c.name}
+	}
+	return nil
+}
+
+func (c *kleeneEventCapture) QueryText() string {
+	if c.reluctant {
+		return fmt.Sprintf("%s+? %s[]", c.eventType, quoteName(c.name))
+	}
+	return fmt.Sprintf("%s+ %s[]", c.eventType, quoteName(c.name))
+}
+
+func (c *kleeneEventCapture) Negations() []string {
+	return nil
+}
+
+func (c *kleeneEventCapture) Names() map[string]string {
+	return map[string]string{
+		c.name: c.eventType,
+	}
+}
+
+func (c *kleeneEventCapture) aliases() []string {
+	return []string{c.name}
+}
+
+func (c *kleeneEventCapture) closures() map[string]bool {
+	return map[string]bool{c.name: !c.reluctant}
+}
+
+func (c *kleeneEventCapture) evaluate(evs domain.CapturedEvents) Result {
+	e, ok := evs[c.name]
+	if !ok {
+		return Uncertain // Not yet matched
+	}
+	list, ok := e.(domain.EventList)
+	if !ok {
+		list = domain.EventList{e}
+	}
+	if len(list) == 0 { // At least one event is needed
+		return Uncertain
+	}
+	for _, e := range list {
+		if e.Type() != c.eventType {
+			return Negative
+		}
+	}
+	return Positive
+}
+
 // A seqEventCapture captures a sequence of events
 type seqEventCapture []EventCapture
 
@@ -130,6 +198,16 @@ func (c seqEventCapture) aliases() []string {
 	return result
 }
 
+func (c seqEventCapture) closures() map[string]bool {
+	result := make(map[string]bool)
+	for _, subCap := range c {
+		for alias, greedy := range subCap.closures() {
+			result[alias] = greedy
+		}
+	}
+	return result
+}
+
 func (c seqEventCapture) evaluate(evs domain.CapturedEvents) Result {
 	result := Uncertain
 	for i, subCap := range c {
@@ -156,6 +234,75 @@ func (c seqEventCapture) evaluate(evs domain.CapturedEvents) Result {
 	return result
 }
 
+// An allEventCapture captures all of its contained captures, in any order (eg. "AND(A a, B b)")
+type allEventCapture []EventCapture
+
+func (c allEventCapture) Matches(e domain.Event) []string {
+	var result []string
+	for _, subCap := range c {
+		result = append(result, subCap.Matches(e)...)
+	}
+	return result
+}
+
+func (c allEventCapture) QueryText() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("AND(")
+	for i, subCap := range c {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(subCap.QueryText())
+	}
+	buf.WriteRune(')')
+	return buf.String()
+}
+
+func (c allEventCapture) Negations() []string {
+	return nil // Negations can't be unordered
+}
+
+func (c allEventCapture) Names() map[string]string {
+	result := make(map[string]string, len(c))
+	for _, subCap := range c {
+		for k, v := range subCap.Names() {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+func (c allEventCapture) aliases() []string {
+	result := make([]string, 0, len(c))
+	for _, subCap := range c {
+		result = append(result, subCap.aliases()...)
+	}
+	return result
+}
+
+func (c allEventCapture) closures() map[string]bool {
+	result := make(map[string]bool)
+	for _, subCap := range c {
+		for alias, greedy := range subCap.closures() {
+			result[alias] = greedy
+		}
+	}
+	return result
+}
+
+// evaluate is like that of a seqEventCapture, but the events may have occurred in any order
+func (c allEventCapture) evaluate(evs domain.CapturedEvents) Result {
+	result := Uncertain
+	for i, subCap := range c {
+		if sr := subCap.evaluate(evs); i == 0 {
+			result = sr
+		} else {
+			result = result.And(sr)
+		}
+	}
+	return result
+}
+
 // An anyEventCapture will capture a match of any of its contained captures
 type anyEventCapture []EventCapture
 
@@ -222,6 +369,16 @@ func (c anyEventCapture) aliases() []string {
 	return result
 }
 
+func (c anyEventCapture) closures() map[string]bool {
+	result := make(map[string]bool)
+	for _, subCap := range c {
+		for alias, greedy := range subCap.closures() {
+			result[alias] = greedy
+		}
+	}
+	return result
+}
+
 func (c anyEventCapture) evaluate(evs domain.CapturedEvents) Result {
 	result := Uncertain
 	for i, subCap := range c {
@@ -234,6 +391,142 @@ func (c anyEventCapture) evaluate(evs domain.CapturedEvents) Result {
 	return result
 }
 
+// An orEventCapture captures any one of several alternatives (eg. "SEQ(A a, B b) OR SEQ(A a, C c)"), each of which is
+// matched separately (see Query.alternatives). Alternatives may share an alias, so long as they all capture it in the
+// same way; captured events only satisfy an alternative which captures every one of their aliases.
+type orEventCapture []EventCapture
+
+func (c orEventCapture) Matches(e domain.Event) []string {
+	var (
+		result        []string
+		negatedResult []string
+		seen          = make(map[string]struct{})
+	)
+	for _, alt := range c {
+		negated := make(map[string]struct{})
+		for _, alias := range alt.Negations() {
+			negated[alias] = struct{}{}
+		}
+		for _, alias := range alt.Matches(e) {
+			if _, ok := seen[alias]; ok {
+				continue
+			}
+			seen[alias] = struct{}{}
+			if _, ok := negated[alias]; ok {
+				negatedResult = append(negatedResult, alias)
+			} else {
+				result = append(result, alias)
+			}
+		}
+	}
+	return append(result, negatedResult...) // Negated aliases must be at the end (see seqEventCapture.Matches)
+}
+
+func (c orEventCapture) QueryText() string {
+	buf := new(bytes.Buffer)
+	for i, alt := range c {
+		if i > 0 {
+			buf.WriteString(" OR ")
+		}
+		buf.WriteString(alt.QueryText())
+	}
+	return buf.String()
+}
+
+func (c orEventCapture) Negations() []string {
+	var (
+		result []string
+		seen   = make(map[string]struct{})
+	)
+	for _, alt := range c {
+		for _, alias := range alt.Negations() {
+			if _, ok := seen[alias]; !ok {
+				seen[alias] = struct{}{}
+				result = append(result, alias)
+			}
+		}
+	}
+	return result
+}
+
+func (c orEventCapture) Names() map[string]string {
+	result := make(map[string]string)
+	for _, alt := range c {
+		for k, v := range alt.Names() {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// aliases returns those of each alternative in turn, except those shared with an earlier one
+func (c orEventCapture) aliases() []string {
+	var (
+		result []string
+		seen   = make(map[string]struct{})
+	)
+	for _, alt := range c {
+		aliases := alt.aliases()
+		for _, alias := range aliases {
+			if _, ok := seen[alias]; !ok {
+				result = append(result, alias)
+			}
+		}
+		for _, alias := range aliases {
+			seen[alias] = struct{}{}
+		}
+	}
+	return result
+}
+
+func (c orEventCapture) closures() map[string]bool {
+	result := make(map[string]bool)
+	for _, alt := range c {
+		for alias, greedy := range alt.closures() {
+			result[alias] = greedy
+		}
+	}
+	return result
+}
+
+func (c orEventCapture) evaluate(evs domain.CapturedEvents) Result {
+	result := Negative
+	for _, alt := range c {
+		if capturesAll(alt, evs) {
+			result = result.Or(alt.evaluate(evs))
+		}
+	}
+	return result
+}
+
+// capturesAll reports whether a capture has all of the aliases of the captured events
+func capturesAll(c EventCapture, evs domain.CapturedEvents) bool {
+	names := c.Names()
+	for alias := range evs {
+		if _, ok := names[alias]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// captureSignature describes how a capture captures an alias, so it may be checked that alternatives sharing the alias
+// capture it in the same way
+func captureSignature(c EventCapture, alias string) string {
+	sig := c.Names()[alias]
+	if greedy, ok := c.closures()[alias]; ok && greedy {
+		sig += "+"
+	} else if ok {
+		sig += "+?"
+	}
+	for _, negated := range c.Negations() {
+		if negated == alias {
+			return "!(" + sig + ")"
+		}
+	}
+	return sig
+}
+
 // A negatedEventCapture still captures the event, but reports it as being a negated event (this is significant in later
 // processing)
 type negatedEventCapture struct {
@@ -259,6 +552,10 @@ candidateLoop:
 	return result
 }
 
+func (c *negatedEventCapture) closures() map[string]bool {
+	return nil // Closures can't be negated
+}
+
 func (c *negatedEventCapture) evaluate(evs domain.CapturedEvents) Result {
 	r := c.EventCapture.evaluate(evs)
 	switch r {
@@ -270,3 +567,43 @@ func (c *negatedEventCapture) evaluate(evs domain.CapturedEvents) Result {
 		return r
 	}
 }
+
+// requiredAliases returns the aliases which a capture must capture to match: not those of negated events, nor those
+// of which only one is captured (the alternatives of ANY), nor those which only some alternatives of OR capture
+func requiredAliases(c EventCapture) []string {
+	switch c := c.(type) {
+	case *basicEventCapture:
+		return []string{c.name}
+	case *kleeneEventCapture:
+		return []string{c.name}
+	case seqEventCapture:
+		return requiredByAll([]EventCapture(c))
+	case allEventCapture:
+		return requiredByAll([]EventCapture(c))
+	case anyEventCapture, *negatedEventCapture:
+		return nil
+	case orEventCapture:
+		counts := make(map[string]int)
+		for _, alt := range c {
+			for _, alias := range dedupeAliases(requiredAliases(alt)) {
+				counts[alias]++
+			}
+		}
+		result := make([]string, 0)
+		for _, alias := range dedupeAliases(requiredAliases(c[0])) {
+			if counts[alias] == len(c) {
+				result = append(result, alias)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func requiredByAll(cs []EventCapture) []string {
+	result := make([]string, 0)
+	for _, c := range cs {
+		result = append(result, requiredAliases(c)...)
+	}
+	return dedupeAliases(result)
+}
@@ -0,0 +1,385 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A Function is a scalar function which may be called from a query, eg. lower(a.name)
+type Function struct {
+	Arity int // Number of arguments the function takes, or -1 if it is variadic
+	// Apply calls the function. It may be called concurrently, by concurrent evaluations.
+	Apply func(args []interface{}) (interface{}, error)
+}
+
+var (
+	functionsM sync.RWMutex
+	functions  = map[string]Function{
+		"concat": {Arity: -1, Apply: fnConcat},
+		"lower":  stringFunction(strings.ToLower),
+		"upper":  stringFunction(strings.ToUpper),
+		"trim":   stringFunction(strings.TrimSpace),
+		"length": {Arity: 1, Apply: fnLength},
+		"abs":    numericFunction(math.Abs),
+		"floor":  numericFunction(math.Floor),
+		"ceil":   numericFunction(math.Ceil),
+		"round":  numericFunction(math.Round), // Half away from zero
+		"sqrt":   numericFunction(math.Sqrt),
+		"pow":    {Arity: 2, Apply: fnPow},
+	}
+)
+
+// RegisterFunction makes a function available to queries parsed subsequently under the given (case-insensitive)
+// name. It panics if the name is already taken, either by another function or by an aggregate.
+func RegisterFunction(name string, fn Function) {
+	name = strings.ToLower(name)
+	if fn.Apply == nil {
+		panic("sase: RegisterFunction " + name + " has a nil Apply")
+	} else if _, ok := aggregateFuncs[name]; ok {
+		panic("sase: RegisterFunction " + name + " clashes with an aggregate")
+	} else if isReservedFunction(name) {
+		panic("sase: RegisterFunction " + name + " is reserved")
+	}
+
+	functionsM.Lock()
+	defer functionsM.Unlock()
+	if _, ok := functions[name]; ok {
+		panic("sase: RegisterFunction called twice for " + name)
+	}
+	functions[name] = fn
+}
+
+// isReservedFunction reports whether a (lower-case) name is taken by one of the values which are called like functions
+// but aren't Functions, eg. coalesce
+func isReservedFunction(name string) bool {
+	switch name {
+	case "coalesce", "first", "last", "any", "all", "recent":
+		return true
+	}
+	_, ok := castTypes[name]
+	return ok
+}
+
+func lookupFunction(name string) (Function, bool) {
+	functionsM.RLock()
+	defer functionsM.RUnlock()
+	fn, ok := functions[name]
+	return fn, ok
+}
+
+// stringFunction adapts a string transformation into a single-argument Function
+func stringFunction(f func(string) string) Function {
+	return Function{
+		Arity: 1,
+		Apply: func(args []interface{}) (interface{}, error) {
+			s, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("Expected a string, got %T", args[0])
+			}
+			return f(s), nil
+		},
+	}
+}
+
+// numericFunction adapts a numeric transformation into a single-argument Function
+func numericFunction(f func(float64) float64) Function {
+	return Function{
+		Arity: 1,
+		Apply: func(args []interface{}) (interface{}, error) {
+			num, ok := numericValue(args[0])
+			if !ok {
+				return nil, fmt.Errorf("Expected a number, got %T", args[0])
+			}
+			return f(num), nil
+		},
+	}
+}
+
+func fnPow(args []interface{}) (interface{}, error) {
+	base, ok := numericValue(args[0])
+	if !ok {
+		return nil, fmt.Errorf("Expected a numeric base, got %T", args[0])
+	}
+	exp, ok := numericValue(args[1])
+	if !ok {
+		return nil, fmt.Errorf("Expected a numeric exponent, got %T", args[1])
+	}
+	return math.Pow(base, exp), nil
+}
+
+func fnConcat(args []interface{}) (interface{}, error) {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("Argument %d is not a string: %T", i+1, arg)
+		}
+		parts[i] = s
+	}
+	return strings.Join(parts, ""), nil
+}
+
+func fnLength(args []interface{}) (interface{}, error) {
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("Expected a string, got %T", args[0])
+	}
+	return float64(utf8.RuneCountInString(s)), nil
+}
+
+// A functionValue is the result of calling a (registered) Function with some argument values
+type functionValue struct {
+	name string
+	fn   Function
+	args []value
+}
+
+// newFunctionValue looks up the named function and checks the arguments it's called with
+func newFunctionValue(name string, args []value) (*functionValue, error) {
+	name = strings.ToLower(name)
+	fn, ok := lookupFunction(name)
+	if !ok {
+		return nil, fmt.Errorf("Unknown function %s", name)
+	} else if fn.Arity >= 0 && len(args) != fn.Arity {
+		return nil, fmt.Errorf("%s takes %d argument(s), got %d", name, fn.Arity, len(args))
+	}
+	return &functionValue{name: name, fn: fn, args: args}, nil
+}
+
+func (v *functionValue) QueryText() string {
+	args := make([]string, len(v.args))
+	for i, arg := range v.args {
+		args[i] = arg.QueryText()
+	}
+	return v.name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (v *functionValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.valueContext(context.Background(), evs)
+}
+
+func (v *functionValue) valueContext(ctx context.Context, evs domain.CapturedEvents) (interface{}, error) {
+	args := make([]interface{}, len(v.args))
+	for i, arg := range v.args {
+		val, err := resolve(ctx, arg, evs)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = val
+	}
+
+	result, err := v.fn.Apply(args)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot compute %s: %w", v.QueryText(), err)
+	}
+	return result, nil
+}
+
+func (v *functionValue) usedAliases() []string {
+	aliases := make([]string, 0, len(v.args))
+	for _, arg := range v.args {
+		aliases = append(aliases, arg.usedAliases()...)
+	}
+	return dedupeAliases(aliases)
+}
+
+func (v *functionValue) Equal(other value) bool {
+	o, ok := other.(*functionValue)
+	return ok && v.name == o.name && sameValues(v.args, o.args)
+}
+
+func (v *functionValue) Clone() Value {
+	return &functionValue{name: v.name, fn: v.fn, args: cloneValues(v.args)}
+}
+
+func (v *functionValue) children() []interface{} {
+	return valueNodes(v.args...)
+}
+
+// A coalesceValue resolves to the first of its operands which is non-nil. Operands whose events or attributes are
+// missing are skipped over; only if none of them can be resolved is the value itself missing (as an attribute, if any
+// of them was).
+type coalesceValue []value
+
+func (v coalesceValue) QueryText() string {
+	args := make([]string, len(v))
+	for i, arg := range v {
+		args[i] = arg.QueryText()
+	}
+	return "coalesce(" + strings.Join(args, ", ") + ")"
+}
+
+func (v coalesceValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.valueContext(context.Background(), evs)
+}
+
+func (v coalesceValue) valueContext(ctx context.Context, evs domain.CapturedEvents) (interface{}, error) {
+	resolved := false
+	var missing error // Why the last of the operands skipped which refer to a captured event couldn't be resolved
+	for _, operand := range v {
+		val, err := resolve(ctx, operand, evs)
+		if isMissing(err) {
+			if !errors.Is(err, ErrEventNotFound) || errors.Is(err, ErrAttributeNotFound) {
+				missing = err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		resolved = true
+		if !isNil(val) {
+			return val, nil
+		}
+	}
+	if !resolved && missing != nil {
+		return nil, missing
+	} else if !resolved {
+		return nil, ErrEventNotFound
+	}
+	return nil, nil
+}
+
+func (v coalesceValue) usedAliases() []string {
+	aliases := make([]string, 0, len(v))
+	for _, operand := range v {
+		aliases = append(aliases, operand.usedAliases()...)
+	}
+	return dedupeAliases(aliases)
+}
+
+func (v coalesceValue) Equal(other value) bool {
+	o, ok := other.(coalesceValue)
+	return ok && sameValues(v, o)
+}
+
+func (v coalesceValue) Clone() Value {
+	return coalesceValue(cloneValues(v))
+}
+
+func (v coalesceValue) children() []interface{} {
+	return valueNodes(v...)
+}
+
+// castTypes maps the names of the casts to the types they convert to
+var castTypes = map[string]AttributeType{
+	"number": TypeNumber,
+	"string": TypeString,
+	"bool":   TypeBool,
+}
+
+// A castValue converts its operand to a number, string or bool, for attributes which don't always arrive with the same
+// type (eg. number(a.code) == b.code, where a.code is sometimes a string). A string is a number if strconv.ParseFloat
+// can parse it, and a bool if strconv.ParseBool can (the empty string being false); a number is true if it isn't zero,
+// and a list or map if it isn't empty. Any value can be a string: a number is written as strconv.FormatFloat does, a
+// time in RFC 3339 and anything else as fmt.Sprint does. Nil stays nil, and a decimal stays a decimal as a number.
+// Any other conversion is an error.
+type castValue struct {
+	to      AttributeType // One of castTypes
+	operand value
+}
+
+func (v *castValue) QueryText() string {
+	return v.to.String() + "(" + valueText(v.operand) + ")"
+}
+
+func (v *castValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.valueContext(context.Background(), evs)
+}
+
+func (v *castValue) valueContext(ctx context.Context, evs domain.CapturedEvents) (interface{}, error) {
+	if v.operand == nil {
+		return nil, fmt.Errorf("Could not evaluate %s: operand must not be nil", v.QueryText())
+	}
+	val, err := resolve(ctx, v.operand, evs)
+	if err != nil || val == nil {
+		return val, err
+	}
+	result, ok := castTo(v.to, val)
+	if !ok {
+		return nil, fmt.Errorf("Cannot convert %#v (%T) to a %s: %s", val, val, v.to, v.QueryText())
+	}
+	return result, nil
+}
+
+// castTo converts a (non-nil) value as a castValue does, reporting whether it could be
+func castTo(t AttributeType, val interface{}) (interface{}, bool) {
+	switch t {
+	case TypeNumber:
+		if d, ok := val.(decimal.Decimal); ok {
+			return d, true
+		} else if f, ok := numericValue(val); ok {
+			return f, true
+		} else if s, ok := val.(string); ok {
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			return f, err == nil
+		}
+
+	case TypeString:
+		switch val := val.(type) {
+		case string:
+			return val, true
+		case decimal.Decimal:
+			return val.String(), true
+		case time.Time:
+			return val.Format(time.RFC3339Nano), true
+		}
+		if f, ok := numericValue(val); ok {
+			return strconv.FormatFloat(f, 'f', -1, 64), true
+		}
+		return fmt.Sprint(val), true
+
+	case TypeBool:
+		switch val := val.(type) {
+		case bool:
+			return val, true
+		case string:
+			if strings.TrimSpace(val) == "" {
+				return false, true
+			}
+			b, err := strconv.ParseBool(strings.TrimSpace(val))
+			return b, err == nil
+		case decimal.Decimal:
+			return !val.IsZero(), true
+		}
+		if f, ok := numericValue(val); ok {
+			return f != 0, true
+		}
+		switch rv := reflect.ValueOf(val); rv.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map:
+			return rv.Len() > 0, true
+		}
+	}
+	return nil, false
+}
+
+func (v *castValue) usedAliases() []string {
+	if v.operand == nil {
+		return []string{}
+	}
+	return v.operand.usedAliases()
+}
+
+func (v *castValue) Equal(other value) bool {
+	o, ok := other.(*castValue)
+	return ok && v.to == o.to && sameValue(v.operand, o.operand)
+}
+
+func (v *castValue) Clone() Value {
+	return &castValue{to: v.to, operand: cloneValue(v.operand)}
+}
+
+func (v *castValue) children() []interface{} {
+	return valueNodes(v.operand)
+}
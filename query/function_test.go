@@ -0,0 +1,316 @@
+package query
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestFunctionValue(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "person",
+			attrs: map[string]interface{}{
+				"first": "Ada",
+				"last":  "Lovelace",
+				"pad":   "  Mixed Case ",
+				"uni":   "Ωmega",
+				"n":     float64(1),
+			}},
+	}
+	call := func(name string, args ...value) *functionValue {
+		v, err := newFunctionValue(name, args)
+		require.NoError(t, err, name)
+		return v
+	}
+
+	cases := map[*functionValue]interface{}{
+		call("concat", attributeLookup("a.first"), literalValue{" "}, attributeLookup("a.last")): "Ada Lovelace",
+		call("concat"):                                         "",
+		call("LOWER", attributeLookup("a.pad")):                "  mixed case ",
+		call("upper", attributeLookup("a.pad")):                "  MIXED CASE ",
+		call("trim", attributeLookup("a.pad")):                 "Mixed Case",
+		call("length", attributeLookup("a.uni")):               float64(5),
+		call("length", call("trim", attributeLookup("a.pad"))): float64(10),
+	}
+	for v, expected := range cases {
+		result, err := v.Value(evs)
+		require.NoError(t, err, v.QueryText())
+		require.Equal(t, expected, result, v.QueryText())
+	}
+
+	// Missing events propagate as such; mistyped arguments are errors
+	_, err := call("lower", attributeLookup("b.first")).Value(evs)
+	require.Equal(t, ErrEventNotFound, err)
+	_, err = call("upper", attributeLookup("a.n")).Value(evs)
+	require.Error(t, err)
+	_, err = call("concat", attributeLookup("a.first"), attributeLookup("a.n")).Value(evs)
+	require.Error(t, err)
+
+	v := call("concat", attributeLookup("a.first"), literalValue{" "}, attributeLookup("b.last"), attributeLookup("a.x"))
+	require.Equal(t, `concat(a.first, " ", b.last, a.x)`, v.QueryText())
+	require.Equal(t, []string{"a", "b"}, v.usedAliases())
+}
+
+func TestMathFunctions(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "stock",
+			attrs: map[string]interface{}{
+				"delta": float64(-7.5),
+				"qty":   -3, // Not a float64
+				"sym":   "GOOG",
+			}},
+	}
+	num := func(f float64) value { return literalValue{f} }
+	call := func(name string, args ...value) *functionValue {
+		v, err := newFunctionValue(name, args)
+		require.NoError(t, err, name)
+		return v
+	}
+
+	cases := []struct {
+		v        *functionValue
+		expected float64
+	}{
+		{call("abs", attributeLookup("a.delta")), 7.5},
+		{call("abs", attributeLookup("a.qty")), 3},
+		{call("abs", num(2)), 2},
+		{call("floor", attributeLookup("a.delta")), -8},
+		{call("floor", num(7.5)), 7},
+		{call("ceil", attributeLookup("a.delta")), -7},
+		{call("ceil", num(7.2)), 8},
+		{call("round", attributeLookup("a.delta")), -8},
+		{call("round", num(7.5)), 8},
+		{call("round", num(2.4)), 2},
+		{call("round", num(-2.4)), -2},
+		{call("round", num(0.5)), 1},
+		{call("sqrt", num(16)), 4},
+		{call("pow", num(2), num(10)), 1024},
+		{call("pow", attributeLookup("a.qty"), num(3)), -27},
+		{call("pow", num(4), num(-0.5)), 0.5},
+	}
+	for _, c := range cases {
+		result, err := c.v.Value(evs)
+		require.NoError(t, err, c.v.QueryText())
+		require.Equal(t, c.expected, result, c.v.QueryText())
+	}
+
+	for _, v := range []*functionValue{
+		call("abs", attributeLookup("a.sym")),
+		call("round", literalValue{true}),
+		call("pow", attributeLookup("a.sym"), num(2)),
+		call("pow", num(2), literalValue{nil}),
+	} {
+		_, err := v.Value(evs)
+		require.Error(t, err, v.QueryText())
+	}
+	_, err := newFunctionValue("pow", []value{num(2)})
+	require.Error(t, err)
+
+	q, err := Parse("EVENT stock a WHERE abs(a.delta) > 5 AND round(a.delta) == -8")
+	require.NoError(t, err)
+	result, err := q.predicate.EvaluateErr(evs)
+	require.NoError(t, err)
+	require.Equal(t, Positive, result)
+}
+
+func TestFunctionValueConstruction(t *testing.T) {
+	_, err := newFunctionValue("nonexistant", nil)
+	require.Error(t, err)
+	_, err = newFunctionValue("lower", nil)
+	require.Error(t, err)
+	_, err = newFunctionValue("trim", []value{literalValue{"a"}, literalValue{"b"}})
+	require.Error(t, err)
+}
+
+// Functions are registered once, as they can't be registered again if the tests are run more than once
+func init() {
+	RegisterFunction("tRepeat", Function{
+		Arity: 2,
+		Apply: func(args []interface{}) (interface{}, error) {
+			return fmt.Sprintf("%v%v", args[0], args[1]), nil
+		}})
+	RegisterFunction("tScore", Function{
+		Arity: 1,
+		Apply: func(args []interface{}) (interface{}, error) {
+			switch ev := args[0].(type) {
+			case domain.EventList: // The events captured by a Kleene closure
+				return float64(len(ev)), nil
+			case domain.Event:
+				attrs := ev.Attributes()
+				return attrs["hits"].(float64) / attrs["tries"].(float64), nil
+			}
+			return nil, fmt.Errorf("Cannot score %T", args[0])
+		}})
+}
+
+func TestRegisterFunction(t *testing.T) {
+	q, err := Parse(`EVENT a b WHERE trepeat(b.x, b.x) == "ss"`)
+	require.NoError(t, err)
+	evs := domain.CapturedEvents{"b": &tEventImpl{typ: "a", attrs: map[string]interface{}{"x": "s"}}}
+	result, err := q.predicate.EvaluateErr(evs)
+	require.NoError(t, err)
+	require.Equal(t, Positive, result)
+
+	require.Panics(t, func() { RegisterFunction("TREPEAT", Function{Arity: 1, Apply: fnLength}) })
+	require.Panics(t, func() { RegisterFunction("avg", Function{Arity: 1, Apply: fnLength}) })
+	require.Panics(t, func() { RegisterFunction("nothing", Function{Arity: 1}) })
+}
+
+// A function may be passed the whole event captured under an alias
+func TestEventValue(t *testing.T) {
+	q, err := Parse(`EVENT SEQ(A a, B+ b[]) WHERE tscore(a) > 0.9 AND tscore(b) >= 2`)
+	require.NoError(t, err)
+	require.Equal(t, "(tscore(a) > 0.900000 AND tscore(b) >= 2.000000)", q.predicate.QueryText())
+	require.ElementsMatch(t, []string{"a", "b"}, q.predicate.usedAliases())
+	a := &tEventImpl{typ: "A", attrs: map[string]interface{}{"hits": 19.0, "tries": 20.0}}
+	b := &tEventImpl{typ: "B"}
+	result, err := q.EvaluateErr(domain.CapturedEvents{"a": a, "b": domain.EventList{b, b}})
+	require.NoError(t, err)
+	require.Equal(t, Positive, result)
+	result, err = q.EvaluateErr(domain.CapturedEvents{"a": a, "b": domain.EventList{b}})
+	require.NoError(t, err)
+	require.Equal(t, Negative, result)
+
+	v := eventValue("a")
+	resolved, err := v.Value(domain.CapturedEvents{"a": a})
+	require.NoError(t, err)
+	require.Equal(t, a, resolved)
+	_, err = v.Value(domain.CapturedEvents{})
+	require.Equal(t, ErrEventNotFound, err)
+	result, err = q.predicate.EvaluateErr(domain.CapturedEvents{"b": domain.EventList{b, b}}) // a isn't captured yet
+	require.NoError(t, err)
+	require.Equal(t, Positive, result)
+
+	_, err = Parse(`EVENT SEQ(A a, B b) WHERE tscore(c) > 0.9`)
+	require.Error(t, err) // c isn't declared
+}
+
+func TestCoalesceValue(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "person",
+			attrs: map[string]interface{}{
+				"name":     "Ada",
+				"nickname": nil,
+			}},
+	}
+
+	cases := map[string]struct {
+		v        coalesceValue
+		expected interface{}
+	}{
+		"first non-nil": {coalesceValue{attributeLookup("a.nickname"), attributeLookup("a.name"), literalValue{"anon"}}, "Ada"},
+		"missing event": {coalesceValue{attributeLookup("b.name"), attributeLookup("a.name")}, "Ada"},
+		"fallback":      {coalesceValue{attributeLookup("a.nickname"), attributeLookup("b.x"), literalValue{"anon"}}, "anon"},
+		"all nil":       {coalesceValue{attributeLookup("a.nickname"), attributeLookup("b.nickname")}, nil},
+	}
+	for desc, c := range cases {
+		result, err := c.v.Value(evs)
+		require.NoError(t, err, desc)
+		require.Equal(t, c.expected, result, desc)
+	}
+
+	_, err := coalesceValue{attributeLookup("b.x"), attributeLookup("c.x")}.Value(evs)
+	require.Equal(t, ErrEventNotFound, err)
+	_, err = coalesceValue{&arithmeticValue{left: attributeLookup("a.name"), right: literalValue{float64(1)}, op: aoAdd}}.Value(evs)
+	require.Error(t, err)
+	require.NotEqual(t, ErrEventNotFound, err)
+
+	// Attributes which are absent are skipped over too, but if none can be resolved, the value is of a missing attribute
+	evs["p"] = &tEventImpl{typ: "person", attrs: map[string]interface{}{"name": "Bob"}}
+	result, err := coalesceValue{attributeLookup("p.nickname"), attributeLookup("p.name"), literalValue{"anon"}}.Value(evs)
+	require.NoError(t, err)
+	require.Equal(t, "Bob", result)
+	_, err = coalesceValue{attributeLookup("p.nickname"), attributeLookup("b.x")}.Value(evs)
+	require.True(t, isMissing(err), "%v", err)
+	require.NotEqual(t, ErrEventNotFound, err)
+	q, err := Parse(`EVENT person p WHERE coalesce(p.nickname, p.name, "anon") == "Bob"`)
+	require.NoError(t, err)
+	require.Equal(t, Positive, q.Evaluate(evs))
+
+	v := coalesceValue{attributeLookup("b.nickname"), attributeLookup("a.name"), attributeLookup("b.name"), literalValue{"anon"}}
+	require.Equal(t, `coalesce(b.nickname, a.name, b.name, "anon")`, v.QueryText())
+	require.Equal(t, []string{"b", "a"}, v.usedAliases())
+	require.Panics(t, func() { RegisterFunction("coalesce", Function{Arity: 1, Apply: fnLength}) })
+}
+
+func TestCastValue(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "order",
+			attrs: map[string]interface{}{
+				"code":  " 42 ",
+				"n":     int8(7),
+				"price": decimal.RequireFromString("1.50"),
+				"flag":  "false",
+				"empty": "",
+				"tags":  []string{"x"},
+				"at":    time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC),
+				"null":  nil,
+				"word":  "forty-two",
+			}},
+	}
+	cases := map[string]interface{}{
+		"number(a.code)":  float64(42),
+		"number(a.n)":     float64(7),
+		"number(a.price)": decimal.RequireFromString("1.50"),
+		"number(a.null)":  nil,
+		"string(a.n)":     "7",
+		"string(1.5)":     "1.5",
+		"string(a.price)": "1.5",
+		"string(true)":    "true",
+		"string(a.at)":    "2014-01-01T12:00:00Z",
+		"string(a.tags)":  "[x]",
+		"STRING(a.code)":  " 42 ",
+		"bool(a.flag)":    false,
+		"bool(a.empty)":   false,
+		"bool(a.n)":       true,
+		"bool(0)":         false,
+		"bool(a.tags)":    true,
+		"bool(a.null)":    nil,
+		"number(a.n) * 2": float64(14),
+	}
+	cast := func(expr string) value {
+		q, err := Parse("EVENT order a WHERE " + expr + " == null")
+		require.NoError(t, err, expr)
+		return q.predicate.(*operatorPredicate).left
+	}
+	for expr, expected := range cases {
+		result, err := cast(expr).Value(evs)
+		require.NoError(t, err, expr)
+		require.Equal(t, expected, result, expr)
+	}
+
+	q, err := Parse("EVENT SEQ(order a, order b) WHERE number(a.code) == b.code")
+	require.NoError(t, err)
+	require.Equal(t, "number(a.code) == b.code", q.predicate.QueryText())
+	evs["b"] = &tEventImpl{typ: "order", attrs: map[string]interface{}{"code": 42}}
+	r, err := q.predicate.EvaluateErr(evs)
+	require.NoError(t, err)
+	require.Equal(t, Positive, r)
+
+	// A failed conversion is an error; a missing event propagates as such
+	for expr, msg := range map[string]string{
+		"number(a.word)": `Cannot convert "forty-two" (string) to a number: number(a.word)`,
+		"number(a.at)":   "Cannot convert time.Date(2014, time.January, 1, 12, 0, 0, 0, time.UTC) (time.Time) to a number",
+		"bool(a.word)":   `Cannot convert "forty-two" (string) to a bool: bool(a.word)`,
+	} {
+		_, err := cast(expr).Value(evs)
+		require.Error(t, err, expr)
+		require.Contains(t, err.Error(), msg, expr)
+	}
+	_, err = (&castValue{to: TypeString, operand: attributeLookup("c.code")}).Value(evs)
+	require.Equal(t, ErrEventNotFound, err)
+
+	_, err = Parse("EVENT order a WHERE number(a.x, a.y) == 1")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "number takes exactly one argument, got 2")
+	require.Panics(t, func() { RegisterFunction("Number", Function{Arity: 1, Apply: fnLength}) })
+}
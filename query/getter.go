@@ -0,0 +1,93 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// An AttributeGetter gives access to the attributes of an event which aren't (or aren't cheaply) held as a map, eg. a
+// protobuf message. An event which implements it has its attributes looked up through Get rather than Attributes.
+type AttributeGetter interface {
+	// Get returns the attribute at a dotted path, not including the alias (eg. "customer.id"), and whether there is one.
+	// Names in the path which aren't identifiers are quoted as they are in a query (eg. "`user.id`").
+	Get(path string) (interface{}, bool)
+}
+
+// MapAttributes adapts a map of attributes (eg. decoded JSON) to an AttributeGetter. Paths are resolved as they are in
+// an event's attributes, so they may pass through nested maps, slices and structs.
+type MapAttributes map[string]interface{}
+
+func (m MapAttributes) Get(path string) (interface{}, bool) {
+	return getPath(reflect.ValueOf(map[string]interface{}(m)), path)
+}
+
+// StructAttributes adapts a struct (or a pointer to one) to an AttributeGetter by reflection. Each part of a path names
+// an exported field, ignoring case, or by the name in its json tag (see lookupPath).
+func StructAttributes(v interface{}) AttributeGetter {
+	return structAttributes{reflect.ValueOf(v)}
+}
+
+type structAttributes struct {
+	val reflect.Value
+}
+
+func (s structAttributes) Get(path string) (interface{}, bool) {
+	return getPath(s.val, path)
+}
+
+func getPath(val reflect.Value, path string) (interface{}, bool) {
+	result, err := followPath(path, val, splitPath(path), true)
+	return result, err == nil
+}
+
+// NewEvent returns an event of the given type and timestamp whose attributes are looked up through a getter, so that
+// events may be matched without being converted to maps. Its Attributes are nil, unless the getter is MapAttributes.
+func NewEvent(typ string, when time.Time, attrs AttributeGetter) domain.Event {
+	return &getterEvent{typ: typ, when: when, AttributeGetter: attrs}
+}
+
+type getterEvent struct {
+	AttributeGetter
+	typ  string
+	when time.Time
+}
+
+func (e *getterEvent) Type() string {
+	return e.typ
+}
+
+func (e *getterEvent) Attributes() map[string]interface{} {
+	if m, ok := e.AttributeGetter.(MapAttributes); ok {
+		return m
+	}
+	return nil
+}
+
+func (e *getterEvent) When() time.Time {
+	return e.when
+}
+
+// lookupEvent resolves a key path within an event's attributes, through its AttributeGetter if it has one (see
+// lookupPath). As a getter only says whether it has the whole path, when it hasn't, the path's parent is looked up too:
+// if that is missing (or nil), the path passes through a missing part, so as for lookupPath, the error wraps
+// ErrAttributeNotFound.
+func lookupEvent(desc string, ev domain.Event, path []string) (interface{}, error) {
+	g, ok := ev.(AttributeGetter)
+	if !ok {
+		return lookupPath(desc, ev.Attributes(), path)
+	}
+	val, ok := g.Get(joinPath(path...))
+	if ok {
+		return val, nil
+	} else if parent := path[:len(path)-1]; len(parent) > 0 {
+		if val, ok := g.Get(joinPath(parent...)); !ok || !indirect(reflect.ValueOf(val)).IsValid() {
+			return nil, fmt.Errorf("Attribute lookup failed for %s: cannot find field %s: %w", desc, joinPath(parent...),
+				ErrAttributeNotFound)
+		}
+	}
+	return nil, fmt.Errorf("Attribute lookup failed for %s: %w", desc,
+		&missingPart{"cannot find field " + joinPath(path...)})
+}
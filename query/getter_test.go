@@ -0,0 +1,85 @@
+package query
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A tFlatEvent holds its attributes keyed by their full paths, as an exotic event type might
+type tFlatEvent map[string]interface{}
+
+func (e tFlatEvent) Type() string                       { return "flat" }
+func (e tFlatEvent) Attributes() map[string]interface{} { return nil }
+func (e tFlatEvent) When() time.Time                    { return time.Time{} }
+
+func (e tFlatEvent) Get(path string) (interface{}, bool) {
+	v, ok := e[path]
+	return v, ok
+}
+
+func TestAttributeGetter(t *testing.T) {
+	ts := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := NewEvent("A", ts, MapAttributes{"price": 10, "customer": map[string]interface{}{"id": "c1"}})
+	b := NewEvent("B", ts, StructAttributes(&tOrder{Total: 12, Customer: &tCustomer{ID: "c1"}}))
+	c := tFlatEvent{"order.total": 15.0, "customer.id": "c1"}
+	evs := domain.CapturedEvents{"a": a, "b": b, "c": c, "d": domain.EventList{c, c}}
+
+	require.Equal(t, "A", a.Type())
+	require.Equal(t, ts, a.When())
+	require.Equal(t, map[string]interface{}{"price": 10, "customer": map[string]interface{}{"id": "c1"}},
+		a.Attributes())
+	require.Nil(t, b.Attributes())
+
+	cases := map[string]Result{
+		"a.price < b.total AND b.total < c.order.total":              Positive,
+		"a.customer.id == b.customer.id":                             Positive,
+		"b.customer.id == c.customer.id":                             Positive,
+		"c.order.total > 20":                                         Negative,
+		"sum(d[].order.total) == 30 AND d[1].order.total == 15":      Positive,
+		"b.customer.full_name IS NULL AND b.customer.id IS NOT NULL": Positive,
+	}
+	for predicate, expected := range cases {
+		q, err := Parse("EVENT SEQ(A a, B b, flat c, flat+ d[]) WHERE " + predicate)
+		require.NoError(t, err, predicate)
+		r, err := q.predicate.EvaluateErr(evs)
+		require.NoError(t, err, predicate)
+		require.Equal(t, expected, r, predicate)
+		require.Equal(t, expected, Compile(q.predicate)(evs), predicate)
+	}
+
+	// A getter which hasn't got an attribute makes its lookup fail
+	for _, path := range []string{"a.missing", "b.customer.missing", "c.missing"} {
+		_, err := attributeLookup(path).Value(evs)
+		require.Error(t, err, path)
+		require.False(t, errors.Is(err, ErrEventNotFound), "%s: %v", path, err)
+	}
+	// but passing through a part which is missing (or nil) makes comparisons Uncertain, as it does for attributes held
+	// as a map
+	noCustomer := domain.CapturedEvents{"a": a, "b": NewEvent("B", ts, StructAttributes(&tOrder{Total: 12})), "c": c}
+	for _, path := range []string{"a.missing.id", "a.customer.missing.id", "b.customer.id", "c.missing.id"} {
+		_, err := attributeLookup(path).Value(noCustomer)
+		require.True(t, errors.Is(err, ErrAttributeNotFound), "%s: %v", path, err)
+	}
+	for _, where := range []string{"b.customer.id IN ('c1')", "b.customer.id == 'c1'", "b.customer.id != 'c1'"} {
+		missingPart, err := Parse("EVENT SEQ(A a, B b) WHERE " + where)
+		require.NoError(t, err, where)
+		require.Equal(t, Uncertain, missingPart.predicate.Evaluate(noCustomer), where)
+		require.Equal(t, Uncertain, Compile(missingPart.predicate)(noCustomer), where)
+		require.Equal(t, Negative, missingPart.Evaluate(noCustomer), where)
+		require.Equal(t, Uncertain, missingPart.predicate.Evaluate(domain.CapturedEvents{"b": &tEventImpl{typ: "B",
+			attrs: map[string]interface{}{"customer": nil}}}), where)
+	}
+
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE a.price > 1 PARTITION BY customer.id")
+	require.NoError(t, err)
+	for _, ev := range []domain.Event{a, b, c} {
+		key, ok := q.PartitionKey(ev)
+		require.True(t, ok)
+		require.Equal(t, "c1", key)
+	}
+}
@@ -0,0 +1,72 @@
+package query
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+)
+
+// hashPredicate implements Hash. Most predicates are hashed by their text; the normalisations Equal allows for are made
+// first, so that predicates which are Equal hash alike: the operands of AND and OR are combined by their own hashes, in
+// sorted order, and comparisons are hashed in their canonical orientation (see operatorPredicate.canonical).
+func hashPredicate(p Predicate) uint64 {
+	switch p := unwrapCondition(p).(type) {
+	case nil:
+		return 0
+	case conjunction:
+		return hashOperands("AND", p)
+	case disjunction:
+		return hashOperands("OR", p)
+	case *negationPredicate:
+		h := fnv.New64a()
+		h.Write([]byte("NOT"))
+		binary.Write(h, binary.BigEndian, hashPredicate(p.Predicate))
+		return h.Sum64()
+	case *operatorPredicate:
+		left, right, op := p.canonical()
+		return hashText(valueText(left) + " " + op.symbol() + " " + valueText(right))
+	default:
+		return hashText(p.QueryText())
+	}
+}
+
+// hashOperands hashes a connective from the hashes of its operands, regardless of their order
+func hashOperands(connective string, operands []Predicate) uint64 {
+	hashes := make([]uint64, len(operands))
+	for i, operand := range operands {
+		hashes[i] = hashPredicate(operand)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	h := fnv.New64a()
+	h.Write([]byte(connective))
+	binary.Write(h, binary.BigEndian, hashes)
+	return h.Sum64()
+}
+
+func hashText(text string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(text))
+	return h.Sum64()
+}
+
+// sameOperands reports whether two sets of predicates are Equal, in any order
+func sameOperands(a, b []Predicate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	matched := make([]bool, len(b))
+	for _, p := range a {
+		found := false
+		for j, other := range b {
+			if !matched[j] && samePredicate(p, other) {
+				matched[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package query
+
+import (
+	"strings"
+)
+
+// Names (aliases, and the parts of attribute paths) which aren't identifiers may be quoted in backticks in a query, eg.
+// a.`user.id` or `first name`.x, as may those which are keywords (eg. a.`in`); a backtick within a quoted name is
+// doubled. Quoted names are held unquoted, except in the text of an attributeLookup, which is a path as it is written.
+
+// keywords are the words which can't be used as names without being quoted (see the Keyword machine in tokeniser.rl)
+var keywords = map[string]struct{}{
+	"AND": {}, "OR": {}, "NOT": {}, "BETWEEN": {}, "IN": {}, "MATCHES": {}, "STARTSWITH": {}, "ENDSWITH": {},
+	"CONTAINS": {}, "IS": {}, "NULL": {}, "TRUE": {}, "FALSE": {}, "WITHIN": {}, "PARTITION": {},
+}
+
+// isIdentifier returns whether a name may be written without quoting as part of a path: a letter or underscore,
+// followed by any number of letters, digits and underscores
+func isIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		letter := (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || r == '_'
+		if !letter && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// quote returns a name quoted in backticks
+func quote(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// quoteName returns a name which stands on its own (eg. an alias) as it is written in a query, quoted if it isn't an
+// identifier or is a keyword
+func quoteName(name string) string {
+	if _, ok := keywords[strings.ToUpper(name)]; ok || !isIdentifier(name) {
+		return quote(name)
+	}
+	return name
+}
+
+// joinPath returns a path of names as it is written in a query (eg. "a.`user.id`"), quoting the names which aren't
+// identifiers. Keywords needn't be quoted within a path.
+func joinPath(names ...string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		if isIdentifier(name) {
+			quoted[i] = name
+		} else {
+			quoted[i] = quote(name)
+		}
+	}
+	return strings.Join(quoted, ".")
+}
+
+// splitPath splits a path as it is written in a query into its names, unquoting those which are quoted. (A quote which
+// isn't closed, which the tokeniser doesn't allow, runs to the end of the path.)
+func splitPath(path string) []string {
+	var (
+		result = make([]string, 0, strings.Count(path, ".")+1)
+		name   = new(strings.Builder)
+		quoted bool
+	)
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '`' && quoted && i+1 < len(path) && path[i+1] == '`':
+			name.WriteByte(c)
+			i++
+		case c == '`':
+			quoted = !quoted
+		case c == '.' && !quoted:
+			result = append(result, name.String())
+			name.Reset()
+		default:
+			name.WriteByte(c)
+		}
+	}
+	return append(result, name.String())
+}
+
+// unquoteName returns a name which stands on its own as it is, rather than as it is written in a query
+func unquoteName(name string) string {
+	if strings.HasPrefix(name, "`") {
+		return splitPath(name)[0]
+	}
+	return name
+}
+
+// isQuoted returns whether the last name of a path is quoted
+func isQuoted(path string) bool {
+	return strings.HasSuffix(path, "`")
+}
@@ -0,0 +1,987 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+)
+
+// Predicates and values are marshalled to JSON as a tagged union: an object whose "type" says which kind of node it
+// is, and whose other fields hold the node's operands, eg.
+//
+//	{"type":"operator","op":"gt","left":{"type":"attribute","path":"a.x"},"right":{"type":"literal","value":1}}
+//
+// UnmarshalPredicate reverses this. Nil operands are represented by null (or an absent field).
+
+var opNames = map[op]string{
+	opEq:  "eq",
+	opNe:  "ne",
+	opGt:  "gt",
+	opLt:  "lt",
+	opGe:  "ge",
+	opLe:  "le",
+	opIEq: "ieq",
+}
+
+var arithmeticOpNames = map[arithmeticOp]string{
+	aoAdd:       "add",
+	aoSubtract:  "sub",
+	aoMultiply:  "mul",
+	aoDivide:    "div",
+	aoModulo:    "mod",
+	aoIntDivide: "idiv",
+	aoBitAnd:    "bitand",
+	aoBitOr:     "bitor",
+	aoBitXor:    "bitxor",
+}
+
+var stringMatchNames = map[stringMatch]string{
+	smPrefix:   "prefix",
+	smSuffix:   "suffix",
+	smContains: "contains",
+}
+
+// A nodeDecoder builds a predicate or value from the fields of its JSON representation
+type nodeDecoder func(fields jsonFields) (interface{}, error)
+
+// nodeDecoders maps the type tags of JSON nodes to their decoders (populated in init, as they refer back to it)
+var nodeDecoders map[string]nodeDecoder
+
+func init() {
+	nodeDecoders = map[string]nodeDecoder{
+		"operator":     decodeOperator,
+		"between":      decodeBetween,
+		"in":           decodeIn,
+		"quantified":   decodeQuantified,
+		"null_check":   decodeNullCheck,
+		"equivalence":  decodeEquivalence,
+		"and":          decodeConjunction,
+		"or":           decodeDisjunction,
+		"not":          decodeNegation,
+		"regex":        decodeRegex,
+		"string_match": decodeStringMatch,
+		"literal":      decodeLiteral,
+		"duration":     decodeDuration,
+		"parameter":    decodeParameter,
+		"variable":     decodeVariable,
+		"attribute":    decodeAttribute,
+		"subscript":    decodeSubscript,
+		"timestamp":    decodeTimestamp,
+		"event":        decodeEvent,
+		"arithmetic":   decodeArithmetic,
+		"list":         decodeList,
+		"index":        decodeIndex,
+		"length":       decodeLength,
+		"first":        decodeBoundary(false),
+		"last":         decodeBoundary(true),
+		"aggregate":    decodeAggregate,
+		"recent":       decodeRecent,
+		"function":     decodeFunction,
+		"coalesce":     decodeCoalesce,
+		"list_literal": decodeListLiteral,
+		"cast":         decodeCast,
+		"bitnot":       decodeBitwiseNot,
+		"conditional":  decodeConditional,
+	}
+}
+
+// UnmarshalPredicate decodes a predicate from its JSON representation (as produced by json.Marshal)
+func UnmarshalPredicate(data []byte) (Predicate, error) {
+	n, err := unmarshalNode(data)
+	if err != nil {
+		return nil, err
+	} else if p, ok := n.(Predicate); !ok {
+		return nil, fmt.Errorf("Expected a predicate, got %T", n)
+	} else {
+		return p, nil
+	}
+}
+
+func marshalNode(typ string, fields map[string]interface{}) ([]byte, error) {
+	fields["type"] = typ
+	return json.Marshal(fields)
+}
+
+func unmarshalNode(data []byte) (interface{}, error) {
+	var fields jsonFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	var typ string
+	if err := fields.decode("type", &typ); err != nil {
+		return nil, err
+	}
+	decoder, ok := nodeDecoders[typ]
+	if !ok {
+		return nil, fmt.Errorf("Unknown node type %q", typ)
+	}
+	n, err := decoder(fields)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding %s: %w", typ, err)
+	}
+	return n, nil
+}
+
+// unmarshalAs implements UnmarshalJSON: it decodes a node, which must be of the type dest points to
+func unmarshalAs(data []byte, dest interface{}) error {
+	n, err := unmarshalNode(data)
+	if err != nil {
+		return err
+	}
+	d, v := reflect.ValueOf(dest).Elem(), reflect.ValueOf(n)
+	if v.Type() == d.Type() {
+		d.Set(v)
+	} else if v.Kind() == reflect.Ptr && v.Elem().Type() == d.Type() {
+		d.Set(v.Elem())
+	} else {
+		return fmt.Errorf("Cannot unmarshal %T into %T", n, dest)
+	}
+	return nil
+}
+
+// jsonFields are the (as yet undecoded) fields of a JSON node
+type jsonFields map[string]json.RawMessage
+
+// has reports whether the field is present and not null
+func (f jsonFields) has(key string) bool {
+	raw, ok := f[key]
+	return ok && string(raw) != "null"
+}
+
+func (f jsonFields) decode(key string, dest interface{}) error {
+	if !f.has(key) {
+		return fmt.Errorf("Missing field %q", key)
+	} else if err := json.Unmarshal(f[key], dest); err != nil {
+		return fmt.Errorf("Invalid field %q: %w", key, err)
+	}
+	return nil
+}
+
+// value decodes an optional value field
+func (f jsonFields) value(key string) (value, error) {
+	if !f.has(key) {
+		return nil, nil
+	}
+	n, err := unmarshalNode(f[key])
+	if err != nil {
+		return nil, err
+	} else if v, ok := n.(value); !ok {
+		return nil, fmt.Errorf("Field %q should be a value, got %T", key, n)
+	} else {
+		return v, nil
+	}
+}
+
+func (f jsonFields) values(key string) ([]value, error) {
+	var raws []json.RawMessage
+	if f.has(key) {
+		if err := f.decode(key, &raws); err != nil {
+			return nil, err
+		}
+	}
+	result := make([]value, len(raws))
+	for i, raw := range raws {
+		v, err := jsonFields{"v": raw}.value("v")
+		if err != nil {
+			return nil, err
+		}
+		result[i] = v
+	}
+	return result, nil
+}
+
+// predicate decodes an optional predicate field
+func (f jsonFields) predicate(key string) (Predicate, error) {
+	if !f.has(key) {
+		return nil, nil
+	}
+	n, err := unmarshalNode(f[key])
+	if err != nil {
+		return nil, err
+	} else if p, ok := n.(Predicate); !ok {
+		return nil, fmt.Errorf("Field %q should be a predicate, got %T", key, n)
+	} else {
+		return p, nil
+	}
+}
+
+func (f jsonFields) predicates(key string) ([]Predicate, error) {
+	var raws []json.RawMessage
+	if f.has(key) {
+		if err := f.decode(key, &raws); err != nil {
+			return nil, err
+		}
+	}
+	result := make([]Predicate, len(raws))
+	for i, raw := range raws {
+		p, err := jsonFields{"p": raw}.predicate("p")
+		if err != nil {
+			return nil, err
+		}
+		result[i] = p
+	}
+	return result, nil
+}
+
+// optional decodes a field into dest if it is present (leaving dest untouched otherwise)
+func (f jsonFields) optional(key string, dest interface{}) error {
+	if !f.has(key) {
+		return nil
+	}
+	return f.decode(key, dest)
+}
+
+// operatorPredicate
+
+func (p *operatorPredicate) MarshalJSON() ([]byte, error) {
+	name, ok := opNames[p.op]
+	if !ok {
+		return nil, fmt.Errorf("Cannot marshal unknown op %d", p.op)
+	}
+	return marshalNode("operator", map[string]interface{}{"op": name, "left": p.left, "right": p.right})
+}
+
+func (p *operatorPredicate) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, p)
+}
+
+func decodeOperator(f jsonFields) (interface{}, error) {
+	var name string
+	if err := f.decode("op", &name); err != nil {
+		return nil, err
+	}
+	p := &operatorPredicate{}
+	found := false
+	for candidate, candidateName := range opNames {
+		if candidateName == name {
+			p.op, found = candidate, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Unknown op %q", name)
+	}
+
+	var err error
+	if p.left, err = f.value("left"); err != nil {
+		return nil, err
+	} else if p.right, err = f.value("right"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// betweenPredicate
+
+func (p *betweenPredicate) MarshalJSON() ([]byte, error) {
+	return marshalNode("between", map[string]interface{}{"operand": p.operand, "low": p.low, "high": p.high})
+}
+
+func (p *betweenPredicate) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, p)
+}
+
+func decodeBetween(f jsonFields) (interface{}, error) {
+	p := &betweenPredicate{}
+	var err error
+	if p.operand, err = f.value("operand"); err != nil {
+		return nil, err
+	} else if p.low, err = f.value("low"); err != nil {
+		return nil, err
+	} else if p.high, err = f.value("high"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// inPredicate
+
+func (p *inPredicate) MarshalJSON() ([]byte, error) {
+	return marshalNode("in", map[string]interface{}{"left": p.left, "set": p.set})
+}
+
+func (p *inPredicate) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, p)
+}
+
+func decodeIn(f jsonFields) (interface{}, error) {
+	p := &inPredicate{}
+	var err error
+	if p.left, err = f.value("left"); err != nil {
+		return nil, err
+	} else if p.set, err = f.values("set"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// quantifiedPredicate
+
+func (p *quantifiedPredicate) MarshalJSON() ([]byte, error) {
+	name, ok := opNames[p.op]
+	if !ok {
+		return nil, fmt.Errorf("Cannot marshal unknown op %d", p.op)
+	}
+	return marshalNode("quantified", map[string]interface{}{
+		"left":       p.left,
+		"op":         name,
+		"quantifier": p.quantifier(),
+		"list":       p.list,
+	})
+}
+
+func (p *quantifiedPredicate) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, p)
+}
+
+func decodeQuantified(f jsonFields) (interface{}, error) {
+	var name, quantifier string
+	if err := f.decode("op", &name); err != nil {
+		return nil, err
+	} else if err := f.decode("quantifier", &quantifier); err != nil {
+		return nil, err
+	}
+	p := &quantifiedPredicate{}
+	found := false
+	for candidate, candidateName := range opNames {
+		if candidateName == name {
+			p.op, found = candidate, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Unknown op %q", name)
+	}
+	switch quantifier {
+	case "any":
+	case "all":
+		p.all = true
+	default:
+		return nil, fmt.Errorf("Unknown quantifier %q", quantifier)
+	}
+
+	var err error
+	if p.left, err = f.value("left"); err != nil {
+		return nil, err
+	} else if p.list, err = f.value("list"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// nullCheckPredicate
+
+func (p *nullCheckPredicate) MarshalJSON() ([]byte, error) {
+	return marshalNode("null_check", map[string]interface{}{"operand": p.operand, "negated": p.negated})
+}
+
+func (p *nullCheckPredicate) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, p)
+}
+
+func decodeNullCheck(f jsonFields) (interface{}, error) {
+	p := &nullCheckPredicate{}
+	var err error
+	if p.operand, err = f.value("operand"); err != nil {
+		return nil, err
+	} else if err = f.optional("negated", &p.negated); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// equivalencePredicate
+
+func (p *equivalencePredicate) MarshalJSON() ([]byte, error) {
+	return marshalNode("equivalence", map[string]interface{}{"key": p.key, "aliases": p.aliases})
+}
+
+func (p *equivalencePredicate) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, p)
+}
+
+func decodeEquivalence(f jsonFields) (interface{}, error) {
+	var (
+		key     string
+		aliases []string
+	)
+	if err := f.decode("key", &key); err != nil {
+		return nil, err
+	} else if err := f.optional("aliases", &aliases); err != nil { // Absent from those marshalled before they had any
+		return nil, err
+	}
+	return newEquivalencePredicate(key, aliases...), nil
+}
+
+// conjunction, disjunction, and negationPredicate
+
+func (c conjunction) MarshalJSON() ([]byte, error) {
+	return marshalNode("and", map[string]interface{}{"predicates": []Predicate(c)})
+}
+
+func (c *conjunction) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, c)
+}
+
+func decodeConjunction(f jsonFields) (interface{}, error) {
+	ps, err := f.predicates("predicates")
+	return conjunction(ps), err
+}
+
+func (d disjunction) MarshalJSON() ([]byte, error) {
+	return marshalNode("or", map[string]interface{}{"predicates": []Predicate(d)})
+}
+
+func (d *disjunction) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, d)
+}
+
+func decodeDisjunction(f jsonFields) (interface{}, error) {
+	ps, err := f.predicates("predicates")
+	return disjunction(ps), err
+}
+
+func (p *negationPredicate) MarshalJSON() ([]byte, error) {
+	return marshalNode("not", map[string]interface{}{"predicate": p.Predicate})
+}
+
+func (p *negationPredicate) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, p)
+}
+
+func decodeNegation(f jsonFields) (interface{}, error) {
+	p, err := f.predicate("predicate")
+	if err != nil {
+		return nil, err
+	} else if p == nil {
+		return nil, fmt.Errorf("Missing field %q", "predicate")
+	}
+	return &negationPredicate{p}, nil
+}
+
+// regexPredicate and stringMatchPredicate
+
+func (p *regexPredicate) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{"left": p.left, "pattern": nil}
+	if p.pattern != nil {
+		fields["pattern"] = p.pattern.String()
+	}
+	return marshalNode("regex", fields)
+}
+
+func (p *regexPredicate) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, p)
+}
+
+func decodeRegex(f jsonFields) (interface{}, error) {
+	p := &regexPredicate{}
+	var (
+		pattern string
+		err     error
+	)
+	if p.left, err = f.value("left"); err != nil {
+		return nil, err
+	} else if err = f.decode("pattern", &pattern); err != nil {
+		return nil, err
+	} else if p.pattern, err = regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("Invalid regular expression %q: %w", pattern, err)
+	}
+	return p, nil
+}
+
+func (p *stringMatchPredicate) MarshalJSON() ([]byte, error) {
+	name, ok := stringMatchNames[p.match]
+	if !ok {
+		return nil, fmt.Errorf("Cannot marshal unknown string match %d", p.match)
+	}
+	return marshalNode("string_match", map[string]interface{}{"match": name, "left": p.left, "right": p.right})
+}
+
+func (p *stringMatchPredicate) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, p)
+}
+
+func decodeStringMatch(f jsonFields) (interface{}, error) {
+	var name string
+	if err := f.decode("match", &name); err != nil {
+		return nil, err
+	}
+	p := &stringMatchPredicate{}
+	found := false
+	for candidate, candidateName := range stringMatchNames {
+		if candidateName == name {
+			p.match, found = candidate, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Unknown string match %q", name)
+	}
+
+	var err error
+	if p.left, err = f.value("left"); err != nil {
+		return nil, err
+	} else if p.right, err = f.value("right"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// literalValue and attributeLookup
+
+func (v literalValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("literal", map[string]interface{}{"value": v.v})
+}
+
+func (v *literalValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeLiteral(f jsonFields) (interface{}, error) {
+	var v interface{}
+	if err := f.optional("value", &v); err != nil {
+		return nil, err
+	}
+	switch v.(type) {
+	case nil, string, float64, bool:
+		return literalValue{v}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported literal %T", v)
+	}
+}
+
+func (v durationLiteralValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("duration", map[string]interface{}{"value": v.QueryText()})
+}
+
+func (v *durationLiteralValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeDuration(f jsonFields) (interface{}, error) {
+	var s string
+	if err := f.decode("value", &s); err != nil {
+		return nil, err
+	}
+	d, err := parseDuration(s)
+	if err != nil {
+		return nil, err
+	}
+	return durationLiteralValue(d), nil
+}
+
+func (v parameterValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("parameter", map[string]interface{}{"name": string(v)})
+}
+
+func (v *parameterValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeParameter(f jsonFields) (interface{}, error) {
+	var name string
+	if err := f.decode("name", &name); err != nil {
+		return nil, err
+	}
+	return parameterValue(name), nil
+}
+
+func (v variableValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("variable", map[string]interface{}{"name": string(v)})
+}
+
+func (v *variableValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeVariable(f jsonFields) (interface{}, error) {
+	var name string
+	if err := f.decode("name", &name); err != nil {
+		return nil, err
+	}
+	return variableValue(name), nil
+}
+
+func (p attributeLookup) MarshalJSON() ([]byte, error) {
+	return marshalNode("attribute", map[string]interface{}{"path": string(p)})
+}
+
+func (p *attributeLookup) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, p)
+}
+
+func decodeAttribute(f jsonFields) (interface{}, error) {
+	var path string
+	if err := f.decode("path", &path); err != nil {
+		return nil, err
+	}
+	return attributeLookup(path), nil
+}
+
+func (v *subscriptLookup) MarshalJSON() ([]byte, error) {
+	return marshalNode("subscript", map[string]interface{}{"operand": v.operand, "key": v.key, "path": v.path})
+}
+
+func (v *subscriptLookup) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeSubscript(f jsonFields) (interface{}, error) {
+	v := &subscriptLookup{}
+	var err error
+	if v.operand, err = f.value("operand"); err != nil {
+		return nil, err
+	} else if v.key, err = f.value("key"); err != nil {
+		return nil, err
+	} else if err = f.optional("path", &v.path); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v timestampValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("timestamp", map[string]interface{}{"alias": string(v)})
+}
+
+func (v *timestampValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeTimestamp(f jsonFields) (interface{}, error) {
+	var alias string
+	if err := f.decode("alias", &alias); err != nil {
+		return nil, err
+	}
+	return timestampValue(alias), nil
+}
+
+func (v eventValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("event", map[string]interface{}{"alias": string(v)})
+}
+
+func (v *eventValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeEvent(f jsonFields) (interface{}, error) {
+	var alias string
+	if err := f.decode("alias", &alias); err != nil {
+		return nil, err
+	}
+	return eventValue(alias), nil
+}
+
+// arithmeticValue
+
+func (v *arithmeticValue) MarshalJSON() ([]byte, error) {
+	name, ok := arithmeticOpNames[v.op]
+	if !ok {
+		return nil, fmt.Errorf("Cannot marshal unknown arithmetic op %d", v.op)
+	}
+	return marshalNode("arithmetic", map[string]interface{}{"op": name, "left": v.left, "right": v.right})
+}
+
+func (v *arithmeticValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeArithmetic(f jsonFields) (interface{}, error) {
+	var name string
+	if err := f.decode("op", &name); err != nil {
+		return nil, err
+	}
+	v := &arithmeticValue{}
+	found := false
+	for candidate, candidateName := range arithmeticOpNames {
+		if candidateName == name {
+			v.op, found = candidate, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Unknown arithmetic op %q", name)
+	}
+
+	var err error
+	if v.left, err = f.value("left"); err != nil {
+		return nil, err
+	} else if v.right, err = f.value("right"); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// listLookup, indexLookup, boundaryLookup, lengthValue, and aggregateValue
+
+func (v *listLookup) MarshalJSON() ([]byte, error) {
+	return marshalNode("list", map[string]interface{}{"alias": v.alias, "path": v.path})
+}
+
+func (v *listLookup) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeList(f jsonFields) (interface{}, error) {
+	v := &listLookup{}
+	if err := f.decode("alias", &v.alias); err != nil {
+		return nil, err
+	} else if err := f.optional("path", &v.path); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *indexLookup) MarshalJSON() ([]byte, error) {
+	return marshalNode("index", map[string]interface{}{
+		"alias":  v.alias,
+		"index":  v.index,
+		"offset": v.offset,
+		"path":   v.path,
+	})
+}
+
+func (v *indexLookup) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeIndex(f jsonFields) (interface{}, error) {
+	v := &indexLookup{}
+	var err error
+	if err = f.decode("alias", &v.alias); err != nil {
+		return nil, err
+	} else if v.index, err = f.value("index"); err != nil {
+		return nil, err
+	} else if err = f.optional("offset", &v.offset); err != nil {
+		return nil, err
+	} else if err = f.optional("path", &v.path); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *boundaryLookup) MarshalJSON() ([]byte, error) {
+	return marshalNode(v.name(), map[string]interface{}{"alias": v.alias, "path": v.path})
+}
+
+func (v *boundaryLookup) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeBoundary(last bool) nodeDecoder {
+	return func(f jsonFields) (interface{}, error) {
+		v := &boundaryLookup{last: last}
+		if err := f.decode("alias", &v.alias); err != nil {
+			return nil, err
+		} else if err := f.optional("path", &v.path); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+}
+
+func (v lengthValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("length", map[string]interface{}{"alias": string(v)})
+}
+
+func (v *lengthValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeLength(f jsonFields) (interface{}, error) {
+	var alias string
+	if err := f.decode("alias", &alias); err != nil {
+		return nil, err
+	}
+	return lengthValue(alias), nil
+}
+
+func (v *aggregateValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("aggregate", map[string]interface{}{"fn": v.fn.String(), "operand": v.operand})
+}
+
+func (v *aggregateValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeAggregate(f jsonFields) (interface{}, error) {
+	var name string
+	if err := f.decode("fn", &name); err != nil {
+		return nil, err
+	}
+	fn, ok := aggregateFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown aggregate %q", name)
+	}
+	operand, err := f.value("operand")
+	if err != nil {
+		return nil, err
+	}
+	return &aggregateValue{fn: fn, operand: operand}, nil
+}
+
+// recentValue
+
+func (v *recentValue) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{"operand": v.operand}
+	if v.count > 0 {
+		fields["count"] = v.count
+	} else {
+		fields["window"] = formatDuration(v.window)
+	}
+	return marshalNode("recent", fields)
+}
+
+func (v *recentValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeRecent(f jsonFields) (interface{}, error) {
+	operand, err := f.value("operand")
+	if err != nil {
+		return nil, err
+	}
+	var (
+		window string
+		count  int
+	)
+	if err := f.optional("window", &window); err != nil {
+		return nil, err
+	} else if err := f.optional("count", &count); err != nil {
+		return nil, err
+	}
+	args := []value{operand, literalValue{float64(count)}}
+	if window != "" {
+		d, err := parseDuration(window)
+		if err != nil {
+			return nil, err
+		}
+		args[1] = durationLiteralValue(d)
+	}
+	return newRecentValue(args)
+}
+
+// functionValue and coalesceValue
+
+func (v *functionValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("function", map[string]interface{}{"name": v.name, "args": v.args})
+}
+
+func (v *functionValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeFunction(f jsonFields) (interface{}, error) {
+	var name string
+	if err := f.decode("name", &name); err != nil {
+		return nil, err
+	}
+	args, err := f.values("args")
+	if err != nil {
+		return nil, err
+	}
+	return newFunctionValue(name, args) // The function must be registered in this process too
+}
+
+func (v coalesceValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("coalesce", map[string]interface{}{"operands": []value(v)})
+}
+
+func (v *coalesceValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeCoalesce(f jsonFields) (interface{}, error) {
+	operands, err := f.values("operands")
+	if err != nil {
+		return nil, err
+	} else if len(operands) == 0 {
+		return nil, fmt.Errorf("coalesce takes at least one argument")
+	}
+	return coalesceValue(operands), nil
+}
+
+// listLiteralValue
+
+func (v listLiteralValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("list_literal", map[string]interface{}{"members": []value(v)})
+}
+
+func (v *listLiteralValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeListLiteral(f jsonFields) (interface{}, error) {
+	members, err := f.values("members")
+	if err != nil {
+		return nil, err
+	}
+	return listLiteralValue(members), nil
+}
+
+// castValue
+
+func (v *castValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("cast", map[string]interface{}{"to": v.to.String(), "operand": v.operand})
+}
+
+func (v *castValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeCast(f jsonFields) (interface{}, error) {
+	var name string
+	if err := f.decode("to", &name); err != nil {
+		return nil, err
+	}
+	to, ok := castTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cast to %q", name)
+	}
+	operand, err := f.value("operand")
+	if err != nil {
+		return nil, err
+	}
+	return &castValue{to: to, operand: operand}, nil
+}
+
+// bitwiseNotValue
+
+func (v *bitwiseNotValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("bitnot", map[string]interface{}{"operand": v.operand})
+}
+
+func (v *bitwiseNotValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeBitwiseNot(f jsonFields) (interface{}, error) {
+	operand, err := f.value("operand")
+	if err != nil {
+		return nil, err
+	}
+	return &bitwiseNotValue{operand}, nil
+}
+
+// conditionalValue
+
+func (v *conditionalValue) MarshalJSON() ([]byte, error) {
+	return marshalNode("conditional", map[string]interface{}{
+		"condition": v.condition,
+		"then":      v.then,
+		"else":      v.otherwise,
+	})
+}
+
+func (v *conditionalValue) UnmarshalJSON(data []byte) error {
+	return unmarshalAs(data, v)
+}
+
+func decodeConditional(f jsonFields) (interface{}, error) {
+	v := &conditionalValue{}
+	var err error
+	if v.condition, err = f.predicate("condition"); err != nil {
+		return nil, err
+	} else if v.then, err = f.value("then"); err != nil {
+		return nil, err
+	} else if v.otherwise, err = f.value("else"); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
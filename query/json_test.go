@@ -0,0 +1,100 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	queries := []string{
+		"EVENT SEQ(a b, a c) WHERE b.x == c.x AND b.y ~= 'foo' AND b.z <= 1",
+		"EVENT SEQ(a b, a c) WHERE NOT (b.x != c.x OR [foo]) AND b.y >= -1.5",
+		"EVENT a b WHERE b.x BETWEEN 1 AND b.y AND b.z IN (1, 'two', true, null)",
+		"EVENT a b WHERE b.x IS NULL OR b.y IS NOT NULL",
+		"EVENT a b WHERE b.x MATCHES '^a.*\\\\d$' AND b.y STARTSWITH 'a' AND b.y ENDSWITH 'b' AND b.y CONTAINS 'c'",
+		"EVENT a b WHERE (b.x + 1) * 2 > b.y / 3 - 4",
+		"EVENT SEQ(a b, a c) WHERE c.TS - b.TS < 1m30s",
+		"EVENT a b WHERE avg(b[].x) > b[i-1].x AND count(b[]) < b.LEN AND b[0].m.x < b[b.LEN - 1].x",
+		"EVENT a b WHERE lower(concat(b.x, ' ', b.y)) == coalesce(b.z, 'anon') AND pow(b.n, 2) > 4",
+		"EVENT a+ b[] WHERE first(b[]).x < last(b[]).m.y AND first(b[]) != null",
+		"EVENT a b WHERE number(b.code) == string(b.n) AND bool(b.flag) == true",
+		"EVENT a b WHERE (b.vip == true AND b.x > 1 ? b.x * 0.9 : b.x) < 10",
+		"EVENT a b WHERE b.flags & 0x4 != 0 AND (b.x | b.y) ^ ~b.z == 1",
+		"EVENT a b WHERE length(b) == 1",
+		"EVENT a b WHERE b.region == $deployRegion",
+		"EVENT a+ b[] WHERE b[0].x > all([1, b[0].y, 'x']) AND b[0].t == any(b[].t) AND b[0].u != all([])",
+	}
+	for _, queryText := range queries {
+		q, err := Parse(queryText)
+		require.NoError(t, err, queryText)
+
+		data, err := json.Marshal(q.predicate)
+		require.NoError(t, err, queryText)
+		p, err := UnmarshalPredicate(data)
+		require.NoError(t, err, string(data))
+		require.True(t, q.predicate.Equal(p), "%s\n%s", queryText, string(data))
+		require.Equal(t, q.predicate.QueryText(), p.QueryText())
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	p := &operatorPredicate{left: attributeLookup("a.x"), right: literalValue{float64(1)}, op: opGt}
+	data, err := json.Marshal(p)
+	require.NoError(t, err)
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, map[string]interface{}{
+		"type":  "operator",
+		"op":    "gt",
+		"left":  map[string]interface{}{"type": "attribute", "path": "a.x"},
+		"right": map[string]interface{}{"type": "literal", "value": float64(1)},
+	}, decoded)
+
+	// Concrete types can be unmarshalled into directly
+	p2 := &operatorPredicate{}
+	require.NoError(t, json.Unmarshal(data, p2))
+	require.True(t, p.Equal(p2))
+	var c conjunction
+	require.NoError(t, json.Unmarshal([]byte(`{"type":"and","predicates":[`+string(data)+`]}`), &c))
+	require.True(t, conjunction{p}.Equal(c))
+	require.Error(t, json.Unmarshal([]byte(`{"type":"or","predicates":[]}`), &c)) // Wrong type
+
+	// Nil operands survive
+	data, err = json.Marshal(&operatorPredicate{left: attributeLookup("a.x"), op: opEq})
+	require.NoError(t, err)
+	p3, err := UnmarshalPredicate(data)
+	require.NoError(t, err)
+	require.True(t, p3.Equal(&operatorPredicate{left: attributeLookup("a.x"), op: opEq}))
+}
+
+func TestJSONErrors(t *testing.T) {
+	cases := map[string]string{
+		"unknown type":       `{"type":"wibble"}`,
+		"missing type":       `{"op":"gt"}`,
+		"not an object":      `[1, 2]`,
+		"value at top level": `{"type":"attribute","path":"a.x"}`,
+		"value expected":     `{"type":"operator","op":"eq","left":{"type":"equivalence","key":"x"}}`,
+		"predicate expected": `{"type":"not","predicate":{"type":"literal","value":1}}`,
+		"unknown op":         `{"type":"operator","op":"approx"}`,
+		"unknown nested":     `{"type":"and","predicates":[{"type":"wibble"}]}`,
+		"bad regex":          `{"type":"regex","left":{"type":"attribute","path":"a.x"},"pattern":"("}`,
+		"unknown function":   `{"type":"function","name":"wibble","args":[]}`,
+		"unknown aggregate":  `{"type":"aggregate","fn":"median"}`,
+		"bad literal":        `{"type":"literal","value":[1]}`,
+	}
+	for desc, data := range cases {
+		_, err := UnmarshalPredicate([]byte(data))
+		require.Error(t, err, desc)
+	}
+	_, err := UnmarshalPredicate([]byte(`{"type":"and","predicates":[{"type":"wibble"}]}`))
+	require.Contains(t, err.Error(), `Unknown node type "wibble"`)
+	for _, data := range []string{`{"type":"not"}`, `{"type":"not","predicate":null}`} {
+		_, err = UnmarshalPredicate([]byte(data))
+		require.EqualError(t, err, `Error decoding not: Missing field "predicate"`, data)
+	}
+
+	_, err = json.Marshal(&operatorPredicate{op: op(99)})
+	require.Error(t, err)
+}
@@ -0,0 +1,25 @@
+package query
+
+// A Logger receives the package's diagnostic output. Its methods have the same signatures as those of (for example)
+// zap's SugaredLogger, so most logging libraries can be plugged in directly or with a thin adapter.
+type Logger interface {
+	Errorf(format string, params ...interface{})
+	Debugf(format string, params ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Errorf(format string, params ...interface{}) {}
+func (nopLogger) Debugf(format string, params ...interface{}) {}
+
+// logger is where the package logs to; by default, nowhere
+var logger Logger = nopLogger{}
+
+// SetLogger redirects the package's logging (for example, errors encountered when evaluating predicates) to l. A nil
+// Logger silences it. This is not safe to call concurrently with evaluation, so should be done during initialisation.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	logger = l
+}
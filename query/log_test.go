@@ -0,0 +1,36 @@
+package query
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type tLogger struct {
+	errors []string
+}
+
+func (l *tLogger) Errorf(format string, params ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, params...))
+}
+
+func (l *tLogger) Debugf(format string, params ...interface{}) {}
+
+func TestSetLogger(t *testing.T) {
+	l := &tLogger{}
+	SetLogger(l)
+	defer SetLogger(nil)
+
+	p := &operatorPredicate{left: literalValue{"a"}, right: literalValue{float64(1)}, op: opGt}
+	require.Equal(t, Negative, p.Evaluate(nil))
+	require.Len(t, l.errors, 1)
+	require.Contains(t, l.errors[0], "[sase:operatorPredicate]")
+
+	require.Equal(t, Positive, tPredicate{result: Positive}.Evaluate(nil))
+	require.Len(t, l.errors, 1) // Successful evaluation logs nothing
+
+	SetLogger(nil)
+	require.Equal(t, Negative, p.Evaluate(nil))
+	require.Len(t, l.errors, 1)
+}
@@ -0,0 +1,530 @@
+package query
+
+import (
+	"container/heap"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A SelectionStrategy determines which events from a stream are selected into the candidate matches of a query
+type SelectionStrategy uint8
+
+const (
+	// SkipTillNextMatch skips events which are irrelevant to a candidate, but the next relevant one must be selected:
+	// each event can extend a candidate only once, so candidates don't overlap
+	SkipTillNextMatch SelectionStrategy = iota
+	// SkipTillAnyMatch lets every relevant event extend a candidate while also leaving it as it was, so that later
+	// events may extend it differently. This finds every possible match, so candidates (and matches) overlap.
+	SkipTillAnyMatch
+)
+
+func (s SelectionStrategy) String() string {
+	switch s {
+	case SkipTillNextMatch:
+		return "skip-till-next-match"
+	case SkipTillAnyMatch:
+		return "skip-till-any-match"
+	default:
+		return ""
+	}
+}
+
+// A Matcher matches a query against a stream of events, reporting each match (the events it captured, by alias) once it
+// is complete. Events are fed to it in the order they occur, or nearly so (see Query.SetAllowedLateness), and candidate
+// matches are formed from them according to the query's selection strategy, partitioning and window. A Matcher is not
+// safe for concurrent use, and the query must not be changed while it is matching.
+type Matcher struct {
+	m       *matcher
+	matches chan domain.CapturedEvents // Once there is a channel, matches are sent on it
+}
+
+// NewMatcher returns a Matcher for a query, with no events fed to it yet
+func NewMatcher(q *Query) *Matcher {
+	return &Matcher{m: newMatcher(q)}
+}
+
+// Feed captures an event, returning any matches which are complete as a result (or, if Matches has been called,
+// sending them on its channel instead)
+func (m *Matcher) Feed(ev domain.Event) []domain.CapturedEvents {
+	return m.deliver(m.m.feed(ev))
+}
+
+// Flush ends the stream: it returns the matches which are still outstanding (those held open by greedy Kleene
+// closures, or events awaiting late arrivals), as Feed does, and discards every candidate. The Matcher may be fed again
+// afterwards, as the start of a new stream.
+func (m *Matcher) Flush() []domain.CapturedEvents {
+	return m.deliver(m.m.flush())
+}
+
+// Matches returns a channel on which matches are sent as they complete, rather than being returned by Feed and Flush.
+// Since sending blocks until the match is received, the channel must be read from another goroutine. Close closes it.
+func (m *Matcher) Matches() <-chan domain.CapturedEvents {
+	if m.matches == nil {
+		m.matches = make(chan domain.CapturedEvents)
+	}
+	return m.matches
+}
+
+// Close flushes the Matcher (see Flush) and closes the channel returned by Matches, if it has been called. It returns
+// the matches flushed, unless they were sent on the channel. The Matcher must not be used afterwards.
+func (m *Matcher) Close() []domain.CapturedEvents {
+	matches := m.Flush()
+	if m.matches != nil {
+		close(m.matches)
+	}
+	return matches
+}
+
+// OnEvict sets a function to be called with each candidate which is dropped because the query's candidate limit was
+// reached (see Query.SetMaxCandidates), eg. to count them. It is called from Feed, before it returns.
+func (m *Matcher) OnEvict(f func(evicted domain.CapturedEvents)) {
+	m.m.setOnEvict(f)
+}
+
+// Candidates returns the number of candidate (partial) matches currently held
+func (m *Matcher) Candidates() int {
+	return m.m.size()
+}
+
+func (m *Matcher) deliver(matches []domain.CapturedEvents) []domain.CapturedEvents {
+	if m.matches == nil {
+		return matches
+	}
+	for _, match := range matches {
+		m.matches <- match
+	}
+	return nil
+}
+
+// A matcher drives a query over a stream of events, forming candidate matches according to its selection strategy.
+// If the query is partitioned, each partition has its own candidates, so they never cross partitions; those of an
+// unpartitioned query are all kept under the nil key.
+type matcher struct {
+	q          *Query
+	evaluate   func(domain.CapturedEvents) Result
+	closures   map[string]bool // Aliases captured by Kleene closures (alias: greedy)
+	partitions map[interface{}][]candidate
+	candidates int // Number of candidates, across all partitions
+	fed        int // Number of events processed (the position of the latest in the stream), to schedule sweeps
+	onEvict    func(domain.CapturedEvents)
+	// Events which may still be preceded by late arrivals are held in pending (in the order they occurred) until the
+	// watermark passes them. The watermark trails the latest event seen by the query's allowed lateness.
+	pending   []domain.Event
+	latest    time.Time
+	watermark time.Time
+	// If the query's event clause has alternatives, each is matched by a matcher of its own (and this one only
+	// combines their matches)
+	alternatives []*matcher
+	recent       []*recentValue // Those of the matcher's copy of the query, whose histories it keeps
+}
+
+// A candidate is a partial match
+type candidate struct {
+	evs domain.CapturedEvents
+	// matched is set once the candidate has matched, but is held open because a greedy closure may still extend it. It
+	// is reported once it can't be extended any more: when its window elapses, or the stream ends.
+	matched bool
+	first   int // The position in the stream of its first event, for the query's window count (see Query.WindowCount)
+	last    int // and of its latest, so that an event isn't captured twice (events needn't be comparable to tell)
+}
+
+// Windows are enforced on each partition as it is fed. So that quiet partitions don't retain expired candidates
+// indefinitely, all of them are swept this often (in events fed).
+const expirySweepInterval = 1024
+
+func newMatcher(q *Query) *matcher {
+	if alts := q.alternatives(); alts != nil {
+		m := &matcher{q: q}
+		for _, alt := range alts {
+			m.alternatives = append(m.alternatives, newMatcher(alt))
+		}
+		return m
+	}
+	q, recent := q.withHistories()
+	return &matcher{
+		q:          q,
+		evaluate:   q.compilePruning(),
+		closures:   q.capture.closures(),
+		partitions: make(map[interface{}][]candidate),
+		recent:     recent,
+	}
+}
+
+// feed captures an event, returning any matches which are complete as a result. Events may be fed out of the order they
+// occurred by up to the query's allowed lateness; those which are any later than that are dropped.
+func (m *matcher) feed(ev domain.Event) []domain.CapturedEvents {
+	if m.alternatives != nil {
+		var matches []domain.CapturedEvents
+		for _, alt := range m.alternatives {
+			matches = append(matches, alt.feed(ev)...)
+		}
+		return matches
+	}
+	when := ev.When()
+	if when.Before(m.watermark) {
+		logger.Debugf("[sase:matcher] Dropping %s event which arrived %s late", ev.Type(), m.latest.Sub(when))
+		return nil
+	}
+
+	// Hold it until nothing could arrive which occurred before it (those at the same instant arrive after it)
+	i := sort.Search(len(m.pending), func(i int) bool { return m.pending[i].When().After(when) })
+	m.pending = append(m.pending, nil)
+	copy(m.pending[i+1:], m.pending[i:])
+	m.pending[i] = ev
+	if when.After(m.latest) {
+		m.latest = when
+		m.watermark = when.Add(-m.q.lateness)
+	}
+
+	var matches []domain.CapturedEvents
+	n := 0
+	for ; n < len(m.pending) && !m.pending[n].When().After(m.watermark); n++ {
+		matches = append(matches, m.process(m.pending[n])...)
+	}
+	m.release(n)
+	return matches
+}
+
+// release drops the first n pending events, which have been processed
+func (m *matcher) release(n int) {
+	remaining := copy(m.pending, m.pending[n:])
+	for i := remaining; i < len(m.pending); i++ {
+		m.pending[i] = nil // Don't retain what was released
+	}
+	m.pending = m.pending[:remaining]
+}
+
+// process captures an event in the order it occurred, returning any matches which are complete as a result
+func (m *matcher) process(ev domain.Event) []domain.CapturedEvents {
+	m.fed++ // Events which can't be matched still count towards the window count
+	var key interface{}
+	if m.q.partition != "" {
+		k, ok := m.q.PartitionKey(ev)
+		if !ok {
+			logger.Debugf("[sase:matcher] %s event has no %s to partition by", ev.Type(), m.q.partition)
+			return nil
+		}
+		key = partitionBucket(k)
+	}
+
+	var matches []domain.CapturedEvents
+	if m.fed%expirySweepInterval == 0 {
+		for k := range m.partitions {
+			matches = append(matches, m.expire(k, ev.When())...)
+		}
+	} else {
+		matches = append(matches, m.expire(key, ev.When())...)
+	}
+
+	anyMatch := m.q.strategy == SkipTillAnyMatch
+	original := ev
+	for _, alias := range m.q.CaptureAliases(original) {
+		ev, err := m.q.schema.Conform(alias, original)
+		if err != nil {
+			logger.Errorf("[sase:matcher] Not capturing event as %s: %s", alias, err.Error())
+			continue
+		}
+		existing := m.partitions[key]
+		candidates := make([]candidate, 0, len(existing)+1)
+		for _, c := range existing {
+			extended, ok := m.extend(c, alias, ev)
+			if !ok {
+				candidates = append(candidates, c)
+				continue
+			}
+
+			r := m.evaluate(extended)
+			if r == Negative { // This event isn't relevant to the candidate
+				candidates = append(candidates, c)
+				continue
+			} else if anyMatch && r != Invalid { // The candidate remains, to be extended differently
+				candidates = append(candidates, c)
+			} else if c.matched && r != Positive { // It has matched, and can't be extended any further
+				matches = append(matches, c.evs)
+			}
+			switch r {
+			case Positive:
+				if m.open(extended) {
+					candidates = append(candidates, candidate{evs: extended, matched: true, first: c.first, last: m.fed})
+				} else {
+					matches = append(matches, extended)
+				}
+			case Uncertain:
+				candidates = append(candidates, candidate{evs: extended, first: c.first, last: m.fed})
+			}
+		}
+
+		// The event may also start a new candidate
+		virgin := m.start(alias, ev)
+		switch m.evaluate(virgin) {
+		case Positive:
+			if m.open(virgin) {
+				candidates = append(candidates, candidate{evs: virgin, matched: true, first: m.fed, last: m.fed})
+			} else {
+				matches = append(matches, virgin)
+			}
+		case Uncertain:
+			candidates = append(candidates, candidate{evs: virgin, first: m.fed, last: m.fed})
+		}
+		m.set(key, candidates)
+		if limit := m.q.maxCandidates; limit > 0 && m.candidates > limit {
+			matches = append(matches, m.evict(m.candidates-limit)...)
+		}
+	}
+	m.record(matches)
+	return matches
+}
+
+// record adds completed matches to the histories of the query's recent values, if it has any
+func (m *matcher) record(matches []domain.CapturedEvents) {
+	for _, v := range m.recent {
+		for _, match := range matches {
+			v.record(match)
+		}
+	}
+}
+
+// evict discards the n oldest candidates (see Query.SetMaxCandidates), returning those which had matched. Events are
+// processed in the order they occurred, so each partition's candidates are in the order their first events did, and
+// the oldest are found at the heads of the partitions without ranking the rest.
+func (m *matcher) evict(n int) []domain.CapturedEvents {
+	heads := make(partitionHeads, 0, len(m.partitions))
+	for key, candidates := range m.partitions {
+		heads = append(heads, partitionHead{key: key, start: candidateStart(candidates[0])})
+	}
+	heap.Init(&heads)
+
+	var matches []domain.CapturedEvents
+	for remaining := n; remaining > 0 && len(heads) > 0; {
+		// Those which are as old as each other (in any partition) go together, fewest captured events first
+		type ranked struct {
+			key  interface{}
+			i    int
+			size int
+		}
+		var group []ranked
+		prefixes := make(map[interface{}]int)
+		for start := heads[0].start; len(heads) > 0 && heads[0].start.Equal(start); {
+			key := heap.Pop(&heads).(partitionHead).key
+			for i, c := range m.partitions[key] {
+				if !candidateStart(c).Equal(start) {
+					break
+				}
+				group = append(group, ranked{key: key, i: i, size: capturedCount(c.evs)})
+				prefixes[key]++
+			}
+		}
+		sort.SliceStable(group, func(i, j int) bool { return group[i].size < group[j].size })
+		if len(group) > remaining {
+			group = group[:remaining]
+		}
+		remaining -= len(group)
+
+		evicted := make(map[interface{}]map[int]bool, len(prefixes))
+		for _, r := range group {
+			if evicted[r.key] == nil {
+				evicted[r.key] = make(map[int]bool)
+			}
+			evicted[r.key][r.i] = true
+			c := m.partitions[r.key][r.i]
+			if c.matched {
+				matches = append(matches, c.evs)
+			} else if m.onEvict != nil {
+				m.onEvict(c.evs)
+			}
+		}
+		// Only the heads of the partitions change: those which are kept move up to the rest
+		for key, prefix := range prefixes {
+			existing, kept := m.partitions[key], prefix
+			for i := prefix - 1; i >= 0; i-- {
+				if c := existing[i]; !evicted[key][i] {
+					kept--
+					existing[kept] = c
+				}
+			}
+			for i := 0; i < kept; i++ {
+				existing[i] = candidate{} // Don't retain what was evicted
+			}
+			m.set(key, existing[kept:])
+			if candidates := m.partitions[key]; len(candidates) > 0 {
+				heap.Push(&heads, partitionHead{key: key, start: candidateStart(candidates[0])})
+			}
+		}
+	}
+	logger.Debugf("[sase:matcher] Evicted %d candidates at the limit of %d", n, m.q.maxCandidates)
+	return matches
+}
+
+// candidateStart returns when a candidate's first event occurred
+func candidateStart(c candidate) time.Time {
+	start, _ := captureSpan(c.evs)
+	return start
+}
+
+// A partitionHead is a partition, by when the first of its candidates started (see evict)
+type partitionHead struct {
+	key   interface{}
+	start time.Time
+}
+
+// partitionHeads is a heap of partitions, the one whose first candidate is the oldest first
+type partitionHeads []partitionHead
+
+func (h partitionHeads) Len() int           { return len(h) }
+func (h partitionHeads) Less(i, j int) bool { return h[i].start.Before(h[j].start) }
+func (h partitionHeads) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *partitionHeads) Push(x interface{}) {
+	*h = append(*h, x.(partitionHead))
+}
+
+func (h *partitionHeads) Pop() interface{} {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return head
+}
+
+// capturedCount returns the number of events captured, counting each of those in a Kleene closure
+func capturedCount(evs domain.CapturedEvents) int {
+	n := 0
+	for _, ev := range evs {
+		if list, ok := ev.(domain.EventList); ok {
+			n += len(list)
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// setOnEvict sets the function called with each candidate dropped by evict, for this matcher and its alternatives
+func (m *matcher) setOnEvict(f func(domain.CapturedEvents)) {
+	m.onEvict = f
+	for _, alt := range m.alternatives {
+		alt.setOnEvict(f)
+	}
+}
+
+// flush processes any events still awaiting late arrivals and returns the matches which are being held open by greedy
+// closures, as at the end of the stream, then discards all candidates
+func (m *matcher) flush() []domain.CapturedEvents {
+	var matches []domain.CapturedEvents
+	for _, alt := range m.alternatives {
+		matches = append(matches, alt.flush()...)
+	}
+	for _, ev := range m.pending {
+		matches = append(matches, m.process(ev)...)
+	}
+	m.release(len(m.pending))
+	var held []domain.CapturedEvents
+	for _, candidates := range m.partitions {
+		for _, c := range candidates {
+			if c.matched {
+				held = append(held, c.evs)
+			}
+		}
+	}
+	m.record(held)
+	matches = append(matches, held...)
+	m.partitions = make(map[interface{}][]candidate)
+	m.candidates = 0
+	return matches
+}
+
+// open reports whether a matching candidate may still be extended by a greedy closure: one which has captured the
+// latest of its events
+func (m *matcher) open(evs domain.CapturedEvents) bool {
+	_, latest := captureSpan(evs)
+	for alias, greedy := range m.closures {
+		if ev, ok := evs[alias]; ok && greedy && !ev.When().Before(latest) {
+			return true
+		}
+	}
+	return false
+}
+
+// set replaces the candidates of a partition, forgetting it entirely if it has none
+func (m *matcher) set(key interface{}, candidates []candidate) {
+	m.candidates += len(candidates) - len(m.partitions[key])
+	if len(candidates) == 0 {
+		delete(m.partitions, key)
+	} else {
+		m.partitions[key] = candidates
+	}
+}
+
+// expire discards any candidates in a partition whose window has elapsed by now, returning those which had matched. A
+// window count has elapsed once the event being processed is too far from the candidate's first to be captured with it.
+func (m *matcher) expire(key interface{}, now time.Time) []domain.CapturedEvents {
+	var (
+		matches    []domain.CapturedEvents
+		existing   = m.partitions[key]
+		candidates = existing[:0]
+		count      = m.q.windowCount
+	)
+	for _, c := range existing {
+		if !m.q.Expired(c.evs, now) && (count == 0 || m.fed-c.first < count) {
+			candidates = append(candidates, c)
+		} else if c.matched {
+			matches = append(matches, c.evs)
+		}
+	}
+	for i := len(candidates); i < len(existing); i++ {
+		existing[i] = candidate{} // Don't retain what was discarded
+	}
+	m.set(key, candidates)
+	return matches
+}
+
+// size returns the number of candidates across all partitions
+func (m *matcher) size() int {
+	n := 0
+	for _, alt := range m.alternatives {
+		n += alt.size()
+	}
+	return n + m.candidates
+}
+
+// partitionBucket returns a map key for a partition key. Values which can't be map keys (eg. slices) are keyed by their
+// representation instead.
+func partitionBucket(key interface{}) interface{} {
+	if key == nil || reflect.TypeOf(key).Comparable() {
+		return key
+	}
+	return fmt.Sprintf("%T %#v", key, key)
+}
+
+// start returns a new candidate with just the event captured under alias
+func (m *matcher) start(alias string, ev domain.Event) domain.CapturedEvents {
+	if _, ok := m.closures[alias]; ok {
+		return domain.CapturedEvents{alias: domain.EventList{ev}}
+	}
+	return domain.CapturedEvents{alias: ev}
+}
+
+// extend returns a copy of the candidate with the event captured under alias (appended to the list, if the alias is a
+// Kleene closure). ok is false if the event can't be captured under the alias, or is captured already (under another
+// alias), which it is if the candidate's latest event is the one being processed.
+func (m *matcher) extend(c candidate, alias string, ev domain.Event) (domain.CapturedEvents, bool) {
+	_, closure := m.closures[alias]
+	if _, ok := c.evs[alias]; (ok && !closure) || c.last == m.fed {
+		return nil, false
+	}
+
+	extended := make(domain.CapturedEvents, len(c.evs)+1)
+	for k, v := range c.evs {
+		extended[k] = v
+	}
+	if closure {
+		list, _ := c.evs[alias].(domain.EventList)
+		extended[alias] = append(list[:len(list):len(list)], ev) // Copied, as other candidates may share the list
+	} else {
+		extended[alias] = ev
+	}
+	return extended, true
+}
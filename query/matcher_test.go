@@ -0,0 +1,632 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// tStream builds a stream of events, one second apart, from specs like "A1 x=5" (type A, id A1, attribute x=5)
+func tStream(specs ...string) []domain.Event {
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	result := make([]domain.Event, len(specs))
+	for i, spec := range specs {
+		fields := strings.Fields(spec)
+		attrs := map[string]interface{}{"id": fields[0]}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			var num float64
+			if _, err := fmt.Sscan(kv[1], &num); err == nil {
+				attrs[kv[0]] = num
+			} else {
+				attrs[kv[0]] = kv[1]
+			}
+		}
+		result[i] = &tEventImpl{typ: fields[0][:1], attrs: attrs, ts: start.Add(time.Duration(i) * time.Second)}
+	}
+	return result
+}
+
+// tMatches feeds the stream through a matcher, describing each match as eg. "a=A1 b=B2"
+func tMatches(t *testing.T, queryText string, strategy SelectionStrategy, stream []domain.Event) []string {
+	q, err := Parse(queryText)
+	require.NoError(t, err, queryText)
+	q.SetStrategy(strategy)
+	m := newMatcher(q)
+
+	var matches []domain.CapturedEvents
+	for _, ev := range stream {
+		matches = append(matches, m.feed(ev)...)
+	}
+	matches = append(matches, m.flush()...)
+
+	var result []string
+	for _, match := range matches {
+		result = append(result, tDescribeMatch(match))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// tDescribeMatch describes a match by the ids of its events, eg. "a=A1 b=B1,B2"
+func tDescribeMatch(match domain.CapturedEvents) string {
+	parts := make([]string, 0, len(match))
+	for alias, ev := range match {
+		if list, ok := ev.(domain.EventList); ok {
+			ids := make([]string, len(list))
+			for i, ev := range list {
+				ids[i] = fmt.Sprint(ev.Attributes()["id"])
+			}
+			parts = append(parts, alias+"="+strings.Join(ids, ","))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s=%v", alias, ev.Attributes()["id"]))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+func TestMatcher(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, B+ b[]) WHERE b[i].x > a.x WITHIN 10s")
+	require.NoError(t, err)
+	stream := tStream("A1 x=1", "B1 x=2", "B2 x=3", "A2 x=5", "B3 x=6")
+
+	m := NewMatcher(q)
+	var matches []string
+	for _, ev := range stream {
+		for _, match := range m.Feed(ev) {
+			matches = append(matches, tDescribeMatch(match))
+		}
+	}
+	require.Len(t, matches, 0) // The greedy closure holds its match open
+	require.True(t, m.Candidates() > 0)
+	for _, match := range m.Flush() {
+		matches = append(matches, tDescribeMatch(match))
+	}
+	sort.Strings(matches)
+	require.Equal(t, []string{"a=A1 b=B1,B2,B3", "a=A2 b=B3"}, matches)
+	require.Equal(t, 0, m.Candidates())
+
+	// Matches may be received from a channel instead
+	m = NewMatcher(q)
+	ch := m.Matches()
+	require.True(t, ch == m.Matches())
+	received := make(chan []string)
+	go func() {
+		var matches []string
+		for match := range ch {
+			matches = append(matches, tDescribeMatch(match))
+		}
+		sort.Strings(matches)
+		received <- matches
+	}()
+	for _, ev := range stream {
+		require.Len(t, m.Feed(ev), 0)
+	}
+	require.Len(t, m.Close(), 0)
+	require.Equal(t, []string{"a=A1 b=B1,B2,B3", "a=A2 b=B3"}, <-received)
+}
+
+func TestMatcherNegation(t *testing.T) {
+	// NOT of a comparison with an event not captured yet doesn't rule out the candidate which is waiting for it
+	for _, strategy := range []SelectionStrategy{SkipTillNextMatch, SkipTillAnyMatch} {
+		stream := tStream("A1 x=1", "B1 x=2")
+		require.Equal(t, []string{"a=A1 b=B1"}, tMatches(t, "EVENT SEQ(A a, B b) WHERE NOT (a.x > b.x)", strategy, stream))
+		require.Equal(t, []string{"a=A1 b=B1"}, tMatches(t, "EVENT SEQ(A a, B b) WHERE a.x <= b.x", strategy, stream))
+		require.Len(t, tMatches(t, "EVENT SEQ(A a, B b) WHERE NOT (a.x < b.x)", strategy, stream), 0)
+
+		// nor with a negated event, which may never be
+		query := "EVENT SEQ(A a, !(C c), B b) WHERE NOT (c.x != a.x)"
+		require.Equal(t, []string{"a=A1 b=B1"}, tMatches(t, query, strategy, stream))
+		require.Equal(t, []string{"a=A1 b=B1"}, tMatches(t, query, strategy, tStream("A1 x=1", "C1 x=2", "B1")))
+		require.Len(t, tMatches(t, query, strategy, tStream("A1 x=1", "C1 x=1", "B1")), 0)
+	}
+}
+
+func TestMatcherMissingAttributes(t *testing.T) {
+	// An event without a part of an attribute's path doesn't match a comparison with it, as it won't gain the attribute
+	stream := tStream("A1", "A2", "A3")
+	stream[1].(*tEventImpl).attrs["customer"] = nil
+	stream[2].(*tEventImpl).attrs["customer"] = map[string]interface{}{"id": "c1", "spend": 150.0}
+	for _, where := range []string{`a.customer.id == "c1"`, "a.customer.spend > 100", `NOT (a.customer.id != "c1")`} {
+		require.Equal(t, []string{"a=A3"}, tMatches(t, "EVENT A a WHERE "+where, SkipTillNextMatch, stream), where)
+	}
+
+	// and likewise without a key or index of a subscript
+	stream[0].(*tEventImpl).attrs["tags"] = map[string]interface{}{"region": "eu"}
+	stream[0].(*tEventImpl).attrs["items"] = []interface{}{1.0}
+	stream[1].(*tEventImpl).attrs["tags"] = map[string]interface{}{"env": "prod"}
+	stream[1].(*tEventImpl).attrs["items"] = []interface{}{1.0, 2.0, 3.0, 1.0}
+	for _, where := range []string{`a.tags["env"] == "prod"`, "a.items[3] == 1"} {
+		require.Equal(t, []string{"a=A2"}, tMatches(t, "EVENT A a WHERE "+where, SkipTillNextMatch, stream), where)
+	}
+}
+
+func TestMatcherValueEvents(t *testing.T) {
+	// Events needn't be comparable, but are still captured only once
+	stream := tValues(tStream("A1 x=1", "A2 x=2", "A3 x=3"))
+	require.Equal(t, []string{"a=A1 b=A2", "a=A2 b=A3"}, tMatches(t, "EVENT SEQ(A a, A b) WHERE a.x + 1 == b.x",
+		SkipTillNextMatch, stream))
+	require.Equal(t, []string{"a=A1 b=A2,A3", "a=A2 b=A3"}, tMatches(t, "EVENT SEQ(A a, A+ b[]) WHERE b[i].x > a.x",
+		SkipTillNextMatch, stream))
+	require.Empty(t, tMatches(t, "EVENT SEQ(A a, A b) WHERE a.x == b.x", SkipTillAnyMatch, stream))
+}
+
+func TestSelectionStrategies(t *testing.T) {
+	cases := []struct {
+		query       string
+		stream      []domain.Event
+		nextMatch   []string
+		anyMatch    []string
+		description string
+	}{
+		{
+			query:       "EVENT SEQ(A a, B b)",
+			stream:      tStream("A1", "B1", "B2"),
+			nextMatch:   []string{"a=A1 b=B1"},
+			anyMatch:    []string{"a=A1 b=B1", "a=A1 b=B2"},
+			description: "a candidate can be extended by more than one event",
+		},
+		{
+			query:       "EVENT SEQ(A a, B b)",
+			stream:      tStream("A1", "C1", "A2", "B1"),
+			nextMatch:   []string{"a=A1 b=B1", "a=A2 b=B1"},
+			anyMatch:    []string{"a=A1 b=B1", "a=A2 b=B1"},
+			description: "irrelevant events are skipped",
+		},
+		{
+			query:       "EVENT SEQ(A a, B b) WHERE b.x > a.x",
+			stream:      tStream("A1 x=5", "B1 x=1", "B2 x=6", "B3 x=7"),
+			nextMatch:   []string{"a=A1 b=B2"},
+			anyMatch:    []string{"a=A1 b=B2", "a=A1 b=B3"},
+			description: "events which don't satisfy the predicate are irrelevant",
+		},
+		{
+			query:     "EVENT SEQ(A a, B b, C c)",
+			stream:    tStream("A1", "B1", "B2", "C1", "C2"),
+			nextMatch: []string{"a=A1 b=B1 c=C1"},
+			anyMatch: []string{
+				"a=A1 b=B1 c=C1", "a=A1 b=B1 c=C2", "a=A1 b=B2 c=C1", "a=A1 b=B2 c=C2",
+			},
+			description: "matches overlap under skip-till-any-match",
+		},
+		{
+			query:       "EVENT SEQ(A a, !(B b), C c)",
+			stream:      tStream("A1", "C1", "B1", "C2", "A2", "C3"),
+			nextMatch:   []string{"a=A1 c=C1", "a=A2 c=C3"},
+			anyMatch:    []string{"a=A1 c=C1", "a=A2 c=C3"},
+			description: "a negated event rules out any candidate it follows",
+		},
+		{
+			query:       "EVENT SEQ(A a, B b) WITHIN 1s",
+			stream:      tStream("A1", "A2", "A3", "B1"),
+			nextMatch:   []string{"a=A3 b=B1"},
+			anyMatch:    []string{"a=A3 b=B1"},
+			description: "candidates outside the window are discarded",
+		},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.nextMatch, tMatches(t, c.query, SkipTillNextMatch, c.stream), c.description)
+		require.Equal(t, c.anyMatch, tMatches(t, c.query, SkipTillAnyMatch, c.stream), c.description)
+	}
+}
+
+func TestMatcherExpiry(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, B b) WITHIN 2s")
+	require.NoError(t, err)
+	m := newMatcher(q)
+	for _, ev := range tStream("A1", "A2", "A3", "A4", "A5") {
+		m.feed(ev)
+	}
+	require.Equal(t, 3, m.size()) // A1 and A2 are more than 2s before A5
+
+	require.Equal(t, SkipTillNextMatch, q.Strategy())
+	require.Equal(t, "skip-till-any-match", SkipTillAnyMatch.String())
+}
+
+func TestWindowCount(t *testing.T) {
+	cases := []struct {
+		query    string
+		stream   []string
+		expected []string
+	}{
+		// The first and last events of a match count towards the window, as do those of other types in between
+		{"EVENT SEQ(A a, B b) WITHIN 3 EVENTS", []string{"A1", "C1", "B1", "A2", "C2", "C3", "B2"},
+			[]string{"a=A1 b=B1"}},
+		{"EVENT SEQ(A a, B b) WITHIN 2 EVENTS", []string{"A1", "C1", "B1", "A2", "B2"}, []string{"a=A2 b=B2"}},
+		// A candidate is discarded once it exceeds either window
+		{"EVENT SEQ(A a, B b) WITHIN 10s AND 2 EVENTS", []string{"A1", "C1", "B1"}, nil},
+		{"EVENT SEQ(A a, B b) WITHIN 10s AND 3 EVENTS", []string{"A1", "C1", "B1"}, []string{"a=A1 b=B1"}},
+		{"EVENT SEQ(A a, B b) WITHIN 1s AND 3 EVENTS", []string{"A1", "C1", "B1"}, nil},
+		// A match held open by a greedy closure is reported once it can't be extended within the window
+		{"EVENT SEQ(A a, B+ b[]) WITHIN 3 EVENTS", []string{"A1", "B1", "B2", "B3"}, []string{"a=A1 b=B1,B2"}},
+		// Events of other partitions count too
+		{"EVENT SEQ(A a, B b) PARTITION BY g WITHIN 2 EVENTS", []string{"A1 g=1", "A2 g=2", "B1 g=1"}, nil},
+		{"EVENT SEQ(A a, B b) PARTITION BY g WITHIN 3 EVENTS", []string{"A1 g=1", "A2 g=2", "B1 g=1"},
+			[]string{"a=A1 b=B1"}},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.expected, tMatches(t, c.query, SkipTillNextMatch, tStream(c.stream...)), c.query)
+	}
+
+	// Captured events don't record their positions, so evaluating them doesn't consider it
+	q, err := Parse("EVENT SEQ(A a, B b) WITHIN 1 EVENT")
+	require.NoError(t, err)
+	stream := tStream("A1", "C1", "B1")
+	require.Equal(t, Positive, q.Evaluate(domain.CapturedEvents{"a": stream[0], "b": stream[2]}))
+
+	// Candidates keep their positions in a snapshot
+	q, err = Parse("EVENT SEQ(A a, B b) WITHIN 3 EVENTS")
+	require.NoError(t, err)
+	m := NewMatcher(q)
+	require.Empty(t, m.Feed(stream[0]))
+	require.Empty(t, m.Feed(stream[1]))
+	snapshot, err := m.Snapshot()
+	require.NoError(t, err)
+	m, err = RestoreMatcher(q, snapshot)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a=A1 b=B1"}, tMatchDescriptions(m.Feed(stream[2])))
+}
+
+func TestMaxCandidates(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, B b, C c)")
+	require.NoError(t, err)
+	q.SetStrategy(SkipTillAnyMatch)
+	q.SetMaxCandidates(50)
+	require.Equal(t, 50, q.MaxCandidates())
+	require.Panics(t, func() { q.SetMaxCandidates(-1) })
+
+	// Every A starts a candidate, and every B extends every one (leaving it too), so without a limit there would be
+	// over a hundred thousand candidates by the end
+	specs := make([]string, 0, 1000)
+	for i := 0; i < 500; i++ {
+		specs = append(specs, fmt.Sprintf("A%d", i), fmt.Sprintf("B%d", i))
+	}
+	m := NewMatcher(q)
+	evicted := 0
+	m.OnEvict(func(domain.CapturedEvents) { evicted++ })
+	for _, ev := range tStream(specs...) {
+		require.Len(t, m.Feed(ev), 0)
+		require.True(t, m.Candidates() <= 50, "%d candidates", m.Candidates())
+	}
+	require.Equal(t, 50, m.Candidates())
+	require.True(t, evicted > 1000, "%d evicted", evicted)
+
+	// The oldest were evicted, so the newest candidates remain to match
+	matches := m.Feed(tStream(append(specs, "C1")...)[len(specs)])
+	require.True(t, len(matches) > 0)
+	for _, match := range matches {
+		require.True(t, strings.HasPrefix(match["a"].Attributes()["id"].(string), "A49"), tDescribeMatch(match))
+	}
+
+	// Candidates which have matched (and are only held open by a greedy closure) are reported when they are evicted,
+	// rather than dropped
+	q, err = Parse("EVENT SEQ(A a, B+ b[])")
+	require.NoError(t, err)
+	q.SetMaxCandidates(1)
+	m = NewMatcher(q)
+	var dropped, reported []string
+	m.OnEvict(func(evs domain.CapturedEvents) { dropped = append(dropped, tDescribeMatch(evs)) })
+	for _, ev := range tStream("A1", "B1", "A2", "B2") {
+		for _, match := range m.Feed(ev) {
+			reported = append(reported, tDescribeMatch(match))
+		}
+	}
+	require.Equal(t, 1, m.Candidates())
+	for _, match := range m.Flush() {
+		reported = append(reported, tDescribeMatch(match))
+	}
+	require.Equal(t, []string{"b=B1"}, dropped)
+	require.Equal(t, []string{"a=A1 b=B1", "a=A2 b=B2"}, reported)
+
+	// The oldest are evicted whichever partitions they are in
+	q, err = Parse("EVENT SEQ(A a, B b, C c) PARTITION BY sym")
+	require.NoError(t, err)
+	q.SetStrategy(SkipTillAnyMatch)
+	q.SetMaxCandidates(3)
+	m = NewMatcher(q)
+	dropped = nil
+	m.OnEvict(func(evs domain.CapturedEvents) { dropped = append(dropped, tDescribeMatch(evs)) })
+	for _, ev := range tStream("A1 sym=x", "A2 sym=y", "B1 sym=x", "A3 sym=y", "B2 sym=y") {
+		require.Len(t, m.Feed(ev), 0)
+	}
+	require.Equal(t, 3, m.Candidates())
+	require.Equal(t, []string{"a=A1", "a=A1 b=B1", "a=A2", "a=A2 b=B2", "b=B1"}, dropped)
+}
+
+func TestPartitionBy(t *testing.T) {
+	stream := tStream("A1 sym=GOOG", "A2 sym=AAPL", "B1 sym=AAPL", "B2 sym=GOOG", "B3", "B4 sym=MSFT", "A3 sym=1",
+		"B5 sym=1")
+	for _, strategy := range []SelectionStrategy{SkipTillNextMatch, SkipTillAnyMatch} {
+		require.Equal(t, []string{"a=A1 b=B2", "a=A2 b=B1", "a=A3 b=B5"},
+			tMatches(t, "EVENT SEQ(A a, B b) PARTITION BY sym", strategy, stream))
+		// The same as an equivalence test, but without ever forming candidates across partitions
+		require.Equal(t, []string{"a=A1 b=B2", "a=A2 b=B1", "a=A3 b=B5"},
+			tMatches(t, "EVENT SEQ(A a, B b) WHERE [sym]", SkipTillAnyMatch, stream))
+	}
+
+	q, err := Parse("EVENT SEQ(A a, B b) PARTITION BY m.sym")
+	require.NoError(t, err)
+	require.Equal(t, "m.sym", q.Partition())
+	require.Equal(t, "EVENT SEQ(A a, B b) PARTITION BY m.sym", q.QueryText())
+	m := newMatcher(q)
+	for _, ev := range tStream("A1", "A2", "A3") {
+		ev.Attributes()["m"] = map[string]interface{}{"sym": ev.Attributes()["id"]}
+		m.feed(ev)
+	}
+	require.Len(t, m.partitions, 3)
+
+	// Evaluating directly (rather than through a matcher) respects partitions too
+	a := &tEventImpl{typ: "A", attrs: map[string]interface{}{"m": map[string]interface{}{"sym": 1}}}
+	b := &tEventImpl{typ: "B", attrs: map[string]interface{}{"m": map[string]interface{}{"sym": float64(1)}}}
+	require.Equal(t, Positive, q.Evaluate(domain.CapturedEvents{"a": a, "b": b}))
+	b.attrs["m"] = map[string]interface{}{"sym": 2}
+	require.Equal(t, Negative, q.Evaluate(domain.CapturedEvents{"a": a, "b": b}))
+	delete(b.attrs, "m")
+	require.Equal(t, Negative, q.Evaluate(domain.CapturedEvents{"a": a, "b": b}))
+	_, ok := q.PartitionKey(b)
+	require.False(t, ok)
+}
+
+func TestMatcherSchema(t *testing.T) {
+	stream := tStream("A1", "A2", "A3", "A4")
+	for i, price := range []interface{}{"5", 7.0, "lots", "9"} { // As if from a source which sends numbers as strings
+		stream[i].Attributes()["price"] = price
+	}
+	q, err := Parse("EVENT SEQ(A a, A b) WHERE b.price > a.price")
+	require.NoError(t, err)
+	q.SetSchema(Schema{"a.price": TypeNumber, "b.price": TypeNumber})
+	require.Equal(t, TypeNumber, q.Schema()["a.price"])
+
+	var matches []string
+	m := newMatcher(q)
+	for _, ev := range stream {
+		for _, match := range m.feed(ev) {
+			require.IsType(t, float64(0), match["b"].Attributes()["price"], "Matches hold the coerced values")
+			matches = append(matches, tDescribeMatch(match))
+		}
+	}
+	// A3 is rejected, and the others are compared as numbers (a string can't be ordered against 7)
+	require.Equal(t, []string{"a=A1 b=A2", "a=A2 b=A4"}, matches)
+}
+
+func TestAlternatives(t *testing.T) {
+	query := "EVENT SEQ(A a, B b) OR SEQ(A a, C c) WHERE a.x > 1 AND b.x > a.x AND (c.x < a.x OR b.x > 2)"
+	for _, strategy := range []SelectionStrategy{SkipTillNextMatch, SkipTillAnyMatch} {
+		// Each stream satisfies just one of the alternatives
+		require.Equal(t, []string{"a=A1 b=B1"}, tMatches(t, query, strategy, tStream("A1 x=2", "C1 x=3", "B1 x=3")))
+		require.Equal(t, []string{"a=A1 c=C1"}, tMatches(t, query, strategy, tStream("A1 x=2", "B1 x=1", "C1 x=1")))
+		require.Len(t, tMatches(t, query, strategy, tStream("A1 x=1", "B1 x=3", "C1 x=0")), 0)
+		require.Len(t, tMatches(t, query, strategy, tStream("C1 x=1", "B1 x=3", "A1 x=2")), 0)
+	}
+	// Both may be matched by the same events
+	require.Equal(t, []string{"a=A1 b=B1", "a=A1 c=C1"},
+		tMatches(t, query, SkipTillNextMatch, tStream("A1 x=2", "C1 x=1", "B1 x=3")))
+
+	// A negation applies only to its own alternative
+	query = "EVENT SEQ(A a, !(N n), B b) OR SEQ(A a, C c) WHERE n.x == a.x"
+	require.Equal(t, []string{"a=A1 c=C1"},
+		tMatches(t, query, SkipTillNextMatch, tStream("A1 x=1", "N1 x=1", "B1", "C1")))
+	require.Equal(t, []string{"a=A1 b=B1", "a=A1 c=C1"},
+		tMatches(t, query, SkipTillNextMatch, tStream("A1 x=1", "N1 x=2", "B1", "C1")))
+
+	q, err := Parse(query + " WITHIN 1m")
+	require.NoError(t, err)
+	require.Equal(t, "EVENT SEQ(A a, !(N n), B b) OR SEQ(A a, C c) WHERE n.x == a.x WITHIN 1m", q.QueryText())
+	require.Equal(t, map[string]string{"a": "A", "n": "N", "b": "B", "c": "C"}, q.Captures())
+	require.Equal(t, []string{"a"}, q.CaptureAliases(tStream("A1")[0]))
+
+	// Evaluating directly (rather than through a matcher) respects the alternatives too
+	stream := tStream("A1 x=1", "N1 x=2", "B1", "C1")
+	cases := []struct {
+		evs      domain.CapturedEvents
+		expected Result
+	}{
+		{domain.CapturedEvents{"a": stream[0]}, Uncertain},
+		{domain.CapturedEvents{"a": stream[0], "b": stream[2]}, Positive},
+		{domain.CapturedEvents{"a": stream[0], "c": stream[3]}, Positive},
+		{domain.CapturedEvents{"a": stream[0], "b": stream[2], "c": stream[3]}, Negative}, // No alternative has them all
+		{domain.CapturedEvents{"c": stream[3], "b": stream[2]}, Negative},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.expected, q.Evaluate(c.evs), tDescribeMatch(c.evs))
+		require.Equal(t, c.expected, q.Compile()(c.evs), tDescribeMatch(c.evs))
+	}
+
+	// Each alternative is held only to the conditions on its own events
+	q, err = Parse("EVENT SEQ(A a, B b) OR SEQ(A a, C c) OR A a WHERE a.x > 1 AND (b.x > 1 OR c.x > 1 OR a.y > 1) " +
+		"AND NOT b.z == 1")
+	require.NoError(t, err)
+	var predicates []string
+	for _, alt := range q.alternatives() {
+		predicates = append(predicates, alt.predicate.QueryText())
+	}
+	require.Equal(t, []string{
+		"(a.x > 1.000000 AND (b.x > 1.000000 OR a.y > 1.000000) AND NOT (b.z == 1.000000))",
+		"(a.x > 1.000000 AND (c.x > 1.000000 OR a.y > 1.000000))",
+		"(a.x > 1.000000 AND a.y > 1.000000)",
+	}, predicates)
+
+	// The alternatives are built once, and rebuilt as the query changes
+	q, err = Parse("EVENT SEQ(A a, B b) OR A a WHERE a.x > :min")
+	require.NoError(t, err)
+	alts := q.alternatives()
+	require.Len(t, alts, 2)
+	require.True(t, alts[0] == q.alternatives()[0])
+	q.SetStrategy(SkipTillAnyMatch)
+	q.SetMaxCandidates(10)
+	for _, alt := range q.alternatives() {
+		require.Equal(t, SkipTillAnyMatch, alt.Strategy())
+		require.Equal(t, 10, alt.MaxCandidates())
+	}
+	require.Equal(t, SkipTillNextMatch, alts[0].Strategy())
+	bound, err := q.Bind(map[string]interface{}{"min": 1})
+	require.NoError(t, err)
+	require.Equal(t, "a.x > :min", q.alternatives()[1].predicate.QueryText())
+	require.Equal(t, "a.x > 1.000000", bound.alternatives()[1].predicate.QueryText())
+	require.Equal(t, Negative, bound.Evaluate(domain.CapturedEvents{"a": tStream("A1 x=1")[0]}))
+	require.Equal(t, Positive, bound.Evaluate(domain.CapturedEvents{"a": tStream("A1 x=2")[0]}))
+}
+
+func TestUnorderedConjunction(t *testing.T) {
+	query := "EVENT AND(A a, B b, C c) WHERE a.x == b.x WITHIN 5s"
+	orders := [][]string{
+		{"A1 x=1", "B1 x=1", "C1"}, {"A1 x=1", "C1", "B1 x=1"}, {"B1 x=1", "A1 x=1", "C1"},
+		{"B1 x=1", "C1", "A1 x=1"}, {"C1", "A1 x=1", "B1 x=1"}, {"C1", "B1 x=1", "A1 x=1"},
+	}
+	for _, order := range orders {
+		for _, strategy := range []SelectionStrategy{SkipTillNextMatch, SkipTillAnyMatch} {
+			require.Equal(t, []string{"a=A1 b=B1 c=C1"}, tMatches(t, query, strategy, tStream(order...)), "%v", order)
+		}
+	}
+
+	// Events which are irrelevant (or unsatisfying) are skipped, and the predicate still applies
+	require.Equal(t, []string{"a=A1 b=B2 c=C1"},
+		tMatches(t, query, SkipTillAnyMatch, tStream("C1", "B1 x=2", "D1", "A1 x=1", "B2 x=1")))
+	require.Len(t, tMatches(t, query, SkipTillNextMatch, tStream("C1", "B1 x=2", "A1 x=1")), 0)
+
+	// The window bounds the whole set, whichever order its events are in
+	require.Len(t, tMatches(t, query, SkipTillAnyMatch, tStream("B1 x=1", "D1", "D2", "D3", "D4", "A1 x=1", "C1")),
+		0)
+	require.Equal(t, []string{"a=A1 b=B1 c=C1"}, tMatches(t, query, SkipTillAnyMatch,
+		tStream("B1 x=1", "D1", "D2", "D3", "C1", "A1 x=1")))
+
+	q, err := Parse(query)
+	require.NoError(t, err)
+	require.Equal(t, "EVENT AND(A a, B b, C c) WHERE a.x == b.x WITHIN 5s", q.QueryText())
+	stream := tStream("C1", "B1 x=1", "A1 x=1")
+	require.Equal(t, Uncertain, q.Evaluate(domain.CapturedEvents{"c": stream[0], "b": stream[1]}))
+	require.Equal(t, Positive, q.Evaluate(domain.CapturedEvents{"c": stream[0], "b": stream[1], "a": stream[2]}))
+}
+
+func TestKleeneClosure(t *testing.T) {
+	cases := []struct {
+		query       string
+		stream      []domain.Event
+		nextMatch   []string
+		anyMatch    []string
+		description string
+	}{
+		{
+			query:       "EVENT SEQ(A a, B+ b[], C c)",
+			stream:      tStream("A1", "B1", "D1", "B2", "C1", "B3"),
+			nextMatch:   []string{"a=A1 b=B1,B2 c=C1"},
+			anyMatch:    []string{"a=A1 b=B1 c=C1", "a=A1 b=B1,B2 c=C1", "a=A1 b=B2 c=C1"},
+			description: "consecutive events accumulate in the closure",
+		},
+		{
+			query:       "EVENT SEQ(A a, B+ b[], C c)",
+			stream:      tStream("A1", "C1", "B1"),
+			description: "a closure needs at least one event",
+		},
+		{
+			query:     "EVENT SEQ(A a, B+ b[], C c) WHERE b[i].x > b[i-1].x",
+			stream:    tStream("A1", "B1 x=1", "B2 x=3", "B3 x=2", "B4 x=4", "C1"),
+			nextMatch: []string{"a=A1 b=B1,B2,B4 c=C1"},
+			anyMatch: []string{
+				"a=A1 b=B1 c=C1", "a=A1 b=B1,B2 c=C1", "a=A1 b=B1,B2,B4 c=C1", "a=A1 b=B1,B3 c=C1",
+				"a=A1 b=B1,B3,B4 c=C1", "a=A1 b=B1,B4 c=C1", "a=A1 b=B2 c=C1", "a=A1 b=B2,B4 c=C1", "a=A1 b=B3 c=C1",
+				"a=A1 b=B3,B4 c=C1", "a=A1 b=B4 c=C1",
+			},
+			description: "each event is checked against the previous one as it is added",
+		},
+		{
+			query:       "EVENT SEQ(A a, B+ b[])",
+			stream:      tStream("A1", "B1", "C1", "B2"),
+			nextMatch:   []string{"a=A1 b=B1,B2"},
+			anyMatch:    []string{"a=A1 b=B1", "a=A1 b=B1,B2", "a=A1 b=B2"},
+			description: "a greedy closure captures as much as it can",
+		},
+		{
+			query:       "EVENT SEQ(A a, B+? b[])",
+			stream:      tStream("A1", "B1", "C1", "B2"),
+			nextMatch:   []string{"a=A1 b=B1"},
+			anyMatch:    []string{"a=A1 b=B1", "a=A1 b=B2"},
+			description: "a reluctant closure matches as soon as it can",
+		},
+		{
+			query:       "EVENT SEQ(A a, B+ b[]) WITHIN 2s",
+			stream:      tStream("A1", "B1", "B2", "B3", "A2", "B4"),
+			nextMatch:   []string{"a=A1 b=B1,B2", "a=A2 b=B4"},
+			anyMatch:    []string{"a=A1 b=B1", "a=A1 b=B1,B2", "a=A1 b=B2", "a=A2 b=B4"},
+			description: "a greedy closure is complete once the window elapses",
+		},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.nextMatch, tMatches(t, c.query, SkipTillNextMatch, c.stream), c.description)
+		require.Equal(t, c.anyMatch, tMatches(t, c.query, SkipTillAnyMatch, c.stream), c.description)
+	}
+
+	// Matches which are complete are reported as soon as they are, even if they were held open
+	q, err := Parse("EVENT SEQ(A a, B+ b[]) WITHIN 2s")
+	require.NoError(t, err)
+	m := newMatcher(q)
+	var reported []string
+	for _, ev := range tStream("A1", "B1", "B2", "C1", "C2") {
+		for _, match := range m.feed(ev) {
+			reported = append(reported, tDescribeMatch(match))
+		}
+	}
+	require.Equal(t, []string{"a=A1 b=B1,B2"}, reported)
+	require.Empty(t, m.flush())
+}
+
+func TestAllowedLateness(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, B b) WITHIN 2s")
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), q.AllowedLateness())
+	stream := tStream("A1", "B1", "A2", "C1", "C2", "B2")
+	disordered := []domain.Event{stream[1], stream[0], stream[3], stream[2], stream[5], stream[4]}
+
+	feed := func(m *matcher, evs []domain.Event) []string {
+		var result []string
+		for _, ev := range evs {
+			for _, match := range m.feed(ev) {
+				result = append(result, tDescribeMatch(match))
+			}
+		}
+		return result
+	}
+
+	// In order, any lateness finds the same matches
+	for _, lateness := range []time.Duration{0, time.Second, time.Minute} {
+		q.SetAllowedLateness(lateness)
+		m := newMatcher(q)
+		require.Equal(t, []string{"a=A1 b=B1"}, append(feed(m, stream), tMatchDescriptions(m.flush())...))
+	}
+
+	// Without allowing for lateness, events which arrive behind others are dropped
+	q.SetAllowedLateness(0)
+	m := newMatcher(q)
+	require.Empty(t, append(feed(m, disordered), tMatchDescriptions(m.flush())...))
+
+	// Allowing for it, they are reordered and matched by when they occurred, but matches are delayed until the lateness
+	// bound passes
+	q.SetAllowedLateness(time.Second)
+	m = newMatcher(q)
+	require.Empty(t, feed(m, disordered[:2]))
+	require.Equal(t, []string{"a=A1 b=B1"}, feed(m, disordered[2:5])) // A2 is not within 2s of B2
+	require.Len(t, m.pending, 1)                                      // B2 awaits anything up to 1s late
+	require.Empty(t, m.flush())
+	require.Empty(t, m.pending)
+
+	// Events later than the bound are still dropped
+	m = newMatcher(q)
+	require.Empty(t, feed(m, []domain.Event{stream[0], stream[3], stream[1], stream[5]}))
+	require.Empty(t, m.flush())
+	require.Equal(t, 0, m.size())
+}
+
+func tMatchDescriptions(matches []domain.CapturedEvents) []string {
+	var result []string
+	for _, match := range matches {
+		result = append(result, tDescribeMatch(match))
+	}
+	return result
+}
@@ -0,0 +1,57 @@
+package query
+
+import (
+	"context"
+	"time"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// An Observer is told about predicates as they are evaluated, eg. to count each one's results or time it with metrics.
+// It is told about each predicate evaluated through Evaluate or EvaluateErr (of a predicate or a Query), a compiled
+// function or BatchEvaluate, and about each of the operands of AND, OR and NOT within it, so it sees how selective each
+// condition is. Predicates are identified by themselves: QueryText describes one, but is worth remembering (eg. keyed
+// by the predicate) rather than rendering for every observation.
+//
+// Observers are called from whichever goroutine is evaluating, so must be safe for concurrent use; they should also be
+// quick, since evaluation waits for them.
+type Observer interface {
+	// ObserveEvaluation is called once a predicate has been evaluated, with its result (or the error which prevented
+	// it from being evaluated) and how long that took, including evaluating its operands
+	ObserveEvaluation(p Predicate, result Result, err error, d time.Duration)
+}
+
+// observer is told about evaluations; by default, there is none
+var observer Observer
+
+// SetObserver sets an Observer to be told about predicates as they are evaluated. A nil Observer (the default) stops
+// observation, which then costs nothing. Like SetLogger, this is not safe to call concurrently with evaluation, so
+// should be done during initialisation.
+func SetObserver(o Observer) {
+	observer = o
+}
+
+// evaluateObserved evaluates a predicate, telling the observer (if there is one) about it
+func evaluateObserved(ctx context.Context, p Predicate, evs domain.CapturedEvents) (Result, error) {
+	if observer == nil {
+		return p.EvaluateContext(ctx, evs)
+	}
+	start := time.Now()
+	result, err := p.EvaluateContext(ctx, evs)
+	observer.ObserveEvaluation(unwrapCondition(p), result, err, time.Since(start))
+	return result, err
+}
+
+// observeCompiled wraps a compiled predicate so the observer (if there is one when it is called) is told about it
+func observeCompiled(p Predicate, compiled compiledPredicate) compiledPredicate {
+	p = unwrapCondition(p)
+	return func(evs domain.CapturedEvents) (Result, error) {
+		if observer == nil {
+			return compiled(evs)
+		}
+		start := time.Now()
+		result, err := compiled(evs)
+		observer.ObserveEvaluation(p, result, err, time.Since(start))
+		return result, err
+	}
+}
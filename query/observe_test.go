@@ -0,0 +1,93 @@
+package query
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A tObserver records the evaluations it is told about, as eg. "a.x > 1.000000: Positive"
+type tObserver struct {
+	sync.Mutex
+	observed []string
+	errs     int
+}
+
+func (o *tObserver) ObserveEvaluation(p Predicate, result Result, err error, d time.Duration) {
+	o.Lock()
+	defer o.Unlock()
+	o.observed = append(o.observed, p.QueryText()+": "+result.String())
+	if err != nil {
+		o.errs++
+	}
+}
+
+func (o *tObserver) take() []string {
+	o.Lock()
+	defer o.Unlock()
+	result := o.observed
+	sort.Strings(result)
+	o.observed = nil
+	return result
+}
+
+func TestObserver(t *testing.T) {
+	o := &tObserver{}
+	SetObserver(o)
+	defer SetObserver(nil)
+
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE a.x > 1 AND (a.y == 2 OR NOT a.z == 3) AND a.x < b.x")
+	require.NoError(t, err)
+	evs := domain.CapturedEvents{"a": &tEventImpl{typ: "A", attrs: map[string]interface{}{"x": 2, "y": 1, "z": 4}}}
+	expected := []string{
+		"(a.x > 1.000000 AND (a.y == 2.000000 OR NOT (a.z == 3.000000)) AND a.x < b.x): Positive",
+		"(a.y == 2.000000 OR NOT (a.z == 3.000000)): Positive",
+		"a.x < b.x: Positive",
+		"a.x > 1.000000: Positive",
+		"a.y == 2.000000: Negative",
+		"a.z == 3.000000: Negative",
+		"NOT (a.z == 3.000000): Positive",
+	}
+	sort.Strings(expected)
+
+	require.Equal(t, Positive, q.predicate.Evaluate(evs))
+	require.Equal(t, expected, o.take())
+	_, err = q.predicate.EvaluateErr(evs)
+	require.NoError(t, err)
+	require.Equal(t, expected, o.take())
+	require.Equal(t, Uncertain, q.Evaluate(evs)) // b hasn't been captured yet
+	require.Equal(t, expected, o.take())
+	require.Equal(t, Positive, Compile(q.predicate)(evs), "Compiled predicates are observed in the same way")
+	require.Equal(t, expected, o.take())
+	BatchEvaluate([]Predicate{q.predicate}, evs)
+	require.Equal(t, expected, o.take())
+
+	// Conditions which aren't evaluated (because the result is known already) aren't observed
+	evs["a"].Attributes()["x"] = 0
+	require.Equal(t, Negative, Compile(q.predicate)(evs))
+	require.Equal(t, []string{
+		"(a.x > 1.000000 AND (a.y == 2.000000 OR NOT (a.z == 3.000000)) AND a.x < b.x): Negative",
+		"a.x > 1.000000: Negative",
+	}, o.take())
+
+	// Errors are observed too (by the comparison which fails, and the AND which it fails)
+	evs["a"].Attributes()["x"] = "two"
+	_, err = q.predicate.EvaluateErr(evs)
+	require.Error(t, err)
+	require.Equal(t, 2, o.errs)
+}
+
+func TestObserverAllocations(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE 1 < 2 AND NOT 'a' == 'b'")
+	require.NoError(t, err)
+	compiled := Compile(q.predicate)
+	evs := domain.CapturedEvents{}
+	require.Equal(t, 0.0, testing.AllocsPerRun(100, func() {
+		compiled(evs)
+	}), "Observation costs nothing when there is no observer")
+}
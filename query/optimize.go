@@ -0,0 +1,270 @@
+package query
+
+import (
+	"context"
+	"time"
+)
+
+// Optimize returns a copy of p which is cheaper to evaluate, but gives the same results (including errors) for any
+// events:
+//
+//   - values which don't refer to any events are computed in advance (eg. "10 * 60" becomes "600"), as are conditions
+//     which don't (so "(1 > 2 ? a.x : b.x)" becomes "b.x")
+//   - operands of AND and OR which can't change the result are removed: those which always hold from AND, those which
+//     never do from OR, repeated operands, and any which follow one which settles the result. Nested ANDs (or ORs) are
+//     flattened into one.
+//
+// Note that "p AND NOT p" is not always Negative (nor "p OR NOT p" Positive): both are Uncertain until p's events are
+// captured, so they are left as they are. So is "NOT NOT p", which is Uncertain while p's events are missing even when
+// p is Positive (see negationPredicate).
+func Optimize(p Predicate) Predicate {
+	if p == nil {
+		return nil
+	}
+	return optimizer{context.Background()}.predicate(unwrapCondition(p))
+}
+
+// Optimize optimises the query's predicate (see Optimize). Conditions which don't refer to any events are settled
+// using the query's comparators, if it has any.
+func (q *Query) Optimize() {
+	if q.predicate != nil {
+		q.predicate = optimizer{withComparators(context.Background(), q.comparators)}.predicate(q.predicate)
+		q.updateAlternatives()
+	}
+}
+
+// An optimizer rebuilds predicates and values with their constant parts computed in advance. Its context carries
+// whatever constant conditions must be evaluated with (eg. comparators).
+type optimizer struct {
+	ctx context.Context
+}
+
+func (o optimizer) value(v value) value {
+	switch v := v.(type) {
+	case nil, literalValue, durationLiteralValue:
+		return v
+
+	case *arithmeticValue:
+		v = &arithmeticValue{left: o.value(v.left), right: o.value(v.right), op: v.op}
+		return o.fold(v)
+
+	case *indexLookup:
+		result := *v
+		result.index = o.value(v.index)
+		return &result
+
+	case *subscriptLookup:
+		return o.fold(&subscriptLookup{operand: o.value(v.operand), key: o.value(v.key), path: v.path})
+
+	case *aggregateValue:
+		return &aggregateValue{fn: v.fn, operand: o.value(v.operand)}
+
+	case *recentValue: // Its operand is resolved against earlier matches, so may be optimised as any other
+		return &recentValue{operand: o.value(v.operand), window: v.window, count: v.count}
+
+	case *functionValue: // Functions aren't computed in advance, as they may not always give the same result
+		return &functionValue{name: v.name, fn: v.fn, args: o.values(v.args)}
+
+	case coalesceValue:
+		return o.fold(coalesceValue(o.values(v)))
+
+	case listLiteralValue: // A list can't be a literal, but its members may be
+		return listLiteralValue(o.values(v))
+
+	case *castValue:
+		return o.fold(&castValue{to: v.to, operand: o.value(v.operand)})
+
+	case *bitwiseNotValue:
+		return o.fold(&bitwiseNotValue{o.value(v.operand)})
+
+	case *conditionalValue:
+		condition := o.predicate(unwrapCondition(v.condition))
+		then, otherwise := o.value(v.then), o.value(v.otherwise)
+		if r, ok := o.constant(condition); ok && r == Positive {
+			return then
+		} else if ok {
+			return otherwise
+		}
+		return &conditionalValue{condition: condition, then: then, otherwise: otherwise}
+	}
+	return v
+}
+
+func (o optimizer) values(vs []value) []value {
+	result := make([]value, len(vs))
+	for i, v := range vs {
+		result[i] = o.value(v)
+	}
+	return result
+}
+
+// fold replaces a value which doesn't refer to any events with a literal of what it resolves to, if it can be
+// represented as one (and doesn't fail to resolve)
+func (o optimizer) fold(v value) value {
+	if !isConstant(v) {
+		return v
+	}
+	resolved, err := resolve(o.ctx, v, nil)
+	if err != nil {
+		return v
+	}
+	switch resolved := resolved.(type) {
+	case float64, string, bool, nil:
+		return literalValue{resolved}
+	case time.Duration:
+		return durationLiteralValue(resolved)
+	case int64: // Eg. of integer division, kept as a literal only if a float64 holds it exactly
+		if resolved >= -1<<53 && resolved <= 1<<53 {
+			return literalValue{float64(resolved)}
+		}
+	}
+	return v
+}
+
+func (o optimizer) predicate(p Predicate) Predicate {
+	switch p := p.(type) {
+	case *operatorPredicate:
+		return o.settle(&operatorPredicate{left: o.value(p.left), right: o.value(p.right), op: p.op})
+
+	case *betweenPredicate:
+		return o.settle(&betweenPredicate{operand: o.value(p.operand), low: o.value(p.low), high: o.value(p.high)})
+
+	case *inPredicate:
+		return o.settle(&inPredicate{left: o.value(p.left), set: o.values(p.set)})
+
+	case *quantifiedPredicate:
+		return o.settle(&quantifiedPredicate{left: o.value(p.left), op: p.op, all: p.all, list: o.value(p.list)})
+
+	case *nullCheckPredicate:
+		return o.settle(&nullCheckPredicate{operand: o.value(p.operand), negated: p.negated})
+
+	case *regexPredicate:
+		return o.settle(&regexPredicate{left: o.value(p.left), pattern: p.pattern})
+
+	case *stringMatchPredicate:
+		return o.settle(&stringMatchPredicate{left: o.value(p.left), right: o.value(p.right), match: p.match})
+
+	case conjunction:
+		return o.conjunction(p)
+
+	case disjunction:
+		return o.disjunction(p)
+
+	case *negationPredicate:
+		inner := o.predicate(unwrapCondition(p.Predicate))
+		if r, ok := o.constant(inner); ok {
+			return constantPredicate(negate(r))
+		}
+		return &negationPredicate{inner}
+	}
+	return p
+}
+
+// conjunction optimises the operands of an AND. Operands which always hold make no difference to it; once one never
+// does, the result is Negative unless an earlier operand errors, so the rest are moot.
+func (o optimizer) conjunction(c conjunction) Predicate {
+	result := make(conjunction, 0, len(c))
+	for _, operand := range o.flatten(c, true) {
+		if r, ok := o.constant(operand); ok && r == Positive {
+			continue
+		} else if ok {
+			if len(result) == 0 {
+				return constantPredicate(Negative)
+			}
+			result = append(result, operand)
+			break
+		}
+		result = appendOperand(result, operand)
+	}
+	switch len(result) {
+	case 0:
+		return constantPredicate(Positive)
+	case 1:
+		return result[0]
+	default:
+		return result
+	}
+}
+
+// disjunction optimises the operands of an OR. Operands which never hold make no difference to it, and if any always
+// does, it is Positive whatever the others are (even if they error).
+func (o optimizer) disjunction(d disjunction) Predicate {
+	result := make(disjunction, 0, len(d))
+	for _, operand := range o.flatten(d, false) {
+		if r, ok := o.constant(operand); ok && r == Positive {
+			return constantPredicate(Positive)
+		} else if ok {
+			continue
+		}
+		result = appendOperand(result, operand)
+	}
+	switch len(result) {
+	case 0:
+		return constantPredicate(Negative)
+	case 1:
+		return result[0]
+	default:
+		return result
+	}
+}
+
+// flatten optimises the operands of an AND (or an OR), merging in the operands of any which are themselves ANDs (or
+// ORs)
+func (o optimizer) flatten(operands []Predicate, and bool) []Predicate {
+	result := make([]Predicate, 0, len(operands))
+	for _, operand := range operands {
+		switch operand := o.predicate(unwrapCondition(operand)).(type) {
+		case conjunction:
+			if and {
+				result = append(result, operand...)
+				continue
+			}
+			result = append(result, operand)
+		case disjunction:
+			if !and {
+				result = append(result, operand...)
+				continue
+			}
+			result = append(result, operand)
+		default:
+			result = append(result, operand)
+		}
+	}
+	return result
+}
+
+// appendOperand appends an operand to those of an AND or OR, unless it is already among them: evaluating it again
+// can only give the same result
+func appendOperand(operands []Predicate, p Predicate) []Predicate {
+	for _, operand := range operands {
+		if operand.Equal(p) {
+			return operands
+		}
+	}
+	return append(operands, p)
+}
+
+// settle replaces a predicate which doesn't refer to any events with one which always has the same result (see
+// constantPredicate), if it doesn't fail to evaluate
+func (o optimizer) settle(p Predicate) Predicate {
+	if r, ok := o.constant(p); ok {
+		return constantPredicate(r)
+	}
+	return p
+}
+
+// constant returns the result a predicate which doesn't refer to any events always has. ok is false if it does refer to
+// events, or can't be evaluated.
+func (o optimizer) constant(p Predicate) (result Result, ok bool) {
+	if p == nil || !isConstant(p) {
+		return 0, false
+	}
+	r, err := evaluateObserved(o.ctx, p, nil)
+	return r, err == nil && (r == Positive || r == Negative)
+}
+
+// constantPredicate returns a predicate whose result is always r (Positive or Negative): a comparison of true or false
+// with true
+func constantPredicate(r Result) Predicate {
+	return &operatorPredicate{left: literalValue{r == Positive}, right: literalValue{true}, op: opEq}
+}
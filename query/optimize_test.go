@@ -0,0 +1,71 @@
+package query
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptimize(t *testing.T) {
+	cases := map[string]string{
+		"a.x > 10 * 60":                                      "a.x > 600.000000",
+		"a.x > b.x * (2 + 3)":                                "a.x > b.x * 5.000000",
+		"a.d < 1m + 30s":                                     "a.d < 90.000000",
+		"a.s == coalesce(null, 'x')":                         `a.s == "x"`,
+		"a.x == (1 > 2 ? a.y : b.y + 0x10 - 16)":             "a.x == b.y + 16.000000 - 16.000000",
+		"a.flag == true AND a.flag == true":                  "a.flag == true",
+		"a.x > 1 AND 2 > 1":                                  "a.x > 1.000000",
+		"a.x > 1 OR 1 > 2":                                   "a.x > 1.000000",
+		"a.x > 1 OR 'x' == 'x'":                              "true == true",
+		"1 > 2 AND a.x > 1":                                  "false == true",
+		"a.x > 1 AND 1 > 2 AND a.y > 1":                      "(a.x > 1.000000 AND false == true)",
+		"NOT (NOT (a.x > 1))":                                "NOT (NOT (a.x > 1.000000))",
+		"NOT (1 IN (2, 3))":                                  "true == true",
+		"(a.x > 1 AND (a.y > 2 AND a.x > 1)) OR a.z == true": "((a.x > 1.000000 AND a.y > 2.000000) OR a.z == true)",
+		"a.x > 1 / 0":                                        "a.x > 1.000000 / 0.000000", // Left to fail as it would have
+		"a.x > :limit * 2":                                   "a.x > :limit * 2.000000",
+		"lower('FOO') == a.s":                                `lower("FOO") == a.s`,
+		"a.x BETWEEN 1 + 1 AND 2 * 2 AND a.x != b.x":         "(a.x BETWEEN 2.000000 AND 4.000000 AND a.x != b.x)",
+	}
+	for where, expected := range cases {
+		q, err := Parse("EVENT SEQ(A a, B b) WHERE " + where)
+		require.NoError(t, err, where)
+		require.Equal(t, expected, Optimize(q.predicate).QueryText(), where)
+	}
+	require.Nil(t, Optimize(nil))
+
+	// The optimised predicate is a copy
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE a.x > 10 * 60")
+	require.NoError(t, err)
+	optimized := Optimize(q.predicate)
+	require.Equal(t, "a.x > 10.000000 * 60.000000", q.predicate.QueryText())
+	q.Optimize()
+	require.True(t, optimized.Equal(q.predicate))
+
+	// A query's comparators settle its constant conditions
+	q, err = Parse("EVENT SEQ(A a, B b) WHERE a.x > 1 AND '1.10' > '1.9'")
+	require.NoError(t, err)
+	require.Equal(t, "(a.x > 1.000000 AND false == true)", Optimize(q.predicate).QueryText())
+	q.SetComparator(reflect.TypeOf(""), tCompareVersions)
+	q.Optimize()
+	require.Equal(t, "a.x > 1.000000", q.predicate.QueryText())
+}
+
+// An optimised predicate must give the same results as the original, whatever the events
+func TestOptimizeEquivalence(t *testing.T) {
+	g := tGenerator{rand.New(rand.NewSource(5))}
+	for i := 0; i < 2000; i++ {
+		p := g.predicate(3)
+		optimized := Optimize(p)
+		for j := 0; j < 3; j++ {
+			evs := g.events()
+			expected, expectedErr := p.EvaluateErr(evs)
+			r, err := optimized.EvaluateErr(evs)
+			require.Equal(t, expected, r, "%s\noptimised: %s", p.QueryText(), optimized.QueryText())
+			require.Equal(t, expectedErr != nil, err != nil, "%s\noptimised: %s", p.QueryText(),
+				optimized.QueryText())
+		}
+	}
+}
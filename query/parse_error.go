@@ -0,0 +1,100 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// A ParseError is a syntax error in a query, located at the offending token
+type ParseError struct {
+	Line   int    // 1-based
+	Column int    // 1-based, in characters (not bytes)
+	Msg    string // What was wrong
+	Token  string // The offending text, if there is any
+
+	offset int    // Byte offset of the error within the query
+	source string // The line of the query on which the error is, for rendering
+	err    error  // The underlying error, if there is one
+}
+
+// Error describes the error and underlines where it is, eg.
+//
+//	Error parsing ttWhereClause: Unbalanced parentheses (line 2, column 7)
+//	WHERE (a.x > 1
+//	      ^
+func (e *ParseError) Error() string {
+	if e.Line == 0 { // Not located within a query
+		return e.Msg
+	}
+
+	buf := new(strings.Builder)
+	fmt.Fprintf(buf, "%s (line %d, column %d)\n%s\n", e.Msg, e.Line, e.Column, e.source)
+	for i, r := range []rune(e.source) {
+		if i >= e.Column-1 {
+			break
+		} else if r == '\t' { // Keep the caret aligned
+			buf.WriteRune('\t')
+		} else {
+			buf.WriteRune(' ')
+		}
+	}
+	width := utf8.RuneCountInString(e.Token)
+	if rest := utf8.RuneCountInString(e.source) - (e.Column - 1); width > rest {
+		width = rest // The token continues onto the next line
+	}
+	if width < 1 {
+		width = 1
+	}
+	buf.WriteString(strings.Repeat("^", width))
+	return buf.String()
+}
+
+// errorAt returns a ParseError at the start of a token (which is located once the query is known; see locate)
+func errorAt(t *token, format string, args ...interface{}) *ParseError {
+	return &ParseError{
+		Msg:    fmt.Sprintf(format, args...),
+		Token:  t.content,
+		offset: t.pos,
+	}
+}
+
+// causedAt returns a ParseError at the start of a token, caused by another error
+func causedAt(t *token, err error) *ParseError {
+	perr := errorAt(t, "%s", err.Error())
+	perr.err = err
+	return perr
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.err
+}
+
+// wrapParseError prefixes the message of a ParseError with context, keeping its position. Other errors are wrapped as
+// usual.
+func wrapParseError(err error, prefix string) error {
+	var perr *ParseError
+	if errors.As(err, &perr) {
+		perr.Msg = prefix + ": " + perr.Msg
+		return perr
+	}
+	return fmt.Errorf("%s: %w", prefix, err)
+}
+
+// locate works out the line and column of the error within the query
+func (e *ParseError) locate(query string) {
+	if e.offset > len(query) {
+		e.offset = len(query)
+	}
+	lineStart := strings.LastIndexByte(query[:e.offset], '\n') + 1
+	lineEnd := strings.IndexByte(query[e.offset:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(query)
+	} else {
+		lineEnd += e.offset
+	}
+	e.Line = strings.Count(query[:lineStart], "\n") + 1
+	e.Column = utf8.RuneCountInString(query[lineStart:e.offset]) + 1
+	e.source = strings.TrimRight(query[lineStart:lineEnd], "\r")
+}
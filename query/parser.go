@@ -1,72 +1,39 @@
 package query
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	// log "github.com/cihub/seelog"
 )
 
-func visitToken(t *token) (*token, error) {
-	newChildren := make([]*token, 0, len(t.children))
-	skipNext := false
-
-	for i, child := range t.children {
-		if skipNext {
-			skipNext = false
-			continue
-		}
-
-		switch child.tt {
-		case ttConjunction, ttDisjunction, ttEq, ttNe, ttGt, ttLt, ttGe, ttLe:
-			if i > 0 && len(t.children) > i+1 {
-				child.children = append(child.children, newChildren[len(newChildren)-1], t.children[i+1])
-				newChildren = newChildren[:len(newChildren)-1]
-				skipNext = true
-			}
-		}
-
-		if newChild, err := visitToken(child); err != nil {
-			return nil, err
-		} else {
-			newChildren = append(newChildren, newChild)
-		}
-	}
-	t.children = newChildren
-	return t, nil
-}
-
 func postprocessTokens(tokens []*token) ([]*token, error) {
-	// This function is, honestly, cruft. Should be more efficient.
 	whereToken := &token{
 		tt:       ttWhereClause,
-		children: make([]*token, 0, 2),
+		children: make([]*token, 0, 3),
 	}
 	result := make([]*token, 0, len(tokens))
 
 	for _, t := range tokens {
 		switch t.tt {
-		// Crufty: find all root-level predicates and connectives, stick them inside a ttWhereClause token.
-		case ttPredicate, ttConjunction, ttDisjunction, ttEquivalenceTest:
-			whereToken.children = append(whereToken.children, t)
+		case ttEventClause, ttEventAlternative, ttPartitionClause, ttWithinClause:
+			result = append(result, t)
 
+		// The WHERE clause is tokenised as a flat stream of root-level tokens: stick them inside a ttWhereClause token
 		default:
-			result = append(result, t)
+			if len(whereToken.children) == 0 {
+				whereToken.pos = t.pos
+			}
+			whereToken.children = append(whereToken.children, t)
 		}
 	}
 
 	if len(whereToken.children) > 0 {
 		result = append(result, whereToken)
 	}
-
-	for i, t := range result {
-		if newToken, err := visitToken(t); err != nil {
-			return nil, err
-		} else {
-			result[i] = newToken
-		}
-	}
 	return result, nil
 }
 
@@ -84,7 +51,7 @@ func parseEventClauseToken(t *token) (EventCapture, error) {
 	}
 
 	switch t.tt {
-	case ttEventClause:
+	case ttEventClause, ttEventAlternative:
 		if len(t.children) > 0 {
 			return parseEventClauseToken(t.children[0])
 		} else {
@@ -92,10 +59,17 @@ func parseEventClauseToken(t *token) (EventCapture, error) {
 		}
 
 	case ttEventDecl:
-		// MUST have a type and an alias, in that order
+		// MUST have a type and an alias, in that order, optionally separated by a Kleene closure
+		if len(t.children) == 3 && t.children[1].tt == ttKleeneClosure {
+			return &kleeneEventCapture{
+				eventType: t.children[0].content,
+				name:      unquoteName(t.children[2].content),
+				reluctant: t.children[1].content == "+?",
+			}, nil
+		}
 		return &basicEventCapture{
 			eventType: t.children[0].content,
-			name:      t.children[1].content,
+			name:      unquoteName(t.children[1].content),
 		}, nil
 
 	case ttSeqDecl:
@@ -112,11 +86,20 @@ func parseEventClauseToken(t *token) (EventCapture, error) {
 			return anyEventCapture(childCaptures), nil
 		}
 
+	case ttAllDecl:
+		if childCaptures, err := parseChildren(); err != nil {
+			return nil, err
+		} else {
+			return allEventCapture(childCaptures), nil
+		}
+
 	case ttNegatedDecl:
 		if childCaptures, err := parseChildren(); err != nil {
 			return nil, err
 		} else if len(childCaptures) != 1 {
-			return nil, fmt.Errorf("Negated declaration may only have one child")
+			return nil, errorAt(t, "Negated declaration may only have one child")
+		} else if len(childCaptures[0].closures()) > 0 {
+			return nil, errorAt(t, "Kleene closures may not be negated")
 		} else {
 			return &negatedEventCapture{childCaptures[0]}, nil
 		}
@@ -129,127 +112,875 @@ func parseEventClauseToken(t *token) (EventCapture, error) {
 func parseValue(t *token) (value, error) {
 	switch t.tt {
 	case ttAttributeSelector:
-		return attributeLookup(t.content), nil
+		parts := splitPath(t.content)
+		if len(parts) == 2 && parts[1] == "LEN" && !isQuoted(t.content) {
+			return lengthValue(parts[0]), nil
+		} else if len(parts) == 2 && parts[1] == "TS" && !isQuoted(t.content) {
+			return timestampValue(parts[0]), nil
+		} else if len(parts) == 1 { // The whole event
+			return eventValue(parts[0]), nil
+		}
+		return newAttributeLookup(parts[0], parts[1:]), nil
 
 	case ttStringLiteral:
-		return literalValue{t.content}, nil
+		if val, err := unescapeString(t.content); err != nil {
+			return nil, err
+		} else {
+			return literalValue{val}, nil
+		}
+
+	case ttBooleanLiteral:
+		return literalValue{strings.EqualFold(t.content, "true")}, nil
+
+	case ttNull:
+		return literalValue{nil}, nil
+
+	case ttParameter:
+		return parameterValue(t.content), nil
+
+	case ttVariable:
+		return variableValue(t.content), nil
 
 	case ttNumericLiteral:
-		if val, err := strconv.ParseFloat(t.content, 32); err != nil {
+		if val, err := parseNumber(t.content); err != nil {
 			return nil, err
 		} else {
 			return literalValue{val}, nil
 		}
 
+	case ttDurationLiteral:
+		if val, err := parseDuration(t.content); err != nil {
+			return nil, err
+		} else {
+			return durationLiteralValue(val), nil
+		}
+
 	default:
 		return nil, fmt.Errorf("Unhandled token type: %s", t.tt.String())
 	}
 }
 
-func parseWhereClauseToken(t *token) (Predicate, error) {
-	parseChildren := func() ([]Predicate, error) {
-		results := make([]Predicate, 0, len(t.children))
-		for _, child := range t.children {
-			if r, err := parseWhereClauseToken(child); err != nil {
-				return nil, err
-			} else if r != nil {
-				results = append(results, r)
-			}
+// A predicateParser assembles the flat token stream of a WHERE clause into a predicate tree. AND binds more tightly
+// than OR, and parentheses may be used to group predicates.
+type predicateParser struct {
+	tokens   []*token
+	pos      int
+	furthest int       // Furthest position reached, which is where any error is (parsing may backtrack from it)
+	caret    caretMode // How a "^" after a value in the expression being parsed is read
+	xorAt    map[int]bool
+	aliases  []string // Those declared by the EVENT clause, against which unqualified attributes are resolved
+	required []string // Those the EVENT clause must capture to match, which equivalence tests are over
+}
+
+// "^" is both AND and bitwise XOR (which binds more tightly than comparisons). A caretMode is how it is read where it
+// follows a value.
+type caretMode uint8
+
+const (
+	caretXor    caretMode = iota // XOR, as a predicate can't end here (eg. before a comparison operator)
+	caretEither                  // AND if a predicate follows it (eg. "a.x > 1 ^ b.y < 2"), otherwise XOR
+	caretAnd                     // AND (it ends the low bound of a BETWEEN)
+)
+
+// xorAhead reports whether the "^" at the current position is XOR rather than AND (see caretMode)
+func (p *predicateParser) xorAhead() bool {
+	switch p.caret {
+	case caretAnd:
+		return false
+	case caretEither:
+		if xor, ok := p.xorAt[p.pos]; ok { // Each "^" may be looked past many times, but is only tried once
+			return xor
+		}
+		start, furthest := p.pos, p.furthest
+		p.pos++
+		_, err := p.parseTerm()
+		p.pos, p.furthest = start, furthest
+		if p.xorAt == nil {
+			p.xorAt = make(map[int]bool)
+		}
+		p.xorAt[start] = err != nil
+		return err != nil
+	default:
+		return true
+	}
+}
+
+// expressionWith parses an expression in which a "^" is read as mode says (see caretMode)
+func (p *predicateParser) expressionWith(mode caretMode) (value, error) {
+	defer func(prev caretMode) { p.caret = prev }(p.caret)
+	p.caret = mode
+	return p.parseExpression()
+}
+
+func (p *predicateParser) peek() *token {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *predicateParser) next() (*token, error) {
+	if t := p.peek(); t == nil {
+		return nil, fmt.Errorf("Unexpected end of predicate")
+	} else {
+		p.pos++
+		if p.pos > p.furthest {
+			p.furthest = p.pos
 		}
-		if len(results) > 0 {
-			return results, nil
+		return t, nil
+	}
+}
+
+// disjunction := conjunction (OR conjunction)*
+func (p *predicateParser) parseDisjunction() (Predicate, error) {
+	result := make(disjunction, 0, 1)
+	for {
+		if child, err := p.parseConjunction(); err != nil {
+			return nil, err
 		} else {
-			return nil, nil
+			result = append(result, child)
+		}
+
+		if t := p.peek(); t == nil || t.tt != ttDisjunction {
+			break
 		}
+		p.pos++
+	}
+
+	if len(result) == 1 {
+		return result[0], nil
+	}
+	return result, nil
+}
+
+// conjunction := term (AND term)*
+func (p *predicateParser) parseConjunction() (Predicate, error) {
+	result := make(conjunction, 0, 1)
+	for {
+		if child, err := p.parseTerm(); err != nil {
+			return nil, err
+		} else {
+			result = append(result, child)
+		}
+
+		if t := p.peek(); t == nil || t.tt != ttConjunction {
+			break
+		}
+		p.pos++
+	}
+
+	if len(result) == 1 {
+		return result[0], nil
+	}
+	return result, nil
+}
+
+// term := NOT term | "(" disjunction ")" | equivalence | value comparison value
+func (p *predicateParser) parseTerm() (Predicate, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
 	}
 
 	switch t.tt {
-	case ttEq, ttNe, ttGt, ttLt, ttGe, ttLe:
-		if len(t.children) != 2 {
-			return nil, fmt.Errorf("%s must have 2 children", t.tt.String())
+	case ttNegation:
+		if inner, err := p.parseTerm(); err != nil {
+			return nil, err
+		} else {
+			return &negationPredicate{inner}, nil
 		}
 
-		if left, err := parseValue(t.children[0]); err != nil {
+	case ttGroupOpen:
+		// The parenthesis may instead open an arithmetic expression, eg. "(a.x + a.y) * 2 > 10"
+		if value, _ := p.valueGroup(p.pos); value {
+			p.pos--
+			return p.parseComparison()
+		}
+
+		if result, err := p.parseDisjunction(); err != nil {
 			return nil, err
-		} else if right, err := parseValue(t.children[1]); err != nil {
+		} else if t, err := p.next(); err != nil || t.tt != ttGroupClose {
+			return nil, fmt.Errorf("Unbalanced parentheses")
+		} else {
+			return result, nil
+		}
+
+	case ttListOpen:
+		// The bracket may instead open a list literal, eg. "[1, 2] == a.xs"
+		start := p.pos - 1
+		p.pos = start
+		result, err := p.parseComparison()
+		if err == nil {
+			return result, nil
+		}
+		p.pos = start + 1
+		if key := p.peek(); key != nil && key.tt == ttAttributeSelector && len(splitPath(key.content)) == 1 &&
+			p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].tt == ttIndexClose && p.tokens[p.pos+1].content == "" {
+			p.pos += 2
+			return newEquivalencePredicate(joinPath(splitPath(key.content)...), p.required...), nil
+		}
+		return nil, err
+
+	default:
+		p.pos--
+		return p.parseComparison()
+	}
+}
+
+// comparison := expr op expr | expr op ("any" | "all") "(" expr ")" | expr BETWEEN expr AND expr |
+//               expr IN ("(" [expr ("," expr)*] ")" | list) | expr MATCHES expr |
+//               expr (STARTSWITH | ENDSWITH | CONTAINS) expr | expr IS [NOT] NULL
+func (p *predicateParser) parseComparison() (Predicate, error) {
+	result := new(operatorPredicate)
+
+	left, err := p.expressionWith(caretXor)
+	if err != nil {
+		return nil, err
+	}
+	opToken, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch opToken.tt {
+	case ttBetween:
+		return p.parseBetween(left)
+	case ttIn:
+		return p.parseIn(left)
+	case ttMatches:
+		if pattern, err := p.expressionWith(caretEither); err != nil {
 			return nil, err
 		} else {
-			result := &operatorPredicate{
-				left:  left,
-				right: right,
-			}
+			return newRegexPredicate(left, pattern)
+		}
+	case ttIs:
+		return p.parseNullCheck(left)
+	case ttStartsWith, ttEndsWith, ttContains:
+		sm := &stringMatchPredicate{left: left}
+		switch opToken.tt {
+		case ttStartsWith:
+			sm.match = smPrefix
+		case ttEndsWith:
+			sm.match = smSuffix
+		case ttContains:
+			sm.match = smContains
+		}
+		if sm.right, err = p.expressionWith(caretEither); err != nil {
+			return nil, err
+		}
+		return sm, nil
+	case ttEq:
+		result.op = opEq
+	case ttNe:
+		result.op = opNe
+	case ttGt:
+		result.op = opGt
+	case ttLt:
+		result.op = opLt
+	case ttGe:
+		result.op = opGe
+	case ttLe:
+		result.op = opLe
+	case ttIEq:
+		result.op = opIEq
+	default:
+		return nil, fmt.Errorf("Expected comparison operator, got %s", opToken.tt.String())
+	}
 
-			switch t.tt {
-			case ttEq:
-				result.op = opEq
-			case ttNe:
-				result.op = opNe
-			case ttGt:
-				result.op = opGt
-			case ttLt:
-				result.op = opLt
-			case ttGe:
-				result.op = opGe
-			case ttLe:
-				result.op = opLe
-			}
+	if all, ok := p.quantifierAhead(); ok {
+		return p.parseQuantified(left, result.op, all)
+	} else if right, err := p.expressionWith(caretEither); err != nil {
+		return nil, err
+	} else {
+		result.left = left
+		result.right = right
+		return result, nil
+	}
+}
 
+// quantifierAhead reports whether the right side of a comparison is quantified (eg. "all(b[].x)"), and if so whether
+// by all rather than any
+func (p *predicateParser) quantifierAhead() (all, ok bool) {
+	t := p.peek()
+	if t == nil || t.tt != ttAttributeSelector || p.pos+1 >= len(p.tokens) || p.tokens[p.pos+1].tt != ttGroupOpen {
+		return false, false
+	}
+	switch strings.ToLower(t.content) {
+	case "all":
+		return true, true
+	case "any":
+		return false, true
+	}
+	return false, false
+}
+
+// parseQuantified parses the quantified right side of a comparison, once the quantifier has been seen
+func (p *predicateParser) parseQuantified(left value, o op, all bool) (Predicate, error) {
+	p.pos += 2 // The quantifier and (
+	list, err := p.expressionWith(caretXor)
+	if err != nil {
+		return nil, err
+	} else if t, err := p.next(); err != nil || t.tt != ttGroupClose {
+		return nil, fmt.Errorf("Unbalanced parentheses")
+	}
+	return &quantifiedPredicate{left: left, op: o, all: all, list: list}, nil
+}
+
+// listLiteral := "[" [expr ("," expr)*] "]"
+func (p *predicateParser) parseList() (value, error) {
+	result := make(listLiteralValue, 0)
+	if t := p.peek(); t != nil && t.tt == ttIndexClose && t.content == "" {
+		p.pos++
+		return result, nil
+	}
+	for {
+		if v, err := p.expressionWith(caretXor); err != nil {
+			return nil, err
+		} else {
+			result = append(result, v)
+		}
+
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case t.tt == ttListSeparator:
+		case t.tt == ttIndexClose && t.content == "":
 			return result, nil
+		case t.tt == ttIndexClose:
+			return nil, fmt.Errorf("Cannot select .%s from a list", t.content)
+		default:
+			return nil, fmt.Errorf("Expected , or ] in list, got %s", t.tt.String())
 		}
+	}
+}
 
-	case ttConjunction:
-		if childCaptures, err := parseChildren(); err != nil {
+var arithmeticOps = map[tt]arithmeticOp{
+	ttAdd:        aoAdd,
+	ttSubtract:   aoSubtract,
+	ttMultiply:   aoMultiply,
+	ttDivide:     aoDivide,
+	ttModulo:     aoModulo,
+	ttIntDivide:  aoIntDivide,
+	ttBitwiseAnd: aoBitAnd,
+	ttBitwiseOr:  aoBitOr,
+}
+
+// expr := bitxor ("|" bitxor)*
+// bitxor := bitand ("^" bitand)*
+// bitand := sum ("&" sum)*
+// sum := product (("+" | "-") product)*
+// product := operand (("*" | "/" | "%" | "\") operand)*
+func (p *predicateParser) parseExpression() (value, error) {
+	return p.parseBinary(aoBitOr.precedence())
+}
+
+// parseBinary parses operands joined by the (left-associative) arithmetic operators of the given precedence, each of
+// which is an operation binding more tightly
+func (p *predicateParser) parseBinary(precedence int) (value, error) {
+	if precedence > aoMultiply.precedence() {
+		return p.parseOperand()
+	}
+	result, err := p.parseBinary(precedence + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t == nil {
+			return result, nil
+		}
+		op, ok := arithmeticOps[t.tt]
+		if t.tt == ttConjunction && t.content == "^" {
+			op, ok = aoBitXor, true
+		}
+		if !ok || op.precedence() != precedence || (op == aoBitXor && !p.xorAhead()) {
+			return result, nil
+		}
+		p.pos++
+		right, err := p.parseBinary(precedence + 1)
+		if err != nil {
 			return nil, err
-		} else if childCaptures == nil || len(childCaptures) < 1 {
-			return nil, nil
-		} else {
-			return append(make(conjunction, 0, len(childCaptures)), childCaptures...), nil
 		}
+		result = &arithmeticValue{left: result, right: right, op: op}
+	}
+}
 
-	case ttDisjunction:
-		if childCaptures, err := parseChildren(); err != nil {
+// operand := "(" expr ")" | conditional | ("+" | "-") number | "~" operand | index | subscript | call | value
+func (p *predicateParser) parseOperand() (value, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	defer func(prev caretMode) { p.caret = prev }(p.caret)
+	p.caret = caretXor // Within any group it opens, a predicate can't end
+
+	switch t.tt {
+	case ttGroupOpen:
+		if p.conditionalAhead() {
+			return p.parseConditional()
+		} else if result, err := p.parseExpression(); err != nil {
 			return nil, err
-		} else if childCaptures == nil || len(childCaptures) < 1 {
-			return nil, nil
+		} else if t, err := p.next(); err != nil || t.tt != ttGroupClose {
+			return nil, fmt.Errorf("Unbalanced parentheses")
 		} else {
-			return append(make(disjunction, 0, len(childCaptures)), childCaptures...), nil
+			return result, nil
+		}
+
+	case ttAdd, ttSubtract: // A signed number (or duration)
+		numToken, err := p.next()
+		if err != nil {
+			return nil, err
+		} else if numToken.tt != ttNumericLiteral && numToken.tt != ttDurationLiteral {
+			return nil, fmt.Errorf("Expected number after sign, got %s", numToken.tt.String())
+		}
+		sign := "+"
+		if t.tt == ttSubtract {
+			sign = "-"
 		}
+		return parseValue(&token{tt: numToken.tt, content: sign + numToken.content})
 
-	case ttPredicate, ttWhereClause:
-		if result, err := parseChildren(); err != nil || result == nil || len(result) < 1 {
+	case ttBitwiseNot:
+		if operand, err := p.parseOperand(); err != nil {
 			return nil, err
 		} else {
-			return result[0], nil
+			return &bitwiseNotValue{operand}, nil
 		}
 
-	case ttEquivalenceTest:
-		return equivalenceTestPredicate(t.content), nil
+	case ttIndexOpen:
+		if len(splitPath(t.content)) > 1 { // An attribute, rather than a Kleene closure
+			operand, err := parseValue(&token{tt: ttAttributeSelector, content: t.content})
+			if err != nil {
+				return nil, err
+			}
+			return p.parseSubscript(operand)
+		}
+		return p.parseIndex(unquoteName(t.content))
+
+	case ttAttributeSelector:
+		if next := p.peek(); next != nil && next.tt == ttGroupOpen && isIdentifier(t.content) {
+			return p.parseCall(t.content)
+		}
+		return p.parseSelector(t)
+
+	case ttListOpen:
+		return p.parseList()
 
 	default:
-		return nil, fmt.Errorf("Unhandled token type: %s", t.tt.String())
+		return parseValue(t)
 	}
 }
 
-func parseWithinClauseToken(t *token) (time.Duration, error) {
-	parseChildren := func() (time.Duration, error) {
-		for _, child := range t.children {
-			return parseWithinClauseToken(child)
+// parseSelector parses an attribute selector. One without an alias (eg. "price") refers to the whole event if it is
+// an alias, and otherwise to an attribute of the only event the query declares: "price" is read as "a.price" (and
+// "TS" as "a.TS") in "EVENT SEQ(A a) WHERE price > 100". Where there is more than one event, which is meant is
+// ambiguous. A selector of several parts (eg. "venue.code") always begins with an alias.
+func (p *predicateParser) parseSelector(t *token) (value, error) {
+	if len(splitPath(t.content)) > 1 || len(p.aliases) == 0 {
+		return parseValue(t)
+	}
+	name := unquoteName(t.content)
+	for _, alias := range p.aliases {
+		if alias == name {
+			return parseValue(t)
 		}
-		return time.Duration(0), nil
 	}
+	if len(p.aliases) > 1 {
+		return nil, errorAt(t, "Ambiguous attribute %s: the query has more than one event, so it must be qualified "+
+			"with an alias (eg. %s.%s)", t.content, joinPath(p.aliases[0]), t.content)
+	}
+	return parseValue(&token{tt: ttAttributeSelector, content: joinPath(p.aliases[0]) + "." + t.content, pos: t.pos})
+}
 
-	switch t.tt {
-	case ttDuration:
-		return time.ParseDuration(t.content)
+// conditionalAhead reports whether the group just opened is a conditional, ie. has a "?" within it (and not only within
+// a group nested in it). Looking ahead saves trying to parse every group as one.
+func (p *predicateParser) conditionalAhead() bool {
+	depth := 0
+	for _, t := range p.tokens[p.pos:] {
+		switch t.tt {
+		case ttGroupOpen:
+			depth++
+		case ttGroupClose, ttGroupCloseSelector:
+			if depth == 0 {
+				return false
+			}
+			depth--
+		case ttConditional:
+			if depth == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	case ttWithinClause:
-		return parseChildren()
+// valueGroup reports whether the group whose contents start at the token at start holds a value, eg. the "(a.x + a.y)"
+// of "(a.x + a.y) * 2 > 10", rather than a predicate, along with the position of the token which closes it. Looking
+// ahead saves trying to parse every group as both. A group holds a predicate if it has a comparison, a connective, an
+// equivalence term or a group holding a predicate within it (and not only within a group nested in one of those); a
+// conditional is a value, whatever its condition.
+func (p *predicateParser) valueGroup(start int) (value bool, end int) {
+	var predicate, conditional bool
+	for i := start; i < len(p.tokens); i++ {
+		switch t := p.tokens[i]; t.tt {
+		case ttGroupOpen:
+			nested, end := p.valueGroup(i + 1)
+			predicate, i = predicate || !nested, end
+		case ttGroupClose, ttGroupCloseSelector:
+			return conditional || !predicate, i
+		case ttConditional:
+			conditional = true
+		case ttConjunction: // A "^" may instead be XOR
+			predicate = predicate || t.content != "^"
+		case ttEq, ttNe, ttGt, ttLt, ttGe, ttLe, ttIEq, ttBetween, ttIn, ttMatches, ttStartsWith, ttEndsWith, ttContains,
+			ttIs, ttDisjunction, ttNegation:
+			predicate = true
+		case ttListOpen:
+			predicate = predicate || p.equivalenceAt(i)
+		}
+	}
+	return conditional || !predicate, len(p.tokens)
+}
 
-	default:
-		return time.Duration(0), fmt.Errorf("Unhandled token type: %s", t.tt.String())
+// equivalenceAt reports whether the "[" at i opens an equivalence term (eg. "[symbol]"), rather than a list: a single
+// name, which nothing follows but a connective or the end of a group
+func (p *predicateParser) equivalenceAt(i int) bool {
+	if i+2 >= len(p.tokens) {
+		return false
+	}
+	key, end := p.tokens[i+1], p.tokens[i+2]
+	if key.tt != ttAttributeSelector || len(splitPath(key.content)) != 1 || end.tt != ttIndexClose || end.content != "" {
+		return false
+	} else if i+3 == len(p.tokens) {
+		return true
+	}
+	switch p.tokens[i+3].tt {
+	case ttConjunction, ttDisjunction, ttGroupClose:
+		return true
+	}
+	return false
+}
+
+// conditional := "(" (disjunction | expr) "?" expr ":" expr ")"
+//
+// A condition which is just a value (eg. "a.vip") is short for comparing it with true.
+func (p *predicateParser) parseConditional() (value, error) {
+	start := p.pos
+	condition, err := p.parseDisjunction()
+	if t := p.peek(); err != nil || t == nil || t.tt != ttConditional {
+		end := p.pos
+		p.pos = start
+		if operand, exprErr := p.parseExpression(); exprErr == nil && p.peek() != nil && p.peek().tt == ttConditional {
+			condition = &operatorPredicate{left: operand, right: literalValue{true}, op: opEq}
+		} else if err != nil {
+			return nil, err
+		} else {
+			p.pos = end
+		}
+	}
+
+	result := &conditionalValue{condition: condition}
+	if t, err := p.next(); err != nil {
+		return nil, err
+	} else if t.tt != ttConditional {
+		return nil, fmt.Errorf("Expected ? after condition %s, got %s", condition.QueryText(), t.tt.String())
+	} else if result.then, err = p.parseExpression(); err != nil {
+		return nil, err
+	} else if t, err := p.next(); err != nil {
+		return nil, err
+	} else if t.tt != ttConditionalElse {
+		return nil, fmt.Errorf("Expected : after %s ? %s, got %s", condition.QueryText(), result.then.QueryText(),
+			t.tt.String())
+	} else if result.otherwise, err = p.parseExpression(); err != nil {
+		return nil, err
+	} else if t, err := p.next(); err != nil || t.tt != ttGroupClose {
+		return nil, fmt.Errorf("Unbalanced parentheses")
+	}
+	return result, nil
+}
+
+// index := name "[" [i [("+" | "-") number] | expr] "]" ["." path]
+func (p *predicateParser) parseIndex(alias string) (value, error) {
+	var (
+		index    value
+		offset   int
+		relative bool
+	)
+	if t := p.peek(); t != nil && t.tt == ttAttributeSelector && t.content == "i" { // Relative to the current element
+		relative = true
+		p.pos++
+		if t := p.peek(); t != nil && (t.tt == ttAdd || t.tt == ttSubtract) {
+			p.pos++
+			if numToken, err := p.next(); err != nil {
+				return nil, err
+			} else if n, err := strconv.Atoi(numToken.content); err != nil || numToken.tt != ttNumericLiteral {
+				return nil, fmt.Errorf("Expected whole number offset in %s[i], got %s", alias, numToken.tt.String())
+			} else if t.tt == ttSubtract {
+				offset = -n
+			} else {
+				offset = n
+			}
+		}
+	} else if t != nil && t.tt != ttIndexClose {
+		var err error
+		if index, err = p.parseExpression(); err != nil {
+			return nil, err
+		}
+	}
+
+	closeToken, err := p.next()
+	if err != nil {
+		return nil, err
+	} else if closeToken.tt != ttIndexClose && closeToken.tt != ttIndexReopen {
+		return nil, fmt.Errorf("Expected ] after %s[, got %s", alias, closeToken.tt.String())
+	}
+	var path []string
+	if closeToken.content != "" {
+		path = splitPath(closeToken.content)
+	}
+
+	if !relative && index == nil {
+		if closeToken.tt == ttIndexReopen {
+			return nil, fmt.Errorf("Cannot subscript %s[], which is a list", alias)
+		}
+		return &listLookup{alias: alias, path: path}, nil
+	}
+	result := &indexLookup{alias: alias, index: index, offset: offset, path: path}
+	if closeToken.tt == ttIndexReopen {
+		return p.parseSubscript(result)
+	}
+	return result, nil
+}
+
+// subscript := operand "[" expr "]" ["." path]
+func (p *predicateParser) parseSubscript(operand value) (value, error) {
+	if t := p.peek(); t != nil && (t.tt == ttIndexClose || t.tt == ttIndexReopen) {
+		return nil, fmt.Errorf("Expected a key or index in %s[]", operand.QueryText())
+	}
+	key, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	closeToken, err := p.next()
+	if err != nil {
+		return nil, err
+	} else if closeToken.tt != ttIndexClose && closeToken.tt != ttIndexReopen {
+		return nil, fmt.Errorf("Expected ] after %s[, got %s", operand.QueryText(), closeToken.tt.String())
+	}
+	result := &subscriptLookup{operand: operand, key: key}
+	if closeToken.content != "" {
+		result.path = splitPath(closeToken.content)
+	}
+	if closeToken.tt == ttIndexReopen {
+		return p.parseSubscript(result)
+	}
+	return result, nil
+}
+
+// call := name "(" [expr ("," expr)*] ")" ["." path]
+func (p *predicateParser) parseCall(name string) (value, error) {
+	var (
+		args     = make([]value, 0, 1)
+		selector []string // The path selected from the result, if any
+	)
+	if lower := strings.ToLower(name); lower == "any" || lower == "all" {
+		return nil, fmt.Errorf("%s() may only be compared with, eg. a.x > %s(b[].x)", name, name)
+	}
+	p.pos++ // (
+	if t := p.peek(); t != nil && (t.tt == ttGroupClose || t.tt == ttGroupCloseSelector) {
+		p.pos++
+		if t.tt == ttGroupCloseSelector {
+			selector = splitPath(t.content)
+		}
+	} else {
+		for done := false; !done; {
+			if arg, err := p.parseExpression(); err != nil {
+				return nil, err
+			} else {
+				args = append(args, arg)
+			}
+
+			t, err := p.next()
+			if err != nil {
+				return nil, fmt.Errorf("Unbalanced parentheses")
+			}
+			switch t.tt {
+			case ttListSeparator:
+			case ttGroupClose:
+				done = true
+			case ttGroupCloseSelector:
+				done = true
+				selector = splitPath(t.content)
+			default:
+				return nil, fmt.Errorf("Expected , or ) in arguments to %s, got %s", name, t.tt.String())
+			}
+		}
+	}
+
+	if lower := strings.ToLower(name); lower == "first" || lower == "last" {
+		var list *listLookup
+		if len(args) == 1 {
+			list, _ = args[0].(*listLookup)
+		}
+		if list == nil {
+			return nil, fmt.Errorf("%s takes the events captured under an alias, eg. %s(a[]).x", name, name)
+		}
+		return &boundaryLookup{alias: list.alias, last: lower == "last", path: append(list.path, selector...)}, nil
+	} else if selector != nil {
+		return nil, fmt.Errorf("Cannot select .%s from %s(), which is not an event", joinPath(selector...), name)
+	} else if strings.EqualFold(name, "recent") {
+		return newRecentValue(args)
+	} else if strings.EqualFold(name, "coalesce") {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("coalesce takes at least one argument")
+		}
+		return coalesceValue(args), nil
+	} else if to, ok := castTypes[strings.ToLower(name)]; ok {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s takes exactly one argument, got %d", name, len(args))
+		}
+		return &castValue{to: to, operand: args[0]}, nil
+	} else if fn, ok := aggregateFuncs[strings.ToLower(name)]; !ok {
+		return newFunctionValue(name, args)
+	} else if len(args) != 1 {
+		return nil, fmt.Errorf("%s takes exactly one argument, got %d", name, len(args))
+	} else {
+		return &aggregateValue{fn: fn, operand: args[0]}, nil
+	}
+}
+
+func (p *predicateParser) parseBetween(operand value) (Predicate, error) {
+	if low, err := p.expressionWith(caretAnd); err != nil {
+		return nil, err
+	} else if andToken, err := p.next(); err != nil {
+		return nil, err
+	} else if andToken.tt != ttConjunction {
+		return nil, fmt.Errorf("Expected AND in BETWEEN, got %s", andToken.tt.String())
+	} else if high, err := p.expressionWith(caretEither); err != nil {
+		return nil, err
+	} else {
+		return &betweenPredicate{
+			operand: operand,
+			low:     low,
+			high:    high,
+		}, nil
+	}
+}
+
+func (p *predicateParser) parseNullCheck(operand value) (Predicate, error) {
+	result := &nullCheckPredicate{operand: operand}
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.tt == ttNegation {
+		result.negated = true
+		if t, err = p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if t.tt != ttNull {
+		return nil, fmt.Errorf("Expected NULL after IS, got %s", t.tt.String())
+	}
+	return result, nil
+}
+
+func (p *predicateParser) parseIn(left value) (Predicate, error) {
+	result := &inPredicate{
+		left: left,
+		set:  make([]value, 0),
+	}
+
+	if t, err := p.next(); err != nil {
+		return nil, err
+	} else if t.tt == ttIndexOpen { // The values captured across a Kleene closure (eg. "a[].symbol")
+		p.pos--
+		v, err := p.expressionWith(caretEither)
+		if err != nil {
+			return nil, err
+		} else if _, ok := v.(*listLookup); !ok {
+			return nil, fmt.Errorf("Expected ( or a list (eg. a[].x) after IN, got %s", v.QueryText())
+		}
+		result.set = append(result.set, v)
+		return result, nil
+	} else if t.tt != ttGroupOpen {
+		return nil, fmt.Errorf("Expected ( after IN, got %s", t.tt.String())
+	}
+	if t := p.peek(); t != nil && t.tt == ttGroupClose {
+		p.pos++
+		return result, nil
+	}
+	for {
+		if v, err := p.expressionWith(caretXor); err != nil {
+			return nil, err
+		} else {
+			result.set = append(result.set, v)
+		}
+
+		t, err := p.next()
+		if err != nil {
+			return nil, fmt.Errorf("Unbalanced parentheses")
+		}
+		switch t.tt {
+		case ttListSeparator:
+			continue
+		case ttGroupClose:
+			return result, nil
+		default:
+			return nil, fmt.Errorf("Expected , or ) in IN set, got %s", t.tt.String())
+		}
 	}
 }
 
+func parseWhereClauseToken(t *token, capture EventCapture) (Predicate, error) {
+	if t.tt != ttWhereClause {
+		return nil, fmt.Errorf("Unhandled token type: %s", t.tt.String())
+	}
+
+	p := &predicateParser{tokens: t.children}
+	if capture != nil {
+		p.aliases, p.required = capture.aliases(), requiredAliases(capture)
+	}
+	if result, err := p.parseDisjunction(); err != nil {
+		var perr *ParseError
+		if errors.As(err, &perr) || len(p.tokens) == 0 {
+			return nil, err
+		}
+		at := p.tokens[len(p.tokens)-1]
+		if p.furthest > 0 && p.furthest <= len(p.tokens) {
+			at = p.tokens[p.furthest-1] // The last token consumed
+		}
+		return nil, causedAt(at, err)
+	} else if t := p.peek(); t != nil {
+		return nil, errorAt(t, "Unexpected token: %s", t.tt.String())
+	} else {
+		return result, nil
+	}
+}
+
+// parseWithinClauseToken parses the window of a WITHIN clause (or of the AND which follows one): of time, or of a
+// number of events
+func parseWithinClauseToken(t *token) (window time.Duration, count int, err error) {
+	for _, child := range t.children {
+		switch child.tt {
+		case ttDuration:
+			if window, err = parseDuration(child.content); err != nil {
+				return 0, 0, causedAt(child, err)
+			}
+
+		case ttEventCount:
+			if count, err = strconv.Atoi(child.content); err != nil || count < 1 {
+				return 0, 0, errorAt(child, "Window must be of at least 1 event, got %s", child.content)
+			}
+
+		default:
+			return 0, 0, fmt.Errorf("Unhandled token type: %s", child.tt.String())
+		}
+	}
+	return window, count, nil
+}
+
 func parseTokens(tokens []*token) (*Query, error) {
 	q := new(Query)
 
@@ -257,23 +988,41 @@ func parseTokens(tokens []*token) (*Query, error) {
 		switch t.tt {
 		case ttEventClause:
 			if capture, err := parseEventClauseToken(t); err != nil {
-				return nil, fmt.Errorf("Error parsing %s: %s", t.tt.String(), err.Error())
+				return nil, wrapParseError(err, "Error parsing "+t.tt.String())
 			} else {
 				q.capture = capture
 			}
 
+		case ttEventAlternative:
+			if capture, err := parseEventClauseToken(t); err != nil {
+				return nil, wrapParseError(err, "Error parsing "+t.tt.String())
+			} else if alts, ok := q.capture.(orEventCapture); ok {
+				q.capture = append(alts, capture)
+			} else {
+				q.capture = orEventCapture{q.capture, capture}
+			}
+
 		case ttWhereClause:
-			if predicate, err := parseWhereClauseToken(t); err != nil {
-				return nil, fmt.Errorf("Error parsing %s: %s", t.tt.String(), err.Error())
+			if predicate, err := parseWhereClauseToken(t, q.capture); err != nil {
+				return nil, wrapParseError(err, "Error parsing "+t.tt.String())
 			} else {
 				q.predicate = predicate
 			}
 
+		case ttPartitionClause:
+			q.partition = joinPath(splitPath(t.content)...)
+
 		case ttWithinClause:
-			if window, err := parseWithinClauseToken(t); err != nil {
-				return nil, fmt.Errorf("Error parsing %s: %s", t.tt.String(), err.Error())
-			} else {
+			window, count, err := parseWithinClauseToken(t)
+			if err == nil && ((window != 0 && q.window != 0) || (count != 0 && q.windowCount != 0)) {
+				err = errorAt(t, "Query may only have one window of time and one of events")
+			}
+			if err != nil {
+				return nil, wrapParseError(err, "Error parsing "+t.tt.String())
+			} else if window != 0 {
 				q.window = window
+			} else {
+				q.windowCount = count
 			}
 
 		default:
@@ -284,21 +1033,80 @@ func parseTokens(tokens []*token) (*Query, error) {
 	if err := q.validate(); err != nil {
 		return nil, err
 	} else {
+		q.updateAlternatives()
 		return q, nil
 	}
 }
 
+// Parse parses a query. A syntax error is returned as a *ParseError, which says where in the query it is.
 func Parse(data string) (*Query, error) {
+	q, err := parse(data)
+	var perr *ParseError
+	if errors.As(err, &perr) {
+		perr.locate(data)
+		return nil, perr
+	}
+	return q, err
+}
+
+// blankComments replaces the comments in a query with whitespace, keeping every other character where it is (so that
+// positions in the query are unchanged). A comment is either from "--" to the end of the line, or between "/*" and
+// "*/"; neither may begin within a string literal or a quoted name. As in SQL, this means "a.x--1" is not a subtraction
+// of -1.
+func blankComments(data string) (string, error) {
+	if !strings.Contains(data, "--") && !strings.Contains(data, "/*") {
+		return data, nil
+	}
+	buf := []byte(data)
+	var quote byte // The quote which opened the string literal (or quoted name) we're in, if any
+	for i := 0; i < len(buf); i++ {
+		switch c := buf[i]; {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+
+		case c == '-' && i+1 < len(buf) && buf[i+1] == '-':
+			for ; i < len(buf) && buf[i] != '\n'; i++ {
+				buf[i] = ' '
+			}
+
+		case c == '/' && i+1 < len(buf) && buf[i+1] == '*':
+			end := strings.Index(data[i+2:], "*/")
+			if end < 0 {
+				return "", &ParseError{Msg: "Unterminated comment", Token: "/*", offset: i}
+			}
+			for end += i + 4; i < end; i++ {
+				if buf[i] != '\n' { // Keep line numbers
+					buf[i] = ' '
+				}
+			}
+			i--
+		}
+	}
+	return string(buf), nil
+}
+
+func parse(data string) (*Query, error) {
 	// start := time.Now()
 	// defer log.Tracef("[sase:Parser] Took %s", time.Since(start).String())
 
-	tokens, err := tokenize(data)
+	stripped, err := blankComments(data)
+	if err != nil {
+		return nil, wrapParseError(err, "Error tokenizing")
+	}
+	tokens, err := tokenize(stripped)
 	if err != nil {
-		return nil, fmt.Errorf("Error tokenizing: %s", err.Error())
+		return nil, wrapParseError(err, "Error tokenizing")
 	}
 	tokens, err = postprocessTokens(tokens)
 	if err != nil {
-		return nil, fmt.Errorf("Error postprocessing tokens: %s", err.Error())
+		return nil, wrapParseError(err, "Error postprocessing tokens")
 	}
 	// for _, t := range tokens {
 	// 	log.Tracef("[Parser] Parsed input tokens: %s", t.Tree())
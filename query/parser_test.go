@@ -1,12 +1,15 @@
 package query
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
 
 	log "github.com/cihub/seelog"
 	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
 )
 
 func TestParsing(t *testing.T) {
@@ -37,6 +40,8 @@ func TestParsing(t *testing.T) {
 		"EVENT SEQ(t1 e1, t2 e2, ANY(t3 e3, t4 e4)) WHERE e1.a1 == e2.a2": true,
 		"EVENT a b WHERE b.n == 1.0":                                      true,
 		"EVENT a b WHERE b.n == -1.0":                                     true,
+		"EVENT a b WHERE b.n < -0.5 AND b.m > 6.02e23 AND b.o == 1E-3":    true,
+		"EVENT a b WHERE b.n BETWEEN -2.5e+2 AND +1e21":                   true,
 		"EVENT a b WHERE b.n != 1.0":                                      true,
 		"EVENT a b WHERE b.n < 1.0":                                       true,
 		"EVENT a b WHERE b.n > 1.0":                                       true,
@@ -48,11 +53,82 @@ func TestParsing(t *testing.T) {
 		"EVENT SEQ(t a, t b) WHERE a.n > b.n":                             true,
 		"EVENT SEQ(t a, t b) WHERE a.n <= b.n":                            true,
 		"EVENT SEQ(t a, t b) WHERE a.n >= b.n":                            true,
+		"EVENT SEQ(t a, t b) WHERE a.s ~= b.s":                            true,
+		// Grouping
+		"EVENT a b WHERE (b.foo == 'bar')":                                  true,
+		"EVENT a b WHERE (b.foo == 'bar' OR b.bar == 'baz') AND b.n == 1":   true,
+		"EVENT a b WHERE b.n == 1 AND (b.foo == 'bar' OR (b.bar == 'baz'))": true,
+		"EVENT a b WHERE b.n == 1 OR b.n == 2 AND b.foo == 'bar'":           true, // AND binds more tightly
+		"EVENT a b WHERE ([foo] || b.n>=1)&&b.n<=2":                         true,
+		"EVENT SEQ(a b, a orb) WHERE orb.foo == b.foo AND b.n == 1":         true, // Identifiers may start with keywords
+		"EVENT a b WHERE NOT (b.foo == 'bar')":                              true,
+		"EVENT a b WHERE not b.foo == 'bar' AND !(b.n > 1 OR [foo])":        true,
+		"EVENT a b WHERE NOT NOT b.foo == 'bar'":                            true,
+		"EVENT SEQ(a b, a notes) WHERE notes.foo == b.foo":                  true,
+		"EVENT a b WHERE b.n BETWEEN 1 AND 2 AND b.foo == 'bar'":            true,
+		"EVENT a b WHERE NOT b.n between b.lo and b.hi":                     true,
+		"EVENT a b WHERE b.s IN ('OPEN', \"PENDING\", 1) AND b.n in ()":     true,
+		"EVENT SEQ(a b, a inbox) WHERE inbox.foo IN (b.foo)":                true,
+		"EVENT a b WHERE b.path matches '^/api/.*' AND b.n == 1":            true,
+		"EVENT a b WHERE b.url startswith 'https://' OR b.url ENDSWITH '/'": true,
+		"EVENT SEQ(a b, a contained) WHERE b.s CONTAINS contained.s":        true,
+		"EVENT a b WHERE b.d is null OR b.d IS NOT NULL":                    true,
+		"EVENT a b WHERE b.x == true OR b.y != FALSE OR b.z == null":        true,
+		"EVENT a b WHERE b.x == 'it\\'s' AND b.y == \"say \\\"hi\\\"\"":     true,
+		// Arithmetic
+		"EVENT SEQ(a b, a c) WHERE (b.x + c.y) * 2 > 10":                    true,
+		"EVENT a b WHERE b.price*b.qty>=100 AND b.x - (b.y - 1) < b.y / 2":  true,
+		"EVENT a b WHERE ((b.x + 1) > 2 OR b.y < -1) AND b.x-1 != +2":       true,
+		"EVENT a b WHERE b.x IN (b.y + 1, 2 * 3) AND b.x BETWEEN 1 AND b.y": true,
+		// Kleene closures
+		"EVENT SEQ(s a, s b) WHERE avg(a[].x) < b.x AND COUNT(a[]) > 1": true,
+		"EVENT SEQ(s a, s b) WHERE sum(a[].m.x) + 1 == max(a[].y) / 2":  true,
+		"EVENT SEQ(s a, s b) WHERE a[i].price > a[i-1].price":           true,
+		"EVENT SEQ(s a, s b) WHERE a[0].x == a[i+1].x + a[b.n - 1].x":   true,
+		"EVENT SEQ(s a, s b) WHERE a.LEN > 2 AND a[a.LEN - 1].x > b.x":  true,
+		// Timestamps
+		"EVENT SEQ(s a, s b) WHERE b.TS - a.TS < 60 AND b.TS > a.TS + 1":      true,
+		"EVENT SEQ(s a, s b) WHERE b.TS - a.TS < 30s AND b.TS > a.TS + 1h30m": true,
+		"EVENT SEQ(s a, s b) WHERE b.x BETWEEN -1.5ms AND 2us + 10ns":         true,
+		// Functions
+		"EVENT SEQ(a b, a c) WHERE concat(b.first, ' ', b.last) == c.name":  true,
+		"EVENT a b WHERE LOWER(trim(b.x)) == 'foo' AND length(b.y) > 2":     true,
+		"EVENT SEQ(a b, a c) WHERE coalesce(b.nick, b.name, 'anon') == c.x": true,
 		// Errors
-		"EVENT a b WHERE b.foo == 'bar":    false, // Unterminated quote
-		"EVENT a b WHERE b.foo == \"bar":   false, // Unterminated quote
-		"EVENT a b WHERE a.foo == \"bar\"": false, // Nonexistant event
-		"EVENT a b WHERE b.foo == a.bar":   false, // Nonexistant event
+		"EVENT a b WHERE foo(b[].x) > 1":     false, // Unknown function
+		"EVENT a b WHERE lower(b.x, 1) > 1":  false, // Too many arguments
+		"EVENT a b WHERE coalesce() == 1":    false, // Too few arguments
+		"EVENT a b WHERE avg(b[].x, 1) > 1":  false, // Too many arguments
+		"EVENT a b WHERE avg(c[].x) > 1":     false, // Nonexistant event
+		"EVENT a b WHERE c.LEN > 1":          false, // Nonexistant event
+		"EVENT a b WHERE c.TS > b.TS":        false, // Nonexistant event
+		"EVENT a b WHERE b.x > 5d":           false, // Unknown unit
+		"EVENT a b WHERE b.x > 1e":           false, // Missing exponent
+		"EVENT a b WHERE b.x > 1e2.5":        false, // Fractional exponent
+		"EVENT a b WHERE b.x > - b.y":        false, // Only literals may be signed
+		"EVENT a b WHERE b[i-x].y == 1":      false, // Offset must be a number
+		"EVENT a b WHERE b[1 == 1":           false, // Unterminated index
+		"EVENT a b WHERE b.x + > 1":          false, // Missing operand
+		"EVENT a b WHERE (b.x + 1 > 2":       false, // Unbalanced parentheses
+		"EVENT a b WHERE -b.x > 1":           false, // Only numbers may be signed
+		"EVENT a b WHERE b.d IS 1":           false, // Only NULL checks are supported
+		"EVENT a b WHERE b.d IS NOT":         false, // Missing NULL
+		"EVENT a b WHERE b.p MATCHES '('":    false, // Invalid pattern
+		"EVENT a b WHERE b.p MATCHES b.foo":  false, // Pattern must be a literal
+		"EVENT a b WHERE b.n IN 1":           false, // Set must be parenthesised
+		"EVENT a b WHERE b.n IN (1, 2":       false, // Unbalanced parentheses
+		"EVENT a b WHERE b.n IN (1 2)":       false, // Missing separator
+		"EVENT a b WHERE b.n BETWEEN 1 OR 2": false, // BETWEEN requires AND
+		"EVENT a b WHERE b.n BETWEEN 1":      false, // Missing upper bound
+		"EVENT a b WHERE NOT":                false, // Nothing to negate
+		"EVENT a b WHERE (b.foo == 'bar'":    false, // Unbalanced parentheses
+		"EVENT a b WHERE b.foo == 'bar')":    false, // Unbalanced parentheses
+		"EVENT a b WHERE ()":                 false, // Empty group
+		"EVENT a b WHERE b.foo 'bar'":        false, // Missing operator
+		"EVENT a b WHERE b.foo == 'bar":      false, // Unterminated quote
+		"EVENT a b WHERE b.foo == \"bar":     false, // Unterminated quote
+		"EVENT a b WHERE a.foo == \"bar\"":   false, // Nonexistant event
+		"EVENT a b WHERE b.foo == a.bar":     false, // Nonexistant event
 
 		// EVENT + WITHIN
 		"EVENT a b WITHIN 1h":                                  true,
@@ -65,6 +141,50 @@ func TestParsing(t *testing.T) {
 		// Errors
 		"EVENT a b WITHIN 100000000000000h": false, // Duration overflow
 		"EVENT a b WITHIN -4h":              false, // Negative duration
+
+		// Kleene closures
+		"EVENT SEQ(a b, c+ d[])": true,
+		"EVENT SEQ(a b, c+? d[], e f) WHERE d[i].x > d[i-1].x AND d.LEN > 1": true,
+		"EVENT c+ d[] WITHIN 1m": true,
+		"EVENT ANY(a b, c+ d[])": true,
+		// Errors
+		"EVENT SEQ(a b, c+ d)":      false, // Missing []
+		"EVENT SEQ(a b, c d[])":     false, // Missing +
+		"EVENT SEQ(a b, !(c+ d[]))": false, // Negated closure
+		"EVENT SEQ(a b, c++ d[])":   false,
+
+		// PARTITION BY
+		"EVENT SEQ(a b, a c) PARTITION BY symbol":                             true,
+		"EVENT SEQ(a b, a c) WHERE b.x > c.x partition by m.symbol WITHIN 1h": true,
+		"EVENT SEQ(a b, a c) PARTITION BY symbol WITHIN 1h":                   true,
+		// Errors
+		"EVENT SEQ(a b, a c) PARTITION BY":             false, // No key
+		"EVENT SEQ(a b, a c) PARTITION symbol":         false,
+		"EVENT SEQ(a b, a c) WITHIN 1h PARTITION BY x": false, // Out of order
+
+		// Unordered conjunctions
+		"EVENT AND(A a, B b, C c) WHERE a.x == b.x WITHIN 1h": true,
+		"EVENT and(A a, ANY(B b, C c), D+ d[])":               true,
+		"EVENT AND(A a, B b) OR SEQ(A a, C c)":                true,
+		// Errors
+		"EVENT AND(A a, !(B b))":   false, // Negations must be ordered
+		"EVENT AND(A a, A a)":      false, // Duplicate alias
+		"EVENT SEQ(A a, AND(B b))": false, // Only at the top level
+		"EVENT AND(A a B b)":       false, // Missing separator
+
+		// Alternatives
+		"EVENT SEQ(A a, B b) OR SEQ(A a, C c)":                                     true,
+		"EVENT SEQ(A a, B b) or A a OR ANY(C c, D d) WHERE a.x > 1 WITHIN 1h":      true,
+		"EVENT SEQ(A a, !(N n), B b) || SEQ(A a, C+ c[]) WHERE n.x == a.x OR [id]": true,
+		"EVENT SEQ(A a, B b) OR SEQ(A a, C c) PARTITION BY sym":                    true,
+		// Errors
+		"EVENT SEQ(A a, B b) OR":                             false, // Missing alternative
+		"EVENT SEQ(A a, B b) OR SEQ(C a, D d)":               false, // a is captured as different types
+		"EVENT SEQ(A a, B b) OR SEQ(A+ a[], D d)":            false, // a is captured as a closure by only one
+		"EVENT SEQ(A a, B b) OR SEQ(!(A a), D d)":            false, // a is negated by only one
+		"EVENT SEQ(A a, B b) OR SEQ(A a, D b)":               false, // b is captured as different types
+		"EVENT SEQ(A a, B b) OR SEQ(A a, C c, D c)":          false, // Duplicate alias within an alternative
+		"EVENT SEQ(A a, B b) OR SEQ(A a, C c) WHERE d.x > 1": false, // Nonexistant event
 	}
 
 	te := func(queryText string, expectSuccess bool) {
@@ -82,6 +202,8 @@ func TestParsing(t *testing.T) {
 					output, queryText))
 				require.Equal(t, output, q2.QueryText(), fmt.Sprintf("Generated outputs do not match for input \"%s\"",
 					queryText))
+				require.True(t, samePredicate(q.predicate, q2.predicate), "Re-parsed predicate differs for \"%s\"",
+					queryText)
 			} else {
 				require.Error(t, err, fmt.Sprintf("Error expected parsing \"%s\"", queryText))
 				require.Nil(t, q, "Query unexpectedly not-nil for \"%s\"", queryText)
@@ -137,6 +259,33 @@ func TestParsingWindow(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, expectedDuration, q.Window())
 	}
+
+	// Windows of a number of events, alone or with one of time
+	counts := map[string]string{
+		"100 EVENTS":          "100 EVENTS",
+		"1 event":             "1 EVENT",
+		"5m and 100 events":   "5m AND 100 EVENTS",
+		"20 Events AND 1h":    "1h AND 20 EVENTS",
+		"1h10m   AND 2 EVENT": "1h10m AND 2 EVENTS",
+	}
+	for window, expected := range counts {
+		q, err := Parse("EVENT t0 e0 WITHIN " + window)
+		require.NoError(t, err, window)
+		require.Equal(t, "EVENT t0 e0 WITHIN "+expected, q.QueryText(), window)
+		reparsed, err := Parse(q.QueryText())
+		require.NoError(t, err, window)
+		require.Equal(t, q.Window(), reparsed.Window(), window)
+		require.Equal(t, q.WindowCount(), reparsed.WindowCount(), window)
+	}
+	q, err := Parse("EVENT t0 e0 WITHIN 5m AND 100 EVENTS")
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Minute, q.Window())
+	require.Equal(t, 100, q.WindowCount())
+
+	for _, window := range []string{"0 EVENTS", "100", "5m AND 10m", "5 EVENTS AND 6 EVENTS", "1.5 EVENTS"} {
+		_, err := Parse("EVENT t0 e0 WITHIN " + window)
+		require.Error(t, err, window)
+	}
 }
 
 func BenchmarkParsing(b *testing.B) {
@@ -154,3 +303,278 @@ func BenchmarkParsingParallel(b *testing.B) {
 		}
 	})
 }
+
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		query        string
+		line, column int
+		token, msg   string
+	}{
+		{"EVENT SEQ(A a, B b)\nWHERE a.x > 1 AND\n\t(b.y < 2", 3, 9, "2",
+			"Error parsing ttWhereClause: Unbalanced parentheses"},
+		{"EVENT SEQ(A a, B b) WHERE a.x > 1 b.y", 1, 35, "b.y",
+			"Error parsing ttWhereClause: Unexpected token: ttAttributeSelector"},
+		{"EVENT SEQ(A a,\n  !(B+ b[]))", 2, 3, "", "Error parsing ttEventClause: Kleene closures may not be negated"},
+		{"EVENT SEQ(A a, B b) WITHIN 100000000000000h", 1, 28, "100000000000000h",
+			`Error parsing ttWithinClause: time: invalid duration "100000000000000h"`},
+		{"EVENT SEQ(A a, B b", 1, 19, "", "Error tokenizing: Unexpected end of query"},
+		{"EVENT SEQ(A a, B b) WHERE b.x == \"ü\" AND a.ñ == 1", 1, 44, "ñ", "Error tokenizing: Unexpected input"},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.query)
+		perr, ok := err.(*ParseError)
+		require.True(t, ok, "%s: %v", c.query, err)
+		require.Equal(t, c.line, perr.Line, c.query)
+		require.Equal(t, c.column, perr.Column, c.query)
+		require.Equal(t, c.token, perr.Token, c.query)
+		require.Equal(t, c.msg, perr.Msg, c.query)
+	}
+
+	_, err := Parse("EVENT SEQ(A a, B b)\nWHERE a.x > 1 AND\n\t(b.y < 2\nWITHIN 1h")
+	require.Equal(t, "Error parsing ttWhereClause: Unbalanced parentheses (line 3, column 9)\n"+
+		"\t(b.y < 2\n"+
+		"\t       ^", err.Error())
+	_, err = Parse("EVENT SEQ(A a, B b) WHERE a.x > 1 b.yy")
+	require.Contains(t, err.Error(), "\n                                  ^^^^")
+
+	// The underlying error is still available
+	_, err = Parse("EVENT a b WITHIN 100000000000000h")
+	require.True(t, errors.As(err, new(*ParseError)))
+	require.Contains(t, errors.Unwrap(err).Error(), "invalid duration")
+}
+
+// A sign is part of a number literal where a value is expected, and an operator where one is
+// Whether a group holds a value or a predicate is decided without parsing it as both, so deeply nested groups don't
+// take exponentially longer to parse
+func TestNestedGroups(t *testing.T) {
+	condition, value, predicate := "a.x > 1", "a.x", "a.x > 1"
+	for i := 0; i < 40; i++ {
+		condition = "((" + condition + ") ? 1 : 2) > 1"
+		value = "(" + value + " + 1)"
+		predicate = "(" + predicate + " ^ (" + value + ") * 2 > 1)"
+	}
+	for _, where := range []string{condition, value + " > 1", predicate} {
+		start := time.Now()
+		q, err := Parse("EVENT A a WHERE " + where)
+		require.NoError(t, err)
+		require.True(t, time.Since(start) < 5*time.Second, "Took %s", time.Since(start))
+		_, err = Parse(q.QueryText())
+		require.NoError(t, err)
+	}
+
+	cases := map[string]string{
+		"((a.x)) + 1 > 2":                "a.x + 1.000000 > 2.000000",
+		"((a.x > 1))":                    "a.x > 1.000000",
+		"((a.x > 1) ^ (a.y < 2))":        "(a.x > 1.000000 AND a.y < 2.000000)",
+		"((a.x) ^ 3) == 1":               "a.x ^ 3.000000 == 1.000000",
+		"((a.x > 1) ? a.y : a.z) IN (1)": "(a.x > 1.000000 ? a.y : a.z) IN (1.000000)",
+		"(lower(a.s) + (a.t)) == 'x'":    `lower(a.s) + a.t == "x"`,
+		"([x] AND a.x > 1)":              "([x] AND a.x > 1.000000)",
+	}
+	for where, expected := range cases {
+		q, err := Parse("EVENT A a WHERE " + where)
+		require.NoError(t, err, where)
+		require.Equal(t, expected, q.predicate.QueryText(), where)
+	}
+}
+
+func TestSignedNumbers(t *testing.T) {
+	cases := map[string]string{
+		"b.x > -1":         "b.x > -1.000000",
+		"b.x - 1 > 0":      "b.x - 1.000000 > 0.000000",
+		"b.x-1 > 0":        "b.x - 1.000000 > 0.000000",
+		"b.x - -1 > +2":    "b.x - -1.000000 > 2.000000",
+		"-1 - b.x > 0":     "-1.000000 - b.x > 0.000000",
+		"b.x * -2e3 > 0":   "b.x * -2000.000000 > 0.000000",
+		"b.x > 6.02e23":    "b.x > 6.02e+23",
+		"b.x < 1.5E-7":     "b.x < 0.00000015",
+		"(b.x) - 1 < -1e0": "b.x - 1.000000 < -1.000000",
+	}
+	for predicate, expected := range cases {
+		q, err := Parse("EVENT a b WHERE " + predicate)
+		require.NoError(t, err, predicate)
+		require.Equal(t, expected, q.predicate.QueryText(), predicate)
+	}
+
+	q, err := Parse("EVENT a b WHERE b.x > -1 AND b.y > 6.02e23")
+	require.NoError(t, err)
+	c := q.predicate.(conjunction)
+	require.Equal(t, literalValue{float64(-1)}, c[0].(*operatorPredicate).right)
+	require.Equal(t, literalValue{6.02e23}, c[1].(*operatorPredicate).right)
+	q, err = Parse("EVENT a b WHERE b.x -1 > 0")
+	require.NoError(t, err)
+	require.IsType(t, &arithmeticValue{}, q.predicate.(*operatorPredicate).left)
+}
+
+// Number literals may be hexadecimal, and may separate groups of digits with underscores; either way they are rendered
+// as decimals
+func TestNumberLiterals(t *testing.T) {
+	cases := map[string]string{
+		"b.flags >= 0xFF":       "b.flags >= 255.000000",
+		"b.flags == 0Xff":       "b.flags == 255.000000",
+		"b.flags == -0x10":      "b.flags == -16.000000",
+		"b.n > 1_000_000":       "b.n > 1000000.000000",
+		"b.n > 1_000.000_5":     "b.n > 1000.000500",
+		"b.mask == 0xFFFF_FFFF": "b.mask == 4294967295.000000",
+		"b.n - 0x1_0 > 1_6":     "b.n - 16.000000 > 16.000000",
+	}
+	for predicate, expected := range cases {
+		q, err := Parse("EVENT a b WHERE " + predicate)
+		require.NoError(t, err, predicate)
+		require.Equal(t, expected, q.predicate.QueryText(), predicate)
+	}
+
+	errs := map[string]string{
+		"b.n > 1_":                  "Invalid number 1_: underscores may only separate digits",
+		"b.n > 1__000":              "Invalid number 1__000: underscores may only separate digits",
+		"b.n > 1_.5":                "Invalid number 1_.5: underscores may only separate digits",
+		"b.n > 0x_FF":               "Invalid number 0x_FF: underscores may only separate digits",
+		"b.n > 0xFF_":               "Invalid number 0xFF_: underscores may only separate digits",
+		"b.n > 0x":                  "Invalid number 0x: expected hex digits",
+		"b.n > 0x1FFFFFFFFFFFFFFFF": "Invalid number 0x1FFFFFFFFFFFFFFFF: ",
+	}
+	for predicate, msg := range errs {
+		_, err := Parse("EVENT a b WHERE " + predicate)
+		require.Error(t, err, predicate)
+		require.Contains(t, err.Error(), msg, predicate)
+	}
+	for _, predicate := range []string{"b.n > 1._5", "b.n > 0xFG", "b.n > 1e1_0"} { // Not number literals at all
+		_, err := Parse("EVENT a b WHERE " + predicate)
+		require.Error(t, err, predicate)
+	}
+}
+
+// Where the query declares only one event, its attributes needn't be qualified with its alias
+func TestUnqualifiedAttributes(t *testing.T) {
+	cases := map[string]string{
+		"EVENT Trade t WHERE price > 100":                           "t.price > 100.000000",
+		"EVENT Trade t WHERE price * qty > 1e3 AND t.side == 'buy'": `(t.price * t.qty > 1000.000000 AND t.side == "buy")`,
+		"EVENT Trade t WHERE upper(symbol) IN ('A', venue)":         `upper(t.symbol) IN ("A", t.venue)`,
+		"EVENT SEQ(Trade t) WHERE TS - t.TS < 1s":                   "t.TS - t.TS < 1s",
+		"EVENT SEQ(Trade+ t[]) WHERE LEN > 2 AND t.LEN < 5":         "(t.LEN > 2.000000 AND t.LEN < 5.000000)",
+		"EVENT SEQ(Trade t) WHERE t == t":                           "t == t", // The alias itself is the whole event
+	}
+	for queryText, expected := range cases {
+		q, err := Parse(queryText)
+		require.NoError(t, err, queryText)
+		require.Equal(t, expected, q.predicate.QueryText(), queryText)
+		require.Equal(t, []string{"t"}, Aliases(q.predicate), queryText)
+	}
+
+	q, err := Parse("EVENT Trade t WHERE price > 100")
+	require.NoError(t, err)
+	require.Equal(t, Positive, q.Evaluate(domain.CapturedEvents{
+		"t": &tEventImpl{typ: "Trade", attrs: map[string]interface{}{"price": 101.0}},
+	}))
+
+	// With more than one event, which is meant is ambiguous
+	_, err = Parse("EVENT SEQ(A a, B b) WHERE a.x > 1 AND price > 100")
+	perr, ok := err.(*ParseError)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, "Error parsing ttWhereClause: Ambiguous attribute price: the query has more than one event, so it "+
+		"must be qualified with an alias (eg. a.price)", perr.Msg)
+	require.Equal(t, "price", perr.Token)
+	require.Equal(t, 39, perr.Column)
+}
+
+func TestComments(t *testing.T) {
+	plain := "EVENT SEQ(A a, !(B b), C c) WHERE a.x > 1 AND a.y == 'a -- b /* c */' AND c.z - -1 > a.x PARTITION BY sym " +
+		"WITHIN 1h"
+	commented := `-- Spikes which aren't cancelled
+EVENT SEQ(A a, /* unless */ !(B b), C c)
+WHERE
+	a.x > 1 -- a.x is a count
+	AND a.y == 'a -- b /* c */' /* the string
+	isn't a comment */ AND c.z - -1 > a.x --
+PARTITION/**/BY sym
+WITHIN 1h -- The end`
+	expected, err := Parse(plain)
+	require.NoError(t, err)
+	q, err := Parse(commented)
+	require.NoError(t, err)
+	require.True(t, expected.predicate.Equal(q.predicate))
+	require.Equal(t, expected.QueryText(), q.QueryText())
+
+	// Errors are still located in the original query
+	_, err = Parse("EVENT a b /* a comment */\nWHERE b.x > > 1")
+	perr, ok := err.(*ParseError)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, 2, perr.Line)
+
+	_, err = Parse("EVENT a b WHERE b.x > 1 /* unterminated")
+	perr, ok = err.(*ParseError)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, "Error tokenizing: Unterminated comment", perr.Msg)
+	require.Equal(t, 25, perr.Column)
+
+	q, err = Parse("EVENT a b WHERE b.x == 1 /* 'quotes in comments aren't strings */")
+	require.NoError(t, err)
+	q, err = Parse("EVENT a b WHERE b.x == \"\\\"--\" -- \"")
+	require.NoError(t, err)
+	require.Equal(t, `EVENT a b WHERE b.x == "\"--"`, q.QueryText())
+}
+
+func TestCaseInsensitiveKeywords(t *testing.T) {
+	mixed := "event Seq(A a, !(B b), aNy(C c, D d)) Where a.x between 1 And 2 or Not (a.y iN (True, fAlSe, NULL)) " +
+		"aNd a.Z Is nOt Null AND a.s StartsWith 'x' and a.s matches 'y' oR a.s endswith 'z' AND a.s Contains 'w' " +
+		"partition BY a.Sym within 1H"
+	q, err := Parse(mixed)
+	require.NoError(t, err)
+	require.Equal(t, "EVENT SEQ(A a, !(B b), ANY(C c, D d)) WHERE (a.x BETWEEN 1.000000 AND 2.000000 OR "+
+		"(NOT (a.y IN (true, false, null)) AND a.Z IS NOT NULL AND a.s STARTSWITH \"x\" AND a.s MATCHES \"y\") OR "+
+		"(a.s ENDSWITH \"z\" AND a.s CONTAINS \"w\")) PARTITION BY a.Sym WITHIN 1h", q.QueryText())
+
+	// Identifiers are still case-sensitive
+	require.Equal(t, map[string]string{"a": "A", "b": "B", "c": "C", "d": "D"}, q.Captures())
+	_, err = Parse("EVENT SEQ(A a, B b) WHERE A.x > 1")
+	require.Error(t, err)
+}
+
+func TestQuotedNames(t *testing.T) {
+	cases := map[string]string{
+		// Names containing dots, spaces and backticks, and keywords
+		"EVENT SEQ(A a, B b) WHERE a.`user.id` == b.x": "EVENT SEQ(A a, B b) WHERE a.`user.id` == b.x",
+		"EVENT SEQ(A `first event`, B b) WHERE `first event`.x > b.`a b`.c": "EVENT SEQ(A `first event`, B b) WHERE " +
+			"`first event`.x > b.`a b`.c",
+		"EVENT SEQ(A a, B `in`) WHERE a.`order` == `in`.`in` AND `in` != a": "EVENT SEQ(A a, B `in`) WHERE " +
+			"(a.order == in.in AND `in` != a)",
+		"EVENT A a WHERE a.`x``y` == 1 AND `a`.`x` == 2": "EVENT A a WHERE (a.`x``y` == 1.000000 AND a.x == 2.000000)",
+		// Quoted, LEN and TS are attributes rather than the length and timestamp of the event
+		"EVENT A+ a[] WHERE a.`LEN` > a.LEN AND a.`TS` < a.TS AND a.`--` == 1": "EVENT A+ a[] WHERE (a.`LEN` > a.LEN " +
+			"AND a.`TS` < a.TS AND a.`--` == 1.000000)",
+		"EVENT SEQ(A a, B+ `b b`[]) WHERE `b b`[i].`x.y` > first(`b b`[]).`x.y` AND a.m[\"k\"].`p q` == sum(`b b`[].z)": "" +
+			"EVENT SEQ(A a, B+ `b b`[]) WHERE (`b b`[i].`x.y` > first(`b b`[]).`x.y` AND a.m[\"k\"].`p q` == " +
+			"sum(`b b`[].z))",
+		"EVENT A a WHERE `price` > 1 PARTITION BY `user.id`": "EVENT A a WHERE a.price > 1.000000 PARTITION BY `user.id`",
+	}
+	for queryText, expected := range cases {
+		q, err := Parse(queryText)
+		require.NoError(t, err, queryText)
+		require.Equal(t, expected, q.QueryText(), queryText)
+		reparsed, err := Parse(q.QueryText())
+		require.NoError(t, err, queryText)
+		require.True(t, q.predicate.Equal(reparsed.predicate), queryText)
+	}
+
+	q, err := Parse("EVENT SEQ(A `first event`, B b) WHERE `first event`.`user.id` == b.`order` AND b.`a b` > 1 " +
+		"PARTITION BY `user.id`")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"first event": "A", "b": "B"}, q.Captures())
+	a := &tEventImpl{typ: "A", attrs: map[string]interface{}{"user.id": 1.0, "user": map[string]interface{}{"id": 2.0}}}
+	b := &tEventImpl{typ: "B", attrs: map[string]interface{}{"order": 1.0, "a b": 2.0, "user.id": 1.0}}
+	require.Equal(t, Positive, q.Evaluate(domain.CapturedEvents{"first event": a, "b": b}))
+	b.attrs["order"] = 2.0
+	require.Equal(t, Negative, q.Evaluate(domain.CapturedEvents{"first event": a, "b": b}))
+	key, ok := q.PartitionKey(a)
+	require.True(t, ok)
+	require.Equal(t, 1.0, key)
+
+	require.Equal(t, "a.`user.id`", NewAttribute("a", "user.id").QueryText())
+	require.Equal(t, "`a b`.`LEN`", NewAttribute("a b", "LEN").QueryText())
+
+	// Quoted names can't be empty, and must be closed
+	for _, queryText := range []string{"EVENT A a WHERE a.`` == 1", "EVENT A a WHERE a.`x == 1", "EVENT A `a"} {
+		_, err := Parse(queryText)
+		require.Error(t, err, queryText)
+	}
+}
@@ -0,0 +1,108 @@
+package query
+
+import (
+	"context"
+	"sort"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// EvaluatePartial evaluates a predicate as EvaluateErr does, also reporting which of the aliases it uses are missing
+// from the events in a way which could still change the result (eg. to explain that a candidate is waiting for a B).
+// A comparison whose aliases have all been captured is settled; one which refers to any that haven't been is waiting
+// for them. AND is settled once any settled operand is Negative (or Invalid), and otherwise waits for whatever its
+// unsettled operands do; OR likewise, once any settled operand is Positive; NOT waits for whatever its operand does.
+// The missing aliases are sorted, and empty if the result is settled (or the predicate couldn't be evaluated).
+func EvaluatePartial(p Predicate, evs domain.CapturedEvents) (PredicateResult, []string) {
+	return missingAliases(evaluatePartial(withValueCache(context.Background(), evs), p, evs))
+}
+
+// EvaluatePartial evaluates the query's predicate with its comparators, as EvaluatePartial does. Without a predicate,
+// the result is Positive and settled.
+func (q *Query) EvaluatePartial(evs domain.CapturedEvents) (PredicateResult, []string) {
+	if q.predicate == nil {
+		return PredicateResult{Result: Positive}, []string{}
+	}
+	ctx := withComparators(withValueCache(context.Background(), evs), q.comparators)
+	return missingAliases(evaluatePartial(ctx, q.predicate, evs))
+}
+
+// missingAliases sorts the set of missing aliases from evaluatePartial, which are none if the predicate errored
+func missingAliases(result PredicateResult, missing map[string]struct{}) (PredicateResult, []string) {
+	if result.Err != nil {
+		return result, []string{}
+	}
+	aliases := make([]string, 0, len(missing))
+	for alias := range missing {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return result, aliases
+}
+
+// evaluatePartial implements EvaluatePartial, returning the set of missing aliases
+func evaluatePartial(ctx context.Context, p Predicate, evs domain.CapturedEvents) (PredicateResult,
+	map[string]struct{}) {
+	switch p := unwrapCondition(p).(type) {
+	case conjunction:
+		results, missing := evaluateOperandsPartial(ctx, p, evs, func(r Result) bool {
+			return r == Negative || r == Invalid
+		})
+		return AndResults(results...), missing
+
+	case disjunction:
+		results, missing := evaluateOperandsPartial(ctx, p, evs, func(r Result) bool {
+			return r == Positive
+		})
+		return OrResults(results...), missing
+
+	case *negationPredicate:
+		r, missing := evaluatePartial(ctx, p.Predicate, evs)
+		return negationResult(r, missing), missing
+
+	default:
+		r, err := evaluateObserved(ctx, p, evs)
+		missing := make(map[string]struct{})
+		for _, alias := range p.usedAliases() {
+			if _, ok := evs[alias]; !ok {
+				missing[alias] = struct{}{}
+			}
+		}
+		return PredicateResult{Result: r, Err: err}, missing
+	}
+}
+
+// negationResult inverts the result of NOT's operand, given the aliases it is missing, as NOT does: a Positive result
+// which isn't settled may be only because of a missing event, so is Uncertain until the event arrives
+func negationResult(r PredicateResult, missing map[string]struct{}) PredicateResult {
+	if r.Err == nil && r.Result == Positive && len(missing) > 0 {
+		return PredicateResult{Result: Uncertain}
+	}
+	return NotResult(r)
+}
+
+// evaluateOperandsPartial evaluates each of the operands of AND or OR (even once the result is known, since which of
+// them decide it matters), returning their results and the aliases they are missing: none, if any settled operand has
+// a result which settles the whole.
+func evaluateOperandsPartial(ctx context.Context, operands []Predicate, evs domain.CapturedEvents,
+	settles func(Result) bool) ([]PredicateResult, map[string]struct{}) {
+	var (
+		results = make([]PredicateResult, len(operands))
+		missing = make(map[string]struct{})
+		settled = false
+	)
+	for i, operand := range operands {
+		r, operandMissing := evaluatePartial(ctx, operand, evs)
+		results[i] = r
+		if len(operandMissing) == 0 && r.Err == nil && settles(r.Result) {
+			settled = true
+		}
+		for alias := range operandMissing {
+			missing[alias] = struct{}{}
+		}
+	}
+	if settled {
+		return results, make(map[string]struct{})
+	}
+	return results, missing
+}
@@ -0,0 +1,73 @@
+package query
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestEvaluatePartial(t *testing.T) {
+	a := &tEventImpl{typ: "A", attrs: map[string]interface{}{"x": 1, "y": 2}}
+	b := &tEventImpl{typ: "B", attrs: map[string]interface{}{"x": 2}}
+	cases := []struct {
+		where    string
+		evs      domain.CapturedEvents
+		expected Result
+		missing  []string
+	}{
+		{"a.x < b.x AND a.y == 2", domain.CapturedEvents{"a": a, "b": b}, Positive, []string{}},
+		{"a.x < b.x AND a.y == 2", domain.CapturedEvents{"a": a}, Positive, []string{"b"}},
+		{"a.x < b.x AND a.y == 3", domain.CapturedEvents{"a": a}, Negative, []string{}}, // Settled by a alone
+		{"a.x < b.x AND c.x IS NULL", domain.CapturedEvents{"a": a}, Uncertain, []string{"b", "c"}},
+		{"a.x < b.x AND c.x IS NULL", domain.CapturedEvents{"a": a, "b": b}, Uncertain, []string{"c"}},
+		{"a.y == 2 OR c.x IS NULL", domain.CapturedEvents{"a": a}, Positive, []string{}},
+		{"a.y == 3 OR c.x IS NULL", domain.CapturedEvents{"a": a}, Uncertain, []string{"c"}},
+		{"NOT (a.x == b.x)", domain.CapturedEvents{"a": a}, Uncertain, []string{"b"}}, // Not inverted until b arrives
+		{"NOT (a.x == 2 AND b.x == 2)", domain.CapturedEvents{"a": a}, Positive, []string{}},
+		{"NOT (a.x == b.x)", domain.CapturedEvents{"a": a, "b": b}, Positive, []string{}},
+		{"a.y == 2 AND (b.x BETWEEN 1 AND 3 OR c.x IN (1, 2))", domain.CapturedEvents{"a": a}, Uncertain,
+			[]string{"b", "c"}},
+		{"a.y == 2 AND (b.x BETWEEN 1 AND 3 OR c.x IN (1, 2))", domain.CapturedEvents{"a": a, "b": b}, Positive,
+			[]string{}},
+		{"a.z > 1 AND b.x > 1", domain.CapturedEvents{"a": a}, Negative, []string{}}, // An error settles it
+	}
+	for _, c := range cases {
+		q, err := Parse("EVENT SEQ(A a, B b, C c) WHERE " + c.where)
+		require.NoError(t, err, c.where)
+		result, missing := EvaluatePartial(q.predicate, c.evs)
+		expected, expectedErr := q.predicate.EvaluateErr(c.evs)
+		require.Equal(t, PredicateResult{Result: expected, Err: expectedErr}, result, "%s with %d", c.where, len(c.evs))
+		require.Equal(t, c.expected, result.Result, "%s with %d", c.where, len(c.evs))
+		require.Equal(t, c.missing, missing, "%s with %d", c.where, len(c.evs))
+
+		result, missing = q.EvaluatePartial(c.evs)
+		require.Equal(t, PredicateResult{Result: expected, Err: expectedErr}, result, "%s with %d", c.where, len(c.evs))
+		require.Equal(t, c.missing, missing, "%s with %d", c.where, len(c.evs))
+	}
+
+	// The query's comparators apply, and without a predicate it is settled
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE a.x == 'ONE' AND b.x > 1")
+	require.NoError(t, err)
+	q.SetComparator(reflect.TypeOf(""), func(a, b interface{}) (int, bool) {
+		return strings.Compare(strings.ToLower(a.(string)), strings.ToLower(b.(string))), true
+	})
+	result, missing := q.EvaluatePartial(domain.CapturedEvents{"a": &tEventImpl{typ: "A",
+		attrs: map[string]interface{}{"x": "one"}}})
+	require.Equal(t, PredicateResult{Result: Positive}, result)
+	require.Equal(t, []string{"b"}, missing)
+	q, err = Parse("EVENT A a")
+	require.NoError(t, err)
+	result, missing = q.EvaluatePartial(domain.CapturedEvents{})
+	require.Equal(t, PredicateResult{Result: Positive}, result)
+	require.Equal(t, []string{}, missing)
+
+	// Building conditions wraps them, which makes no difference
+	result, missing = EvaluatePartial(Attr("a", "x").Lt(Attr("b", "x")).And(Attr("a", "y").Eq(Lit(2))),
+		domain.CapturedEvents{"a": a})
+	require.Equal(t, PredicateResult{Result: Positive}, result)
+	require.Equal(t, []string{"b"}, missing)
+}
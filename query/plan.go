@@ -0,0 +1,194 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A Plan describes how a query is matched against a stream of events, with estimates of how expensive its predicate is
+// and how selective (see Query.Plan)
+type Plan struct {
+	Query         string // The text of the query
+	Strategy      SelectionStrategy
+	Window        time.Duration // 0 if there is no window of time
+	WindowCount   int           // 0 if there is no window of events (see Query.WindowCount)
+	Partition     string        // "" if the query isn't partitioned
+	Lateness      time.Duration
+	MaxCandidates int
+	// Stages are the events the query captures, in the order they are declared (see PlanStage). If the event clause
+	// has alternatives, each is matched separately, so has a plan of its own instead.
+	Stages       []PlanStage
+	Alternatives []*Plan
+	// Cost and Selectivity are estimates for the whole predicate (see Cost): the selectivity is the fraction of
+	// candidates which have captured every event that are expected to satisfy it, from 0 to 1
+	Cost        int
+	Selectivity float64
+}
+
+// A PlanStage is a step of a plan: the capture of one of the query's events. Predicate is the part of the query's
+// predicate which can be evaluated once the event, and those which are required by the stages before it, are captured
+// (nil if no part can): candidates for which it is Negative are ruled out before the rest of the predicate is
+// evaluated. Events captured by ANY aren't required, so aren't counted as captured by the stages after them; nor are
+// negated events, which would rule out the candidate.
+type PlanStage struct {
+	Alias       string
+	Type        string
+	Negated     bool
+	Kleene      bool
+	Greedy      bool // If it is a Kleene closure
+	Predicate   Predicate
+	Cost        int
+	Selectivity float64 // Of the predicate; 1 if there is none
+}
+
+// Plan describes how the query is matched against a stream of events (see Plan)
+func (q *Query) Plan() *Plan {
+	plan := &Plan{
+		Query:         q.QueryText(),
+		Strategy:      q.strategy,
+		Window:        q.window,
+		WindowCount:   q.windowCount,
+		Partition:     q.partition,
+		Lateness:      q.lateness,
+		MaxCandidates: q.maxCandidates,
+		Selectivity:   1,
+	}
+	if q.predicate != nil {
+		plan.Cost, plan.Selectivity = Cost(q.predicate), selectivity(q.predicate)
+	}
+	if alts := q.alternatives(); alts != nil {
+		for _, alt := range alts {
+			plan.Alternatives = append(plan.Alternatives, alt.Plan())
+		}
+		return plan
+	}
+	plan.Stages, _ = q.stages(q.capture, nil, false)
+	return plan
+}
+
+// stages returns the stages of capturing the events of c, given the aliases required by those before it, along with
+// the aliases required once they have been
+func (q *Query) stages(c EventCapture, before []string, negated bool) ([]PlanStage, []string) {
+	switch c := c.(type) {
+	case *basicEventCapture:
+		return []PlanStage{q.stage(c.name, c.eventType, before, negated)}, withAlias(before, c.name)
+	case *kleeneEventCapture:
+		stage := q.stage(c.name, c.eventType, before, negated)
+		stage.Kleene, stage.Greedy = true, !c.reluctant
+		return []PlanStage{stage}, withAlias(before, c.name)
+	case seqEventCapture:
+		return q.stagesOf(c, before, negated)
+	case allEventCapture:
+		return q.stagesOf(c, before, negated)
+	case anyEventCapture:
+		var result []PlanStage
+		for _, sub := range c {
+			stages, _ := q.stages(sub, before, negated)
+			result = append(result, stages...)
+		}
+		return result, before
+	case *negatedEventCapture:
+		stages, _ := q.stages(c.EventCapture, before, true)
+		return stages, before
+	}
+	return nil, before
+}
+
+// withAlias returns a copy of some aliases with another added
+func withAlias(aliases []string, alias string) []string {
+	return append(append(make([]string, 0, len(aliases)+1), aliases...), alias)
+}
+
+// stagesOf returns the stages of capturing each of several events in turn (see stages)
+func (q *Query) stagesOf(cs []EventCapture, before []string, negated bool) ([]PlanStage, []string) {
+	var result []PlanStage
+	for _, c := range cs {
+		stages, after := q.stages(c, before, negated)
+		result, before = append(result, stages...), after
+	}
+	return result, before
+}
+
+func (q *Query) stage(alias, eventType string, before []string, negated bool) PlanStage {
+	stage := PlanStage{Alias: alias, Type: eventType, Negated: negated, Selectivity: 1}
+	if q.predicate == nil {
+		return stage
+	}
+	captured := map[string]struct{}{alias: {}}
+	for _, alias := range before {
+		captured[alias] = struct{}{}
+	}
+	if stage.Predicate = evaluablePart(q.predicate, captured); stage.Predicate != nil {
+		stage.Cost, stage.Selectivity = Cost(stage.Predicate), selectivity(stage.Predicate)
+	}
+	return stage
+}
+
+// String renders the plan as text, eg.
+//
+//	EVENT SEQ(A a, B b) WHERE (a.x > 1.000000 AND b.x > a.x) WITHIN 5m
+//	strategy: skip-till-next-match
+//	window: 5m
+//	1. A a: a.x > 1.000000 (cost 3, selectivity 0.33)
+//	2. B b: (a.x > 1.000000 AND b.x > a.x) (cost 6, selectivity 0.11)
+//	predicate: cost 6, selectivity 0.11
+func (p *Plan) String() string {
+	return strings.Join(p.lines(""), "\n")
+}
+
+// lines returns the lines of the plan's text, each indented
+func (p *Plan) lines(indent string) []string {
+	lines := []string{p.Query, "strategy: " + p.Strategy.String()}
+	if window := formatWindow(p.Window, p.WindowCount); window != "" {
+		lines = append(lines, "window: "+window)
+	}
+	if p.Partition != "" {
+		lines = append(lines, "partition: "+p.Partition)
+	}
+	if p.Lateness != 0 {
+		lines = append(lines, "lateness: "+formatDuration(p.Lateness))
+	}
+	if p.MaxCandidates != 0 {
+		lines = append(lines, fmt.Sprintf("max candidates: %d", p.MaxCandidates))
+	}
+	for i, alt := range p.Alternatives {
+		lines = append(lines, fmt.Sprintf("alternative %d:", i+1))
+		lines = append(lines, alt.lines("  ")...)
+	}
+	for i, s := range p.Stages {
+		if s.Predicate == nil {
+			lines = append(lines, fmt.Sprintf("%d. %s: -", i+1, s.captureText()))
+		} else {
+			lines = append(lines, fmt.Sprintf("%d. %s: %s (cost %d, selectivity %.2f)", i+1, s.captureText(),
+				s.Predicate.QueryText(), s.Cost, s.Selectivity))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("predicate: cost %d, selectivity %.2f", p.Cost, p.Selectivity))
+	for i := range lines {
+		lines[i] = indent + lines[i]
+	}
+	return lines
+}
+
+// captureText returns the capture of the stage's event as it is written in a query (eg. "!(B b)" or "C+ c[]")
+func (s PlanStage) captureText() string {
+	var text string
+	switch {
+	case s.Kleene && s.Greedy:
+		text = s.Type + "+ " + quoteName(s.Alias) + "[]"
+	case s.Kleene:
+		text = s.Type + "+? " + quoteName(s.Alias) + "[]"
+	default:
+		text = s.Type + " " + quoteName(s.Alias)
+	}
+	if s.Negated {
+		return "!(" + text + ")"
+	}
+	return text
+}
+
+// Explain describes how the query is matched against a stream of events, as text (see Plan.String)
+func (q *Query) Explain() string {
+	return q.Plan().String()
+}
@@ -0,0 +1,102 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, !(B b), C+ c[]) WHERE a.id == b.id AND c.id == a.id AND a.x IN (1, 2) " +
+		"WITHIN 5m AND 10 EVENTS")
+	require.NoError(t, err)
+	plan := q.Plan()
+	require.Equal(t, q.QueryText(), plan.Query)
+	require.Equal(t, 5*time.Minute, plan.Window)
+	require.Equal(t, 10, plan.WindowCount)
+	require.Nil(t, plan.Alternatives)
+	require.Len(t, plan.Stages, 3)
+
+	// Each stage is held to the part of the predicate its event and those required before it can evaluate: the negated
+	// event isn't required, so the stage after it can't use it
+	a, b, c := plan.Stages[0], plan.Stages[1], plan.Stages[2]
+	require.Equal(t, PlanStage{Alias: "a", Type: "A", Predicate: a.Predicate, Cost: a.Cost, Selectivity: a.Selectivity}, a)
+	require.Equal(t, "a.x IN (1.000000, 2.000000)", a.Predicate.QueryText())
+	require.True(t, b.Negated)
+	require.Equal(t, "(a.id == b.id AND a.x IN (1.000000, 2.000000))", b.Predicate.QueryText())
+	require.True(t, c.Kleene)
+	require.True(t, c.Greedy)
+	require.Equal(t, "(c.id == a.id AND a.x IN (1.000000, 2.000000))", c.Predicate.QueryText())
+	require.Equal(t, Cost(c.Predicate), c.Cost)
+	require.InDelta(t, 0.02, c.Selectivity, 1e-9)
+	require.Equal(t, Cost(q.predicate), plan.Cost)
+	require.InDelta(t, 0.002, plan.Selectivity, 1e-9)
+
+	// Events captured by ANY aren't required either
+	q, err = Parse("EVENT SEQ(ANY(A a, B b), C c) WHERE a.x == 1 AND c.x == 1")
+	require.NoError(t, err)
+	plan = q.Plan()
+	require.Len(t, plan.Stages, 3)
+	require.Equal(t, "a.x == 1.000000", plan.Stages[0].Predicate.QueryText())
+	require.Nil(t, plan.Stages[1].Predicate)
+	require.InDelta(t, 1, plan.Stages[1].Selectivity, 0)
+	require.Equal(t, "c.x == 1.000000", plan.Stages[2].Predicate.QueryText())
+
+	// Alternatives are planned separately, each with its own part of the predicate
+	q, err = Parse("EVENT SEQ(A a, B b) OR A a WHERE a.x > 1 AND b.x > 1")
+	require.NoError(t, err)
+	plan = q.Plan()
+	require.Nil(t, plan.Stages)
+	require.Len(t, plan.Alternatives, 2)
+	require.Len(t, plan.Alternatives[0].Stages, 2)
+	require.Equal(t, "(a.x > 1.000000 AND b.x > 1.000000)", plan.Alternatives[0].Stages[1].Predicate.QueryText())
+	require.Len(t, plan.Alternatives[1].Stages, 1)
+	require.Equal(t, "a.x > 1.000000", plan.Alternatives[1].Stages[0].Predicate.QueryText())
+}
+
+func TestSelectivity(t *testing.T) {
+	selectivityOf := func(where string) float64 {
+		q, err := Parse("EVENT SEQ(A a, B b) WHERE " + where)
+		require.NoError(t, err, where)
+		return selectivity(q.predicate)
+	}
+
+	require.InDelta(t, 0.1, selectivityOf("a.x == 1"), 1e-9)
+	require.InDelta(t, 0.9, selectivityOf("a.x != 1"), 1e-9)
+	require.InDelta(t, 0.033, selectivityOf("a.x == 1 AND b.x > 1"), 1e-9)
+	require.InDelta(t, 1-0.9*0.67, selectivityOf("a.x == 1 OR b.x > 1"), 1e-9)
+	require.InDelta(t, 0.9, selectivityOf("NOT a.x == 1"), 1e-9)
+	require.InDelta(t, 0.3, selectivityOf("a.x IN (1, 2, 3)"), 1e-9)
+	require.True(t, selectivityOf("a.x BETWEEN 1 AND 2") < selectivityOf("a.x > 1"))
+	require.InDelta(t, 1, selectivityOf("1 == 1"), 0)
+	require.InDelta(t, 0, selectivityOf("1 == 2"), 0)
+}
+
+func TestExplain(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, B+? b[]) WHERE a.x > 1 AND b.x > a.x PARTITION BY id WITHIN 5m")
+	require.NoError(t, err)
+	require.Equal(t, "EVENT SEQ(A a, B+? b[]) WHERE (a.x > 1.000000 AND b.x > a.x) PARTITION BY id WITHIN 5m\n"+
+		"strategy: skip-till-next-match\n"+
+		"window: 5m\n"+
+		"partition: id\n"+
+		"1. A a: a.x > 1.000000 (cost 3, selectivity 0.33)\n"+
+		"2. B+? b[]: (a.x > 1.000000 AND b.x > a.x) (cost 6, selectivity 0.11)\n"+
+		"predicate: cost 6, selectivity 0.11", q.Explain())
+
+	q, err = Parse("EVENT A a OR B b")
+	require.NoError(t, err)
+	require.Equal(t, "EVENT A a OR B b\n"+
+		"strategy: skip-till-next-match\n"+
+		"alternative 1:\n"+
+		"  EVENT A a\n"+
+		"  strategy: skip-till-next-match\n"+
+		"  1. A a: -\n"+
+		"  predicate: cost 0, selectivity 1.00\n"+
+		"alternative 2:\n"+
+		"  EVENT B b\n"+
+		"  strategy: skip-till-next-match\n"+
+		"  1. B b: -\n"+
+		"  predicate: cost 0, selectivity 1.00\n"+
+		"predicate: cost 0, selectivity 1.00", q.Explain())
+}
@@ -1,25 +1,236 @@
 package query
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"strings"
+	"time"
 
-	log "github.com/cihub/seelog"
+	"github.com/shopspring/decimal"
 
 	"github.com/obeattie/sase/domain"
 )
 
-func leftRightVals(evs domain.CapturedEvents, left, right value) (interface{}, interface{}, error) {
+func leftRightVals(ctx context.Context, evs domain.CapturedEvents, left, right value) (interface{}, interface{}, error) {
 	if left == nil || right == nil {
 		return nil, nil, fmt.Errorf("Left and right must not be nil")
-	} else if leftVal, err := left.Value(evs); err != nil {
-		return nil, nil, err
-	} else if rightVal, err := right.Value(evs); err != nil {
+	}
+	leftVal, err := resolve(ctx, left, evs)
+	if err != nil {
+		return nil, nil, eitherMissing(err, func() error {
+			_, err := resolve(ctx, right, evs)
+			return err
+		})
+	} else if rightVal, err := resolve(ctx, right, evs); err != nil {
 		return nil, nil, err
 	} else {
-		return leftVal, rightVal, err
+		return leftVal, rightVal, nil
+	}
+}
+
+// eitherMissing returns the error resolving a left operand, unless it could be resolved but not used (eg. an aggregate
+// of no values) and the right operand's event is missing, in which case it is ErrEventNotFound: as it would be the
+// other way around, since an operand which can't be resolved yet decides the result regardless of the other.
+func eitherMissing(leftErr error, resolveRight func() error) error {
+	if errors.Is(leftErr, ErrEventNotFound) {
+		return leftErr
+	} else if rightErr := resolveRight(); errors.Is(rightErr, ErrEventNotFound) {
+		return rightErr
+	}
+	return leftErr
+}
+
+// numericValue coerces any of Go's numeric kinds to a float64, so that (for example) int(1) and float64(1.0) compare
+// as equal. ok is false if v is not numeric.
+func numericValue(v interface{}) (f float64, ok bool) {
+	switch val := v.(type) { // The common cases, without reflection
+	case float64:
+		return val, true
+	case int:
+		return float64(val), true
+	case decimal.Decimal:
+		return val.InexactFloat64(), true
+	case time.Duration:
+		return val.Seconds(), true
+	case string, bool, nil:
+		return 0, false
+	}
+	switch val := reflect.ValueOf(v); val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(val.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// valuesEqual reports whether two values are equal. Numeric values are compared by value regardless of their type, and
+// times are equal if they represent the same instant; anything else must be deeply equal.
+func valuesEqual(left, right interface{}) bool {
+	// Fast path for the common scalar types, which avoids reflection
+	switch l := left.(type) {
+	case string:
+		if r, ok := right.(string); ok {
+			return l == r
+		}
+	case float64:
+		if r, ok := right.(float64); ok {
+			return l == r
+		}
+	case bool:
+		if r, ok := right.(bool); ok {
+			return l == r
+		}
+	case nil:
+		return right == nil
+	}
+
+	if l, r, ok := decimalOperands(left, right); ok {
+		return l.Equal(r)
+	}
+	if leftNum, ok := numericValue(left); ok {
+		if rightNum, ok := numericValue(right); ok {
+			return leftNum == rightNum
+		}
+	}
+	if leftTime, ok := left.(time.Time); ok {
+		if rightTime, ok := right.(time.Time); ok {
+			return leftTime.Equal(rightTime)
+		}
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+// isNaN reports whether v is a floating-point NaN. NaN is unordered: any ordering comparison with it doesn't match,
+// and it is not equal to anything (even itself).
+func isNaN(v interface{}) bool {
+	f, ok := numericValue(v)
+	return ok && math.IsNaN(f)
+}
+
+// compareValues orders two values, returning a negative number, zero or a positive number as left is less than, equal to
+// or greater than right. ok is false if the values cannot be ordered against each other.
+func compareValues(left, right interface{}) (cmp int, ok bool) {
+	if l, r, ok := decimalOperands(left, right); ok {
+		return l.Cmp(r), true
+	}
+	if leftNum, ok := numericValue(left); ok {
+		if rightNum, ok := numericValue(right); ok {
+			switch {
+			case leftNum < rightNum:
+				return -1, true
+			case leftNum > rightNum:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+
+	switch left := left.(type) {
+	case string:
+		if right, ok := right.(string); ok {
+			switch {
+			case left < right:
+				return -1, true
+			case left > right:
+				return 1, true
+			}
+			return 0, true
+		}
+
+	case time.Time:
+		if right, ok := right.(time.Time); ok {
+			switch {
+			case left.Before(right):
+				return -1, true
+			case left.After(right):
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// dedupeAliases removes duplicate aliases, preserving the order in which they first appear
+func dedupeAliases(aliases []string) []string {
+	seen := make(map[string]bool, len(aliases))
+	result := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		if !seen[alias] {
+			seen[alias] = true
+			result = append(result, alias)
+		}
+	}
+	return result
+}
+
+// valueText renders a (possibly nil) value
+func valueText(v value) string {
+	if v == nil {
+		return ""
+	}
+	return v.QueryText()
+}
+
+// joinText joins the parts of a predicate's text with spaces, leaving out those which are empty (eg. the missing
+// operands of a partially-constructed predicate) so that no stray spaces are left either
+func joinText(parts ...string) string {
+	nonEmpty := parts[:0:0]
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, " ")
+}
+
+// sameValue reports whether two (possibly nil) values are structurally identical
+func sameValue(a, b value) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(b)
+}
+
+func sameValues(a, b []value) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameValue(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// samePredicate reports whether two (possibly nil) predicates are structurally identical
+func samePredicate(a, b Predicate) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
 	}
+	return a.Equal(b)
+}
+
+// samePath reports whether two attribute key paths are identical (treating nil and empty as the same)
+func samePath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 type Result uint8
@@ -48,6 +259,25 @@ func (r Result) Or(r2 Result) Result {
 	}
 }
 
+// MarshalText renders the result in lower case (eg. "positive"), so it may be used as a JSON value or map key
+func (r Result) MarshalText() ([]byte, error) {
+	if r > Invalid {
+		return nil, fmt.Errorf("Cannot marshal unknown result %d", r)
+	}
+	return []byte(strings.ToLower(r.String())), nil
+}
+
+// UnmarshalText parses a result rendered by MarshalText (in any case)
+func (r *Result) UnmarshalText(text []byte) error {
+	for candidate := Positive; candidate <= Invalid; candidate++ {
+		if strings.EqualFold(string(text), candidate.String()) {
+			*r = candidate
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown result %q", text)
+}
+
 //go:generate stringer -type=Result
 
 const (
@@ -63,134 +293,245 @@ const (
 	Invalid
 )
 
+// A Predicate is a condition over captured events. Predicates aren't modified by evaluating them, so one may be
+// evaluated from many goroutines at once (against the same events or different ones): any state an evaluation needs,
+// such as its cache of resolved values, belongs to that call. The events must not be modified while they are being
+// evaluated.
 type Predicate interface {
 	Representable
-	// Evaluates the predicate against the set of captured events, returning its match status.
+	// Evaluates the predicate against the set of captured events, returning its match status. If the predicate
+	// cannot be evaluated, the error is logged and the result is Negative.
 	Evaluate(domain.CapturedEvents) Result
+	// EvaluateErr is like Evaluate, but returns an error if the predicate cannot be evaluated (eg. its operands are of
+	// incomparable types) rather than logging it. This distinguishes a definite non-match from a broken query.
+	EvaluateErr(domain.CapturedEvents) (Result, error)
+	// EvaluateContext is like EvaluateErr, but abandons evaluation (returning the context's error) once the context is
+	// done. EvaluateErr is equivalent to calling this with context.Background().
+	EvaluateContext(context.Context, domain.CapturedEvents) (Result, error)
+	// Equal reports whether other is structurally identical to the predicate: the same tree of predicates and values,
+	// though not necessarily the same pointers. The operands of commutative operators may be in any order (so a == b is
+	// equal to b == a, and a AND b to b AND a), and comparisons may be reversed along with their operators (so a < b is
+	// equal to b > a).
+	Equal(other Predicate) bool
+	// Hash returns a hash of the predicate, which is the same for predicates which are Equal (eg. to deduplicate them)
+	Hash() uint64
+	// Clone returns a deep copy of the predicate, which is Equal to it but shares none of its (mutable) nodes, so that
+	// either may be modified without affecting the other
+	Clone() Predicate
+	// Validate returns an error naming any alias the predicate uses which is not amongst those declared
+	Validate(declared map[string]struct{}) error
 	// usedAliases returns the events aliases which are consulted during evaluation
 	usedAliases() []string
+	// children returns the predicates and values directly beneath this one in the tree (see Walk)
+	children() []interface{}
+	// compile returns the predicate's compiled form (see Compile)
+	compile() compiledPredicate
 }
 
-type op uint8
+// validateAliases implements Validate in terms of usedAliases
+func validateAliases(p Predicate, declared map[string]struct{}) error {
+	undeclared := make([]string, 0)
+	for _, alias := range p.usedAliases() {
+		if _, ok := declared[alias]; !ok {
+			undeclared = append(undeclared, alias)
+		}
+	}
+	if len(undeclared) > 0 {
+		return fmt.Errorf("Reference to nonexistent capture %s", strings.Join(undeclared, ", "))
+	}
+	return nil
+}
+
+// evaluateOrLog implements Evaluate in terms of EvaluateContext: errors are logged and terminate the match
+func evaluateOrLog(name string, p Predicate, evs domain.CapturedEvents) Result {
+	result, err := evaluateObserved(context.Background(), p, evs)
+	if err != nil {
+		logger.Errorf("[sase:%s] %s", name, err.Error())
+		return Negative // Terminate this match
+	}
+	return result
+}
+
+// An Op is a comparison operator
+type Op uint8
+
+const (
+	OpEq  Op = iota // equal to (==)
+	OpNe            // not equal to (!=)
+	OpGt            // greater than (>)
+	OpLt            // less than (<)
+	OpGe            // greater than or equal to (>=)
+	OpLe            // less than or equal to (<=)
+	OpIEq           // equal to, ignoring case (~=)
+)
+
+// The names used internally
+type op = Op
 
 const (
-	opEq op = iota // equal to (==)
-	opNe           // not equal to (!=)
-	opGt           // greater than (>)
-	opLt           // less than (<)
-	opGe           // greater than or equal to (>=)
-	opLe           // less than or equal to (<=)
+	opEq  = OpEq
+	opNe  = OpNe
+	opGt  = OpGt
+	opLt  = OpLt
+	opGe  = OpGe
+	opLe  = OpLe
+	opIEq = OpIEq
 )
 
-// An operatorPredicate evaluates an operator between two values
+// A Comparison is a predicate which compares two values with an Op. Any predicate built by NewComparison (or parsed
+// from eg. "a.x > b.x") is a Comparison.
+type Comparison interface {
+	Predicate
+	Left() Value
+	Right() Value
+	Op() Op
+}
+
+// An operatorPredicate evaluates an operator between two values. While either's event is missing it is Positive, as it
+// can't yet rule a candidate out; but a missing part of an attribute's path (see ErrAttributeNotFound) is Uncertain.
 type operatorPredicate struct {
 	left  value
 	right value
 	op    op
 }
 
+// NewComparison returns a predicate which compares left and right with op
+func NewComparison(left, right Value, op Op) Predicate {
+	return &operatorPredicate{left: left, right: right, op: op}
+}
+
+func (p *operatorPredicate) Left() Value {
+	return p.left
+}
+
+func (p *operatorPredicate) Right() Value {
+	return p.right
+}
+
+func (p *operatorPredicate) Op() Op {
+	return p.op
+}
+
 func (p *operatorPredicate) Evaluate(evs domain.CapturedEvents) Result {
-	leftVal, rightVal, err := leftRightVals(evs, p.left, p.right)
-	if err == ErrEventNotFound {
-		return Positive
+	return evaluateOrLog("operatorPredicate", p, evs)
+}
+
+func (p *operatorPredicate) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return evaluateObserved(context.Background(), p, evs)
+}
+
+func (p *operatorPredicate) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	ctx = withValueCache(ctx, evs)
+	leftVal, rightVal, err := leftRightVals(ctx, evs, p.left, p.right)
+	if errors.Is(err, ErrAttributeNotFound) {
+		return Uncertain, nil
+	} else if errors.Is(err, ErrEventNotFound) {
+		return Positive, nil
 	} else if err != nil {
-		log.Errorf("[sase:operatorPredicate] Could not evaluate %s left/right: %s", p.QueryText(), err.Error())
-		return Negative // Terminate this match
+		return Negative, fmt.Errorf("Could not evaluate %s left/right: %w", p.QueryText(), err)
 	}
 
-	switch p.op {
-	case opEq:
-		if reflect.DeepEqual(leftVal, rightVal) {
-			return Positive
-		}
-		return Negative
+	compare := p.op.comparator(comparatorsFor(ctx))
+	if compare == nil {
+		return Negative, fmt.Errorf("Unhandled op %v for %s", p.op, p.QueryText())
+	} else if matched, ok := compare(leftVal, rightVal); !ok {
+		return Negative, fmt.Errorf("Could not order %T and %T: %s", leftVal, rightVal, p.QueryText())
+	} else if matched {
+		return Positive, nil
+	}
+	return Negative, nil
+}
 
+// symbol returns the operator as it is written in a query (or "" if it is unknown)
+func (o op) symbol() string {
+	switch o {
+	case opEq:
+		return "=="
 	case opNe:
-		if !reflect.DeepEqual(leftVal, rightVal) {
-			return Positive
-		}
-		return Negative
+		return "!="
+	case opGt:
+		return ">"
+	case opLt:
+		return "<"
+	case opGe:
+		return ">="
+	case opLe:
+		return "<="
+	case opIEq:
+		return "~="
+	default: // Rendered explicitly, rather than as nothing, so that it is obvious (if not parseable)
+		return fmt.Sprintf("<?op=%d?>", uint8(o))
+	}
+}
 
-	// >, <, >=, <= only work for float64's (currently)
+// converse returns the operator which compares the other way around (eg. > for <), which for those which are
+// commutative (eg. ==) is the same one
+func (o op) converse() op {
+	switch o {
 	case opGt:
-		if leftVal, ok := leftVal.(float64); ok {
-			if rightVal, ok := rightVal.(float64); ok {
-				if leftVal > rightVal {
-					return Positive
-				}
-				return Negative
-			}
+		return opLt
+	case opLt:
+		return opGt
+	case opGe:
+		return opLe
+	case opLe:
+		return opGe
+	default:
+		return o
+	}
+}
+
+// A comparator applies an operator to two resolved values. ok is false if the operator can't compare them.
+type comparator func(left, right interface{}) (matched, ok bool)
+
+// comparator returns the function which implements the operator (consulting cs before the defaults), or nil if it is
+// unknown
+func (o op) comparator(cs comparators) comparator {
+	switch o {
+	case opEq:
+		return func(left, right interface{}) (bool, bool) {
+			return cs.equal(left, right), true
 		}
-		log.Errorf("[sase:operatorPredicate] Could not compare gt for non-float64: %s", p.QueryText())
-		return Negative // Terminate this match
 
-	case opLt:
-		if leftVal, ok := leftVal.(float64); ok {
-			if rightVal, ok := rightVal.(float64); ok {
-				if leftVal < rightVal {
-					return Positive
-				}
-				return Negative
-			}
+	case opNe:
+		return func(left, right interface{}) (bool, bool) {
+			return !cs.equal(left, right), true
 		}
-		log.Errorf("[sase:operatorPredicate] Could not compare lt for non-float64: %s", p.QueryText())
-		return Negative // Terminate this match
 
-	case opGe:
-		if leftVal, ok := leftVal.(float64); ok {
-			if rightVal, ok := rightVal.(float64); ok {
-				if leftVal >= rightVal {
-					return Positive
-				}
-				return Negative
+	case opIEq:
+		return func(left, right interface{}) (bool, bool) {
+			leftStr, leftOk := left.(string)
+			rightStr, rightOk := right.(string)
+			if leftOk && rightOk {
+				return strings.EqualFold(leftStr, rightStr), true
 			}
+			return cs.equal(left, right), true // Case is meaningless for non-strings
 		}
-		log.Errorf("[sase:operatorPredicate] Could not compare ge for non-float64: %s", p.QueryText())
-		return Negative // Terminate this match
 
-	case opLe:
-		if leftVal, ok := leftVal.(float64); ok {
-			if rightVal, ok := rightVal.(float64); ok {
-				if leftVal <= rightVal {
-					return Positive
-				}
-				return Negative
+	// >, <, >=, <= only work for numbers, strings and times (currently)
+	case opGt, opLt, opGe, opLe:
+		return func(left, right interface{}) (bool, bool) {
+			if isNaN(left) || isNaN(right) {
+				return false, true
+			}
+			cmp, ok := cs.order(left, right)
+			if !ok {
+				return false, false
 			}
+			switch {
+			case o == opGt && cmp > 0, o == opLt && cmp < 0, o == opGe && cmp >= 0, o == opLe && cmp <= 0:
+				return true, true
+			}
+			return false, true
 		}
-		log.Errorf("[sase:operatorPredicate] Could not compare le for non-float64: %s", p.QueryText())
-		return Negative // Terminate this match
 
 	default:
-		log.Errorf("[sase:operatorPredicate] Unhandled op %v for %s", p.op, p.QueryText())
-		return Negative
+		return nil
 	}
 }
 
 func (p *operatorPredicate) QueryText() string {
-	buf := new(bytes.Buffer)
-	if p.left != nil {
-		buf.WriteString(p.left.QueryText())
-	}
-	buf.WriteRune(' ')
-	switch p.op {
-	case opEq:
-		buf.WriteString("==")
-	case opNe:
-		buf.WriteString("!=")
-	case opGt:
-		buf.WriteRune('>')
-	case opLt:
-		buf.WriteRune('<')
-	case opGe:
-		buf.WriteString(">=")
-	case opLe:
-		buf.WriteString("<=")
-	}
-	if p.right != nil {
-		buf.WriteRune(' ')
-		buf.WriteString(p.right.QueryText())
-	}
-	return buf.String()
+	return joinText(valueText(p.left), p.op.symbol(), valueText(p.right))
 }
 
 func (p *operatorPredicate) usedAliases() []string {
@@ -201,39 +542,316 @@ func (p *operatorPredicate) usedAliases() []string {
 	if p.right != nil {
 		result = append(result, p.right.usedAliases()...)
 	}
-	return result
+	return dedupeAliases(result)
+}
+
+func (p *operatorPredicate) Equal(other Predicate) bool {
+	o, ok := other.(*operatorPredicate)
+	if !ok {
+		return false
+	} else if p.op == o.op && sameValue(p.left, o.left) && sameValue(p.right, o.right) {
+		return true
+	}
+	return p.op == o.op.converse() && sameValue(p.left, o.right) && sameValue(p.right, o.left)
+}
+
+func (p *operatorPredicate) Hash() uint64 {
+	return hashPredicate(p)
+}
+
+// canonical returns the operands and operator of the comparison in a canonical orientation: reversed (along with the
+// operator) if the left operand's text sorts after the right's, so that Equal comparisons have the same one
+func (p *operatorPredicate) canonical() (left, right value, o op) {
+	if valueText(p.left) > valueText(p.right) {
+		return p.right, p.left, p.op.converse()
+	}
+	return p.left, p.right, p.op
+}
+
+func (p *operatorPredicate) Clone() Predicate {
+	return &operatorPredicate{left: cloneValue(p.left), right: cloneValue(p.right), op: p.op}
+}
+
+func (p *operatorPredicate) children() []interface{} {
+	return valueNodes(p.left, p.right)
+}
+
+func (p *operatorPredicate) Validate(declared map[string]struct{}) error {
+	return validateAliases(p, declared)
+}
+
+// A betweenPredicate tests whether a value lies within an (inclusive) range
+type betweenPredicate struct {
+	operand value
+	low     value
+	high    value
+}
+
+func (p *betweenPredicate) Evaluate(evs domain.CapturedEvents) Result {
+	return evaluateOrLog("betweenPredicate", p, evs)
+}
+
+func (p *betweenPredicate) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return evaluateObserved(context.Background(), p, evs)
+}
+
+func (p *betweenPredicate) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	ctx = withValueCache(ctx, evs)
+	var vals [3]interface{}
+	for i, v := range [...]value{p.operand, p.low, p.high} {
+		if v == nil {
+			return Negative, fmt.Errorf("Could not evaluate %s: operand and bounds must not be nil", p.QueryText())
+		} else if val, err := resolve(ctx, v, evs); errors.Is(err, ErrEventNotFound) {
+			return Uncertain, nil
+		} else if err != nil {
+			return Negative, fmt.Errorf("Could not evaluate %s: %w", p.QueryText(), err)
+		} else {
+			vals[i] = val
+		}
+	}
+
+	if isNaN(vals[0]) || isNaN(vals[1]) || isNaN(vals[2]) {
+		return Negative, nil
+	}
+	cs := comparatorsFor(ctx)
+	lowCmp, lowOk := cs.order(vals[1], vals[0])
+	highCmp, highOk := cs.order(vals[0], vals[2])
+	if !lowOk || !highOk {
+		return Negative, fmt.Errorf("Could not order %T between %T and %T: %s", vals[0], vals[1], vals[2],
+			p.QueryText())
+	} else if lowCmp <= 0 && highCmp <= 0 {
+		return Positive, nil
+	}
+	return Negative, nil
+}
+
+func (p *betweenPredicate) QueryText() string {
+	low := valueText(p.low)
+	if a, ok := p.low.(*arithmeticValue); ok && a.op.bitwise() { // A "^" would be read as the AND which ends it
+		low = "(" + low + ")"
+	}
+	return joinText(valueText(p.operand), "BETWEEN", low, "AND", valueText(p.high))
+}
+
+func (p *betweenPredicate) usedAliases() []string {
+	result := make([]string, 0)
+	for _, v := range [...]value{p.operand, p.low, p.high} {
+		if v != nil {
+			result = append(result, v.usedAliases()...)
+		}
+	}
+	return dedupeAliases(result)
+}
+
+func (p *betweenPredicate) Equal(other Predicate) bool {
+	o, ok := other.(*betweenPredicate)
+	return ok && sameValue(p.operand, o.operand) && sameValue(p.low, o.low) && sameValue(p.high, o.high)
+}
+
+func (p *betweenPredicate) Hash() uint64 {
+	return hashPredicate(p)
+}
+
+func (p *betweenPredicate) Clone() Predicate {
+	return &betweenPredicate{operand: cloneValue(p.operand), low: cloneValue(p.low), high: cloneValue(p.high)}
+}
+
+func (p *betweenPredicate) children() []interface{} {
+	return valueNodes(p.operand, p.low, p.high)
+}
+
+func (p *betweenPredicate) Validate(declared map[string]struct{}) error {
+	return validateAliases(p, declared)
+}
+
+// An inPredicate tests whether a value is equal to any member of a set. A member which looks up an attribute across a
+// Kleene closure (eg. "b.symbol IN a[].symbol") stands for each of the values it captured, rather than for the list.
+type inPredicate struct {
+	left value
+	set  []value
 }
 
-type equivalenceTestPredicate string // Holds the equivalence key path
+func (p *inPredicate) Evaluate(evs domain.CapturedEvents) Result {
+	return evaluateOrLog("inPredicate", p, evs)
+}
+
+func (p *inPredicate) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return evaluateObserved(context.Background(), p, evs)
+}
+
+func (p *inPredicate) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	ctx = withValueCache(ctx, evs)
+	if p.left == nil {
+		return Negative, fmt.Errorf("Could not evaluate %s: left operand must not be nil", p.QueryText())
+	}
+	leftVal, err := resolve(ctx, p.left, evs)
+	if errors.Is(err, ErrEventNotFound) {
+		return Uncertain, nil
+	} else if err != nil {
+		return Negative, fmt.Errorf("Could not evaluate %s: %w", p.QueryText(), err)
+	}
 
-func (p equivalenceTestPredicate) Evaluate(evs domain.CapturedEvents) Result {
 	var (
-		lastVal interface{}
-		i       = 0
+		result   = Negative
+		firstErr error
+		cs       = comparatorsFor(ctx)
 	)
-	for alias, _ := range evs {
-		if val, err := attributeLookup(fmt.Sprintf("%s.%s", alias, p)).Value(evs); err != nil {
-			if err == ErrEventNotFound {
-				continue
-			} else if err != nil {
-				log.Errorf("[sase:equivalenceTestPredicate] Could not evaluate %s left/right: %s", p.QueryText(), err.Error())
-				return Negative // Terminate this match
+	for _, member := range p.set {
+		if member == nil {
+			continue
+		} else if memberVal, err := p.resolveMember(ctx, member, evs); errors.Is(err, ErrEventNotFound) {
+			result = Uncertain // Might still be found in a later member
+		} else if err != nil {
+			if firstErr == nil { // A later member may still match, which makes the error moot
+				firstErr = fmt.Errorf("Could not evaluate %s: %w", p.QueryText(), err)
 			}
-		} else {
-			if i > 0 && !reflect.DeepEqual(lastVal, val) {
-				return Negative
+		} else if _, ok := member.(*listLookup); ok {
+			for _, elem := range memberVal.([]interface{}) {
+				if cs.equal(leftVal, elem) {
+					return Positive, nil
+				}
 			}
-			lastVal = val
-			i++
+		} else if cs.equal(leftVal, memberVal) {
+			return Positive, nil
 		}
 	}
-	return Positive
+	if firstErr != nil {
+		return Negative, firstErr
+	}
+	return result, nil
 }
 
-func (p equivalenceTestPredicate) QueryText() string {
-	return fmt.Sprintf("[%s]", p)
+// resolveMember resolves a member of the set. The values of a Kleene closure leave out those of any of its events which
+// don't have the attribute, since the others may still have the value.
+func (p *inPredicate) resolveMember(ctx context.Context, member value, evs domain.CapturedEvents) (interface{}, error) {
+	if list, ok := member.(*listLookup); ok {
+		return list.values(ctx, evs, true)
+	}
+	return resolve(ctx, member, evs)
 }
 
-func (p equivalenceTestPredicate) usedAliases() []string { // Not much we can do here :(
-	return nil
+func (p *inPredicate) QueryText() string {
+	if len(p.set) == 1 {
+		if list, ok := p.set[0].(*listLookup); ok {
+			return joinText(valueText(p.left), "IN", list.QueryText())
+		}
+	}
+	members := make([]string, len(p.set))
+	for i, member := range p.set {
+		members[i] = valueText(member)
+	}
+	return joinText(valueText(p.left), "IN", "("+strings.Join(members, ", ")+")")
+}
+
+func (p *inPredicate) usedAliases() []string {
+	result := make([]string, 0)
+	if p.left != nil {
+		result = append(result, p.left.usedAliases()...)
+	}
+	for _, member := range p.set {
+		if member != nil {
+			result = append(result, member.usedAliases()...)
+		}
+	}
+	return dedupeAliases(result)
+}
+
+func (p *inPredicate) Equal(other Predicate) bool {
+	o, ok := other.(*inPredicate)
+	return ok && sameValue(p.left, o.left) && sameValues(p.set, o.set)
+}
+
+func (p *inPredicate) Hash() uint64 {
+	return hashPredicate(p)
+}
+
+func (p *inPredicate) Clone() Predicate {
+	return &inPredicate{left: cloneValue(p.left), set: cloneValues(p.set)}
+}
+
+func (p *inPredicate) children() []interface{} {
+	return valueNodes(append([]value{p.left}, p.set...)...)
+}
+
+func (p *inPredicate) Validate(declared map[string]struct{}) error {
+	return validateAliases(p, declared)
+}
+
+// A nullCheckPredicate tests whether a value is (or, when negated, is not) nil
+type nullCheckPredicate struct {
+	operand value
+	negated bool
+}
+
+// isNil reports whether v is nil, or a nil pointer, map, slice, etc.
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch val := reflect.ValueOf(v); val.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return val.IsNil()
+	}
+	return false
+}
+
+func (p *nullCheckPredicate) Evaluate(evs domain.CapturedEvents) Result {
+	return evaluateOrLog("nullCheckPredicate", p, evs)
+}
+
+func (p *nullCheckPredicate) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return evaluateObserved(context.Background(), p, evs)
+}
+
+func (p *nullCheckPredicate) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	ctx = withValueCache(ctx, evs)
+	if p.operand == nil {
+		return Negative, fmt.Errorf("Could not evaluate %s: operand must not be nil", p.QueryText())
+	}
+	val, err := resolve(ctx, p.operand, evs)
+	if errors.Is(err, ErrEventNotFound) { // Not captured yet is not the same as nil
+		return Uncertain, nil
+	} else if err != nil {
+		return Negative, fmt.Errorf("Could not evaluate %s: %w", p.QueryText(), err)
+	}
+
+	if isNil(val) != p.negated {
+		return Positive, nil
+	}
+	return Negative, nil
+}
+
+func (p *nullCheckPredicate) QueryText() string {
+	if p.negated {
+		return joinText(valueText(p.operand), "IS NOT NULL")
+	}
+	return joinText(valueText(p.operand), "IS NULL")
+}
+
+func (p *nullCheckPredicate) usedAliases() []string {
+	if p.operand == nil {
+		return make([]string, 0)
+	}
+	return p.operand.usedAliases()
+}
+
+func (p *nullCheckPredicate) Equal(other Predicate) bool {
+	o, ok := other.(*nullCheckPredicate)
+	return ok && p.negated == o.negated && sameValue(p.operand, o.operand)
+}
+
+func (p *nullCheckPredicate) Hash() uint64 {
+	return hashPredicate(p)
+}
+
+func (p *nullCheckPredicate) Clone() Predicate {
+	return &nullCheckPredicate{operand: cloneValue(p.operand), negated: p.negated}
+}
+
+func (p *nullCheckPredicate) children() []interface{} {
+	return valueNodes(p.operand)
+}
+
+func (p *nullCheckPredicate) Validate(declared map[string]struct{}) error {
+	return validateAliases(p, declared)
 }
@@ -1,7 +1,11 @@
 package query
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
 	"testing"
 	"time"
 
@@ -64,31 +68,116 @@ func TestOr(t *testing.T) {
 	}
 }
 
+func TestConjunction(t *testing.T) {
+	expectations := map[[3]Result]Result{
+		[3]Result{Positive, Positive, Positive}:   Positive,
+		[3]Result{Positive, Uncertain, Positive}:  Uncertain,
+		[3]Result{Uncertain, Uncertain, Positive}: Uncertain,
+		[3]Result{Uncertain, Negative, Positive}:  Negative, // A later Negative beats an earlier Uncertain
+		[3]Result{Positive, Positive, Negative}:   Negative,
+		[3]Result{Negative, Uncertain, Uncertain}: Negative,
+		[3]Result{Positive, Invalid, Positive}:    Invalid,
+	}
+
+	for inputs, expected := range expectations {
+		c := conjunction{tPredicate{result: inputs[0]}, tPredicate{result: inputs[1]}, tPredicate{result: inputs[2]}}
+		require.Equal(t, expected.String(), c.Evaluate(nil).String(), c.QueryText())
+	}
+}
+
+func TestDisjunction(t *testing.T) {
+	expectations := map[[3]Result]Result{
+		[3]Result{Negative, Negative, Negative}:   Negative,
+		[3]Result{Negative, Uncertain, Negative}:  Uncertain,
+		[3]Result{Uncertain, Uncertain, Negative}: Uncertain,
+		[3]Result{Uncertain, Positive, Negative}:  Positive, // A later Positive beats an earlier Uncertain
+		[3]Result{Negative, Negative, Positive}:   Positive,
+		[3]Result{Positive, Uncertain, Uncertain}: Positive,
+		[3]Result{Invalid, Negative, Invalid}:     Negative,
+	}
+
+	for inputs, expected := range expectations {
+		d := disjunction{tPredicate{result: inputs[0]}, tPredicate{result: inputs[1]}, tPredicate{result: inputs[2]}}
+		require.Equal(t, expected.String(), d.Evaluate(nil).String(), d.QueryText())
+	}
+}
+
+func TestConnectiveQueryText(t *testing.T) {
+	a := &operatorPredicate{left: attributeLookup("a.n"), right: literalValue{float64(1)}, op: opEq}
+	b := &operatorPredicate{left: attributeLookup("b.n"), right: literalValue{float64(2)}, op: opGt}
+	c := newEquivalencePredicate("foo")
+
+	require.Equal(t, "(a.n == 1.000000 AND b.n > 2.000000)", conjunction{a, b}.QueryText())
+	require.Equal(t, "(a.n == 1.000000 OR b.n > 2.000000)", disjunction{a, b}.QueryText())
+	require.Equal(t, "((a.n == 1.000000 OR b.n > 2.000000) AND [foo])", conjunction{disjunction{a, b}, c}.QueryText())
+	require.Equal(t, []string{"a", "b"}, conjunction{disjunction{a, b}, c}.usedAliases())
+}
+
+func TestNegationPredicate(t *testing.T) {
+	expectations := map[Result]Result{
+		Positive:  Negative,
+		Negative:  Positive,
+		Uncertain: Uncertain, // Not knowing is still not knowing
+		Invalid:   Invalid,
+	}
+
+	evs := domain.CapturedEvents{"a": &tEventImpl{typ: "A"}}
+	for input, expected := range expectations {
+		p := &negationPredicate{tPredicate{result: input, aliases: []string{"a"}}}
+		require.Equal(t, expected.String(), p.Evaluate(evs).String(), p.QueryText())
+		require.Equal(t, expected.String(), Compile(p)(evs).String(), p.QueryText())
+		require.Equal(t, []string{"a"}, p.usedAliases())
+	}
+
+	// Until its events have been captured, a Positive isn't inverted, as it may only be because they're missing
+	p := &negationPredicate{&operatorPredicate{left: attributeLookup("a.x"), right: attributeLookup("b.x"), op: opGt}}
+	captured := domain.CapturedEvents{
+		"a": &tEventImpl{typ: "A", attrs: map[string]interface{}{"x": 1}},
+		"b": &tEventImpl{typ: "B", attrs: map[string]interface{}{"x": 2}},
+	}
+	for _, evaluate := range []func(domain.CapturedEvents) Result{p.Evaluate, Compile(p)} {
+		require.Equal(t, Uncertain, evaluate(evs))
+		require.Equal(t, Positive, evaluate(captured))
+	}
+	// but one which is settled by those which have been still is
+	p = &negationPredicate{disjunction{tPredicate{aliases: []string{"a"}}, tPredicate{aliases: []string{"b"}}}}
+	require.Equal(t, Negative, p.Evaluate(evs))
+	require.Equal(t, Negative, Compile(p)(evs))
+
+	a := &operatorPredicate{left: attributeLookup("a.n"), right: literalValue{float64(1)}, op: opEq}
+	require.Equal(t, "NOT (a.n == 1.000000)", (&negationPredicate{a}).QueryText())
+	require.Equal(t, "NOT (a.n == 1.000000 OR [foo])",
+		(&negationPredicate{disjunction{a, newEquivalencePredicate("foo")}}).QueryText())
+}
+
 func TestOperatorPredicate(t *testing.T) {
 	e1 := &tEventImpl{
 		typ: "e1",
 		attrs: map[string]interface{}{
-			"foo": "bar",
-			"bar": "bar",
-			"num": float64(1.5),
+			"foo":   "bar",
+			"bar":   "bar",
+			"num":   float64(1.5),
+			"count": int(2),
 		},
 		ts: time.Now(),
 	}
 	e2 := &tEventImpl{
 		typ: "e2",
 		attrs: map[string]interface{}{
-			"foo": "bar",
-			"bar": "baz",
-			"num": float64(1.5),
+			"foo":   "bar",
+			"bar":   "baz",
+			"num":   float64(1.5),
+			"count": int64(2),
 		},
 		ts: time.Now(),
 	}
 	e3 := &tEventImpl{
 		typ: "e3",
 		attrs: map[string]interface{}{
-			"foo": "foobar",
-			"bar": "baz",
-			"num": float64(2.0),
+			"foo":   "foobar",
+			"bar":   "baz",
+			"num":   float64(2.0),
+			"count": uint8(3),
 		},
 		ts: time.Now(),
 	}
@@ -106,6 +195,9 @@ func TestOperatorPredicate(t *testing.T) {
 			[2]string{"e1.bar", "e3.bar"}:       Negative,
 			[2]string{"e1.foo", "e3.bazbazbas"}: Negative, // Attribute not found
 			[2]string{"e1.foo", "e5.foo"}:       Positive, // Event not found
+			[2]string{"e1.count", "e2.count"}:   Positive, // Numeric types are coerced
+			[2]string{"e1.count", "e3.num"}:     Positive,
+			[2]string{"e1.count", "e3.count"}:   Negative,
 		},
 		opNe: { // The inverse of opEq's cases
 			[2]string{"e1.foo", "e2.foo"}:       Negative,
@@ -114,6 +206,9 @@ func TestOperatorPredicate(t *testing.T) {
 			[2]string{"e1.bar", "e3.bar"}:       Positive,
 			[2]string{"e1.foo", "e3.bazbazbas"}: Negative, // Attribute not found always return false
 			[2]string{"e1.foo", "e5.foo"}:       Positive,
+			[2]string{"e1.count", "e2.count"}:   Negative,
+			[2]string{"e1.count", "e3.num"}:     Negative,
+			[2]string{"e1.count", "e3.count"}:   Positive,
 		},
 		opLt: {
 			[2]string{"e1.num", "e3.num"}:       Positive,
@@ -122,6 +217,11 @@ func TestOperatorPredicate(t *testing.T) {
 			[2]string{"e3.numfoo", "e1.numfoo"}: Negative, // Attribute not found always returns false
 			[2]string{"e1.foo", "e3.num"}:       Negative, // Wrong attribute type always returns false
 			[2]string{"e3.foo", "e1.num"}:       Negative,
+			[2]string{"e1.foo", "e3.foo"}:       Positive, // Strings are ordered lexicographically
+			[2]string{"e1.foo", "e2.foo"}:       Negative,
+			[2]string{"e1.num", "e1.count"}:     Positive, // Numeric types are coerced
+			[2]string{"e1.count", "e3.count"}:   Positive,
+			[2]string{"e1.count", "e3.num"}:     Negative,
 		},
 		opGt: {
 			[2]string{"e1.num", "e3.num"}:       Negative,
@@ -130,6 +230,8 @@ func TestOperatorPredicate(t *testing.T) {
 			[2]string{"e3.numfoo", "e1.numfoo"}: Negative, // Attribute not found always returns false
 			[2]string{"e1.foo", "e3.num"}:       Negative, // Wrong attribute type always returns false
 			[2]string{"e3.foo", "e1.num"}:       Negative,
+			[2]string{"e1.foo", "e3.foo"}:       Negative, // Strings are ordered lexicographically
+			[2]string{"e1.foo", "e2.foo"}:       Negative,
 		},
 		opLe: {
 			[2]string{"e1.num", "e3.num"}:       Positive,
@@ -138,6 +240,8 @@ func TestOperatorPredicate(t *testing.T) {
 			[2]string{"e3.numfoo", "e1.numfoo"}: Negative, // Attribute not found always returns false
 			[2]string{"e1.foo", "e3.num"}:       Negative, // Wrong attribute type always returns false
 			[2]string{"e3.foo", "e1.num"}:       Negative,
+			[2]string{"e1.foo", "e3.foo"}:       Positive, // Strings are ordered lexicographically
+			[2]string{"e1.foo", "e2.foo"}:       Positive,
 		},
 		opGe: {
 			[2]string{"e1.num", "e3.num"}:       Negative,
@@ -146,6 +250,11 @@ func TestOperatorPredicate(t *testing.T) {
 			[2]string{"e3.numfoo", "e1.numfoo"}: Negative, // Attribute not found always returns false
 			[2]string{"e1.foo", "e3.num"}:       Negative, // Wrong attribute type always returns false
 			[2]string{"e3.foo", "e1.num"}:       Negative,
+			[2]string{"e1.foo", "e3.foo"}:       Negative, // Strings are ordered lexicographically
+			[2]string{"e1.foo", "e2.foo"}:       Positive,
+			[2]string{"e1.count", "e3.num"}:     Positive, // Numeric types are coerced
+			[2]string{"e3.count", "e2.count"}:   Positive,
+			[2]string{"e1.num", "e2.count"}:     Negative,
 		},
 	}
 
@@ -162,3 +271,728 @@ func TestOperatorPredicate(t *testing.T) {
 		}
 	}
 }
+
+func TestOperatorPredicateErrors(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "a",
+			attrs: map[string]interface{}{
+				"foo": "bar",
+				"num": float64(1),
+			},
+		},
+	}
+
+	broken := []*operatorPredicate{
+		{left: attributeLookup("a.foo"), right: attributeLookup("a.num"), op: opGt}, // Incomparable
+		{left: attributeLookup("a.foo"), right: attributeLookup("a.baz"), op: opEq}, // Attribute not found
+		{left: attributeLookup("a.foo"), right: attributeLookup("a.foo"), op: op(99)},
+		{left: attributeLookup("a.foo"), op: opEq},
+	}
+	for _, p := range broken {
+		r, err := p.EvaluateErr(evs)
+		require.Error(t, err, p.QueryText())
+		require.Equal(t, Negative, r, p.QueryText())
+		require.Equal(t, Negative, p.Evaluate(evs), p.QueryText())
+	}
+
+	ok := []*operatorPredicate{
+		{left: attributeLookup("a.foo"), right: attributeLookup("a.num"), op: opEq}, // Definitely not equal
+		{left: attributeLookup("b.foo"), right: attributeLookup("a.num"), op: opGt}, // Event not found
+	}
+	for _, p := range ok {
+		_, err := p.EvaluateErr(evs)
+		require.NoError(t, err, p.QueryText())
+	}
+}
+
+func TestWrappedEventNotFound(t *testing.T) {
+	missing := tValue{err: ErrEventNotFound}
+	wrapped := tValue{err: fmt.Errorf("Looking up x.y: %w", ErrEventNotFound)}
+	one := literalValue{float64(1)}
+
+	predicates := map[string]func(value) Predicate{
+		"operator": func(v value) Predicate { return &operatorPredicate{left: v, right: one, op: opGt} },
+		"between":  func(v value) Predicate { return &betweenPredicate{operand: v, low: one, high: one} },
+		"in":       func(v value) Predicate { return &inPredicate{left: v, set: []value{one}} },
+		"in set":   func(v value) Predicate { return &inPredicate{left: one, set: []value{v}} },
+		"null":     func(v value) Predicate { return &nullCheckPredicate{operand: v} },
+		"contains": func(v value) Predicate {
+			return &stringMatchPredicate{left: v, right: literalValue{"a"}, match: smContains}
+		},
+	}
+	for desc, build := range predicates {
+		expected, err := build(missing).EvaluateErr(nil)
+		require.NoError(t, err, desc)
+		result, err := build(wrapped).EvaluateErr(nil)
+		require.NoError(t, err, desc)
+		require.Equal(t, expected, result, desc)
+	}
+
+	val, err := coalesceValue{wrapped, one}.Value(nil)
+	require.NoError(t, err)
+	require.Equal(t, float64(1), val)
+}
+
+func TestEvaluateContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	prices := make([]interface{}, 1000)
+	for i := range prices {
+		prices[i] = float64(i)
+	}
+	evs := domain.CapturedEvents{"a": tStocks(prices...)}
+	avg := &operatorPredicate{
+		left:  &aggregateValue{fn: afAvg, operand: &listLookup{alias: "a", path: []string{"price"}}},
+		right: literalValue{float64(100)},
+		op:    opGt,
+	}
+
+	predicates := []Predicate{
+		conjunction{tPredicate{result: Positive}, tPredicate{result: Positive}},
+		disjunction{tPredicate{result: Negative}, tPredicate{result: Positive}},
+		&negationPredicate{conjunction{tPredicate{result: Negative}}},
+		avg,
+		conjunction{avg},
+	}
+	for _, p := range predicates {
+		r, err := p.EvaluateContext(context.Background(), evs)
+		require.NoError(t, err, p.QueryText())
+		require.Equal(t, Positive, r, p.QueryText())
+
+		r, err = p.EvaluateContext(cancelled, evs)
+		require.True(t, errors.Is(err, context.Canceled), p.QueryText())
+		require.Equal(t, Negative, r, p.QueryText())
+	}
+
+	_, err := (&arithmeticValue{left: avg.left, right: literalValue{float64(1)}, op: aoAdd}).valueContext(cancelled, evs)
+	require.Equal(t, context.Canceled, err)
+
+	q, err := Parse("EVENT stock a WHERE a.price >= 0")
+	require.NoError(t, err)
+	_, err = q.EvaluateContext(cancelled, domain.CapturedEvents{"a": evs["a"].(domain.EventList)[0]})
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestConnectiveErrors(t *testing.T) {
+	broken := tPredicate{err: fmt.Errorf("Broken")}
+
+	r, err := conjunction{tPredicate{result: Positive}, broken}.EvaluateErr(nil)
+	require.Error(t, err)
+	require.Equal(t, Negative, r)
+	r, err = conjunction{tPredicate{result: Negative}, broken}.EvaluateErr(nil) // Short-circuits
+	require.NoError(t, err)
+	require.Equal(t, Negative, r)
+
+	r, err = disjunction{broken, tPredicate{result: Positive}}.EvaluateErr(nil) // The error is moot
+	require.NoError(t, err)
+	require.Equal(t, Positive, r)
+	r, err = disjunction{broken, tPredicate{result: Uncertain}}.EvaluateErr(nil)
+	require.Error(t, err)
+	require.Equal(t, Negative, r)
+
+	r, err = (&negationPredicate{broken}).EvaluateErr(nil) // Errors must not be inverted
+	require.Error(t, err)
+	require.Equal(t, Negative, r)
+	require.Equal(t, Negative, (&negationPredicate{broken}).Evaluate(nil))
+}
+
+func TestOperatorPredicateCaseInsensitive(t *testing.T) {
+	attrs := map[string]interface{}{
+		"ascii":   "Foo@Example.com",
+		"latin":   "Ünïcödé",
+		"greek":   "ΣΑΣ",
+		"kelvin":  "\u212a", // KELVIN SIGN folds to k
+		"num":     float64(2),
+		"count":   int(2),
+		"boolean": true,
+	}
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{typ: "a", attrs: attrs},
+	}
+
+	cases := map[[2]value]Result{
+		[2]value{attributeLookup("a.ascii"), literalValue{"foo@example.COM"}}: Positive,
+		[2]value{attributeLookup("a.ascii"), literalValue{"foo@example.org"}}: Negative,
+		[2]value{attributeLookup("a.latin"), literalValue{"üNÏCÖDÉ"}}:         Positive,
+		[2]value{attributeLookup("a.latin"), literalValue{"unicode"}}:         Negative, // Accents are significant
+		[2]value{attributeLookup("a.greek"), literalValue{"σας"}}:             Positive, // Final sigma
+		[2]value{attributeLookup("a.kelvin"), literalValue{"K"}}:              Positive,
+		[2]value{attributeLookup("a.num"), attributeLookup("a.count")}:        Positive, // Non-strings use ==
+		[2]value{attributeLookup("a.num"), literalValue{"2"}}:                 Negative,
+		[2]value{attributeLookup("a.boolean"), attributeLookup("a.boolean")}:  Positive,
+		[2]value{attributeLookup("b.ascii"), literalValue{"foo"}}:             Positive, // Event not found
+	}
+
+	for operands, expectedResult := range cases {
+		impl := &operatorPredicate{
+			left:  operands[0],
+			right: operands[1],
+			op:    opIEq,
+		}
+		require.Equal(t, expectedResult, impl.Evaluate(evs), fmt.Sprintf("Incorrect result for \"%s\"",
+			impl.QueryText()))
+	}
+	require.Equal(t, `a.ascii ~= "foo"`, (&operatorPredicate{attributeLookup("a.ascii"), literalValue{"foo"},
+		opIEq}).QueryText())
+}
+
+func TestOperatorPredicateTimes(t *testing.T) {
+	now := time.Now() // Carries a monotonic clock reading
+	loc := time.FixedZone("UTC+5", 5*60*60)
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "a",
+			attrs: map[string]interface{}{
+				"ts": now,
+			},
+		},
+		"b": &tEventImpl{
+			typ: "b",
+			attrs: map[string]interface{}{
+				"ts": now.In(loc), // Same instant in a different location (which also drops the monotonic reading)
+			},
+		},
+		"c": &tEventImpl{
+			typ: "c",
+			attrs: map[string]interface{}{
+				"ts": now.Add(time.Second),
+			},
+		},
+	}
+
+	cases := map[op]map[[2]string]Result{
+		opEq: {
+			[2]string{"a.ts", "b.ts"}: Positive,
+			[2]string{"a.ts", "c.ts"}: Negative,
+		},
+		opNe: {
+			[2]string{"a.ts", "b.ts"}: Negative,
+			[2]string{"a.ts", "c.ts"}: Positive,
+		},
+		opLt: {
+			[2]string{"a.ts", "b.ts"}: Negative,
+			[2]string{"a.ts", "c.ts"}: Positive,
+			[2]string{"c.ts", "a.ts"}: Negative,
+		},
+		opGt: {
+			[2]string{"a.ts", "b.ts"}: Negative,
+			[2]string{"c.ts", "b.ts"}: Positive,
+		},
+		opLe: {
+			[2]string{"a.ts", "b.ts"}: Positive,
+			[2]string{"c.ts", "b.ts"}: Negative,
+		},
+		opGe: {
+			[2]string{"b.ts", "a.ts"}: Positive,
+			[2]string{"b.ts", "c.ts"}: Negative,
+		},
+	}
+
+	for op, opCases := range cases {
+		for operands, expectedResult := range opCases {
+			impl := &operatorPredicate{
+				left:  attributeLookup(operands[0]),
+				right: attributeLookup(operands[1]),
+				op:    op,
+			}
+
+			require.Equal(t, expectedResult, impl.Evaluate(evs), fmt.Sprintf("Incorrect result for \"%s\"",
+				impl.QueryText()))
+		}
+	}
+}
+
+func TestBetweenPredicate(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "a",
+			attrs: map[string]interface{}{
+				"num":   float64(1.5),
+				"count": int(2),
+				"foo":   "bar",
+			},
+		},
+	}
+
+	cases := map[[3]value]Result{
+		[3]value{attributeLookup("a.num"), literalValue{float64(1)}, literalValue{float64(2)}}:    Positive,
+		[3]value{attributeLookup("a.num"), literalValue{float64(1.5)}, literalValue{float64(2)}}:  Positive, // Inclusive
+		[3]value{attributeLookup("a.num"), literalValue{float64(1)}, literalValue{float64(1.5)}}:  Positive,
+		[3]value{attributeLookup("a.num"), literalValue{float64(2)}, literalValue{float64(3)}}:    Negative,
+		[3]value{attributeLookup("a.num"), literalValue{float64(2)}, literalValue{float64(1)}}:    Negative, // Empty range
+		[3]value{attributeLookup("a.count"), attributeLookup("a.num"), literalValue{float64(2)}}:  Positive, // Coerced
+		[3]value{attributeLookup("a.foo"), literalValue{"a"}, literalValue{"c"}}:                  Positive,
+		[3]value{attributeLookup("a.foo"), literalValue{float64(1)}, literalValue{float64(2)}}:    Negative,  // Wrong type
+		[3]value{attributeLookup("a.numfoo"), literalValue{float64(1)}, literalValue{float64(2)}}: Negative,  // Attribute not found
+		[3]value{attributeLookup("b.num"), literalValue{float64(1)}, literalValue{float64(2)}}:    Uncertain, // Event not found
+		[3]value{attributeLookup("a.num"), attributeLookup("b.num"), literalValue{float64(2)}}:    Uncertain,
+		[3]value{attributeLookup("a.num"), literalValue{float64(1)}, attributeLookup("b.num")}:    Uncertain,
+	}
+
+	for operands, expectedResult := range cases {
+		impl := &betweenPredicate{
+			operand: operands[0],
+			low:     operands[1],
+			high:    operands[2],
+		}
+		require.Equal(t, expectedResult, impl.Evaluate(evs), fmt.Sprintf("Incorrect result for \"%s\"",
+			impl.QueryText()))
+	}
+
+	impl := &betweenPredicate{
+		operand: attributeLookup("a.num"),
+		low:     attributeLookup("b.num"),
+		high:    attributeLookup("c.num"),
+	}
+	require.Equal(t, "a.num BETWEEN b.num AND c.num", impl.QueryText())
+	require.Equal(t, []string{"a", "b", "c"}, impl.usedAliases())
+}
+
+func TestInPredicate(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "a",
+			attrs: map[string]interface{}{
+				"status": "OPEN",
+				"count":  int(2),
+			},
+		},
+	}
+
+	cases := map[string]struct {
+		left     value
+		set      []value
+		expected Result
+	}{
+		"match": {attributeLookup("a.status"), []value{literalValue{"OPEN"}, literalValue{"PENDING"}}, Positive},
+		"no match": {attributeLookup("a.status"), []value{literalValue{"CLOSED"}, literalValue{"PENDING"}},
+			Negative},
+		"empty set":     {attributeLookup("a.status"), []value{}, Negative},
+		"coerced":       {attributeLookup("a.count"), []value{literalValue{float64(1)}, literalValue{float64(2)}}, Positive},
+		"wrong type":    {attributeLookup("a.count"), []value{literalValue{"2"}}, Negative},
+		"no attribute":  {attributeLookup("a.foo"), []value{literalValue{"OPEN"}}, Negative},
+		"left missing":  {attributeLookup("b.status"), []value{literalValue{"OPEN"}}, Uncertain},
+		"mixed, match":  {attributeLookup("a.status"), []value{attributeLookup("b.status"), literalValue{"OPEN"}}, Positive},
+		"mixed, none":   {attributeLookup("a.status"), []value{attributeLookup("b.status"), literalValue{"SHUT"}}, Uncertain},
+		"member itself": {attributeLookup("a.status"), []value{attributeLookup("a.status")}, Positive},
+	}
+
+	for name, c := range cases {
+		impl := &inPredicate{
+			left: c.left,
+			set:  c.set,
+		}
+		require.Equal(t, c.expected, impl.Evaluate(evs), fmt.Sprintf("Incorrect result for %s: \"%s\"", name,
+			impl.QueryText()))
+	}
+
+	impl := &inPredicate{
+		left: attributeLookup("a.status"),
+		set:  []value{literalValue{"OPEN"}, attributeLookup("b.status")},
+	}
+	require.Equal(t, `a.status IN ("OPEN", b.status)`, impl.QueryText())
+	require.Equal(t, []string{"a", "b"}, impl.usedAliases())
+	require.Equal(t, "a.status IN ()", (&inPredicate{left: attributeLookup("a.status")}).QueryText())
+}
+
+func TestInKleeneList(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A+ a[], B b, C+ c[]) WHERE b.symbol IN a[].symbol")
+	require.NoError(t, err)
+	p := q.predicate
+	require.Equal(t, "b.symbol IN a[].symbol", p.QueryText())
+	require.Equal(t, []string{"b", "a"}, p.usedAliases())
+
+	list := func(symbols ...string) domain.EventList {
+		result := make(domain.EventList, len(symbols))
+		for i, symbol := range symbols {
+			result[i] = &tEventImpl{typ: "A", attrs: map[string]interface{}{"symbol": symbol}}
+		}
+		return result
+	}
+	b := &tEventImpl{typ: "B", attrs: map[string]interface{}{"symbol": "MSFT"}}
+	unset := &tEventImpl{typ: "A", attrs: map[string]interface{}{}}
+	cases := map[string]struct {
+		evs      domain.CapturedEvents
+		expected Result
+	}{
+		"member":     {domain.CapturedEvents{"a": list("AAPL", "MSFT"), "b": b}, Positive},
+		"duplicates": {domain.CapturedEvents{"a": list("MSFT", "GOOG", "MSFT"), "b": b}, Positive},
+		"none":       {domain.CapturedEvents{"a": list("AAPL", "AAPL"), "b": b}, Negative},
+		"empty":      {domain.CapturedEvents{"a": list(), "b": b}, Negative},
+		"uncaptured": {domain.CapturedEvents{"b": b}, Uncertain},
+		// Events without the attribute are skipped, as they don't stop the others having the value
+		"unset":      {domain.CapturedEvents{"a": append(list("AAPL"), unset, list("MSFT")[0]), "b": b}, Positive},
+		"unset none": {domain.CapturedEvents{"a": append(list("AAPL"), unset), "b": b}, Negative},
+	}
+	for name, c := range cases {
+		require.Equal(t, c.expected, p.Evaluate(c.evs), name)
+		require.Equal(t, c.expected, Compile(p)(c.evs), name)
+	}
+
+	// Lists may also be members of a set, standing for their values alongside the others
+	q, err = Parse(`EVENT SEQ(A+ a[], B b, C+ c[]) WHERE b.symbol IN ("GOOG", c[].symbol, a[].symbol)`)
+	require.NoError(t, err)
+	require.Equal(t, Positive, q.predicate.Evaluate(domain.CapturedEvents{"a": list("MSFT"), "b": b}))
+	require.Equal(t, Uncertain, q.predicate.Evaluate(domain.CapturedEvents{"a": list("AAPL"), "b": b}))
+
+	_, err = Parse("EVENT SEQ(A+ a[], B b) WHERE b.symbol IN a[0].symbol")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Expected ( or a list (eg. a[].x) after IN, got a[0].symbol")
+}
+
+func TestNullCheckPredicate(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "a",
+			attrs: map[string]interface{}{
+				"discount": nil,
+				"ptr":      (*int)(nil),
+				"price":    float64(10),
+				"zero":     float64(0),
+				"empty":    "",
+			},
+		},
+	}
+
+	// Keyed by [is null, is not null]
+	cases := map[string][2]Result{
+		"a.discount": {Positive, Negative}, // Present, but nil
+		"a.ptr":      {Positive, Negative},
+		"a.price":    {Negative, Positive},
+		"a.zero":     {Negative, Positive}, // Zero values are not nil
+		"a.empty":    {Negative, Positive},
+		"a.foo":      {Negative, Negative},   // Attribute not found terminates the match
+		"b.discount": {Uncertain, Uncertain}, // Event not captured (yet)
+	}
+
+	for attr, expected := range cases {
+		for i, negated := range []bool{false, true} {
+			impl := &nullCheckPredicate{
+				operand: attributeLookup(attr),
+				negated: negated,
+			}
+			require.Equal(t, expected[i], impl.Evaluate(evs), fmt.Sprintf("Incorrect result for \"%s\"",
+				impl.QueryText()))
+			require.Equal(t, []string{attr[:1]}, impl.usedAliases())
+		}
+	}
+
+	require.Equal(t, "a.discount IS NULL", (&nullCheckPredicate{operand: attributeLookup("a.discount")}).QueryText())
+	require.Equal(t, "a.discount IS NOT NULL", (&nullCheckPredicate{
+		operand: attributeLookup("a.discount"),
+		negated: true,
+	}).QueryText())
+}
+
+func TestUsedAliasesDeduped(t *testing.T) {
+	p := &operatorPredicate{left: attributeLookup("a.x"), right: attributeLookup("a.y"), op: opGt}
+	require.Equal(t, []string{"a"}, p.usedAliases())
+
+	q := &operatorPredicate{left: attributeLookup("b.x"), right: attributeLookup("a.x"), op: opEq}
+	require.Equal(t, []string{"a", "b"}, conjunction{p, q}.usedAliases())
+	require.Equal(t, []string{"b", "a"}, disjunction{q, p, q}.usedAliases()) // Order of first appearance
+	require.Equal(t, []string{"a"}, (&betweenPredicate{
+		operand: attributeLookup("a.x"),
+		low:     attributeLookup("a.y"),
+		high:    attributeLookup("a.z"),
+	}).usedAliases())
+}
+
+func TestValidate(t *testing.T) {
+	declared := map[string]struct{}{
+		"a": struct{}{},
+		"b": struct{}{},
+	}
+
+	valid := []Predicate{
+		&operatorPredicate{left: attributeLookup("a.x"), right: attributeLookup("b.y"), op: opGt},
+		&negationPredicate{&nullCheckPredicate{operand: attributeLookup("a.x")}},
+		conjunction{tPredicate{aliases: []string{"a"}}, disjunction{tPredicate{aliases: []string{"b"}}}},
+		&inPredicate{left: attributeLookup("a.x"), set: []value{literalValue{"foo"}, attributeLookup("b.x")}},
+		newEquivalencePredicate("x", "a", "b"),
+	}
+	for _, p := range valid {
+		require.NoError(t, p.Validate(declared), p.QueryText())
+	}
+
+	invalid := []struct {
+		p     Predicate
+		names string
+	}{
+		{&operatorPredicate{left: attributeLookup("a.x"), right: attributeLookup("bb.y"), op: opGt}, "bb"},
+		{&stringMatchPredicate{left: attributeLookup("c.x"), right: attributeLookup("d.y")}, "c, d"},
+		{&negationPredicate{&nullCheckPredicate{operand: attributeLookup("c.x")}}, "c"},
+		{conjunction{tPredicate{aliases: []string{"a"}}, disjunction{tPredicate{aliases: []string{"e"}}}}, "e"},
+	}
+	for _, c := range invalid {
+		err := c.p.Validate(declared)
+		require.Error(t, err, c.p.QueryText())
+		require.Contains(t, err.Error(), c.names, c.p.QueryText())
+	}
+}
+
+func TestEqual(t *testing.T) {
+	queries := []string{
+		"EVENT SEQ(a b, a c) WHERE b.x == c.x",
+		"EVENT SEQ(a b, a c) WHERE b.x > c.x",
+		"EVENT SEQ(a b, a c) WHERE b.x < c.x",
+		"EVENT SEQ(a b, a c) WHERE b.x != c.x",
+		"EVENT SEQ(a b, a c) WHERE b.x == c.x AND [foo]",
+		"EVENT SEQ(a b, a c) WHERE b.x == c.x OR [foo]",
+		"EVENT SEQ(a b, a c) WHERE NOT (b.x == c.x AND [foo])",
+		"EVENT a b WHERE [bar]",
+		"EVENT a b WHERE b.x BETWEEN 1 AND 2",
+		"EVENT a b WHERE b.x BETWEEN 1 AND 3",
+		"EVENT a b WHERE b.x IN (1, 'two')",
+		"EVENT a b WHERE b.x IN (1, 'two', null)",
+		"EVENT a b WHERE b.x IS NULL",
+		"EVENT a b WHERE b.x IS NOT NULL",
+		"EVENT a b WHERE b.x MATCHES '^a'",
+		"EVENT a b WHERE b.x MATCHES '^b'",
+		"EVENT a b WHERE b.x STARTSWITH 'a'",
+		"EVENT a b WHERE b.x ENDSWITH 'a'",
+		"EVENT a b WHERE b.x + 1 > b.y * 2",
+		"EVENT a b WHERE b.x - 1 > b.y * 2",
+		"EVENT a b WHERE avg(b[].x) > b[i-1].x",
+		"EVENT a b WHERE sum(b[].x) > b[i-1].x",
+		"EVENT a b WHERE avg(b[].x) > b[0].x",
+		"EVENT a b WHERE b.LEN > b[b.LEN - 1].x",
+		"EVENT a b WHERE lower(b.x) == coalesce(b.y, 'z')",
+		"EVENT a b WHERE upper(b.x) == coalesce(b.y, 'z')",
+		"EVENT a b WHERE lower(b.x) == coalesce(b.y)",
+		"EVENT a b WHERE b.x == true",
+		"EVENT a b WHERE b.x == 1",
+	}
+
+	predicates := make([]Predicate, len(queries))
+	for i, queryText := range queries {
+		q1, err := Parse(queryText)
+		require.NoError(t, err, queryText)
+		q2, err := Parse(queryText)
+		require.NoError(t, err, queryText)
+		require.True(t, q1.predicate.Equal(q2.predicate), queryText) // Built separately, but structurally identical
+		predicates[i] = q1.predicate
+	}
+	for i, p := range predicates {
+		for j, other := range predicates {
+			require.Equal(t, i == j, p.Equal(other), "%s vs. %s", queries[i], queries[j])
+		}
+	}
+
+	require.True(t, sameValue(nil, nil))
+	require.False(t, sameValue(literalValue{nil}, nil))
+	require.False(t, (&operatorPredicate{op: opEq}).Equal(&operatorPredicate{left: literalValue{nil}, op: opEq}))
+}
+
+func TestEqualNormalised(t *testing.T) {
+	parse := func(where string) Predicate {
+		q, err := Parse("EVENT SEQ(A a, B b) WHERE " + where)
+		require.NoError(t, err, where)
+		return q.predicate
+	}
+	equal := [][2]string{
+		{"a.x == b.y", "b.y == a.x"},
+		{"a.x != b.y", "b.y != a.x"},
+		{"a.x ~= b.y", "b.y ~= a.x"},
+		{"a.x < b.y", "b.y > a.x"},
+		{"a.x >= b.y", "b.y <= a.x"},
+		{"a.x == 1 AND b.y > 2", "b.y > 2 AND a.x == 1"},
+		{"a.x == 1 OR b.y > 2 OR a.z IS NULL", "a.z IS NULL OR b.y > 2 OR 1 == a.x"},
+		{"NOT (a.x == 1 AND (b.y == 2 OR b.z == 3))", "NOT ((b.z == 3 OR 2 == b.y) AND a.x == 1)"},
+	}
+	for _, c := range equal {
+		p1, p2 := parse(c[0]), parse(c[1])
+		require.True(t, p1.Equal(p2), "%s vs. %s", c[0], c[1])
+		require.True(t, p2.Equal(p1), "%s vs. %s", c[1], c[0])
+		require.Equal(t, p1.Hash(), p2.Hash(), "%s vs. %s", c[0], c[1])
+		require.NotEqual(t, p1.QueryText(), p2.QueryText(), "Each is rendered as written")
+	}
+
+	notEqual := [][2]string{
+		{"a.x < b.y", "b.y < a.x"}, // Only reversed along with the operator
+		{"a.x - b.y > 1", "b.y - a.x > 1"},
+		{"a.x == 1 AND b.y > 2", "a.x == 1 OR b.y > 2"},
+		{"a.x == 1 AND b.y > 2", "a.x == 1 AND b.y > 2 AND a.x == 1"},
+		{"a.x == 1 AND a.x == 1 AND b.y > 2", "a.x == 1 AND b.y > 2 AND b.y > 2"},
+		{"a.x == 1", "NOT (a.x == 1)"},
+	}
+	for _, c := range notEqual {
+		p1, p2 := parse(c[0]), parse(c[1])
+		require.False(t, p1.Equal(p2), "%s vs. %s", c[0], c[1])
+		require.False(t, p2.Equal(p1), "%s vs. %s", c[1], c[0])
+		require.NotEqual(t, p1.Hash(), p2.Hash(), "%s vs. %s", c[0], c[1])
+	}
+
+	// Conditions hash as what they wrap
+	p := parse("a.x == b.y")
+	require.Equal(t, p.Hash(), Condition{p}.Hash())
+}
+
+func TestOperatorPredicateQueryTextNilOperands(t *testing.T) {
+	a, b := attributeLookup("a.x"), attributeLookup("b.x")
+	require.Equal(t, "a.x == b.x", (&operatorPredicate{left: a, right: b, op: opEq}).QueryText())
+	require.Equal(t, "a.x ==", (&operatorPredicate{left: a, op: opEq}).QueryText())
+	require.Equal(t, "> a.x", (&operatorPredicate{right: a, op: opGt}).QueryText())
+	require.Equal(t, "!=", (&operatorPredicate{op: opNe}).QueryText())
+
+	// Other predicates leave out their missing operands in the same way
+	cases := map[string]Predicate{
+		"a.x STARTSWITH b.x":      &stringMatchPredicate{left: a, right: b, match: smPrefix},
+		"ENDSWITH b.x":            &stringMatchPredicate{right: b, match: smSuffix},
+		"a.x CONTAINS":            &stringMatchPredicate{left: a, match: smContains},
+		"MATCHES":                 &regexPredicate{},
+		"BETWEEN a.x AND":         &betweenPredicate{low: a},
+		"a.x BETWEEN AND b.x":     &betweenPredicate{operand: a, high: b},
+		"IS NOT NULL":             &nullCheckPredicate{negated: true},
+		"IN (a.x, )":              &inPredicate{set: []value{a, nil}},
+		"a.x IN b[].x":            &inPredicate{left: a, set: []value{&listLookup{alias: "b", path: []string{"x"}}}},
+		"a.x IS NULL":             &nullCheckPredicate{operand: a},
+		"a.x BETWEEN a.x AND b.x": &betweenPredicate{operand: a, low: a, high: b},
+	}
+	for expected, p := range cases {
+		require.Equal(t, expected, p.QueryText())
+	}
+}
+
+func TestOperatorPredicateUnknownOp(t *testing.T) {
+	p := &operatorPredicate{left: attributeLookup("a.x"), right: attributeLookup("b.y"), op: Op(42)}
+	require.Equal(t, "a.x <?op=42?> b.y", p.QueryText())
+	_, err := p.EvaluateErr(domain.CapturedEvents{
+		"a": &tEventImpl{attrs: map[string]interface{}{"x": 1}},
+		"b": &tEventImpl{attrs: map[string]interface{}{"y": 1}},
+	})
+	require.EqualError(t, err, "Unhandled op 42 for a.x <?op=42?> b.y")
+}
+
+func TestValuesEqual(t *testing.T) {
+	equal := [][2]interface{}{
+		{"a", "a"},
+		{float64(1), float64(1)},
+		{1, float64(1)},
+		{float32(1.5), float64(1.5)},
+		{uint8(3), int64(3)},
+		{true, true},
+		{nil, nil},
+		{[]string{"a"}, []string{"a"}},
+		{map[string]int{"a": 1}, map[string]int{"a": 1}},
+	}
+	for _, c := range equal {
+		require.True(t, valuesEqual(c[0], c[1]), "%#v == %#v", c[0], c[1])
+		require.True(t, valuesEqual(c[1], c[0]), "%#v == %#v", c[1], c[0])
+	}
+
+	unequal := [][2]interface{}{
+		{"a", "b"},
+		{"1", float64(1)},
+		{float64(1), float64(2)},
+		{true, false},
+		{true, float64(1)},
+		{nil, float64(0)},
+		{nil, ""},
+		{nil, []string(nil)},
+		{[]string{"a"}, []string{"b"}},
+	}
+	for _, c := range unequal {
+		require.False(t, valuesEqual(c[0], c[1]), "%#v != %#v", c[0], c[1])
+		require.False(t, valuesEqual(c[1], c[0]), "%#v != %#v", c[1], c[0])
+	}
+}
+
+// valuesEqualReflect approximates valuesEqual before it had a fast path for scalars, when everything went through reflect
+func valuesEqualReflect(left, right interface{}) bool {
+	switch l, r := reflect.ValueOf(left), reflect.ValueOf(right); {
+	case l.Kind() == reflect.Float64 && r.Kind() == reflect.Float64:
+		return l.Float() == r.Float()
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+func benchmarkEquality(b *testing.B, equal func(l, r interface{}) bool, left, right interface{}) {
+	for i := 0; i < b.N; i++ {
+		if !equal(left, right) {
+			b.Fatal("Expected equality")
+		}
+	}
+}
+
+func BenchmarkValuesEqualString(b *testing.B) {
+	benchmarkEquality(b, valuesEqual, "GOOG", "GOOG")
+}
+
+func BenchmarkValuesEqualStringReflect(b *testing.B) {
+	benchmarkEquality(b, valuesEqualReflect, "GOOG", "GOOG")
+}
+
+func BenchmarkValuesEqualFloat(b *testing.B) {
+	benchmarkEquality(b, valuesEqual, float64(101.5), float64(101.5))
+}
+
+func BenchmarkValuesEqualFloatReflect(b *testing.B) {
+	benchmarkEquality(b, valuesEqualReflect, float64(101.5), float64(101.5))
+}
+
+func TestNewComparison(t *testing.T) {
+	p := NewComparison(NewAttribute("a", "m", "z"), NewLiteral(int32(3)), OpGe)
+	require.Equal(t, "a.m.z >= 3.000000", p.QueryText())
+	q, err := Parse("EVENT t a WHERE " + p.QueryText())
+	require.NoError(t, err)
+	require.True(t, p.Equal(q.predicate))
+
+	c, ok := q.predicate.(Comparison)
+	require.True(t, ok)
+	require.Equal(t, OpGe, c.Op())
+	require.True(t, c.Left().Equal(NewAttribute("a", "m", "z")))
+	require.True(t, c.Right().Equal(NewLiteral(3)))
+
+	evs := domain.CapturedEvents{"a": &tEventImpl{typ: "t", attrs: map[string]interface{}{"m": map[string]interface{}{"z": 4}}}}
+	require.Equal(t, Positive, p.Evaluate(evs))
+	require.Equal(t, Negative, NewComparison(NewAttribute("a", "m", "z"), NewLiteral("4"), OpEq).Evaluate(evs))
+
+	require.Panics(t, func() { NewAttribute("a") })
+	require.Panics(t, func() { NewLiteral([]int{1}) })
+}
+
+func TestNaN(t *testing.T) {
+	nan := math.NaN()
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{typ: "t", attrs: map[string]interface{}{"x": nan, "y": float32(nan), "z": float64(1)}},
+		"b": &tEventImpl{typ: "t", attrs: map[string]interface{}{"x": float64(1)}},
+		"c": domain.EventList{
+			&tEventImpl{typ: "t", attrs: map[string]interface{}{"x": float64(1)}},
+			&tEventImpl{typ: "t", attrs: map[string]interface{}{"x": nan}},
+			&tEventImpl{typ: "t", attrs: map[string]interface{}{"x": float64(3)}},
+		},
+	}
+	cases := map[string]Result{
+		"a.x == a.x":               Negative,
+		"a.x != a.x":               Positive,
+		"a.x == b.x":               Negative,
+		"a.y == a.y":               Negative,
+		"a.x ~= a.x":               Negative,
+		"a.x != b.x":               Positive,
+		"a.y != 1":                 Positive,
+		"a.x > b.x":                Negative,
+		"a.x < b.x":                Negative,
+		"a.x >= b.x":               Negative,
+		"a.x <= a.x":               Negative,
+		"b.x >= a.y":               Negative,
+		"NOT (a.x > b.x)":          Positive,
+		"a.x BETWEEN 0 AND 2":      Negative,
+		"a.z BETWEEN a.x AND 2":    Negative,
+		"a.x IN (1, a.x)":          Negative,
+		"a.x * 2 >= 0":             Negative,
+		"max(c[].x) >= 0":          Negative,
+		"min(c[].x) <= 3":          Negative,
+		"avg(c[].x) != avg(c[].x)": Positive,
+	}
+	for query, expected := range cases {
+		q, err := Parse("EVENT SEQ(t a, t b, t c) WHERE " + query)
+		require.NoError(t, err, query)
+		result, err := q.predicate.EvaluateErr(evs)
+		require.NoError(t, err, query)
+		require.Equal(t, expected, result, query)
+		require.Equal(t, expected, Compile(q.predicate)(evs), query)
+	}
+}
@@ -0,0 +1,108 @@
+package query
+
+import (
+	"bytes"
+	"strings"
+)
+
+// PrettyText renders the query as QueryText does, but across multiple lines: each clause starts a line, and the
+// predicate continues the WHERE clause, laid out by the PrettyText function. It parses to the same query as QueryText
+// does.
+func (q *Query) PrettyText(indent string) string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("EVENT")
+	if q.capture != nil {
+		buf.WriteRune(' ')
+		buf.WriteString(q.capture.QueryText())
+	}
+	if q.predicate != nil {
+		buf.WriteString("\nWHERE ")
+		// The predicate continues within the WHERE clause
+		buf.WriteString(strings.Replace(PrettyText(q.predicate, indent), "\n", "\n"+indent, -1))
+	}
+	if q.partition != "" {
+		buf.WriteString("\nPARTITION BY ")
+		buf.WriteString(q.partition)
+	}
+	if window := formatWindow(q.window, q.windowCount); window != "" {
+		buf.WriteString("\nWITHIN ")
+		buf.WriteString(window)
+	}
+	return buf.String()
+}
+
+// PrettyText renders a predicate across multiple lines: each operand of an AND or OR is on a line of its own (after the
+// first, led by the operator), and those of one nested within another are parenthesised and indented a level further,
+// eg.
+//
+//	a.x > 1
+//	AND (
+//		b.y < 2
+//		OR b.z == 3
+//	)
+//
+// Other predicates are rendered on one line, as QueryText renders them. A nil predicate renders as "".
+func PrettyText(p Predicate, indent string) string {
+	if p == nil {
+		return ""
+	}
+	buf := new(bytes.Buffer)
+	p = unwrapCondition(p)
+	if isConnective(p) { // The outermost operands needn't be parenthesised
+		writePrettyOperands(buf, p, indent, 0)
+	} else {
+		writePretty(buf, p, indent, 0)
+	}
+	return buf.String()
+}
+
+func isConnective(p Predicate) bool {
+	switch p.(type) {
+	case conjunction, disjunction:
+		return true
+	default:
+		return false
+	}
+}
+
+// writePretty writes a predicate which starts at the current position, at the given depth of indentation
+func writePretty(buf *bytes.Buffer, p Predicate, indent string, depth int) {
+	switch p := unwrapCondition(p).(type) {
+	case conjunction, disjunction:
+		buf.WriteString("(")
+		buf.WriteString("\n" + strings.Repeat(indent, depth+1))
+		writePrettyOperands(buf, p, indent, depth+1)
+		buf.WriteString("\n" + strings.Repeat(indent, depth) + ")")
+	case *negationPredicate:
+		if isConnective(unwrapCondition(p.Predicate)) { // Already parenthesised
+			buf.WriteString("NOT ")
+			writePretty(buf, p.Predicate, indent, depth)
+		} else {
+			buf.WriteString("NOT (")
+			writePretty(buf, p.Predicate, indent, depth)
+			buf.WriteString(")")
+		}
+	default:
+		buf.WriteString(p.QueryText())
+	}
+}
+
+// writePrettyOperands writes the operands of an AND or OR, each on its own line at the given depth
+func writePrettyOperands(buf *bytes.Buffer, p Predicate, indent string, depth int) {
+	var (
+		operands []Predicate
+		sep      string
+	)
+	switch p := p.(type) {
+	case conjunction:
+		operands, sep = p, "AND "
+	case disjunction:
+		operands, sep = p, "OR "
+	}
+	for i, operand := range operands {
+		if i > 0 {
+			buf.WriteString("\n" + strings.Repeat(indent, depth) + sep)
+		}
+		writePretty(buf, operand, indent, depth)
+	}
+}
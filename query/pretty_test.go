@@ -0,0 +1,34 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrettyText(t *testing.T) {
+	q, err := Parse(`EVENT SEQ(A a, B b) WHERE a.x > 1 AND (b.y < 2 OR NOT (b.z == 3 AND b.s STARTSWITH "q")) AND ` +
+		`NOT (a.y IS NULL) PARTITION BY symbol WITHIN 10s`)
+	require.NoError(t, err)
+	require.Equal(t, `EVENT SEQ(A a, B b)
+WHERE a.x > 1.000000
+  AND (
+    b.y < 2.000000
+    OR NOT (
+      b.z == 3.000000
+      AND b.s STARTSWITH "q"
+    )
+  )
+  AND NOT (a.y IS NULL)
+PARTITION BY symbol
+WITHIN 10s`, q.PrettyText("  "))
+
+	q, err = Parse(`EVENT A a WHERE a.x > 1`)
+	require.NoError(t, err)
+	require.Equal(t, "EVENT A a\nWHERE a.x > 1.000000", q.PrettyText("\t"))
+	require.Equal(t, "a.x > 1.000000", PrettyText(q.predicate, "\t"))
+	require.Equal(t, "", PrettyText(nil, "\t"))
+
+	p := Or(Attr("a", "x").Eq(Lit(1)), And(Attr("a", "y").Eq(Lit(2)), Attr("a", "z").Eq(Lit(3))))
+	require.Equal(t, "a.x == 1.000000\nOR (\n\ta.y == 2.000000\n\tAND a.z == 3.000000\n)", PrettyText(p, "\t"))
+}
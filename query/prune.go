@@ -0,0 +1,114 @@
+package query
+
+import (
+	"github.com/obeattie/sase/domain"
+)
+
+// evaluablePart returns the part of a predicate which can be evaluated with just the captured aliases, or nil if no
+// part of it can. Operands of AND which refer to any other alias are left out, so the part is implied by the whole: if
+// it is Negative, so is the whole predicate, whatever is captured later. Anything else is evaluable only as a whole.
+func evaluablePart(p Predicate, captured map[string]struct{}) Predicate {
+	if c, ok := unwrapCondition(p).(conjunction); ok {
+		var kept []Predicate
+		for _, operand := range c {
+			if part := evaluablePart(operand, captured); part != nil {
+				kept = append(kept, part)
+			}
+		}
+		switch len(kept) {
+		case 0:
+			return nil
+		case 1:
+			return kept[0]
+		default:
+			return conjunction(kept)
+		}
+	}
+	for _, alias := range p.usedAliases() {
+		if _, ok := captured[alias]; !ok {
+			return nil
+		}
+	}
+	return p
+}
+
+// satisfiedWithout returns a predicate with the conditions which refer to any of the absent aliases left out, as though
+// they were satisfied, or nil if that leaves nothing to evaluate. An operand of OR which is satisfied satisfies the
+// whole disjunction.
+func satisfiedWithout(p Predicate, absent map[string]struct{}) Predicate {
+	switch c := unwrapCondition(p).(type) {
+	case conjunction:
+		var kept []Predicate
+		for _, operand := range c {
+			if part := satisfiedWithout(operand, absent); part != nil {
+				kept = append(kept, part)
+			}
+		}
+		switch len(kept) {
+		case 0:
+			return nil
+		case 1:
+			return kept[0]
+		default:
+			return conjunction(kept)
+		}
+	case disjunction:
+		kept := make([]Predicate, len(c))
+		for i, operand := range c {
+			if kept[i] = satisfiedWithout(operand, absent); kept[i] == nil {
+				return nil
+			}
+		}
+		return disjunction(kept)
+	}
+	for _, alias := range p.usedAliases() {
+		if _, ok := absent[alias]; ok {
+			return nil
+		}
+	}
+	return p
+}
+
+// compilePruning builds a function equivalent to q.Compile for use by a matcher, which rules out candidates as early as
+// it can. While a candidate has captured only some of its events, the whole predicate can't be Negative only because
+// of the operands which refer to the others; the part which can be evaluated already (see evaluablePart) is evaluated
+// first, and if it is Negative, the rest needn't be. Each part is compiled the first time a candidate has captured its
+// combination of aliases. Unlike Compile, the function is NOT safe for concurrent use.
+func (q *Query) compilePruning() func(domain.CapturedEvents) Result {
+	full := q.Compile()
+	aliases := q.capture.aliases()
+	if q.predicate == nil || len(aliases) > 64 {
+		return full
+	}
+
+	parts := make(map[uint64]compiledPredicate) // By the set of aliases captured, as a bit for each; nil if no part
+	return func(evs domain.CapturedEvents) Result {
+		var set uint64
+		for i, alias := range aliases {
+			if _, ok := evs[alias]; ok {
+				set |= 1 << uint(i)
+			}
+		}
+		part, ok := parts[set]
+		if !ok {
+			captured := make(map[string]struct{}, len(evs))
+			for _, alias := range aliases {
+				if _, ok := evs[alias]; ok {
+					captured[alias] = struct{}{}
+				}
+			}
+			if p := evaluablePart(q.predicate, captured); p != nil && !p.Equal(q.predicate) {
+				part = q.compilePredicate(p)
+			}
+			parts[set] = part
+		}
+
+		// Errors are left for the whole predicate to report
+		if part != nil {
+			if r, err := part(evs); err == nil && r == Negative {
+				return q.result(evs, Negative)
+			}
+		}
+		return full(evs)
+	}
+}
@@ -0,0 +1,92 @@
+package query
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluablePart(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, B b, C c) WHERE a.x > 1 AND a.x < b.x AND (a.y == 2 OR c.y == 3) AND NOT b.z == 1 " +
+		"AND 1 < 2")
+	require.NoError(t, err)
+	cases := []struct {
+		captured []string
+		expected string
+	}{
+		{nil, "1.000000 < 2.000000"},
+		{[]string{"a"}, "(a.x > 1.000000 AND 1.000000 < 2.000000)"},
+		{[]string{"b"}, "(NOT (b.z == 1.000000) AND 1.000000 < 2.000000)"},
+		{[]string{"a", "b"}, "(a.x > 1.000000 AND a.x < b.x AND NOT (b.z == 1.000000) AND 1.000000 < 2.000000)"},
+		{[]string{"a", "b", "c"}, q.predicate.QueryText()},
+	}
+	for _, c := range cases {
+		captured := make(map[string]struct{})
+		for _, alias := range c.captured {
+			captured[alias] = struct{}{}
+		}
+		part := evaluablePart(q.predicate, captured)
+		require.NotNil(t, part, "%v", c.captured)
+		require.Equal(t, c.expected, part.QueryText(), "%v", c.captured)
+	}
+
+	q, err = Parse("EVENT SEQ(A a, B b) WHERE a.x > 1 OR b.x > 1")
+	require.NoError(t, err)
+	require.Nil(t, evaluablePart(q.predicate, map[string]struct{}{"a": {}}), "Operands of OR can't be left out")
+}
+
+func TestMatcherPruning(t *testing.T) {
+	o := &tObserver{}
+	SetObserver(o)
+	defer SetObserver(nil)
+
+	// A candidate which the conditions on a alone rule out is ruled out by them, without the conditions on b
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE b.x > a.x AND a.x > 5")
+	require.NoError(t, err)
+	m := NewMatcher(q)
+	m.Feed(tStream("A1 x=1")[0])
+	require.Equal(t, []string{"a.x > 5.000000: Negative"}, o.take())
+	require.Equal(t, 0, m.Candidates())
+
+	// Otherwise, the whole predicate is evaluated, and matches as before
+	for _, ev := range tStream("A1 x=6", "B1 x=7") {
+		m.Feed(ev)
+	}
+	require.Contains(t, o.take(), "(b.x > a.x AND a.x > 5.000000): Positive")
+}
+
+func benchmarkMatcherPruning(b *testing.B, pruning bool) {
+	// Only As in X are relevant, but without pruning every A is checked against B first
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE a.x * a.y + a.z < b.x AND a.y * a.z - a.x < b.y AND a.sym == 'X'")
+	require.NoError(b, err)
+	specs := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		sym := "Y"
+		if i%100 == 0 {
+			sym = "X"
+		}
+		specs = append(specs, fmt.Sprintf("A%d x=1 y=2 z=3 sym=%s", i, sym))
+	}
+	stream := tStream(specs...)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := NewMatcher(q)
+		if !pruning {
+			m.m.evaluate = q.Compile()
+		}
+		for _, ev := range stream {
+			m.Feed(ev)
+		}
+	}
+}
+
+func BenchmarkMatcherUnpruned(b *testing.B) {
+	benchmarkMatcherPruning(b, false)
+}
+
+func BenchmarkMatcherPruned(b *testing.B) {
+	benchmarkMatcherPruning(b, true)
+}
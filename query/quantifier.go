@@ -0,0 +1,182 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A listLiteralValue is a list of values (eg. "[10, 20, a.x]"), which resolves to a []interface{} of what they resolve
+// to. If the event any of them refers to is missing, so is the list.
+type listLiteralValue []value
+
+func (v listLiteralValue) QueryText() string {
+	members := make([]string, len(v))
+	for i, member := range v {
+		members[i] = valueText(member)
+	}
+	return "[" + strings.Join(members, ", ") + "]"
+}
+
+func (v listLiteralValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.valueContext(context.Background(), evs)
+}
+
+func (v listLiteralValue) valueContext(ctx context.Context, evs domain.CapturedEvents) (interface{}, error) {
+	result := make([]interface{}, len(v))
+	for i, member := range v {
+		if member == nil {
+			return nil, fmt.Errorf("Member %d of %s is missing", i, v.QueryText())
+		}
+		val, err := resolve(ctx, member, evs)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = val
+	}
+	return result, nil
+}
+
+func (v listLiteralValue) usedAliases() []string {
+	aliases := make([]string, 0, len(v))
+	for _, member := range v {
+		if member != nil {
+			aliases = append(aliases, member.usedAliases()...)
+		}
+	}
+	return dedupeAliases(aliases)
+}
+
+func (v listLiteralValue) Equal(other value) bool {
+	o, ok := other.(listLiteralValue)
+	return ok && sameValues(v, o)
+}
+
+func (v listLiteralValue) Clone() Value {
+	return listLiteralValue(cloneValues(v))
+}
+
+func (v listLiteralValue) children() []interface{} {
+	return valueNodes(v...)
+}
+
+// A quantifiedPredicate compares a value with every element of a list, holding if the comparison holds for any of them
+// (eg. "a.tag == any(b.tags)") or, quantified by all, for all of them (eg. "a.value > all([10, 20, 30])"). Unlike IN,
+// it may use any operator. The list is whatever its operand resolves to: a list literal, the values captured across a
+// Kleene closure (eg. "b[].x") or an attribute which is a slice. For an empty list, all holds (vacuously) and any
+// doesn't. As for IN, the result is Uncertain if either operand's event is missing. Elements which can't be ordered
+// with the value are skipped by any, which may still hold for the others, but are an error for all.
+type quantifiedPredicate struct {
+	left value
+	op   op
+	all  bool // Whether it is quantified by all, rather than any
+	list value
+}
+
+func (p *quantifiedPredicate) Evaluate(evs domain.CapturedEvents) Result {
+	return evaluateOrLog("quantifiedPredicate", p, evs)
+}
+
+func (p *quantifiedPredicate) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return evaluateObserved(context.Background(), p, evs)
+}
+
+func (p *quantifiedPredicate) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	ctx = withValueCache(ctx, evs)
+	leftVal, listVal, err := leftRightVals(ctx, evs, p.left, p.list)
+	if errors.Is(err, ErrEventNotFound) {
+		return Uncertain, nil
+	} else if err != nil {
+		return Negative, fmt.Errorf("Could not evaluate %s: %w", p.QueryText(), err)
+	}
+	elements, ok := listElements(listVal)
+	if !ok {
+		return Negative, fmt.Errorf("Could not evaluate %s: %s is not a list, got %T", p.QueryText(),
+			p.list.QueryText(), listVal)
+	}
+
+	compare := p.op.comparator(comparatorsFor(ctx))
+	if compare == nil {
+		return Negative, fmt.Errorf("Unhandled op %v for %s", p.op, p.QueryText())
+	}
+	for _, elem := range elements {
+		matched, ok := compare(leftVal, elem)
+		if !ok && !p.all {
+			continue
+		} else if !ok {
+			return Negative, fmt.Errorf("Could not order %T and %T: %s", leftVal, elem, p.QueryText())
+		} else if matched && !p.all {
+			return Positive, nil
+		} else if !matched && p.all {
+			return Negative, nil
+		}
+	}
+	if p.all {
+		return Positive, nil
+	}
+	return Negative, nil
+}
+
+// listElements returns the elements of a list: a []interface{}, or any other slice or array
+func listElements(v interface{}) ([]interface{}, bool) {
+	if list, ok := v.([]interface{}); ok {
+		return list, true
+	}
+	switch val := reflect.ValueOf(v); val.Kind() {
+	case reflect.Slice, reflect.Array:
+		result := make([]interface{}, val.Len())
+		for i := range result {
+			result[i] = val.Index(i).Interface()
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+// quantifier returns how the comparison is quantified, as it is written in a query
+func (p *quantifiedPredicate) quantifier() string {
+	if p.all {
+		return "all"
+	}
+	return "any"
+}
+
+func (p *quantifiedPredicate) QueryText() string {
+	return joinText(valueText(p.left), p.op.symbol(), p.quantifier()+"("+valueText(p.list)+")")
+}
+
+func (p *quantifiedPredicate) usedAliases() []string {
+	result := make([]string, 0)
+	if p.left != nil {
+		result = append(result, p.left.usedAliases()...)
+	}
+	if p.list != nil {
+		result = append(result, p.list.usedAliases()...)
+	}
+	return dedupeAliases(result)
+}
+
+func (p *quantifiedPredicate) Equal(other Predicate) bool {
+	o, ok := other.(*quantifiedPredicate)
+	return ok && p.op == o.op && p.all == o.all && sameValue(p.left, o.left) && sameValue(p.list, o.list)
+}
+
+func (p *quantifiedPredicate) Hash() uint64 {
+	return hashPredicate(p)
+}
+
+func (p *quantifiedPredicate) Clone() Predicate {
+	return &quantifiedPredicate{left: cloneValue(p.left), op: p.op, all: p.all, list: cloneValue(p.list)}
+}
+
+func (p *quantifiedPredicate) children() []interface{} {
+	return valueNodes(p.left, p.list)
+}
+
+func (p *quantifiedPredicate) Validate(declared map[string]struct{}) error {
+	return validateAliases(p, declared)
+}
@@ -0,0 +1,73 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestQuantified(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{typ: "A", attrs: map[string]interface{}{
+			"value": float64(35),
+			"x":     float64(0),
+			"tag":   "blue",
+			"tags":  []string{"red", "blue"},
+		}},
+		"b": domain.EventList{
+			&tEventImpl{typ: "B", attrs: map[string]interface{}{"x": float64(1)}},
+			&tEventImpl{typ: "B", attrs: map[string]interface{}{"x": float64(40)}},
+		},
+	}
+	cases := map[string]Result{
+		"a.value > all([10, 20, 30])":  Positive,
+		"a.value > all([10, 20, 40])":  Negative,
+		"a.value > any([10, 20, 40])":  Positive,
+		"a.value < any([10, 20, 30])":  Negative,
+		"a.value > all([])":            Positive, // Vacuously
+		"a.value > any([])":            Negative,
+		"a.tag == any(a.tags)":         Positive,
+		"a.tag != all(a.tags)":         Negative,
+		"a.value < any(b[].x)":         Positive,
+		"a.value < all(b[].x)":         Negative,
+		"a.value > any([b[0].x, 99])":  Positive,
+		"a.value > all([c.x, 1])":      Uncertain,
+		"c.x > all([1, 2])":            Uncertain,
+		"a.tag == any(c.tags)":         Uncertain,
+		"[a.value, 1] == [a.value, 1]": Positive, // Lists are values like any other
+		"a.x < any(['s', 1])":          Positive, // Elements which can't be ordered are skipped
+		"a.x < any(['s'])":             Negative,
+	}
+	for where, expected := range cases {
+		q, err := Parse("EVENT SEQ(A a, B+ b[], C c) WHERE " + where)
+		require.NoError(t, err, where)
+		r, err := q.predicate.EvaluateErr(evs)
+		require.NoError(t, err, where)
+		require.Equal(t, expected, r, where)
+	}
+
+	// but for all, they are an error
+	q, err := Parse("EVENT A a WHERE a.x < all(['s', 1])")
+	require.NoError(t, err)
+	_, err = q.predicate.EvaluateErr(evs)
+	require.EqualError(t, err, `Could not order float64 and string: a.x < all(["s", 1.000000])`)
+
+	// The list must be one
+	q, err = Parse("EVENT A a WHERE a.tag == any(a.value)")
+	require.NoError(t, err)
+	_, err = q.predicate.EvaluateErr(evs)
+	require.EqualError(t, err, "Could not evaluate a.tag == any(a.value): a.value is not a list, got float64")
+
+	// Quantifiers may only be used on the right of a comparison
+	_, err = Parse("EVENT A a WHERE any(a.tags) == a.tag")
+	require.Error(t, err)
+	_, err = Parse("EVENT A a WHERE a.tag == any(a.tags")
+	require.Error(t, err)
+
+	// Square brackets still test equivalence
+	q, err = Parse("EVENT SEQ(A a, B b) WHERE [symbol] AND a.x IN ([1], 2)")
+	require.NoError(t, err)
+	require.Equal(t, "([symbol] AND a.x IN ([1.000000], 2.000000))", q.predicate.QueryText())
+}
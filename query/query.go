@@ -2,7 +2,9 @@ package query
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,8 +21,25 @@ type Query struct {
 	capture EventCapture
 	// predicate represents filter(s) to be applied to a captured event stream
 	predicate Predicate
+	// partition is the key path of the attribute by which events are partitioned: only events which share its value
+	// may be matched together
+	partition string
 	// window represents the interval over which events may be matched
 	window time.Duration
+	// windowCount, if not 0, is the number of consecutive events of a stream within which events may be matched
+	windowCount int
+	// strategy determines how events are selected into candidate matches
+	strategy SelectionStrategy
+	// lateness is how far (in event time) events may arrive out of order when matching against a stream
+	lateness time.Duration
+	// schema, if there is one, is what events are conformed to as they are captured when matching against a stream
+	schema Schema
+	// maxCandidates, if not 0, is how many candidate matches may be held at once when matching against a stream
+	maxCandidates int
+	// comparators are consulted before the defaults when comparing values of the types they are registered for
+	comparators comparators
+	// alts are the queries for the alternatives of the event clause, if it has any (see alternatives)
+	alts []*Query
 }
 
 func (q *Query) QueryText() string {
@@ -34,17 +53,116 @@ func (q *Query) QueryText() string {
 		buf.WriteString(" WHERE ")
 		buf.WriteString(q.predicate.QueryText())
 	}
-	if q.window != 0 {
+	if q.partition != "" {
+		buf.WriteString(" PARTITION BY ")
+		buf.WriteString(q.partition)
+	}
+	if window := formatWindow(q.window, q.windowCount); window != "" {
 		buf.WriteString(" WITHIN ")
-		buf.WriteString(q.window.String())
+		buf.WriteString(window)
 	}
 	return buf.String()
 }
 
+// formatWindow returns a window of time and of a number of events as it is written in a WITHIN clause (eg. "5m AND 100
+// EVENTS"), or "" if there is neither
+func formatWindow(window time.Duration, count int) string {
+	parts := make([]string, 0, 2)
+	if window != 0 {
+		parts = append(parts, formatDuration(window))
+	}
+	if count == 1 {
+		parts = append(parts, "1 EVENT")
+	} else if count != 0 {
+		parts = append(parts, strconv.Itoa(count)+" EVENTS")
+	}
+	return strings.Join(parts, " AND ")
+}
+
 func (q *Query) Window() time.Duration {
 	return q.window
 }
 
+// WindowCount returns the number of events within which those of a match must occur (eg. 100, for "WITHIN 100
+// EVENTS"), or 0 if there is no such limit. A match's events must all be among that many consecutive events fed to a
+// Matcher, whatever their types (or partitions), counting its first and last. A query may have a window of both time
+// and events, in which case a candidate is discarded once it exceeds either.
+//
+// Events don't record their positions in a stream, so the window only applies when matching against one: evaluating
+// captured events (eg. with Evaluate) doesn't consider it.
+func (q *Query) WindowCount() int {
+	return q.windowCount
+}
+
+// Partition returns the key path of the attribute by which events are partitioned, as it is written in the query (eg.
+// "symbol", or "`user.id`"; see PartitionKey), or "" if they are not
+func (q *Query) Partition() string {
+	return q.partition
+}
+
+// Strategy returns the selection strategy used when matching the query against a stream of events
+func (q *Query) Strategy() SelectionStrategy {
+	return q.strategy
+}
+
+// SetStrategy changes the selection strategy (by default, SkipTillNextMatch)
+func (q *Query) SetStrategy(s SelectionStrategy) {
+	q.strategy = s
+	q.updateAlternatives()
+}
+
+// AllowedLateness returns how far behind the latest event seen an event may arrive when matching against a stream
+func (q *Query) AllowedLateness() time.Duration {
+	return q.lateness
+}
+
+// SetAllowedLateness changes how far behind the latest event seen (by its timestamp) an event may arrive when matching
+// against a stream (by default, 0: events must arrive in order). Events are buffered until the lateness bound has
+// passed, and fed to candidates in the order they occurred; any which arrive later than that are dropped.
+//
+// This is a trade-off: the greater the bound, the more disordered a stream may be without missing matches, but the
+// longer every match is delayed (by up to the bound) and the more events are held in the meantime.
+func (q *Query) SetAllowedLateness(d time.Duration) {
+	q.lateness = d
+	q.updateAlternatives()
+}
+
+// Schema returns the schema events are conformed to as they are captured (see SetSchema), or nil if there is none
+func (q *Query) Schema() Schema {
+	return q.schema
+}
+
+// SetSchema sets a schema to which events are conformed (see Schema.Conform) as they are captured under each alias when
+// matching against a stream; events which can't be are not captured under the alias. By default there is none, so
+// events are captured whatever the types of their attributes.
+func (q *Query) SetSchema(s Schema) {
+	q.schema = s
+	q.updateAlternatives()
+}
+
+// MaxCandidates returns how many candidate matches may be held at once when matching against a stream (see
+// SetMaxCandidates), or 0 if there is no limit
+func (q *Query) MaxCandidates() int {
+	return q.maxCandidates
+}
+
+// SetMaxCandidates limits how many candidate (partial) matches may be held at once when matching against a stream,
+// across all partitions (by default, 0: there is no limit). Under SkipTillAnyMatch their number can grow with the
+// number of combinations of events in the window, so an adversarial stream may otherwise exhaust memory.
+//
+// Once there are more than n candidates, those whose first event occurred earliest (the oldest, which are the closest
+// to expiring anyway) are evicted until there are n; between candidates which are as old as each other, those which
+// have captured fewer events go first. An evicted candidate which had matched, and was only being held open by a greedy
+// closure, is reported as a match as it stands; any other is dropped (see Matcher.OnEvict). If the event clause has
+// alternatives, the limit applies to each separately.
+func (q *Query) SetMaxCandidates(n int) {
+	if n < 0 {
+		panic(fmt.Sprintf("sase: invalid candidate limit %d", n))
+	}
+	q.maxCandidates = n
+	q.updateAlternatives()
+}
+
 // CaptureAliases the aliases under which the event should be captured (in order)
 func (q *Query) CaptureAliases(e domain.Event) []string {
 	return q.capture.Matches(e)
@@ -56,17 +174,197 @@ func (q *Query) Captures() map[string]string {
 }
 
 func (q *Query) Evaluate(evs domain.CapturedEvents) Result {
+	result, err := q.EvaluateErr(evs)
+	if err != nil {
+		logger.Errorf("[sase:Query] %s", err.Error())
+		return Negative // Terminate this match
+	}
+	return result
+}
+
+// EvaluateErr is like Evaluate, but returns an error if the query's predicate cannot be evaluated
+func (q *Query) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return q.EvaluateContext(context.Background(), evs)
+}
+
+// EvaluateContext is like EvaluateErr, but abandons evaluation (returning the context's error) once ctx is done
+func (q *Query) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	ctx = withComparators(withValueCache(ctx, evs), q.comparators)
+	if err := ctx.Err(); err != nil {
+		return Negative, err
+	} else if alts := q.alternatives(); alts != nil {
+		return evaluateAlternatives(ctx, alts, evs)
+	}
+	predicateResult := Positive
+	if q.predicate != nil {
+		r, err := evaluateObserved(ctx, q.predicate, evs)
+		if err == nil && r == Uncertain && q.completeWithoutNegations(evs) {
+			r = Positive
+			if p := q.negationsSatisfied(); p != nil {
+				r, err = evaluateObserved(ctx, p, evs)
+			}
+		}
+		if err != nil {
+			return Negative, err
+		}
+		predicateResult = r
+	}
+	return q.result(evs, predicateResult), nil
+}
+
+// result combines the result of the query's predicate with those of its capture and window.
+//
+// When a negated event is captured, eg. the b of "SEQ(A a, !(B b), C c)", the capture is Invalid: an event ruled out
+// by the query occurred between the events either side of it, so no candidate without it can match either. But this is
+// only so if the event also satisfies the predicate; otherwise the event is irrelevant and only the candidate which
+// captured it is Negative. A predicate which is Uncertain (it depends on events not yet captured) is not satisfied.
+// Since candidates exceeding the window are Invalid anyway, a negated event only rules out a match if it occurs within
+// the window. Whatever the strategy used to select events into candidates, each candidate must be evaluated with any
+// negated event added to it, as that is what reveals that the candidate itself should be discarded. Conversely, once a
+// candidate is complete without having captured any negated event, the conditions on those events are satisfied, so
+// the predicate is held only to the others (see negationsSatisfied) before anything still Uncertain is Negative.
+func (q *Query) result(evs domain.CapturedEvents, predicateResult Result) Result {
 	result := q.capture.evaluate(evs)
+	if result == Invalid && predicateResult != Positive && q.capturedNegation(evs) {
+		result, predicateResult = Negative, Negative
+	}
+	result = result.And(predicateResult).And(q.partitionResult(evs)).And(q.windowResult(evs))
+	if result == Uncertain && q.complete(evs) { // Nothing more could make it match
+		return Negative
+	}
+	return result
+}
+
+// complete reports whether no more events could usefully be captured: every alias has been, except for those of
+// negated events (capturing which can only rule out a match) and Kleene closures (which could grow, but only while the
+// window is open; the matcher discards candidates once it has closed).
+func (q *Query) complete(evs domain.CapturedEvents) bool {
+	if len(q.capture.closures()) > 0 {
+		return false
+	}
+	negated := make(map[string]struct{})
+	for _, alias := range q.capture.Negations() {
+		negated[alias] = struct{}{}
+	}
+	for _, alias := range q.capture.aliases() {
+		if _, ok := negated[alias]; ok {
+			continue
+		} else if _, ok := evs[alias]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// completeWithoutNegations reports whether a candidate is complete (see complete) and has none of the query's negated
+// events, which it could otherwise still capture
+func (q *Query) completeWithoutNegations(evs domain.CapturedEvents) bool {
+	return len(q.capture.Negations()) > 0 && !q.capturedNegation(evs) && q.complete(evs)
+}
+
+// negationsSatisfied returns the query's predicate with the conditions which refer to its negated events satisfied: the
+// predicate a candidate is held to once it is complete without them (see satisfiedWithout)
+func (q *Query) negationsSatisfied() Predicate {
+	negated := make(map[string]struct{})
+	for _, alias := range q.capture.Negations() {
+		negated[alias] = struct{}{}
+	}
+	return satisfiedWithout(q.predicate, negated)
+}
+
+// PartitionKey returns the value of the event's partition attribute (numbers are normalised to float64s, so that eg.
+// int(1) and 1.0 are in the same partition). ok is false if the query isn't partitioned, or the event doesn't have the
+// attribute: such an event can't be matched.
+func (q *Query) PartitionKey(ev domain.Event) (key interface{}, ok bool) {
+	if q.partition == "" {
+		return nil, false
+	}
+	val, err := lookupEvent(q.partition, ev, splitPath(q.partition))
+	if err != nil {
+		return nil, false
+	}
+	if num, ok := numericValue(val); ok {
+		return num, true
+	}
+	return val, true
+}
+
+// partitionResult is Negative if the captured events aren't all from the same partition
+func (q *Query) partitionResult(evs domain.CapturedEvents) Result {
+	if q.partition == "" {
+		return Positive
+	}
+	var (
+		first interface{}
+		seen  bool
+	)
+	for _, ev := range evs {
+		list, ok := ev.(domain.EventList)
+		if !ok {
+			list = domain.EventList{ev}
+		}
+		for _, ev := range list {
+			key, ok := q.PartitionKey(ev)
+			if !ok {
+				return Negative
+			} else if !seen {
+				first, seen = key, true
+			} else if !valuesEqual(first, key) {
+				return Negative
+			}
+		}
+	}
+	return Positive
+}
+
+// capturedNegation reports whether any of the query's negated events have been captured
+func (q *Query) capturedNegation(evs domain.CapturedEvents) bool {
+	for _, alias := range q.capture.Negations() {
+		if _, ok := evs[alias]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ReorderByCost reorders the query's predicate so that cheaper conditions are evaluated first (see ReorderByCost)
+func (q *Query) ReorderByCost() {
 	if q.predicate != nil {
-		result = result.And(q.predicate.Evaluate(evs))
+		q.predicate = ReorderByCost(q.predicate)
+		q.updateAlternatives()
 	}
-	return result.And(q.windowResult(evs))
 }
 
+// windowResult is Invalid if the captured events span more than the query's window. Capturing more events can only
+// widen the span, so no candidate which exceeds the window could ever match.
 func (q *Query) windowResult(evs domain.CapturedEvents) Result {
 	if q.window > 0 {
-		var earliest, latest time.Time
-		for _, ev := range evs {
+		if earliest, latest := captureSpan(evs); latest.Sub(earliest) > q.window {
+			return Invalid
+		}
+	}
+	return Positive
+}
+
+// Expired reports whether, as of now, the window within which events must be matched has elapsed for a candidate: that
+// is, any event which could still be captured would be too late. A candidate which has expired without matching should
+// be discarded. It is never true for a query without a window.
+func (q *Query) Expired(evs domain.CapturedEvents, now time.Time) bool {
+	if q.window <= 0 || len(evs) == 0 {
+		return false
+	}
+	earliest, _ := captureSpan(evs)
+	return !earliest.IsZero() && now.Sub(earliest) > q.window
+}
+
+// captureSpan returns the timestamps of the earliest and latest captured events
+func captureSpan(evs domain.CapturedEvents) (earliest, latest time.Time) {
+	for _, ev := range evs {
+		list, ok := ev.(domain.EventList)
+		if !ok {
+			list = domain.EventList{ev}
+		}
+		for _, ev := range list {
 			w := ev.When()
 			if w.Before(earliest) || earliest.IsZero() {
 				earliest = w
@@ -75,11 +373,8 @@ func (q *Query) windowResult(evs domain.CapturedEvents) Result {
 				latest = w
 			}
 		}
-		if latest.Sub(earliest) > q.window {
-			return Negative
-		}
 	}
-	return Positive
+	return earliest, latest
 }
 
 func (q *Query) validate() error {
@@ -88,29 +383,35 @@ func (q *Query) validate() error {
 	}
 
 	// Check for overlapping aliases
-	seenAliases, duplicateAliases := make(map[string]bool), make([]string, 0)
+	seenAliases, duplicateAliases := make(map[string]struct{}), make([]string, 0)
 	for _, alias := range q.capture.aliases() {
 		if _, ok := seenAliases[alias]; ok {
 			duplicateAliases = append(duplicateAliases, alias)
 		}
-		seenAliases[alias] = true
+		seenAliases[alias] = struct{}{}
 	}
 	if len(duplicateAliases) > 0 {
 		return fmt.Errorf("Query has duplicate aliases %s", strings.Join(duplicateAliases, ", "))
 	}
+	if alts, ok := q.capture.(orEventCapture); ok {
+		if err := validateAlternatives(alts); err != nil {
+			return err
+		}
+	}
 
 	// Check for predicate references to nonexistant events
 	if q.predicate != nil {
-		for _, alias := range q.predicate.usedAliases() {
-			if _, ok := seenAliases[alias]; !ok {
-				return fmt.Errorf("Reference to nonexistent capture %s", alias)
-			}
+		if err := q.predicate.Validate(seenAliases); err != nil {
+			return err
 		}
 	}
 
 	if q.window < 0 {
 		return fmt.Errorf("Query has negative window duration")
 	}
+	if q.windowCount < 0 {
+		return fmt.Errorf("Query has negative window count")
+	}
 
 	return nil
 }
@@ -0,0 +1,91 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestWindow(t *testing.T) {
+	q, err := Parse("EVENT SEQ(t a, t b, t c) WITHIN 1m")
+	require.NoError(t, err)
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) domain.Event {
+		return &tEventImpl{typ: "t", attrs: map[string]interface{}{}, ts: start.Add(d)}
+	}
+
+	cases := []struct {
+		evs      domain.CapturedEvents
+		expected Result
+	}{
+		{domain.CapturedEvents{"a": at(0)}, Uncertain},
+		{domain.CapturedEvents{"a": at(0), "b": domain.EventList{at(time.Second)}}, Uncertain},
+		{domain.CapturedEvents{"a": at(0), "b": domain.EventList{at(time.Second)}, "c": at(time.Minute)}, Positive},
+		// Exactly at the boundary is within the window; any later is not, and can never become so
+		{domain.CapturedEvents{"a": at(0), "b": domain.EventList{at(time.Second)}, "c": at(time.Minute + 1)}, Invalid},
+		{domain.CapturedEvents{"a": at(0), "b": domain.EventList{at(time.Second), at(time.Minute)}}, Uncertain},
+		{domain.CapturedEvents{"a": at(0), "b": domain.EventList{at(time.Second), at(time.Minute + 1)}}, Invalid},
+	}
+	for i, c := range cases {
+		require.Equal(t, c.expected, q.Evaluate(c.evs), "case %d", i)
+		require.Equal(t, c.expected, q.Compile()(c.evs), "case %d", i)
+	}
+
+	evs := domain.CapturedEvents{"a": at(0), "b": domain.EventList{at(30 * time.Second)}}
+	require.False(t, q.Expired(evs, start))
+	require.False(t, q.Expired(evs, start.Add(time.Minute)))
+	require.True(t, q.Expired(evs, start.Add(time.Minute+1)))
+	require.False(t, q.Expired(domain.CapturedEvents{}, start.Add(time.Hour)))
+
+	q, err = Parse("EVENT SEQ(t a, t c)")
+	require.NoError(t, err)
+	require.False(t, q.Expired(evs, start.Add(time.Hour)))
+	require.Equal(t, Positive, q.Evaluate(domain.CapturedEvents{"a": at(0), "c": at(time.Hour)}))
+}
+
+// Once every event which could make a difference has been captured, an Uncertain result can never be resolved
+func TestCompleteUncertain(t *testing.T) {
+	// A negated event which is never captured satisfies the conditions on it, even those which are Uncertain while it
+	// could still be
+	stream := tStream("A1 x=1", "C1 x=5")
+	for _, where := range []string{"b.x BETWEEN a.x AND c.x", "b.x IN (1, 2)", "b.x BETWEEN 1 AND 2", "b.x IS NULL",
+		"b.x IN (1, 2) AND a.x == 1", "b.x IN (1, 2) OR a.x == 2"} {
+		q, err := Parse("EVENT SEQ(A a, !(B b), C c) WHERE " + where)
+		require.NoError(t, err, where)
+		require.Equal(t, Uncertain, q.Evaluate(domain.CapturedEvents{"a": stream[0]}), where)
+		require.Equal(t, Positive, q.Evaluate(domain.CapturedEvents{"a": stream[0], "c": stream[1]}), where)
+		require.Equal(t, Positive, q.Compile()(domain.CapturedEvents{"a": stream[0], "c": stream[1]}), where)
+
+		m := newMatcher(q)
+		var matches []domain.CapturedEvents
+		for _, ev := range stream {
+			matches = append(matches, m.feed(ev)...)
+		}
+		require.Len(t, matches, 1, where)
+	}
+
+	// The others must still be satisfied, and one which does satisfy them rules the match out
+	q, err := Parse("EVENT SEQ(A a, !(B b), C c) WHERE b.x IN (1, 2) AND a.x == 2")
+	require.NoError(t, err)
+	require.Equal(t, Negative, q.Evaluate(domain.CapturedEvents{"a": stream[0], "c": stream[1]}))
+	q, err = Parse("EVENT SEQ(A a, !(B b), C c) WHERE b.x IN (1, 2)")
+	require.NoError(t, err)
+	m := newMatcher(q)
+	for _, ev := range tStream("A1 x=1", "B1 x=1", "C1 x=5") {
+		require.Empty(t, m.feed(ev))
+	}
+
+	// Where a closure could still grow, it's only once the window has closed that the candidate is discarded
+	q, err = Parse("EVENT SEQ(A a, B+ b[], C c) WHERE b[0].x BETWEEN a.x AND c.x WITHIN 2s")
+	require.NoError(t, err)
+	m = newMatcher(q)
+	for _, ev := range tStream("A1 x=1", "D1", "D2") {
+		require.Empty(t, m.feed(ev))
+	}
+	require.Equal(t, 1, m.size())
+	require.Empty(t, m.feed(tStream("D1", "D2", "D3", "D4")[3]))
+	require.Equal(t, 0, m.size())
+}
@@ -0,0 +1,241 @@
+// Package querytest helps to test queries: it runs them over streams of events, and compares the matches they complete
+// with those expected.
+package querytest
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/obeattie/sase/domain"
+	"github.com/obeattie/sase/query"
+)
+
+// An Attrs is the attributes of an event
+type Attrs map[string]interface{}
+
+type event struct {
+	typ   string
+	attrs Attrs
+	when  time.Time
+}
+
+func (e *event) Type() string {
+	return e.typ
+}
+
+func (e *event) Attributes() map[string]interface{} {
+	return e.attrs
+}
+
+func (e *event) When() time.Time {
+	return e.when
+}
+
+// Event returns an event for a stream
+func Event(typ string, when time.Time, attrs Attrs) domain.Event {
+	return &event{typ: typ, attrs: attrs, when: when}
+}
+
+// RunStream parses a query, feeds a Matcher for it each of the events in turn and then flushes it, returning every
+// match completed, in the order they were
+func RunStream(queryText string, events []domain.Event) ([]domain.CapturedEvents, error) {
+	q, err := query.Parse(queryText)
+	if err != nil {
+		return nil, err
+	}
+	return Run(q, events), nil
+}
+
+// Run does as RunStream for a query which has already been parsed (eg. to set its options first)
+func Run(q *query.Query, events []domain.Event) []domain.CapturedEvents {
+	m := query.NewMatcher(q)
+	matches := make([]domain.CapturedEvents, 0)
+	for _, ev := range events {
+		matches = append(matches, m.Feed(ev)...)
+	}
+	return append(matches, m.Flush()...)
+}
+
+// A Match describes a match which is expected: for each alias, the events it captures in order (one, or several for a
+// Kleene closure), each by attributes it must have. Other attributes of the events are ignored, as are the aliases of
+// the match which aren't described.
+type Match map[string][]Attrs
+
+// matches returns whether a match is one described
+func (e Match) matches(match domain.CapturedEvents) bool {
+	for alias, expected := range e {
+		ev, ok := match[alias]
+		if !ok {
+			return false
+		}
+		events, ok := ev.(domain.EventList)
+		if !ok {
+			events = domain.EventList{ev}
+		}
+		if len(events) != len(expected) {
+			return false
+		}
+		for i, attrs := range expected {
+			for k, v := range attrs {
+				if actual, ok := events[i].Attributes()[k]; !ok || !sameAttribute(actual, v) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func (e Match) String() string {
+	aliases := make([]string, 0, len(e))
+	for alias := range e {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	parts := make([]string, len(aliases))
+	for i, alias := range aliases {
+		events := make([]string, len(e[alias]))
+		for j, attrs := range e[alias] {
+			events[j] = describeAttrs(attrs)
+		}
+		parts[i] = alias + "=" + strings.Join(events, ",")
+	}
+	return strings.Join(parts, " ")
+}
+
+// sameAttribute returns whether an attribute has the value expected. Numbers are compared by value, whatever their
+// types (so an expected 1 is the same as a float64 1).
+func sameAttribute(actual, expected interface{}) bool {
+	if a, ok := number(actual); ok {
+		e, ok := number(expected)
+		return ok && a == e
+	}
+	return reflect.DeepEqual(actual, expected)
+}
+
+func number(v interface{}) (float64, bool) {
+	switch val := reflect.ValueOf(v); val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(val.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), true
+	}
+	return 0, false
+}
+
+// Describe returns a description of a match, its aliases in order, giving the type and attributes of each event
+// captured (eg. "a=A{id: 1} b=B{id: 2},B{id: 3}")
+func Describe(match domain.CapturedEvents) string {
+	aliases := make([]string, 0, len(match))
+	for alias := range match {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	parts := make([]string, len(aliases))
+	for i, alias := range aliases {
+		events, ok := match[alias].(domain.EventList)
+		if !ok {
+			events = domain.EventList{match[alias]}
+		}
+		descs := make([]string, len(events))
+		for j, ev := range events {
+			descs[j] = ev.Type() + describeAttrs(ev.Attributes())
+		}
+		parts[i] = alias + "=" + strings.Join(descs, ",")
+	}
+	return strings.Join(parts, " ")
+}
+
+func describeAttrs(attrs map[string]interface{}) string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s: %#v", k, attrs[k])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// Compare returns an error describing how the matches differ from those expected, if they do. The order of either
+// doesn't matter, but each match must be described by a different one of those expected (so a match the query
+// completes twice must be expected twice).
+func Compare(matches []domain.CapturedEvents, expected ...Match) error {
+	// Pair each match with one of those expected which describes it, so that as many are paired as possible: for each
+	// in turn, look for a path through those already paired by which it may be (an augmenting path)
+	pairedWith := make([]int, len(expected)) // The match each of those expected is paired with, if any
+	for i := range pairedWith {
+		pairedWith[i] = -1
+	}
+	var pair func(i int, visited []bool) bool
+	pair = func(i int, visited []bool) bool {
+		for j, e := range expected {
+			if visited[j] || !e.matches(matches[i]) {
+				continue
+			}
+			visited[j] = true
+			if pairedWith[j] < 0 || pair(pairedWith[j], visited) {
+				pairedWith[j] = i
+				return true
+			}
+		}
+		return false
+	}
+	unexpected := make([]string, 0)
+	for i := range matches {
+		if !pair(i, make([]bool, len(expected))) {
+			unexpected = append(unexpected, Describe(matches[i]))
+		}
+	}
+	missing := make([]string, 0)
+	for j, e := range expected {
+		if pairedWith[j] < 0 {
+			missing = append(missing, e.String())
+		}
+	}
+	if len(unexpected) == 0 && len(missing) == 0 {
+		return nil
+	}
+
+	problems := make([]string, 0, len(unexpected)+len(missing))
+	for _, desc := range missing {
+		problems = append(problems, "missing "+desc)
+	}
+	for _, desc := range unexpected {
+		problems = append(problems, "unexpected "+desc)
+	}
+	return fmt.Errorf("Expected %d matches, got %d:\n\t%s", len(expected), len(matches), strings.Join(problems, "\n\t"))
+}
+
+// TestingT is the part of *testing.T which the assertions use
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// AssertMatches runs a query over a stream of events (see RunStream) and checks that the matches it completes are
+// those expected (see Compare), reporting an error to t if they aren't. It returns whether they are.
+func AssertMatches(t TestingT, queryText string, events []domain.Event, expected ...Match) bool {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+	matches, err := RunStream(queryText, events)
+	if err != nil {
+		t.Errorf("Could not run %s: %s", queryText, err.Error())
+		return false
+	}
+	if err := Compare(matches, expected...); err != nil {
+		t.Errorf("%s: %s", queryText, err.Error())
+		return false
+	}
+	return true
+}
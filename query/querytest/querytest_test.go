@@ -0,0 +1,71 @@
+package querytest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+type tRecorder struct {
+	errors []string
+}
+
+func (r *tRecorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRunStream(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []domain.Event{
+		Event("A", t0, Attrs{"id": 1, "x": 1.0}),
+		Event("B", t0.Add(time.Second), Attrs{"id": 2, "x": 2.0}),
+		Event("B", t0.Add(2*time.Second), Attrs{"id": 3, "x": 3.0}),
+		Event("C", t0.Add(3*time.Second), Attrs{"id": 4}),
+	}
+
+	matches, err := RunStream("EVENT SEQ(A a, B+ b[], C c)", events)
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	require.Equal(t, "a=A{id: 1, x: 1} b=B{id: 2, x: 2},B{id: 3, x: 3} c=C{id: 4}", Describe(matches[0]))
+	require.NoError(t, Compare(matches, Match{"a": {{"id": 1}}, "b": {{"id": 2.0}, {"id": 3}}}))
+
+	_, err = RunStream("EVENT SEQ(A a WHERE", events)
+	require.Error(t, err)
+
+	// Matches are compared regardless of order
+	q := "EVENT B b"
+	require.True(t, AssertMatches(t, q, events, Match{"b": {{"id": 3}}}, Match{"b": {{"id": 2, "x": 2}}}))
+
+	r := &tRecorder{}
+	require.False(t, AssertMatches(r, q, events, Match{"b": {{"id": 3}}}, Match{"b": {{"id": 4}}}))
+	require.Equal(t, []string{q + ": Expected 2 matches, got 2:\n" +
+		"\tmissing b={id: 4}\n" +
+		"\tunexpected b=B{id: 2, x: 2}"}, r.errors)
+
+	r = &tRecorder{}
+	require.False(t, AssertMatches(r, "EVENT", events))
+	require.Len(t, r.errors, 1)
+}
+
+func TestCompare(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a1, a2 := Event("A", t0, Attrs{"id": 1, "k": "x"}), Event("A", t0, Attrs{"id": 2, "k": "x"})
+	matches := []domain.CapturedEvents{{"a": a1}, {"a": a2}}
+
+	require.NoError(t, Compare(nil))
+	// Each match is paired with a different one of those expected, even if the first it is described by would leave
+	// another unpaired
+	require.NoError(t, Compare(matches, Match{"a": {{"k": "x"}}}, Match{"a": {{"id": 1}}}))
+	require.EqualError(t, Compare(matches, Match{"a": {{"k": "x"}}}),
+		"Expected 1 matches, got 2:\n\tunexpected a=A{id: 2, k: \"x\"}")
+	require.Error(t, Compare(matches[:1], Match{"a": {{"id": 1}}}, Match{"a": {{"id": 1}}}))
+	// Aliases and attributes which are expected must be present
+	require.Error(t, Compare(matches[:1], Match{"b": {{}}}))
+	require.Error(t, Compare(matches[:1], Match{"a": {{"other": nil}}}))
+	require.Error(t, Compare(matches[:1], Match{"a": {{"id": "1"}}}))
+	require.Error(t, Compare(matches[:1], Match{"a": {{"id": 1}, {"id": 1}}}))
+}
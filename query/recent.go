@@ -0,0 +1,195 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A recentValue is the list of the values an expression had in the matches a Matcher completed most recently, oldest
+// first, so that events may be compared with an aggregate of them (eg. "b.latency > p95(recent(b.latency, 5m))"). The
+// window is either of time ("recent(b.latency, 5m)": the matches completed within 5 minutes of the latest of the events
+// being evaluated) or of a number of matches ("recent(b.latency, 100)": the last 100).
+//
+// Only a Matcher keeps the matches, each in a history of its own (see matchHistory), so evaluated any other way the
+// list is empty. Matches in which the expression can't be resolved aren't kept. Histories are part of a Matcher's
+// snapshot (see Matcher.Snapshot).
+//
+// An aggregate of an empty list (other than count or sum) resolves to ErrEventNotFound, so until there are recent
+// matches a comparison with it is as one with an event which hasn't been captured: the example is Positive, and matches
+// (which, being kept, give it something to compare with), as it would guarded by "count(recent(b.latency, 5m)) == 0".
+type recentValue struct {
+	operand value
+	window  time.Duration // If the window is of time
+	count   int           // If the window is of a number of matches
+	history *matchHistory // Kept by the matcher this copy of the value belongs to, if any
+}
+
+// newRecentValue builds a recentValue from the arguments it is called with in a query
+func newRecentValue(args []value) (*recentValue, error) {
+	if len(args) == 2 {
+		switch window := args[1].(type) {
+		case durationLiteralValue:
+			if window > 0 {
+				return &recentValue{operand: args[0], window: time.Duration(window)}, nil
+			}
+		case literalValue:
+			if isIntegral(window.v) && window.v.(float64) >= 1 {
+				return &recentValue{operand: args[0], count: int(window.v.(float64))}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("recent takes an expression and a window: a duration (eg. 5m) or a number of matches (eg. " +
+		"100)")
+}
+
+func (v *recentValue) QueryText() string {
+	return "recent(" + valueText(v.operand) + ", " + v.windowText() + ")"
+}
+
+// windowText returns the window as it is written in a query
+func (v *recentValue) windowText() string {
+	if v.count > 0 {
+		return strconv.Itoa(v.count)
+	}
+	return formatDuration(v.window)
+}
+
+func (v *recentValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	if v.history == nil {
+		return []interface{}{}, nil
+	}
+	_, latest := captureSpan(evs)
+	return v.history.values(latest), nil
+}
+
+func (v *recentValue) usedAliases() []string {
+	if v.operand == nil {
+		return []string{}
+	}
+	return v.operand.usedAliases()
+}
+
+func (v *recentValue) Equal(other value) bool {
+	o, ok := other.(*recentValue)
+	return ok && v.window == o.window && v.count == o.count && sameValue(v.operand, o.operand)
+}
+
+// Clone copies the value without its history
+func (v *recentValue) Clone() Value {
+	return &recentValue{operand: cloneValue(v.operand), window: v.window, count: v.count}
+}
+
+func (v *recentValue) children() []interface{} {
+	return valueNodes(v.operand)
+}
+
+// record adds the value of the operand in a completed match to the history
+func (v *recentValue) record(match domain.CapturedEvents) {
+	val, err := resolve(context.Background(), v.operand, match)
+	if err != nil {
+		logger.Debugf("[sase:recentValue] Not recording %s: %s", v.QueryText(), err.Error())
+		return
+	}
+	_, when := captureSpan(match)
+	v.history.push(when, val)
+}
+
+// A matchHistory holds the values of a recentValue in the matches completed within its window, in a ring buffer. A
+// window of N matches holds at most N values. A window of time holds one for each match completed within it of the
+// latest, so its footprint grows with the rate at which the query matches: eg. 5m at 100 matches a second is 30,000.
+type matchHistory struct {
+	window  time.Duration
+	count   int
+	entries []historyEntry // The buffer, of which n entries from start (wrapping around) are held
+	start   int
+	n       int
+}
+
+type historyEntry struct {
+	when time.Time // Of the latest event the match captured
+	v    interface{}
+}
+
+func newMatchHistory(v *recentValue) *matchHistory {
+	h := &matchHistory{window: v.window, count: v.count}
+	if v.count > 0 {
+		h.entries = make([]historyEntry, v.count)
+	}
+	return h
+}
+
+func (h *matchHistory) at(i int) *historyEntry {
+	return &h.entries[(h.start+i)%len(h.entries)]
+}
+
+func (h *matchHistory) push(when time.Time, v interface{}) {
+	if h.count > 0 && h.n == h.count { // The oldest makes way
+		*h.at(0) = historyEntry{when: when, v: v}
+		h.start = (h.start + 1) % len(h.entries)
+		return
+	}
+
+	for h.count == 0 && h.n > 0 && h.at(0).when.Before(when.Add(-h.window)) { // Those which have left the window
+		*h.at(0) = historyEntry{}
+		h.start = (h.start + 1) % len(h.entries)
+		h.n--
+	}
+	if h.n == len(h.entries) {
+		entries := make([]historyEntry, 2*len(h.entries)+1)
+		for i := 0; i < h.n; i++ {
+			entries[i] = *h.at(i)
+		}
+		h.entries, h.start = entries, 0
+	}
+	*h.at(h.n) = historyEntry{when: when, v: v}
+	h.n++
+}
+
+// values returns the values in the window as of now, oldest first. Matches completed after now (since events may
+// arrive late) are left out.
+func (h *matchHistory) values(now time.Time) []interface{} {
+	result := make([]interface{}, 0, h.n)
+	for i := 0; i < h.n; i++ {
+		e := h.at(i)
+		if e.when.After(now) || (h.count == 0 && e.when.Before(now.Add(-h.window))) {
+			continue
+		}
+		result = append(result, e.v)
+	}
+	return result
+}
+
+// withHistories returns a copy of the query whose recent values each have a history of their own, for a matcher to
+// keep, along with those values. A query without any is returned as it is.
+func (q *Query) withHistories() (*Query, []*recentValue) {
+	if q.predicate == nil || !hasRecentValues(q.predicate) {
+		return q, nil
+	}
+	result := *q
+	result.predicate = q.predicate.Clone()
+	result.updateAlternatives()
+	var recent []*recentValue
+	Walk(result.predicate, func(node interface{}) bool {
+		if v, ok := node.(*recentValue); ok {
+			v.history = newMatchHistory(v)
+			recent = append(recent, v)
+		}
+		return true
+	})
+	return &result, recent
+}
+
+func hasRecentValues(p Predicate) bool {
+	found := false
+	Walk(p, func(node interface{}) bool {
+		if _, ok := node.(*recentValue); ok {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,106 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestMatchHistory(t *testing.T) {
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(s int) time.Time {
+		return start.Add(time.Duration(s) * time.Second)
+	}
+
+	// A window of a number of matches keeps the last of them, as it slides
+	h := newMatchHistory(&recentValue{count: 3})
+	require.Equal(t, []interface{}{}, h.values(at(0)))
+	for i := 1; i <= 5; i++ {
+		h.push(at(i), i)
+	}
+	require.Equal(t, []interface{}{3, 4, 5}, h.values(at(5)))
+	require.Len(t, h.entries, 3)
+	h.push(at(6), 6)
+	require.Equal(t, []interface{}{4, 5, 6}, h.values(at(6)))
+	require.Equal(t, []interface{}{4, 5}, h.values(at(5)), "Those completed later are left out")
+
+	// A window of time keeps those in it, as of the latest
+	h = newMatchHistory(&recentValue{window: 3 * time.Second})
+	for i := 1; i <= 10; i++ {
+		h.push(at(i), i)
+	}
+	require.Equal(t, []interface{}{7, 8, 9, 10}, h.values(at(10)))
+	require.Equal(t, []interface{}{9, 10}, h.values(at(12)))
+	require.Equal(t, []interface{}{}, h.values(at(20)))
+	require.Equal(t, 4, h.n, "Those which have left the window are dropped")
+	h.push(at(20), 20)
+	require.Equal(t, []interface{}{20}, h.values(at(20)))
+	require.Equal(t, 1, h.n)
+}
+
+func TestRecentValue(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE b.latency > p95(recent(b.latency, 5m)) AND a.n < avg(recent(a.n, 10))")
+	require.NoError(t, err)
+	require.Equal(t, "(b.latency > p95(recent(b.latency, 5m)) AND a.n < avg(recent(a.n, 10)))", q.predicate.QueryText())
+	require.ElementsMatch(t, []string{"a", "b"}, q.predicate.usedAliases())
+
+	for _, queryText := range []string{
+		"EVENT A a WHERE max(recent(a.x)) > 1",
+		"EVENT A a WHERE max(recent(a.x, 0)) > 1",
+		"EVENT A a WHERE max(recent(a.x, 1.5)) > 1",
+		"EVENT A a WHERE max(recent(a.x, a.y)) > 1",
+	} {
+		_, err := Parse(queryText)
+		require.Error(t, err, queryText)
+	}
+
+	// Evaluated outside a matcher, there are no recent matches
+	v := q.predicate.(conjunction)[1].(*operatorPredicate).right.(*aggregateValue).operand
+	result, err := v.Value(domain.CapturedEvents{})
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{}, result)
+
+	data, err := json.Marshal(q.predicate)
+	require.NoError(t, err)
+	decoded, err := UnmarshalPredicate(data)
+	require.NoError(t, err)
+	require.True(t, q.predicate.Equal(decoded), string(data))
+}
+
+func TestRecentMatches(t *testing.T) {
+	// Each match is compared with the three before it, once there are as many
+	stream := tStream("A1 x=5", "A2 x=6", "A3 x=4", "A4 x=5", "A5 x=9", "A6 x=5", "A7 x=10", "A8 x=11", "A9 x=3")
+	require.Equal(t, []string{"a=A1", "a=A2", "a=A3", "a=A5", "a=A7", "a=A8"}, tMatches(t,
+		"EVENT A a WHERE count(recent(a.x, 3)) < 3 OR a.x > max(recent(a.x, 3))", SkipTillNextMatch, stream))
+
+	// Or with those completed within the last 2 seconds (1 event apart)
+	require.Equal(t, []string{"a=A1", "a=A2", "a=A5", "a=A7", "a=A8"}, tMatches(t,
+		"EVENT A a WHERE count(recent(a.x, 2s)) == 0 OR a.x > max(recent(a.x, 2s))", SkipTillNextMatch, stream))
+
+	// Unguarded, an aggregate of no recent matches is as if its events were missing, so the comparison holds
+	require.Equal(t, []string{"a=A1", "a=A2", "a=A5", "a=A7", "a=A8"}, tMatches(t,
+		"EVENT A a WHERE a.x > max(recent(a.x, 2s))", SkipTillNextMatch, stream))
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE b.latency > p95(recent(b.latency, 5m))")
+	require.NoError(t, err)
+	evs := domain.CapturedEvents{"b": &tEventImpl{typ: "B", attrs: map[string]interface{}{"latency": 250.0}}}
+	result, err := q.predicate.EvaluateErr(evs)
+	require.NoError(t, err)
+	require.Equal(t, Positive, result)
+	require.Equal(t, Positive, Compile(q.predicate)(evs))
+	require.Len(t, NewMatcher(q).Feed(evs["b"]), 0) // b must still follow an A
+	m := NewMatcher(q)
+	m.Feed(&tEventImpl{typ: "A", attrs: map[string]interface{}{}})
+	require.Len(t, m.Feed(evs["b"]), 1)
+
+	// Each matcher keeps its own history
+	q, err = Parse("EVENT A a WHERE count(recent(a.x, 3)) < 1")
+	require.NoError(t, err)
+	m1, m2 := NewMatcher(q), NewMatcher(q)
+	require.Len(t, m1.Feed(stream[0]), 1)
+	require.Len(t, m1.Feed(stream[1]), 0)
+	require.Len(t, m2.Feed(stream[1]), 1)
+}
@@ -0,0 +1,67 @@
+package query
+
+// A PredicateResult is the result of evaluating a predicate: the Result, or the error which prevented it from being
+// evaluated (eg. one of a batch; see BatchEvaluate)
+type PredicateResult struct {
+	Result Result
+	Err    error // If the predicate couldn't be evaluated (in which case Result is Negative)
+}
+
+// AndResults combines the results of the operands of a conjunction, in order, exactly as AND does: it is Positive only
+// if they all are, Negative or Invalid as soon as any is (in which case later operands, and any errors they had, are
+// moot), and otherwise Uncertain. An error is reached in order too: the result is Negative, with that error. With no
+// operands, it is Positive.
+func AndResults(results ...PredicateResult) PredicateResult {
+	result := Positive
+	for _, r := range results {
+		if r.Err != nil {
+			return PredicateResult{Result: Negative, Err: r.Err}
+		}
+		result = result.And(r.Result)
+		if result == Negative || result == Invalid { // Nothing can make this positive again
+			break
+		}
+	}
+	return PredicateResult{Result: result}
+}
+
+// OrResults combines the results of the operands of a disjunction, in order, exactly as OR does: it is Positive as
+// soon as any is (in which case any errors are moot), Uncertain if none is but any is uncertain, and otherwise Negative
+// (or Invalid, if they all are). Otherwise, an error is reported: the result is Negative, with the first error. With no
+// operands, it is Negative.
+func OrResults(results ...PredicateResult) PredicateResult {
+	var (
+		result   = Negative
+		firstErr error
+	)
+	for i, r := range results {
+		if r.Err != nil {
+			if firstErr == nil { // A later operand may still be positive, which makes the error moot
+				firstErr = r.Err
+			}
+			r.Result = Negative
+		}
+		if i == 0 {
+			result = r.Result
+		} else {
+			result = result.Or(r.Result)
+		}
+		if result == Positive {
+			return PredicateResult{Result: result}
+		}
+	}
+	if firstErr != nil {
+		return PredicateResult{Result: Negative, Err: firstErr}
+	}
+	return PredicateResult{Result: result}
+}
+
+// NotResult inverts a result as NOT does once the events its operand refers to have all been captured: Positive and
+// Negative are swapped, but Uncertain (and Invalid) are passed through. An error is not a negative result, so isn't
+// inverted into a positive one: the result is Negative, with the error.
+func NotResult(r PredicateResult) PredicateResult {
+	if r.Err != nil {
+		return PredicateResult{Result: Negative, Err: r.Err}
+	}
+	return PredicateResult{Result: negate(r.Result)}
+}
@@ -0,0 +1,110 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestResultHelpers(t *testing.T) {
+	var (
+		p   = PredicateResult{Result: Positive}
+		n   = PredicateResult{Result: Negative}
+		u   = PredicateResult{Result: Uncertain}
+		i   = PredicateResult{Result: Invalid}
+		err = PredicateResult{Result: Negative, Err: errors.New("Broken")}
+	)
+
+	// Keyed by [right][left]
+	and := map[PredicateResult]map[PredicateResult]PredicateResult{
+		p: {p: p, n: n, u: u, i: i},
+		n: {p: n, n: n, u: n, i: i},
+		u: {p: u, n: n, u: u, i: i},
+		i: {p: i, n: n, u: i, i: i},
+	}
+	or := map[PredicateResult]map[PredicateResult]PredicateResult{
+		p: {p: p, n: p, u: p, i: p},
+		n: {p: p, n: n, u: u, i: n},
+		u: {p: p, n: u, u: u, i: u},
+		i: {p: p, n: n, u: u, i: i},
+	}
+	for right, row := range and {
+		for left, expected := range row {
+			require.Equal(t, expected, AndResults(left, right), "%s AND %s", left.Result, right.Result)
+		}
+	}
+	for right, row := range or {
+		for left, expected := range row {
+			require.Equal(t, expected, OrResults(left, right), "%s OR %s", left.Result, right.Result)
+		}
+	}
+	not := map[PredicateResult]PredicateResult{p: n, n: p, u: u, i: i, err: err}
+	for r, expected := range not {
+		require.Equal(t, expected, NotResult(r), "NOT %s", r.Result)
+	}
+
+	// Errors, and no operands at all
+	require.Equal(t, err, AndResults(p, err, n))
+	require.Equal(t, n, AndResults(n, err), "An error after a negative result is moot")
+	require.Equal(t, err, OrResults(err, n))
+	require.Equal(t, p, OrResults(err, p), "An error before a positive result is moot")
+	require.Equal(t, p, AndResults())
+	require.Equal(t, n, OrResults())
+
+	// They give the same results as the connectives, for every combination of up to three operands
+	all := []PredicateResult{p, n, u, i, err}
+	var combinations [][]PredicateResult
+	for _, a := range all {
+		combinations = append(combinations, []PredicateResult{a})
+		for _, b := range all {
+			combinations = append(combinations, []PredicateResult{a, b})
+			for _, c := range all {
+				combinations = append(combinations, []PredicateResult{a, b, c})
+			}
+		}
+	}
+	for _, results := range combinations {
+		operands := make([]Predicate, len(results))
+		for j, r := range results {
+			operands[j] = tPredicate{result: r.Result, err: r.Err}
+		}
+		description := fmt.Sprintf("%v", results)
+		r, e := conjunction(operands).EvaluateErr(domain.CapturedEvents{})
+		require.Equal(t, PredicateResult{Result: r, Err: e}, AndResults(results...), "AND %s", description)
+		r, e = disjunction(operands).EvaluateErr(domain.CapturedEvents{})
+		require.Equal(t, PredicateResult{Result: r, Err: e}, OrResults(results...), "OR %s", description)
+		r, e = (&negationPredicate{operands[0]}).EvaluateErr(domain.CapturedEvents{})
+		require.Equal(t, PredicateResult{Result: r, Err: e}, NotResult(results[0]), "NOT %s", description)
+	}
+}
+
+func TestResultText(t *testing.T) {
+	for _, r := range []Result{Positive, Negative, Uncertain, Invalid} {
+		text, err := r.MarshalText()
+		require.NoError(t, err)
+		var decoded Result
+		require.NoError(t, decoded.UnmarshalText(text))
+		require.Equal(t, r, decoded, string(text))
+	}
+
+	// As JSON values and map keys
+	data, err := json.Marshal(map[Result][]Result{Positive: {Negative, Uncertain}})
+	require.NoError(t, err)
+	require.Equal(t, `{"positive":["negative","uncertain"]}`, string(data))
+	var decoded map[Result][]Result
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, map[Result][]Result{Positive: {Negative, Uncertain}}, decoded)
+
+	var r Result
+	require.NoError(t, r.UnmarshalText([]byte("Invalid")))
+	require.Equal(t, Invalid, r)
+	require.EqualError(t, r.UnmarshalText([]byte("maybe")), `Unknown result "maybe"`)
+	require.Error(t, json.Unmarshal([]byte(`"maybe"`), &r))
+	_, err = Result(7).MarshalText()
+	require.Error(t, err)
+}
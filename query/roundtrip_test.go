@@ -0,0 +1,266 @@
+package query
+
+import (
+	"math/rand"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tGenerator builds random (but well-formed) predicate trees over the captures a and b
+type tGenerator struct {
+	*rand.Rand
+}
+
+var (
+	tGenStrings  = []string{"", "foo", "it's", `say "hi"`, `back\slash`, "ünïcode", "new\nline"}
+	tGenPatterns = []string{"^a", "b+$", `\d{2}`, "(x|y)"}
+	tGenFuncs    = []string{"lower", "upper", "trim", "length", "abs", "round"}
+)
+
+func (g tGenerator) pick(n int) int {
+	return g.Intn(n)
+}
+
+func (g tGenerator) alias() string {
+	return []string{"a", "b"}[g.pick(2)]
+}
+
+func (g tGenerator) path() []string {
+	path := []string{[]string{"x", "y", "m", "user.id", "in", "LEN"}[g.pick(6)]}
+	if g.pick(3) == 0 {
+		path = append(path, "z")
+	}
+	return path
+}
+
+func (g tGenerator) literal() literalValue {
+	switch g.pick(6) {
+	case 0:
+		return literalValue{float64(g.pick(2000) - 1000)}
+	case 1:
+		return literalValue{(g.Float64() - 0.5) * 1000}
+	case 2:
+		return literalValue{g.Float64() / 1e9} // Smaller than %f can show
+	case 3:
+		return literalValue{tGenStrings[g.pick(len(tGenStrings))]}
+	case 4:
+		return literalValue{g.pick(2) == 0}
+	default:
+		return literalValue{nil}
+	}
+}
+
+func (g tGenerator) value(depth int) value {
+	max := 4
+	if depth > 0 {
+		max = 18
+	}
+	switch g.pick(max) {
+	case 0:
+		return g.literal()
+	case 1:
+		return newAttributeLookup(g.alias(), g.path())
+	case 2:
+		return lengthValue(g.alias())
+	case 3:
+		switch g.pick(4) {
+		case 0:
+			return &indexLookup{alias: g.alias(), offset: g.pick(3) - 2, path: g.path()}
+		case 1:
+			return &indexLookup{alias: g.alias(), index: literalValue{float64(g.pick(5))}, path: g.path()}
+		case 2:
+			return &boundaryLookup{alias: g.alias(), last: g.pick(2) == 0, path: g.path()}
+		default:
+			return &indexLookup{alias: g.alias(), index: g.value(depth - 1), path: g.path()}
+		}
+	case 4, 5:
+		return &arithmeticValue{left: g.value(depth - 1), right: g.value(depth - 1), op: arithmeticOp(g.pick(9))}
+	case 6:
+		fn := aggregateFunc(g.pick(len(aggregateFuncs)))
+		return &aggregateValue{fn: fn, operand: &listLookup{alias: g.alias(), path: g.path()}}
+	case 7:
+		v, err := newFunctionValue(tGenFuncs[g.pick(len(tGenFuncs))], []value{g.value(depth - 1)})
+		if err != nil {
+			panic(err)
+		}
+		return v
+	case 8:
+		args := make([]value, g.pick(3))
+		for i := range args {
+			args[i] = g.value(depth - 1)
+		}
+		v, err := newFunctionValue("concat", args)
+		if err != nil {
+			panic(err)
+		}
+		return v
+	case 9:
+		operand := value(newAttributeLookup(g.alias(), g.path()))
+		if g.pick(3) == 0 {
+			operand = &subscriptLookup{operand: operand, key: literalValue{"k"}}
+		}
+		v := &subscriptLookup{operand: operand, key: g.value(depth - 1)}
+		if g.pick(2) == 0 {
+			v.path = g.path()
+		}
+		return v
+	case 10:
+		return &conditionalValue{condition: g.predicate(depth - 1), then: g.value(depth - 1), otherwise: g.value(depth - 1)}
+	case 11:
+		return &castValue{to: []AttributeType{TypeNumber, TypeString, TypeBool}[g.pick(3)], operand: g.value(depth - 1)}
+	case 12:
+		return &bitwiseNotValue{g.value(depth - 1)}
+	case 13:
+		return eventValue(g.alias())
+	case 14:
+		v := make(listLiteralValue, g.pick(3))
+		for i := range v {
+			v[i] = g.value(depth - 1)
+		}
+		return v
+	case 15:
+		return variableValue([]string{"region", "limit"}[g.pick(2)])
+	case 16:
+		if g.pick(2) == 0 {
+			return &recentValue{operand: g.value(depth - 1), count: g.pick(3) + 1}
+		}
+		return &recentValue{operand: g.value(depth - 1), window: time.Duration(g.pick(3)+1) * time.Minute}
+	default:
+		v := make(coalesceValue, g.pick(2)+1)
+		for i := range v {
+			v[i] = g.value(depth - 1)
+		}
+		return v
+	}
+}
+
+func (g tGenerator) predicate(depth int) Predicate {
+	max := 8
+	if depth > 0 {
+		max = 11
+	}
+	switch g.pick(max) {
+	case 0:
+		return &operatorPredicate{left: g.value(depth), right: g.value(depth), op: op(g.pick(7))}
+	case 1:
+		return &betweenPredicate{operand: g.value(depth), low: g.value(depth), high: g.value(depth)}
+	case 2:
+		set := make([]value, g.pick(3)+1)
+		for i := range set {
+			set[i] = g.value(depth)
+		}
+		return &inPredicate{left: g.value(depth), set: set}
+	case 3:
+		return &nullCheckPredicate{operand: g.value(depth), negated: g.pick(2) == 0}
+	case 4:
+		pattern := tGenPatterns[g.pick(len(tGenPatterns))]
+		return &regexPredicate{left: g.value(depth), pattern: regexp.MustCompile(pattern)}
+	case 5:
+		return &stringMatchPredicate{left: g.value(depth), right: g.value(depth), match: stringMatch(g.pick(3))}
+	case 6:
+		return newEquivalencePredicate([]string{"x", "y"}[g.pick(2)], "a", "b")
+	case 7:
+		list := g.value(depth)
+		if g.pick(2) == 0 {
+			list = &listLookup{alias: g.alias(), path: g.path()}
+		}
+		return &quantifiedPredicate{left: g.value(depth), op: op(g.pick(7)), all: g.pick(2) == 0, list: list}
+	case 8:
+		return &negationPredicate{g.predicate(depth - 1)}
+	case 9:
+		c := make(conjunction, g.pick(2)+2)
+		for i := range c {
+			c[i] = g.predicate(depth - 1)
+		}
+		return c
+	default:
+		d := make(disjunction, g.pick(2)+2)
+		for i := range d {
+			d[i] = g.predicate(depth - 1)
+		}
+		return d
+	}
+}
+
+// Rendering any predicate as text and parsing the result must give back the same predicate
+func TestQueryTextRoundTrip(t *testing.T) {
+	g := tGenerator{rand.New(rand.NewSource(1))}
+	for i := 0; i < 2000; i++ {
+		p := g.predicate(3)
+		queryText := "EVENT SEQ(t a, t b) WHERE " + p.QueryText()
+		q, err := Parse(queryText)
+		require.NoError(t, err, queryText)
+		require.True(t, p.Equal(q.predicate), "%s\nre-rendered: %s", queryText, q.predicate.QueryText())
+	}
+}
+
+// The same goes for the multi-line rendering
+func TestPrettyTextRoundTrip(t *testing.T) {
+	g := tGenerator{rand.New(rand.NewSource(2))}
+	for i := 0; i < 2000; i++ {
+		p := g.predicate(3)
+		q, err := Parse("EVENT SEQ(t a, t b) WHERE " + p.QueryText() + " PARTITION BY x WITHIN 1m")
+		require.NoError(t, err)
+		prettyText := q.PrettyText("\t")
+		reparsed, err := Parse(prettyText)
+		require.NoError(t, err, prettyText)
+		require.True(t, p.Equal(reparsed.predicate), "%s\nre-rendered: %s", prettyText, reparsed.PrettyText("\t"))
+		require.Equal(t, q.QueryText(), reparsed.QueryText())
+	}
+}
+
+// tSharedNodes returns the addresses of the nodes of a tree which could be mutated in place (compiled patterns aside)
+func tSharedNodes(p Predicate) map[uintptr]interface{} {
+	result := make(map[uintptr]interface{})
+	Walk(p, func(node interface{}) bool {
+		switch v := reflect.ValueOf(node); v.Kind() {
+		case reflect.Ptr:
+			result[v.Pointer()] = node
+		case reflect.Slice:
+			if v.Len() > 0 {
+				result[v.Pointer()] = node
+			}
+		}
+		if n, ok := node.(*indexLookup); ok && len(n.path) > 0 {
+			result[reflect.ValueOf(n.path).Pointer()] = n.path
+		} else if n, ok := node.(*listLookup); ok && len(n.path) > 0 {
+			result[reflect.ValueOf(n.path).Pointer()] = n.path
+		}
+		return true
+	})
+	return result
+}
+
+// A clone of any predicate is equal to it, but shares none of its nodes
+func TestClone(t *testing.T) {
+	g := tGenerator{rand.New(rand.NewSource(3))}
+	for i := 0; i < 2000; i++ {
+		p := g.predicate(3)
+		clone := p.Clone()
+		require.True(t, p.Equal(clone), p.QueryText())
+		cloneNodes := tSharedNodes(clone)
+		for addr, node := range tSharedNodes(p) {
+			_, shared := cloneNodes[addr]
+			require.False(t, shared, "%s shares %#v", p.QueryText(), node)
+		}
+	}
+
+	// Modifying the clone leaves the original as it was
+	q, err := Parse("EVENT SEQ(A a, B+ b[]) WHERE a.x > 1 AND (b[i-1].y < b[i].y OR a.s MATCHES '^x')")
+	require.NoError(t, err)
+	original := q.predicate.QueryText()
+	clone := q.predicate.Clone()
+	c := clone.(conjunction)
+	c[0].(*operatorPredicate).op = opLt
+	c[0].(*operatorPredicate).right = literalValue{2.0}
+	d := c[1].(disjunction)
+	d[0].(*operatorPredicate).left.(*indexLookup).path[0] = "z"
+	d[1] = newEquivalencePredicate("k", "a", "b")
+	require.Equal(t, original, q.predicate.QueryText())
+	require.Equal(t, "(a.x < 2.000000 AND (b[i-1].z < b[i].y OR [k]))", clone.QueryText())
+	require.True(t, Condition{q.predicate}.Clone().Equal(q.predicate))
+}
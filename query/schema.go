@@ -0,0 +1,355 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// An AttributeType is the type of an attribute (or of a value in a query), as far as checking a query against a
+// Schema is concerned
+type AttributeType uint8
+
+const (
+	TypeUnknown AttributeType = iota // may be anything, so is compatible with everything
+	TypeNumber
+	TypeString
+	TypeBool
+	TypeTime
+)
+
+func (t AttributeType) String() string {
+	switch t {
+	case TypeNumber:
+		return "number"
+	case TypeString:
+		return "string"
+	case TypeBool:
+		return "bool"
+	case TypeTime:
+		return "time"
+	default:
+		return "unknown"
+	}
+}
+
+// A Schema declares the types of the attributes of captured events, keyed by their path including the alias (eg.
+// "a.price"). Attributes which aren't declared may be of any type.
+type Schema map[string]AttributeType
+
+// ParseWithSchema parses a query, and then checks its predicate against the schema (see CheckTypes)
+func ParseWithSchema(data string, s Schema) (*Query, error) {
+	q, err := Parse(data)
+	if err != nil {
+		return nil, err
+	} else if err := q.CheckTypes(s); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// CheckTypes returns an error describing the first comparison in the predicate whose operands can't be compared,
+// according to the types the schema declares for attributes (and those of literals), eg. ordering a numeric attribute
+// against a string. Only operands whose types are known are checked, so this is permissive: a query which passes may
+// still meet ill-typed events when it is evaluated.
+func (q *Query) CheckTypes(s Schema) error {
+	var err error
+	Walk(q.predicate, func(node interface{}) bool {
+		if err == nil {
+			err = s.check(node)
+		}
+		return err == nil
+	})
+	return err
+}
+
+func (s Schema) check(node interface{}) error {
+	switch n := node.(type) {
+	case *operatorPredicate:
+		if n.left == nil || n.right == nil {
+			return nil
+		}
+		switch n.op {
+		case opGt, opLt, opGe, opLe:
+			return s.checkOrdered(n, n.left, n.right)
+		default:
+			return s.checkComparable(n, n.left, n.right)
+		}
+
+	case *betweenPredicate:
+		for _, bound := range []value{n.low, n.high} {
+			if n.operand != nil && bound != nil {
+				if err := s.checkOrdered(n, n.operand, bound); err != nil {
+					return err
+				}
+			}
+		}
+
+	case *inPredicate:
+		for _, v := range n.set {
+			if n.left != nil && v != nil {
+				if err := s.checkComparable(n, n.left, v); err != nil {
+					return err
+				}
+			}
+		}
+
+	case *quantifiedPredicate: // The types of the members of a list literal are known, but not those of other lists
+		members, _ := n.list.(listLiteralValue)
+		for _, v := range members {
+			if n.left == nil || v == nil {
+				continue
+			} else if n.op == opGt || n.op == opLt || n.op == opGe || n.op == opLe {
+				if err := s.checkOrdered(n, n.left, v); err != nil {
+					return err
+				}
+			} else if err := s.checkComparable(n, n.left, v); err != nil {
+				return err
+			}
+		}
+
+	case *regexPredicate:
+		return s.checkString(n, n.left)
+
+	case *stringMatchPredicate:
+		if err := s.checkString(n, n.left); err != nil {
+			return err
+		}
+		return s.checkString(n, n.right)
+
+	case *arithmeticValue:
+		if n.left != nil && n.right != nil {
+			if _, err := s.arithmeticType(n); err != nil {
+				return err
+			}
+		}
+
+	case *bitwiseNotValue:
+		if t := s.typeOf(n.operand); n.operand != nil && t != TypeUnknown && t != TypeNumber {
+			return fmt.Errorf("Cannot apply ~ to %s (%s)", n.operand.QueryText(), t)
+		}
+
+	case *conditionalValue:
+		if n.then != nil && n.otherwise != nil {
+			thenType, elseType := s.typeOf(n.then), s.typeOf(n.otherwise)
+			if thenType != TypeUnknown && elseType != TypeUnknown && thenType != elseType {
+				return fmt.Errorf("The values of %s have different types (%s and %s)", n.QueryText(), thenType,
+					elseType)
+			}
+		}
+	}
+	return nil
+}
+
+// checkComparable checks that two values may be equal
+func (s Schema) checkComparable(p Predicate, left, right value) error {
+	leftType, rightType := s.typeOf(left), s.typeOf(right)
+	if leftType == TypeUnknown || rightType == TypeUnknown || leftType == rightType {
+		return nil
+	}
+	return fmt.Errorf("Cannot compare %s (%s) with %s (%s): %s", left.QueryText(), leftType, right.QueryText(),
+		rightType, p.QueryText())
+}
+
+// checkOrdered checks that two values may be ordered against each other
+func (s Schema) checkOrdered(p Predicate, left, right value) error {
+	if err := s.checkComparable(p, left, right); err != nil {
+		return err
+	}
+	for _, v := range []value{left, right} {
+		if t := s.typeOf(v); t == TypeBool {
+			return fmt.Errorf("Cannot order %s (%s): %s", v.QueryText(), t, p.QueryText())
+		}
+	}
+	return nil
+}
+
+// checkString checks that a value may be a string
+func (s Schema) checkString(p Predicate, v value) error {
+	if v == nil {
+		return nil
+	} else if t := s.typeOf(v); t != TypeUnknown && t != TypeString {
+		return fmt.Errorf("Expected a string, but %s is a %s: %s", v.QueryText(), t, p.QueryText())
+	}
+	return nil
+}
+
+// typeOf returns the type a value resolves to, if it can be known ahead of evaluation
+func (s Schema) typeOf(v value) AttributeType {
+	switch v := v.(type) {
+	case literalValue:
+		switch v.v.(type) {
+		case float64:
+			return TypeNumber
+		case string:
+			return TypeString
+		case bool:
+			return TypeBool
+		}
+	case durationLiteralValue, lengthValue:
+		return TypeNumber
+	case timestampValue:
+		return TypeTime
+	case attributeLookup:
+		return s[string(v)]
+	case *indexLookup:
+		if len(v.path) > 0 { // An attribute of one of the events captured by a closure
+			return s[string(newAttributeLookup(v.alias, v.path))]
+		}
+	case *boundaryLookup:
+		if len(v.path) > 0 {
+			return s[string(newAttributeLookup(v.alias, v.path))]
+		}
+	case *castValue:
+		return v.to
+	case *bitwiseNotValue:
+		if t := s.typeOf(v.operand); v.operand != nil && t == TypeNumber {
+			return t
+		}
+	case *aggregateValue: // Every aggregate is numeric, whichever side of a comparison it is on
+		return TypeNumber
+	case *arithmeticValue:
+		if v.left != nil && v.right != nil {
+			t, _ := s.arithmeticType(v)
+			return t
+		}
+	case *conditionalValue: // Either value may be the result, so it is known only if they agree
+		if t := s.typeOf(v.then); v.then != nil && v.otherwise != nil && t == s.typeOf(v.otherwise) {
+			return t
+		}
+	}
+	return TypeUnknown
+}
+
+// arithmeticType returns the type of the result of arithmetic, or an error if it can't be applied to its operands
+func (s Schema) arithmeticType(v *arithmeticValue) (AttributeType, error) {
+	leftType, rightType := s.typeOf(v.left), s.typeOf(v.right)
+	switch {
+	case leftType == TypeTime && rightType == TypeTime && v.op == aoSubtract:
+		return TypeNumber, nil
+	case leftType == TypeTime && rightType == TypeNumber && (v.op == aoAdd || v.op == aoSubtract):
+		return TypeTime, nil
+	case rightType == TypeTime && leftType == TypeNumber && v.op == aoAdd:
+		return TypeTime, nil
+	case leftType == TypeUnknown || rightType == TypeUnknown:
+		return TypeUnknown, nil
+	case leftType == TypeNumber && rightType == TypeNumber:
+		return TypeNumber, nil
+	}
+	return TypeUnknown, fmt.Errorf("Cannot apply %s to %s (%s) and %s (%s)", v.op.String(), v.left.QueryText(),
+		leftType, v.right.QueryText(), rightType)
+}
+
+// Conform checks the attributes of an event against the types the schema declares for them under an alias, as it is
+// captured. Attributes which don't have the declared type are coerced where there is an obvious conversion (a string
+// holding a number, bool or RFC 3339 time), in which case the event returned has the coerced values; otherwise the
+// event is rejected with an error. Attributes the event doesn't have (or which are nil) are allowed: a schema doesn't
+// make them required.
+func (s Schema) Conform(alias string, ev domain.Event) (domain.Event, error) {
+	prefix := joinPath(alias) + "."
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var coerced map[string]interface{}
+	for _, key := range keys {
+		path := strings.TrimPrefix(key, prefix)
+		val, err := lookupEvent(key, ev, splitPath(path))
+		if err != nil || val == nil {
+			continue
+		}
+		conformed, changed, err := coerce(s[key], val)
+		if err != nil {
+			return nil, fmt.Errorf("%s event does not conform to the schema: %s is %#v, which %s", ev.Type(), key, val,
+				err.Error())
+		} else if changed {
+			if coerced == nil {
+				coerced = make(map[string]interface{})
+			}
+			coerced[path] = conformed
+		}
+	}
+	if coerced == nil {
+		return ev, nil
+	}
+	return &conformedEvent{Event: ev, coerced: coerced}, nil
+}
+
+// coerce converts a value to the given type, if it isn't of that type already. changed reports whether it was.
+func coerce(t AttributeType, val interface{}) (result interface{}, changed bool, err error) {
+	str, isString := val.(string)
+	switch t {
+	case TypeNumber:
+		if _, ok := numericValue(val); ok {
+			return val, false, nil
+		} else if f, err := strconv.ParseFloat(strings.TrimSpace(str), 64); isString && err == nil {
+			return f, true, nil
+		}
+	case TypeString:
+		if isString {
+			return val, false, nil
+		}
+	case TypeBool:
+		if _, ok := val.(bool); ok {
+			return val, false, nil
+		} else if b, err := strconv.ParseBool(strings.TrimSpace(str)); isString && err == nil {
+			return b, true, nil
+		}
+	case TypeTime:
+		if _, ok := val.(time.Time); ok {
+			return val, false, nil
+		} else if ts, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(str)); isString && err == nil {
+			return ts, true, nil
+		}
+	default:
+		return val, false, nil
+	}
+	return nil, false, fmt.Errorf("is not a %s", t)
+}
+
+// A conformedEvent is an event with some of its attributes coerced to the types declared by a schema (keyed by their
+// path, without the alias)
+type conformedEvent struct {
+	domain.Event
+	coerced map[string]interface{}
+}
+
+func (e *conformedEvent) Get(path string) (interface{}, bool) {
+	if val, ok := e.coerced[path]; ok {
+		return val, true
+	}
+	val, err := lookupEvent(path, e.Event, splitPath(path))
+	return val, err == nil
+}
+
+// Attributes returns those of the original event, with the coerced values of its top-level attributes (nested values
+// are only coerced as they are looked up through Get)
+func (e *conformedEvent) Attributes() map[string]interface{} {
+	attrs := e.Event.Attributes()
+	result := make(map[string]interface{}, len(attrs))
+	for k, v := range attrs {
+		result[k] = v
+	}
+	for path, val := range e.coerced {
+		if names := splitPath(path); len(names) == 1 {
+			result[names[0]] = val
+		}
+	}
+	return result
+}
+
+// originalEvent returns an event as it was before it was conformed to a schema
+func originalEvent(ev domain.Event) domain.Event {
+	if c, ok := ev.(*conformedEvent); ok {
+		return c.Event
+	}
+	return ev
+}
@@ -0,0 +1,133 @@
+package query
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestCheckTypes(t *testing.T) {
+	schema := Schema{
+		"a.price":  TypeNumber,
+		"a.symbol": TypeString,
+		"b.price":  TypeNumber,
+		"b.symbol": TypeString,
+		"b.live":   TypeBool,
+		"b.at":     TypeTime,
+	}
+	cases := map[string]string{
+		"a.price > b.price AND a.symbol == b.symbol": "",
+		"a.price > 'foo'":                                            `Cannot compare a.price (number) with "foo" (string): a.price > "foo"`,
+		"a.symbol != 1":                                              `Cannot compare a.symbol (string) with 1.000000 (number): a.symbol != 1.000000`,
+		"a.price > b.other AND a.other > 'foo'":                      "", // Undeclared attributes may be anything
+		"b.live >= b.other":                                          "Cannot order b.live (bool): b.live >= b.other",
+		"b.live == true AND b.symbol == null":                        "",
+		"b.price BETWEEN 1 AND 'z'":                                  `Cannot compare b.price (number) with "z" (string): b.price BETWEEN 1.000000 AND "z"`,
+		"b.symbol IN ('a', 2)":                                       `Cannot compare b.symbol (string) with 2.000000 (number): b.symbol IN ("a", 2.000000)`,
+		"a.price MATCHES '^1'":                                       `Expected a string, but a.price is a number: a.price MATCHES "^1"`,
+		"a.symbol STARTSWITH b.price":                                `Expected a string, but b.price is a number: a.symbol STARTSWITH b.price`,
+		"a.price + a.symbol > 1":                                     "Cannot apply + to a.price (number) and a.symbol (string)",
+		"(a.price + 1) * 2 > 'x'":                                    `Cannot compare (a.price + 1.000000) * 2.000000 (number) with "x" (string): (a.price + 1.000000) * 2.000000 > "x"`,
+		"b.TS - a.TS < 30s AND b.at > a.TS + 1m":                     "",
+		"b.at > 5":                                                   "Cannot compare b.at (time) with 5.000000 (number): b.at > 5.000000",
+		"b.at * 2 > a.TS":                                            "Cannot apply * to b.at (time) and 2.000000 (number)",
+		"avg(a[].price) > a.symbol":                                  "Cannot compare avg(a[].price) (number) with a.symbol (string): avg(a[].price) > a.symbol",
+		"a.symbol < max(a[].price)":                                  "Cannot compare a.symbol (string) with max(a[].price) (number): a.symbol < max(a[].price)",
+		"(b.live ? a.price : b.price) > 'x'":                         `Cannot compare (b.live == true ? a.price : b.price) (number) with "x" (string): (b.live == true ? a.price : b.price) > "x"`,
+		"(b.live ? a.price : a.symbol) > 1":                          "The values of (b.live == true ? a.price : a.symbol) have different types (number and string)",
+		"number(a.symbol) > b.price AND string(a.price) == b.symbol": "",
+		"number(a.symbol) == b.symbol":                               "Cannot compare number(a.symbol) (number) with b.symbol (string): number(a.symbol) == b.symbol",
+		"a[i].price > a[i-1].symbol":                                 "Cannot compare a[i].price (number) with a[i-1].symbol (string): a[i].price > a[i-1].symbol",
+		"NOT (a.price == 'x') OR a.price > b.price":                  `Cannot compare a.price (number) with "x" (string): a.price == "x"`,
+		"lower(a.symbol) > 1 AND coalesce(a.x, 1) > 1":               "", // Function results aren't known
+		"a.price & ~b.price > 'x'":                                   `Cannot compare a.price & ~b.price (number) with "x" (string): a.price & ~b.price > "x"`,
+		"~a.symbol > 1":                                              "Cannot apply ~ to a.symbol (string)",
+		"a.symbol | 1 > 1":                                           "Cannot apply | to a.symbol (string) and 1.000000 (number)",
+	}
+	for predicate, expected := range cases {
+		q, err := Parse("EVENT SEQ(s a, s b) WHERE " + predicate)
+		require.NoError(t, err, predicate)
+		err = q.CheckTypes(schema)
+		if expected == "" {
+			require.NoError(t, err, predicate)
+			require.NoError(t, q.CheckTypes(nil), predicate)
+		} else {
+			require.Error(t, err, predicate)
+			require.Equal(t, expected, err.Error(), predicate)
+			require.NoError(t, q.CheckTypes(nil), "Without a schema, anything goes: %s", predicate)
+		}
+	}
+
+	_, err := ParseWithSchema("EVENT SEQ(s a, s b) WHERE a.price > 'foo'", schema)
+	require.Error(t, err)
+	q, err := ParseWithSchema("EVENT SEQ(s a, s b) WHERE a.price > 1", schema)
+	require.NoError(t, err)
+	require.NotNil(t, q)
+	_, err = ParseWithSchema("EVENT SEQ(s a, s b WHERE a.price > 1", schema)
+	require.IsType(t, &ParseError{}, err)
+	require.Equal(t, "time", TypeTime.String())
+}
+
+func TestSchemaConform(t *testing.T) {
+	schema := Schema{
+		"a.price":       TypeNumber,
+		"a.symbol":      TypeString,
+		"a.live":        TypeBool,
+		"a.at":          TypeTime,
+		"a.order.total": TypeNumber,
+		"b.price":       TypeString, // Per alias: the same event may be captured differently
+	}
+	at := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	ev := &tEventImpl{typ: "s", attrs: map[string]interface{}{
+		"price":  " 5.5",
+		"symbol": "GOOG",
+		"live":   "true",
+		"at":     "2014-01-01T00:00:00Z",
+		"order":  map[string]interface{}{"total": "3"},
+	}}
+
+	conformed, err := schema.Conform("a", ev)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"price":  5.5,
+		"symbol": "GOOG",
+		"live":   true,
+		"at":     at,
+		"order":  map[string]interface{}{"total": "3"}, // Nested values are coerced as they are looked up
+	}, conformed.Attributes())
+	for keyPath, expected := range map[string]interface{}{"a.price": 5.5, "a.at": at, "a.order.total": 3.0} {
+		result, err := attributeLookup(keyPath).Value(domain.CapturedEvents{"a": conformed})
+		require.NoError(t, err, keyPath)
+		require.Equal(t, expected, result, keyPath)
+	}
+	require.Equal(t, " 5.5", ev.attrs["price"], "The original event is unchanged")
+
+	// Events which already conform (or which the schema says nothing about) are returned as they are
+	for alias, ev := range map[string]domain.Event{
+		"a": &tEventImpl{typ: "s", attrs: map[string]interface{}{"price": 5, "symbol": nil}},
+		"c": ev,
+	} {
+		conformed, err := schema.Conform(alias, ev)
+		require.NoError(t, err, alias)
+		require.True(t, conformed == ev, alias)
+	}
+	conformed, err = Schema(nil).Conform("a", ev)
+	require.NoError(t, err)
+	require.True(t, conformed == ev)
+
+	// Those which can't be coerced are rejected
+	for alias, attrs := range map[string]map[string]interface{}{
+		"a": {"price": "five"},
+		"b": {"price": 5.0},
+	} {
+		_, err := schema.Conform(alias, &tEventImpl{typ: "s", attrs: attrs})
+		require.Error(t, err, alias)
+		require.True(t, strings.Contains(err.Error(), alias+".price"), err.Error())
+	}
+	_, err = schema.Conform("a", &tEventImpl{typ: "s", attrs: map[string]interface{}{"live": 1}})
+	require.EqualError(t, err, "s event does not conform to the schema: a.live is 1, which is not a bool")
+}
@@ -0,0 +1,255 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// snapshotVersion is the version of the format Snapshot writes. It must be increased whenever the format changes, and
+// RestoreMatcher taught to migrate snapshots of earlier versions. Version 2 added the positions of candidates' first
+// events, and version 3 the histories of recent values.
+const snapshotVersion = 3
+
+type matcherSnapshot struct {
+	Version int             `json:"version"`
+	Query   string          `json:"query"`  // The text of the query, to check it is restored with the same one
+	Events  []snapshotEvent `json:"events"` // Every event referred to, each once, so they are still shared once restored
+	State   matcherState    `json:"state"`
+}
+
+type snapshotEvent struct {
+	Type       string                 `json:"type"`
+	When       time.Time              `json:"when"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// A matcherState is the state of a matcher, referring to events by their index
+type matcherState struct {
+	Candidates   []candidateState `json:"candidates"`
+	Pending      []int            `json:"pending,omitempty"`
+	Fed          int              `json:"fed"`
+	Latest       time.Time        `json:"latest"`
+	Watermark    time.Time        `json:"watermark"`
+	Alternatives []matcherState   `json:"alternatives,omitempty"`
+	Histories    []historyState   `json:"histories,omitempty"` // Of the query's recent values, in the order they appear
+}
+
+// A historyState is the history of a recent value (see matchHistory), oldest first
+type historyState []historyEntryState
+
+type historyEntryState struct {
+	When  time.Time   `json:"when"`
+	Value interface{} `json:"value"`
+}
+
+type candidateState struct {
+	Events  map[string][]int `json:"events"` // By alias; only a Kleene closure may have more than one
+	Matched bool             `json:"matched,omitempty"`
+	First   int              `json:"first,omitempty"` // The position in the stream of its first event
+}
+
+// Snapshot serialises the state of the Matcher (its candidates, with the events they have captured, the events it is
+// holding for late arrivals, and the histories of the query's recent values) so that matching may be resumed from the
+// same point by RestoreMatcher, eg. after a restart. Events are serialised as JSON, so their attributes must be
+// encodable as JSON, and are restored as decoded JSON (eg. numbers as float64s); so are the values in histories. It is
+// an error to snapshot an event whose attributes aren't held as a map (see AttributeGetter).
+//
+// A snapshot holds each event once, however many candidates have captured it, but also a reference from each candidate
+// to each of its events: its size grows with the number of candidates as well as with the number of events. Under
+// SkipTillAnyMatch, where every relevant event leaves the candidates it extends in place as well as forming new ones,
+// the number of candidates (and so the size of a snapshot) can grow with the number of combinations of the events in
+// the window, far faster than the events themselves; a tight window bounds it.
+func (m *Matcher) Snapshot() ([]byte, error) {
+	s := &snapshotWriter{indexes: make(map[domain.Event]int)}
+	state, err := s.state(m.m)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(matcherSnapshot{
+		Version: snapshotVersion,
+		Query:   m.m.q.QueryText(),
+		Events:  s.events,
+		State:   state,
+	})
+}
+
+// RestoreMatcher returns a Matcher for a query, in the state captured by a snapshot of one (see Snapshot). The query
+// must be the same as the one the snapshot was taken of (which is checked by its text), and set up in the same way.
+func RestoreMatcher(q *Query, snapshot []byte) (*Matcher, error) {
+	var s matcherSnapshot
+	if err := json.Unmarshal(snapshot, &s); err != nil {
+		return nil, fmt.Errorf("Cannot restore matcher: %w", err)
+	}
+	switch s.Version {
+	case snapshotVersion:
+	// Earlier versions are restored with empty histories, and version 1 with every candidate at position 0, which only
+	// windows of a number of events (since added) refer to
+	case 1, 2:
+	default:
+		return nil, fmt.Errorf("Cannot restore matcher: unsupported snapshot version %d", s.Version)
+	}
+	if text := q.QueryText(); s.Query != text {
+		return nil, fmt.Errorf("Cannot restore matcher: the snapshot is of %s, not %s", s.Query, text)
+	}
+
+	events := make([]domain.Event, len(s.Events))
+	for i, ev := range s.Events {
+		events[i] = NewEvent(ev.Type, ev.When, MapAttributes(ev.Attributes))
+	}
+	m := newMatcher(q)
+	if err := restoreState(m, s.State, events); err != nil {
+		return nil, fmt.Errorf("Cannot restore matcher: %w", err)
+	}
+	return &Matcher{m: m}, nil
+}
+
+// A snapshotWriter gathers the events referred to by a matcher's state. Those which can be compared (eg. pointers) are
+// gathered once, however many times they are referred to; those which can't be (eg. structs holding maps) once for
+// each reference.
+type snapshotWriter struct {
+	events  []snapshotEvent
+	indexes map[domain.Event]int
+}
+
+func (s *snapshotWriter) index(ev domain.Event) (int, error) {
+	ev = originalEvent(ev)
+	comparable := reflect.TypeOf(ev).Comparable()
+	if comparable {
+		if i, ok := s.indexes[ev]; ok {
+			return i, nil
+		}
+	}
+	attrs := ev.Attributes()
+	if _, ok := ev.(AttributeGetter); ok && attrs == nil {
+		return 0, fmt.Errorf("Cannot snapshot %s event: its attributes aren't held as a map", ev.Type())
+	}
+	if comparable {
+		s.indexes[ev] = len(s.events)
+	}
+	s.events = append(s.events, snapshotEvent{Type: ev.Type(), When: ev.When(), Attributes: attrs})
+	return len(s.events) - 1, nil
+}
+
+func (s *snapshotWriter) state(m *matcher) (matcherState, error) {
+	state := matcherState{Fed: m.fed, Latest: m.latest, Watermark: m.watermark}
+	for _, alt := range m.alternatives {
+		altState, err := s.state(alt)
+		if err != nil {
+			return state, err
+		}
+		state.Alternatives = append(state.Alternatives, altState)
+	}
+	for _, v := range m.recent {
+		h := make(historyState, v.history.n)
+		for i := range h {
+			e := v.history.at(i)
+			h[i] = historyEntryState{When: e.when, Value: e.v}
+		}
+		state.Histories = append(state.Histories, h)
+	}
+	for _, ev := range m.pending {
+		i, err := s.index(ev)
+		if err != nil {
+			return state, err
+		}
+		state.Pending = append(state.Pending, i)
+	}
+	for _, candidates := range m.partitions {
+		for _, c := range candidates {
+			cs := candidateState{Events: make(map[string][]int, len(c.evs)), Matched: c.matched, First: c.first}
+			for alias, ev := range c.evs {
+				list, ok := ev.(domain.EventList)
+				if !ok {
+					list = domain.EventList{ev}
+				}
+				for _, ev := range list {
+					i, err := s.index(ev)
+					if err != nil {
+						return state, err
+					}
+					cs.Events[alias] = append(cs.Events[alias], i)
+				}
+			}
+			state.Candidates = append(state.Candidates, cs)
+		}
+	}
+	return state, nil
+}
+
+// restoreState restores the state of a (new) matcher. Candidates are returned to their partitions by the key of their
+// events.
+func restoreState(m *matcher, state matcherState, events []domain.Event) error {
+	if len(state.Alternatives) != len(m.alternatives) {
+		return fmt.Errorf("the snapshot has %d alternatives, not %d", len(state.Alternatives), len(m.alternatives))
+	}
+	for i, alt := range m.alternatives {
+		if err := restoreState(alt, state.Alternatives[i], events); err != nil {
+			return err
+		}
+	}
+	event := func(i int) (domain.Event, error) {
+		if i < 0 || i >= len(events) {
+			return nil, fmt.Errorf("the snapshot refers to event %d, but has %d", i, len(events))
+		}
+		return events[i], nil
+	}
+
+	m.fed, m.latest, m.watermark = state.Fed, state.Latest, state.Watermark
+	if len(state.Histories) > 0 && len(state.Histories) != len(m.recent) {
+		return fmt.Errorf("the snapshot has %d histories, not %d", len(state.Histories), len(m.recent))
+	}
+	for i, h := range state.Histories {
+		for _, e := range h {
+			m.recent[i].history.push(e.When, e.Value)
+		}
+	}
+	for _, i := range state.Pending {
+		ev, err := event(i)
+		if err != nil {
+			return err
+		}
+		m.pending = append(m.pending, ev)
+	}
+	for _, cs := range state.Candidates {
+		evs := make(domain.CapturedEvents, len(cs.Events))
+		var first domain.Event
+		for alias, indexes := range cs.Events {
+			list := make(domain.EventList, len(indexes))
+			for j, i := range indexes {
+				ev, err := event(i)
+				if err != nil {
+					return err
+				}
+				list[j] = ev
+			}
+			if _, ok := m.closures[alias]; ok {
+				evs[alias] = list
+			} else if len(list) == 1 {
+				evs[alias] = list[0]
+			} else {
+				return fmt.Errorf("the snapshot captures %d events as %s, which isn't a Kleene closure", len(list),
+					alias)
+			}
+			if len(list) > 0 {
+				first = list[0]
+			}
+		}
+
+		var key interface{}
+		if m.q.partition != "" && first != nil {
+			k, ok := m.q.PartitionKey(first)
+			if !ok {
+				return fmt.Errorf("a candidate's %s event has no %s to partition by", first.Type(), m.q.partition)
+			}
+			key = partitionBucket(k)
+		}
+		// Its latest event is before any the matcher processes from here, so its position needn't have been kept
+		m.partitions[key] = append(m.partitions[key], candidate{evs: evs, matched: cs.Matched, first: cs.First})
+		m.candidates++
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package query
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestMatcherSnapshot(t *testing.T) {
+	stream := tStream("A1 x=1 sym=X", "B1 x=2 sym=X", "A2 x=3 sym=Y", "B2 x=4 sym=Y", "B3 x=5 sym=X", "C1 x=9 sym=X",
+		"B4 x=6 sym=Y", "A3 x=7 sym=X", "B5 x=8 sym=X", "C2 x=2 sym=Y")
+	stream[3], stream[4] = stream[4], stream[3] // Out of order, for the matchers which allow lateness
+	queries := []string{
+		"EVENT SEQ(A a, B b) WHERE b.x > a.x",
+		"EVENT SEQ(A a, B b) PARTITION BY sym WITHIN 5s",
+		"EVENT SEQ(A a, B+ b[], C c) WHERE b[i].x > a.x",
+		"EVENT SEQ(A a, !(C c), B b)",
+		"EVENT SEQ(A a, B b) OR SEQ(A a, C c) WHERE c.x > a.x",
+		"EVENT AND(A a, B b, C c) WITHIN 8s",
+		"EVENT SEQ(A a, B b) WHERE count(recent(b.x, 5)) < 2",
+		"EVENT SEQ(A a, B b) OR SEQ(A a, C c) WHERE count(recent(a.x, 3s)) == 0",
+	}
+
+	describe := func(matches []domain.CapturedEvents) []string {
+		result := make([]string, 0, len(matches))
+		for _, match := range matches {
+			result = append(result, tDescribeMatch(match))
+		}
+		sort.Strings(result)
+		return result
+	}
+	// Events held by value (which can't be compared, to be held once) are snapshotted too
+	for _, stream := range [][]domain.Event{stream, tValues(stream)} {
+		for _, queryText := range queries {
+			for _, strategy := range []SelectionStrategy{SkipTillNextMatch, SkipTillAnyMatch} {
+				q, err := Parse(queryText)
+				require.NoError(t, err)
+				q.SetStrategy(strategy)
+				q.SetAllowedLateness(time.Second)
+
+				var expected []domain.CapturedEvents
+				m := NewMatcher(q)
+				for _, ev := range stream {
+					expected = append(expected, m.Feed(ev)...)
+				}
+				expected = append(expected, m.Flush()...)
+
+				// Snapshot and restore part-way through the stream, at every point
+				for split := 0; split <= len(stream); split++ {
+					var actual []domain.CapturedEvents
+					m := NewMatcher(q)
+					for _, ev := range stream[:split] {
+						actual = append(actual, m.Feed(ev)...)
+					}
+					snapshot, err := m.Snapshot()
+					require.NoError(t, err)
+					m, err = RestoreMatcher(q, snapshot)
+					require.NoError(t, err)
+					for _, ev := range stream[split:] {
+						actual = append(actual, m.Feed(ev)...)
+					}
+					actual = append(actual, m.Flush()...)
+					require.Equal(t, describe(expected), describe(actual), "%s (%s), split at %d", queryText, strategy,
+						split)
+				}
+			}
+		}
+	}
+}
+
+func TestMatcherSnapshotErrors(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, B b)")
+	require.NoError(t, err)
+	m := NewMatcher(q)
+	m.Feed(tStream("A1")[0])
+	snapshot, err := m.Snapshot()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(snapshot), `{"version":3,`), string(snapshot))
+
+	other, err := Parse("EVENT SEQ(A a, C c)")
+	require.NoError(t, err)
+	_, err = RestoreMatcher(other, snapshot)
+	require.EqualError(t, err, "Cannot restore matcher: the snapshot is of EVENT SEQ(A a, B b), not EVENT SEQ(A a, C c)")
+	_, err = RestoreMatcher(q, []byte(strings.Replace(string(snapshot), `"version":3`, `"version":99`, 1)))
+	require.EqualError(t, err, "Cannot restore matcher: unsupported snapshot version 99")
+	// Snapshots of earlier versions are migrated
+	v1 := strings.NewReplacer(`"version":3`, `"version":1`, `,"first":1`, "").Replace(string(snapshot))
+	restored, err := RestoreMatcher(q, []byte(v1))
+	require.NoError(t, err)
+	require.Len(t, restored.Feed(tStream("B1")[0]), 1)
+	_, err = RestoreMatcher(q, []byte(strings.Replace(string(snapshot), `"a":[0]`, `"a":[7]`, 1)))
+	require.EqualError(t, err, "Cannot restore matcher: the snapshot refers to event 7, but has 1")
+	_, err = RestoreMatcher(q, snapshot[:10])
+	require.Error(t, err)
+
+	// Events must hold their attributes as maps
+	m.Feed(NewEvent("A", time.Date(2014, 1, 1, 0, 0, 1, 0, time.UTC), StructAttributes(&tOrder{})))
+	_, err = m.Snapshot()
+	require.EqualError(t, err, "Cannot snapshot A event: its attributes aren't held as a map")
+}
@@ -0,0 +1,210 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A regexPredicate tests whether a string value matches a regular expression
+type regexPredicate struct {
+	left    value
+	pattern *regexp.Regexp
+}
+
+// newRegexPredicate compiles the passed pattern (which must be a string literal) once, up-front
+func newRegexPredicate(left, pattern value) (*regexPredicate, error) {
+	lit, ok := pattern.(literalValue)
+	if !ok {
+		return nil, fmt.Errorf("Regular expression must be a string literal")
+	}
+	s, ok := lit.v.(string)
+	if !ok {
+		return nil, fmt.Errorf("Regular expression must be a string literal, got %T", lit.v)
+	}
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid regular expression %q: %w", s, err)
+	}
+	return &regexPredicate{
+		left:    left,
+		pattern: re,
+	}, nil
+}
+
+func (p *regexPredicate) Evaluate(evs domain.CapturedEvents) Result {
+	return evaluateOrLog("regexPredicate", p, evs)
+}
+
+func (p *regexPredicate) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return evaluateObserved(context.Background(), p, evs)
+}
+
+func (p *regexPredicate) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	ctx = withValueCache(ctx, evs)
+	if p.left == nil || p.pattern == nil {
+		return Negative, fmt.Errorf("Could not evaluate %s: left and pattern must not be nil", p.QueryText())
+	}
+	leftVal, err := resolve(ctx, p.left, evs)
+	if errors.Is(err, ErrEventNotFound) {
+		return Uncertain, nil
+	} else if err != nil {
+		return Negative, fmt.Errorf("Could not evaluate %s: %w", p.QueryText(), err)
+	}
+
+	if s, ok := leftVal.(string); !ok {
+		return Negative, nil
+	} else if p.pattern.MatchString(s) {
+		return Positive, nil
+	}
+	return Negative, nil
+}
+
+func (p *regexPredicate) QueryText() string {
+	pattern := ""
+	if p.pattern != nil {
+		pattern = quoteString(p.pattern.String())
+	}
+	return joinText(valueText(p.left), "MATCHES", pattern)
+}
+
+func (p *regexPredicate) usedAliases() []string {
+	if p.left == nil {
+		return make([]string, 0)
+	}
+	return p.left.usedAliases()
+}
+
+func (p *regexPredicate) Equal(other Predicate) bool {
+	o, ok := other.(*regexPredicate)
+	if !ok || !sameValue(p.left, o.left) || (p.pattern == nil) != (o.pattern == nil) {
+		return false
+	}
+	return p.pattern == nil || p.pattern.String() == o.pattern.String()
+}
+
+func (p *regexPredicate) Hash() uint64 {
+	return hashPredicate(p)
+}
+
+// Clone shares the compiled pattern, which is safe as it is immutable
+func (p *regexPredicate) Clone() Predicate {
+	return &regexPredicate{left: cloneValue(p.left), pattern: p.pattern}
+}
+
+func (p *regexPredicate) children() []interface{} {
+	return valueNodes(p.left)
+}
+
+func (p *regexPredicate) Validate(declared map[string]struct{}) error {
+	return validateAliases(p, declared)
+}
+
+type stringMatch uint8
+
+const (
+	smPrefix   stringMatch = iota // starts with (STARTSWITH)
+	smSuffix                      // ends with (ENDSWITH)
+	smContains                    // contains (CONTAINS)
+)
+
+// keyword returns the match as it is written in a query (or "" if it is unknown)
+func (m stringMatch) keyword() string {
+	switch m {
+	case smPrefix:
+		return "STARTSWITH"
+	case smSuffix:
+		return "ENDSWITH"
+	case smContains:
+		return "CONTAINS"
+	default:
+		return ""
+	}
+}
+
+// A stringMatchPredicate tests whether a string value starts with, ends with, or contains another
+type stringMatchPredicate struct {
+	left  value
+	right value
+	match stringMatch
+}
+
+func (p *stringMatchPredicate) Evaluate(evs domain.CapturedEvents) Result {
+	return evaluateOrLog("stringMatchPredicate", p, evs)
+}
+
+func (p *stringMatchPredicate) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return evaluateObserved(context.Background(), p, evs)
+}
+
+func (p *stringMatchPredicate) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	ctx = withValueCache(ctx, evs)
+	leftVal, rightVal, err := leftRightVals(ctx, evs, p.left, p.right)
+	if errors.Is(err, ErrEventNotFound) {
+		return Uncertain, nil
+	} else if err != nil {
+		return Negative, fmt.Errorf("Could not evaluate %s left/right: %w", p.QueryText(), err)
+	}
+
+	leftStr, leftOk := leftVal.(string)
+	rightStr, rightOk := rightVal.(string)
+	if !leftOk || !rightOk {
+		return Negative, nil
+	}
+
+	var matched bool
+	switch p.match {
+	case smPrefix:
+		matched = strings.HasPrefix(leftStr, rightStr)
+	case smSuffix:
+		matched = strings.HasSuffix(leftStr, rightStr)
+	case smContains:
+		matched = strings.Contains(leftStr, rightStr)
+	default:
+		return Negative, fmt.Errorf("Unhandled match %v for %s", p.match, p.QueryText())
+	}
+	if matched {
+		return Positive, nil
+	}
+	return Negative, nil
+}
+
+func (p *stringMatchPredicate) QueryText() string {
+	return joinText(valueText(p.left), p.match.keyword(), valueText(p.right))
+}
+
+func (p *stringMatchPredicate) usedAliases() []string {
+	result := make([]string, 0)
+	if p.left != nil {
+		result = append(result, p.left.usedAliases()...)
+	}
+	if p.right != nil {
+		result = append(result, p.right.usedAliases()...)
+	}
+	return dedupeAliases(result)
+}
+
+func (p *stringMatchPredicate) Equal(other Predicate) bool {
+	o, ok := other.(*stringMatchPredicate)
+	return ok && p.match == o.match && sameValue(p.left, o.left) && sameValue(p.right, o.right)
+}
+
+func (p *stringMatchPredicate) Hash() uint64 {
+	return hashPredicate(p)
+}
+
+func (p *stringMatchPredicate) Clone() Predicate {
+	return &stringMatchPredicate{left: cloneValue(p.left), right: cloneValue(p.right), match: p.match}
+}
+
+func (p *stringMatchPredicate) children() []interface{} {
+	return valueNodes(p.left, p.right)
+}
+
+func (p *stringMatchPredicate) Validate(declared map[string]struct{}) error {
+	return validateAliases(p, declared)
+}
@@ -0,0 +1,103 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestRegexPredicate(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "a",
+			attrs: map[string]interface{}{
+				"path": "/api/v1/users",
+				"num":  float64(1),
+			},
+		},
+	}
+
+	cases := map[[2]string]Result{
+		[2]string{"a.path", "^/api/.*"}: Positive,
+		[2]string{"a.path", "users$"}:   Positive,
+		[2]string{"a.path", "^/web/"}:   Negative,
+		[2]string{"a.num", "1"}:         Negative, // Not a string
+		[2]string{"a.foo", ".*"}:        Negative, // Attribute not found
+		[2]string{"b.path", ".*"}:       Uncertain,
+	}
+
+	for operands, expectedResult := range cases {
+		impl, err := newRegexPredicate(attributeLookup(operands[0]), literalValue{operands[1]})
+		require.NoError(t, err)
+		require.Equal(t, expectedResult, impl.Evaluate(evs), fmt.Sprintf("Incorrect result for \"%s\"",
+			impl.QueryText()))
+	}
+
+	// Precompiled patterns may be used directly
+	impl := &regexPredicate{left: attributeLookup("a.path"), pattern: regexp.MustCompile("v[0-9]")}
+	require.Equal(t, Positive, impl.Evaluate(evs))
+	require.Equal(t, `a.path MATCHES "v[0-9]"`, impl.QueryText())
+	require.Equal(t, []string{"a"}, impl.usedAliases())
+
+	// Bad patterns are rejected at construction
+	_, err := newRegexPredicate(attributeLookup("a.path"), literalValue{"("})
+	require.Error(t, err)
+	_, err = newRegexPredicate(attributeLookup("a.path"), literalValue{float64(1)})
+	require.Error(t, err)
+	_, err = newRegexPredicate(attributeLookup("a.path"), attributeLookup("a.pattern"))
+	require.Error(t, err)
+}
+
+func TestStringMatchPredicate(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "a",
+			attrs: map[string]interface{}{
+				"url": "https://example.com/path",
+				"num": float64(1),
+			},
+		},
+	}
+
+	cases := map[stringMatch]map[[2]value]Result{
+		smPrefix: {
+			[2]value{attributeLookup("a.url"), literalValue{"https://"}}: Positive,
+			[2]value{attributeLookup("a.url"), literalValue{"http://"}}:  Negative,
+			[2]value{attributeLookup("a.url"), literalValue{""}}:         Positive,
+			[2]value{attributeLookup("a.url"), attributeLookup("a.url")}: Positive,
+		},
+		smSuffix: {
+			[2]value{attributeLookup("a.url"), literalValue{"/path"}}: Positive,
+			[2]value{attributeLookup("a.url"), literalValue{".com"}}:  Negative,
+		},
+		smContains: {
+			[2]value{attributeLookup("a.url"), literalValue{"example"}}:   Positive,
+			[2]value{attributeLookup("a.url"), literalValue{"EXAMPLE"}}:   Negative,
+			[2]value{attributeLookup("a.num"), literalValue{"1"}}:         Negative, // Not a string
+			[2]value{attributeLookup("a.url"), literalValue{float64(1)}}:  Negative,
+			[2]value{attributeLookup("a.foo"), literalValue{"example"}}:   Negative, // Attribute not found
+			[2]value{attributeLookup("b.url"), literalValue{"example"}}:   Uncertain,
+			[2]value{attributeLookup("a.url"), attributeLookup("b.path")}: Uncertain,
+		},
+	}
+
+	for match, matchCases := range cases {
+		for operands, expectedResult := range matchCases {
+			impl := &stringMatchPredicate{
+				left:  operands[0],
+				right: operands[1],
+				match: match,
+			}
+			require.Equal(t, expectedResult, impl.Evaluate(evs), fmt.Sprintf("Incorrect result for \"%s\"",
+				impl.QueryText()))
+		}
+	}
+
+	impl := &stringMatchPredicate{left: attributeLookup("a.url"), right: attributeLookup("b.url"), match: smSuffix}
+	require.Equal(t, "a.url ENDSWITH b.url", impl.QueryText())
+	require.Equal(t, []string{"a", "b"}, impl.usedAliases())
+}
@@ -1,7 +1,7 @@
 package query
 
 import (
-    "fmt"
+    "strings"
 )
 
 %% machine sase;
@@ -30,7 +30,8 @@ func tokenize(data string) ([]*token, error) {
         // log.Tracef("[Tokenizer] propose: %s", typ.String())
         proposals = append(proposals, &proposedToken{
             token: &token{
-                tt: typ,
+                tt:  typ,
+                pos: p,
             },
             i:  len(tokens),
             pi: len(proposals),
@@ -88,9 +89,20 @@ func tokenize(data string) ([]*token, error) {
         
         Letter = [A-Za-z_];
         Digit = [0-9];
-        Decimal = [\-+]? Digit+ ('.' Digit+)?;
+        UnsignedDecimal = Digit+ ('.' Digit+)?;
+        # Number literals may also separate groups of digits with underscores (which the parser checks are between
+        # digits), and may be hexadecimal integers
+        SeparatedDigits = Digit (Digit | "_")*;
+        HexInteger = "0" [xX] (xdigit | "_")*;
+        Exponent = [eE] [\-+]? Digit+;
+        Decimal = [\-+]? UnsignedDecimal;
         Space = space;
         Identifier = Letter (Letter | Digit)*;
+        # Aliases and the parts of attribute paths may be any text quoted in backticks (which are doubled within it),
+        # eg. a.`user.id`, so that they may contain dots, spaces or keywords
+        QuotedName = "`" ((any - "`") | "``")+ "`";
+        Name = Identifier | QuotedName;
+        Path = Name ("." Name)*;
         
         # -- EVENT clause
             # Basic event declaration (type and variable name)
@@ -101,13 +113,21 @@ func tokenize(data string) ([]*token, error) {
                 %{ setText(ttEventDeclType) }
                 %{ commit(ttEventDeclType) };
             EventDeclAlias =
-                Identifier
+                Name
                 >mark
                 >{ propose(ttEventDeclAlias) }
                 %{ setText(ttEventDeclAlias) }
                 %{ commit(ttEventDeclAlias) };
+            # Kleene closure: captures one or more events under an alias, greedily unless marked reluctant ("+?")
+            # Eg: Stock+ a[]
+            KleeneClosure =
+                ("+" "?"?)
+                >mark
+                >{ propose(ttKleeneClosure) }
+                %{ setText(ttKleeneClosure) }
+                %{ commit(ttKleeneClosure) };
             EventDecl =
-                (EventDeclType Space+ EventDeclAlias)
+                (EventDeclType (Space+ EventDeclAlias | KleeneClosure Space+ EventDeclAlias "[]"))
                 >{ propose(ttEventDecl) }
                 %{ commit(ttEventDecl) };
             
@@ -145,41 +165,111 @@ func tokenize(data string) ([]*token, error) {
                 Space* ")"
                 %{ commit(ttSeqDecl) };
             
-            EventClauseArg = NegatedDecl | AnyDecl | SeqDecl | EventDecl;
+            # AND declaration: matches all of the contained events, in any order
+            # Eg: AND(EventType e1, AnotherEventType e2)
+            AllDeclArg = EventDecl | AnyDecl;
+            AllDecl =
+                "AND"i
+                >{ propose(ttAllDecl) }
+                Space? "(" Space*
+                (AllDeclArg (Space* "," Space* AllDeclArg)*)?
+                Space* ")"
+                %{ commit(ttAllDecl) };
+            
+            EventClauseArg = NegatedDecl | AnyDecl | AllDecl | SeqDecl | EventDecl;
             EventClause =
                 "EVENT"i Space+ EventClauseArg
                 >{ propose(ttEventClause) }
                 %{ commit(ttEventClause) };
+            # Further alternatives to the event clause, any of which may be matched
+            # Eg: EVENT SEQ(A a, B b) OR SEQ(A a, C c)
+            EventAlternative =
+                ("OR"i | "∨" | "||")
+                >{ propose(ttEventAlternative) }
+                Space+ EventClauseArg
+                %{ commit(ttEventAlternative) };
         
         # -- WHERE clause
+            # The WHERE clause is tokenised as a flat stream of operands, operators and parentheses, which the parser
+            # then assembles into a predicate tree
             Eq = "==" >{ propose(ttEq) } %{ commit(ttEq) };
             Ne = "!=" >{ propose(ttNe) } %{ commit(ttNe) };
             Gt = ">" >{ propose(ttGt) } %{ commit(ttGt) };
             Lt = "<" >{ propose(ttLt) } %{ commit(ttLt) };
             Ge = ">=" >{ propose(ttGe) } %{ commit(ttGe) };
             Le = "<=" >{ propose(ttLe) } %{ commit(ttLe) };
-            Comparison = (Eq | Ne | Gt | Lt | Ge | Le);
+            IEq = "~=" >{ propose(ttIEq) } %{ commit(ttIEq) };
+            Comparison = (Eq | Ne | Gt | Lt | Ge | Le | IEq);
+            Between = "BETWEEN"i >{ propose(ttBetween) } %{ commit(ttBetween) };
+            In = "IN"i >{ propose(ttIn) } %{ commit(ttIn) };
+            Matches = "MATCHES"i >{ propose(ttMatches) } %{ commit(ttMatches) };
+            StartsWith = "STARTSWITH"i >{ propose(ttStartsWith) } %{ commit(ttStartsWith) };
+            EndsWith = "ENDSWITH"i >{ propose(ttEndsWith) } %{ commit(ttEndsWith) };
+            Contains = "CONTAINS"i >{ propose(ttContains) } %{ commit(ttContains) };
+            StringMatch = StartsWith | EndsWith | Contains;
+            Is = "IS"i >{ propose(ttIs) } %{ commit(ttIs) };
+            Null = "NULL"i >{ propose(ttNull) } %{ commit(ttNull) };
             
+            # "^" is also a bitwise XOR, so which was written is kept for the parser to decide between them
             Conjunction =
                 ("AND"i | "^" | "&&")
+                >mark
                 >{ propose(ttConjunction) }
+                %{ setText(ttConjunction) }
                 %{ commit(ttConjunction) };
             Disjunction =
                 ("OR"i | "∨" | "||")
                 >{ propose(ttDisjunction) }
                 %{ commit(ttDisjunction) };
             Connective = Conjunction | Disjunction;
+            Negation =
+                ("NOT"i | "!")
+                >{ propose(ttNegation) }
+                %{ commit(ttNegation) };
+            
+            GroupOpen = "(" >{ propose(ttGroupOpen) } %{ commit(ttGroupOpen) };
+            GroupClose = ")" >{ propose(ttGroupClose) } %{ commit(ttGroupClose) };
+            # An attribute may be selected from the event a call results in (eg. "first(a[]).price")
+            GroupCloseSelector =
+                ")"
+                >{ propose(ttGroupCloseSelector) }
+                "." Path >mark %{ setText(ttGroupCloseSelector) }
+                %{ commit(ttGroupCloseSelector) };
+            ListSeparator = "," >{ propose(ttListSeparator) } %{ commit(ttListSeparator) };
+            
+            Add = "+" >{ propose(ttAdd) } %{ commit(ttAdd) };
+            Subtract = "-" >{ propose(ttSubtract) } %{ commit(ttSubtract) };
+            Multiply = "*" >{ propose(ttMultiply) } %{ commit(ttMultiply) };
+            Divide = "/" >{ propose(ttDivide) } %{ commit(ttDivide) };
+            Modulo = "%" >{ propose(ttModulo) } %{ commit(ttModulo) };
+            IntDivide = "\\" >{ propose(ttIntDivide) } %{ commit(ttIntDivide) };
+            BitwiseAnd = "&" >{ propose(ttBitwiseAnd) } %{ commit(ttBitwiseAnd) };
+            BitwiseOr = "|" >{ propose(ttBitwiseOr) } %{ commit(ttBitwiseOr) };
+            BitwiseNot = "~" >{ propose(ttBitwiseNot) } %{ commit(ttBitwiseNot) };
+            Arithmetic = Add | Subtract | Multiply | Divide | Modulo | IntDivide | BitwiseAnd | BitwiseOr | BitwiseNot;
+            
+            # A conditional value, eg. "(a.vip ? a.priceVip : a.price)". A colon directly followed by a name is a
+            # parameter, so (as in the query text rendered) the colon must be followed by a space in that case.
+            Conditional = "?" >{ propose(ttConditional) } %{ commit(ttConditional) };
+            ConditionalElse = ":" >{ propose(ttConditionalElse) } %{ commit(ttConditionalElse) };
             
             NumericLiteral =
-                Decimal
+                # Signs are parsed as operators (or as part of the literal, by the parser)
+                ((SeparatedDigits ('.' SeparatedDigits)? Exponent?) | HexInteger)
                 >mark
                 >{ propose(ttNumericLiteral) }
                 %{ setText(ttNumericLiteral) }
                 %{ commit(ttNumericLiteral) };
+            DurationLiteral =
+                (UnsignedDecimal ("ns"i | "us"i | "ms"i | "s"i | "m"i | "h"i))+ # Eg. 1h30m
+                >mark
+                >{ propose(ttDurationLiteral) }
+                %{ setText(ttDurationLiteral) }
+                %{ commit(ttDurationLiteral) };
             SingleQuotedStringLiteral =
                 "'"
                 >{ propose(ttStringLiteral) }
-                ("\\'" | ^("'"))*
+                ("\\" any | ^("'" | "\\"))*
                 >mark
                 %{ setText(ttStringLiteral) }
                 "'"
@@ -187,38 +277,90 @@ func tokenize(data string) ([]*token, error) {
             DoubleQuotedStringLiteral =
                 "\""
                 >{ propose(ttStringLiteral) }
-                ("\\\"" | ^("\""))*
+                ("\\" any | ^("\"" | "\\"))*
                 >mark
                 %{ setText(ttStringLiteral) }
                 "\""
                 %{ commit(ttStringLiteral) };
             StringLiteral = (SingleQuotedStringLiteral | DoubleQuotedStringLiteral);
+            BooleanLiteral =
+                ("TRUE"i | "FALSE"i)
+                >mark
+                >{ propose(ttBooleanLiteral) }
+                %{ setText(ttBooleanLiteral) }
+                %{ commit(ttBooleanLiteral) };
             
-            Equivalence =
-                "[" Space*
+            Parameter =
+                ":"
+                >{ propose(ttParameter) }
+                Identifier
                 >mark
-                >{ propose(ttEquivalenceTest) }
+                %{ setText(ttParameter) }
+                %{ commit(ttParameter) };
+            Variable =
+                "$"
+                >{ propose(ttVariable) }
                 Identifier
-                %{ setText(ttEquivalenceTest) }
-                Space* "]"
-                %{ commit(ttEquivalenceTest) };
+                >mark
+                %{ setText(ttVariable) }
+                %{ commit(ttVariable) };
+            
+            # A list literal (eg. "[1, 2]") is closed as an index is. An equivalence test (eg. "[key]") looks like a
+            # list of one, so is told apart from one by the parser.
+            ListOpen = "[" >{ propose(ttListOpen) } %{ commit(ttListOpen) };
             
+            Keyword =
+                "AND"i | "OR"i | "NOT"i | "BETWEEN"i | "IN"i | "MATCHES"i | "STARTSWITH"i | "ENDSWITH"i |
+                "CONTAINS"i | "IS"i | "NULL"i | "TRUE"i | "FALSE"i | "WITHIN"i | "PARTITION"i;
             AttributeSelector =
-                Identifier
+                (Path - Keyword)
                 >mark
-                ("." Identifier)*
                 >{ propose(ttAttributeSelector) }
                 %{ setText(ttAttributeSelector) }
                 %{ commit(ttAttributeSelector) };
-            PredicateArg =
-                AttributeSelector
-                >{ propose(ttPredicate) }
-                Space* Comparison Space*
-                (StringLiteral | NumericLiteral | AttributeSelector)
-                %{ commit(ttPredicate) };
-            Predicate = (PredicateArg | Equivalence) (Space+ Connective Space+ (PredicateArg | Equivalence))*;
+            # Kleene closure captures are indexed (eg. "a[].price"): "a[" opens the index, and "].price" closes it.
+            # Attributes are subscripted in the same way (eg. "a.tags["env"]").
+            IndexOpen =
+                (Path - Keyword)
+                >mark
+                >{ propose(ttIndexOpen) }
+                %{ setText(ttIndexOpen) }
+                "["
+                %{ commit(ttIndexOpen) };
+            IndexClose =
+                "]"
+                >{ propose(ttIndexClose) }
+                ("." Path >mark %{ setText(ttIndexClose) })?
+                %{ commit(ttIndexClose) };
+            # A subscript may directly follow another (eg. "a.m["x"]["y"]"), in which case the first closes by reopening
+            IndexReopen =
+                "]"
+                >{ propose(ttIndexReopen) }
+                ("." Path >mark %{ setText(ttIndexReopen) })?
+                "["
+                %{ commit(ttIndexReopen) };
+            
+            # Where one token could either end or continue, it continues (so "a.b>=c" tokenises to >= rather than >)
+            WhereToken =
+                (AttributeSelector | IndexOpen | IndexClose | IndexReopen | NumericLiteral | DurationLiteral |
+                 StringLiteral | BooleanLiteral | Parameter | Variable | ListOpen | Comparison | Between | In |
+                 Matches | StringMatch | Is | Null | Connective | Negation | GroupOpen | GroupClose |
+                 GroupCloseSelector | ListSeparator | Arithmetic | Conditional | ConditionalElse)
+                $(where, 1)
+                >(where, 0);
+            WhereTokens = WhereToken (Space* WhereToken)*;
             
-            WhereClause = "WHERE"i Space+ Predicate;
+            WhereClause = "WHERE"i Space+ WhereTokens;
+        
+        # -- PARTITION BY clause
+            # Eg: PARTITION BY symbol
+            PartitionClause =
+                "PARTITION"i Space+ "BY"i Space+
+                >{ propose(ttPartitionClause) }
+                Path
+                >mark
+                %{ setText(ttPartitionClause) }
+                %{ commit(ttPartitionClause) };
         
         # -- WITHIN clause
             Duration =
@@ -227,16 +369,33 @@ func tokenize(data string) ([]*token, error) {
                 >{ propose(ttDuration) }
                 %{ setText(ttDuration) }
                 %{ commit(ttDuration) };
+            # A window may also be of a number of events (eg. "WITHIN 100 EVENTS"), or of both (eg. "WITHIN 5m AND 100
+            # EVENTS"). The second window is a clause of its own (so that the first is committed before it, since it
+            # may just as well be the end of the query), which the parser merges with the first.
+            EventCount =
+                Digit+
+                >mark
+                >{ propose(ttEventCount) }
+                %{ setText(ttEventCount) }
+                Space+ ("EVENTS"i | "EVENT"i)
+                %{ commit(ttEventCount) };
+            Window = Duration | EventCount;
             WithinClause =
-                "WITHIN"i Space+ Duration
+                "WITHIN"i Space+ Window
+                >{ propose(ttWithinClause) }
+                %{ commit(ttWithinClause) };
+            WithinAlso =
+                "AND"i Space+ Window
                 >{ propose(ttWithinClause) }
                 %{ commit(ttWithinClause) };
         
         Query =
             Space*
             EventClause
+            (Space+ EventAlternative)*
             (Space+ WhereClause)?
-            (Space+ WithinClause)?
+            (Space+ PartitionClause)?
+            (Space+ WithinClause (Space+ WithinAlso)?)?
             (Space* ";")? Space*;
         
         main := Query;
@@ -246,13 +405,19 @@ func tokenize(data string) ([]*token, error) {
 
     if cs < sase_first_final {
         if p == pe {
-            return nil, fmt.Errorf("Unexpected EOF")
+            if pt := proposal(ttStringLiteral); pt != nil && pt == proposals[len(proposals)-1] { // Still open
+                return nil, &ParseError{Msg: "Unterminated string literal", Token: data[pt.pos:], offset: pt.pos}
+            }
+            return nil, &ParseError{Msg: "Unexpected end of query", offset: p}
         } else {
             end := p + 30
             if end > len(data) {
                 end = len(data)
             }
-            return nil, fmt.Errorf("Error at position %d (\"%s\"…)", p, data[p:end])
+            if space := strings.IndexAny(data[p:end], " \t\r\n"); space > 0 {
+                end = p + space
+            }
+            return nil, &ParseError{Msg: "Unexpected input", Token: data[p:end], offset: p}
         }
     }
     
@@ -13,15 +13,22 @@ const (
 	ttGeneric tt = iota
 
 	ttNumericLiteral
+	ttDurationLiteral
 	ttStringLiteral
+	ttBooleanLiteral
+	ttParameter
+	ttVariable
 
 	ttEventClause
 	ttEventDecl
 	ttEventDeclType
 	ttEventDeclAlias
+	ttKleeneClosure
 	ttSeqDecl
 	ttNegatedDecl
 	ttAnyDecl
+	ttAllDecl
+	ttEventAlternative
 
 	ttWhereClause
 	ttEq
@@ -30,19 +37,50 @@ const (
 	ttLt
 	ttGe
 	ttLe
+	ttIEq
+	ttBetween
+	ttIn
+	ttMatches
+	ttStartsWith
+	ttEndsWith
+	ttContains
+	ttIs
+	ttNull
 	ttAttributeSelector
-	ttEquivalenceTest
+	ttIndexOpen
+	ttIndexClose
+	ttIndexReopen
+	ttListOpen
 	ttConjunction
 	ttDisjunction
-	ttPredicate
+	ttNegation
+	ttGroupOpen
+	ttGroupClose
+	ttGroupCloseSelector
+	ttListSeparator
+	ttAdd
+	ttSubtract
+	ttMultiply
+	ttDivide
+	ttModulo
+	ttIntDivide
+	ttConditional
+	ttConditionalElse
+	ttBitwiseAnd
+	ttBitwiseOr
+	ttBitwiseNot
+
+	ttPartitionClause
 
 	ttWithinClause
 	ttDuration
+	ttEventCount
 )
 
 type token struct {
 	tt       tt
 	content  string
+	pos      int // Byte offset in the query at which the token starts
 	children []*token
 }
 
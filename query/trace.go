@@ -0,0 +1,83 @@
+package query
+
+import (
+	"context"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// A Trace records how a predicate was evaluated, to explain its result (eg. why an alert fired). It mirrors the
+// predicate's structure: AND, OR and NOT have the traces of their operands as children, and any other predicate has
+// its operands and the values they resolved to.
+type Trace struct {
+	Predicate Predicate
+	PredicateResult
+	// For AND, OR and NOT, the traces of the operands which were evaluated, in order. As in evaluation, AND stops at
+	// the first operand which makes it Negative (or Invalid, or an error), and OR at the first which makes it Positive.
+	Children []*Trace
+	// For any other predicate, its operands in the order they appear in the query text (eg. left and right)
+	Operands []TracedValue
+}
+
+// A TracedValue is an operand of a traced predicate, and what it resolved to
+type TracedValue struct {
+	Value    Value
+	Resolved interface{}
+	Err      error // If it couldn't be resolved: eg. ErrEventNotFound, if its event hasn't been captured
+}
+
+// EvaluateTrace evaluates a predicate as EvaluateErr does, also recording how (see Trace). This costs more than
+// evaluating it alone, so is for explaining results rather than for every evaluation; the other ways of evaluating a
+// predicate are unaffected by it.
+func EvaluateTrace(p Predicate, evs domain.CapturedEvents) (PredicateResult, *Trace) {
+	trace := evaluateTrace(withValueCache(context.Background(), evs), p, evs)
+	return trace.PredicateResult, trace
+}
+
+func evaluateTrace(ctx context.Context, p Predicate, evs domain.CapturedEvents) *Trace {
+	p = unwrapCondition(p)
+	trace := &Trace{Predicate: p}
+	switch p := p.(type) {
+	case conjunction:
+		trace.traceOperands(ctx, p, evs, AndResults, func(r PredicateResult) bool {
+			return r.Err != nil || r.Result == Negative || r.Result == Invalid
+		})
+
+	case disjunction:
+		trace.traceOperands(ctx, p, evs, OrResults, func(r PredicateResult) bool {
+			return r.Result == Positive
+		})
+
+	case *negationPredicate:
+		child := evaluateTrace(ctx, p.Predicate, evs)
+		trace.Children = []*Trace{child}
+		if trace.PredicateResult = NotResult(child.PredicateResult); !allCaptured(p.Predicate.usedAliases(), evs) {
+			trace.PredicateResult = negationResult(evaluatePartial(ctx, p.Predicate, evs))
+		}
+
+	default:
+		trace.Result, trace.Err = evaluateObserved(ctx, p, evs)
+		for _, child := range p.children() {
+			if v, ok := child.(value); ok {
+				resolved, err := resolve(ctx, v, evs) // Usually from the cache, having just been resolved
+				trace.Operands = append(trace.Operands, TracedValue{Value: v, Resolved: resolved, Err: err})
+			}
+		}
+	}
+	return trace
+}
+
+// traceOperands traces the operands of AND or OR until the combined result is settled
+func (t *Trace) traceOperands(ctx context.Context, operands []Predicate, evs domain.CapturedEvents,
+	combine func(...PredicateResult) PredicateResult, settled func(PredicateResult) bool) {
+	results := make([]PredicateResult, 0, len(operands))
+	for _, operand := range operands {
+		child := evaluateTrace(ctx, operand, evs)
+		t.Children = append(t.Children, child)
+		results = append(results, child.PredicateResult)
+		if settled(combine(results...)) {
+			break
+		}
+	}
+	t.PredicateResult = combine(results...)
+}
@@ -0,0 +1,104 @@
+package query
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// tTraceLines describes a trace, a line for each predicate (indented by its depth)
+func tTraceLines(trace *Trace, depth int) []string {
+	operands := make([]string, len(trace.Operands))
+	for i, o := range trace.Operands {
+		if o.Err != nil {
+			operands[i] = fmt.Sprintf("%s: %v", o.Value.QueryText(), o.Err)
+		} else {
+			operands[i] = fmt.Sprintf("%s = %v", o.Value.QueryText(), o.Resolved)
+		}
+	}
+	line := strings.Repeat("  ", depth) + trace.Predicate.QueryText() + ": " + trace.Result.String()
+	if len(operands) > 0 {
+		line += " [" + strings.Join(operands, ", ") + "]"
+	}
+	result := []string{line}
+	for _, child := range trace.Children {
+		result = append(result, tTraceLines(child, depth+1)...)
+	}
+	return result
+}
+
+func TestEvaluateTrace(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{typ: "A", attrs: map[string]interface{}{"x": 1, "y": "foo"}},
+		"b": &tEventImpl{typ: "B", attrs: map[string]interface{}{"x": 2.5}},
+	}
+	cases := []struct {
+		where    string
+		expected []string
+	}{
+		{"a.x < b.x", []string{"a.x < b.x: Positive [a.x = 1, b.x = 2.5]"}},
+		{"a.x * 2 < b.x AND a.y == 'foo'", []string{
+			`(a.x * 2.000000 < b.x AND a.y == "foo"): Positive`,
+			"  a.x * 2.000000 < b.x: Positive [a.x * 2.000000 = 2, b.x = 2.5]",
+			`  a.y == "foo": Positive [a.y = foo, "foo" = foo]`,
+		}},
+		// Operands which aren't evaluated aren't traced
+		{"a.x > b.x AND a.y == 'foo'", []string{
+			`(a.x > b.x AND a.y == "foo"): Negative`,
+			"  a.x > b.x: Negative [a.x = 1, b.x = 2.5]",
+		}},
+		{"a.x > b.x OR NOT (a.y IN ('bar', c.y))", []string{
+			`(a.x > b.x OR NOT (a.y IN ("bar", c.y))): Uncertain`,
+			"  a.x > b.x: Negative [a.x = 1, b.x = 2.5]",
+			`  NOT (a.y IN ("bar", c.y)): Uncertain`,
+			`    a.y IN ("bar", c.y): Uncertain [a.y = foo, "bar" = bar, c.y: Cannot find event]`,
+		}},
+		{"a.x BETWEEN 0 AND b.x OR a.z > 1", []string{
+			"(a.x BETWEEN 0.000000 AND b.x OR a.z > 1.000000): Positive",
+			"  a.x BETWEEN 0.000000 AND b.x: Positive [a.x = 1, 0.000000 = 0, b.x = 2.5]",
+		}},
+		{"a.y > 1", []string{
+			"a.y > 1.000000: Negative [a.y = foo, 1.000000 = 1]",
+		}},
+	}
+	for _, c := range cases {
+		q, err := Parse("EVENT SEQ(A a, B b, C c) WHERE " + c.where)
+		require.NoError(t, err, c.where)
+		result, trace := EvaluateTrace(q.predicate, evs)
+		require.Equal(t, trace.PredicateResult, result, c.where)
+		require.Equal(t, c.expected, tTraceLines(trace, 0), c.where)
+	}
+
+	// The error which prevents evaluation is traced alongside the operands
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE a.y > 1")
+	require.NoError(t, err)
+	result, _ := EvaluateTrace(q.predicate, evs)
+	require.Error(t, result.Err)
+	require.Contains(t, result.Err.Error(), "Could not order string and float64")
+
+	// Building conditions wraps them, which makes no difference
+	result, trace := EvaluateTrace(Attr("a", "x").Lt(Attr("b", "x")), evs)
+	require.Equal(t, PredicateResult{Result: Positive}, result)
+	require.Equal(t, []string{"a.x < b.x: Positive [a.x = 1, b.x = 2.5]"}, tTraceLines(trace, 0))
+}
+
+// Tracing a predicate must give the same result as evaluating it
+func TestEvaluateTraceResults(t *testing.T) {
+	g := tGenerator{rand.New(rand.NewSource(4))}
+	for i := 0; i < 1000; i++ {
+		p := g.predicate(3)
+		for j := 0; j < 3; j++ {
+			evs := g.events()
+			expected, expectedErr := p.EvaluateErr(evs)
+			result, trace := EvaluateTrace(p, evs)
+			require.Equal(t, expected, result.Result, p.QueryText())
+			require.Equal(t, expectedErr != nil, result.Err != nil, p.QueryText())
+			require.Equal(t, result, trace.PredicateResult, p.QueryText())
+		}
+	}
+}
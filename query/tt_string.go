@@ -4,9 +4,9 @@ package query
 
 import "fmt"
 
-const _tt_name = "ttGenericttNumericLiteralttStringLiteralttEventClausettEventDeclttEventDeclTypettEventDeclAliasttSeqDeclttNegatedDeclttAnyDeclttWhereClausettEqttNettGtttLtttGettLettAttributeSelectorttEquivalenceTestttConjunctionttDisjunctionttPredicatettWithinClausettDuration"
+const _tt_name = "ttGenericttNumericLiteralttDurationLiteralttStringLiteralttBooleanLiteralttParameterttVariablettEventClausettEventDeclttEventDeclTypettEventDeclAliasttKleeneClosurettSeqDeclttNegatedDeclttAnyDeclttAllDeclttEventAlternativettWhereClausettEqttNettGtttLtttGettLettIEqttBetweenttInttMatchesttStartsWithttEndsWithttContainsttIsttNullttAttributeSelectorttIndexOpenttIndexClosettIndexReopenttListOpenttConjunctionttDisjunctionttNegationttGroupOpenttGroupClosettGroupCloseSelectorttListSeparatorttAddttSubtractttMultiplyttDividettModulottIntDividettConditionalttConditionalElsettBitwiseAndttBitwiseOrttBitwiseNotttPartitionClausettWithinClausettDurationttEventCount"
 
-var _tt_index = [...]uint16{0, 9, 25, 40, 53, 64, 79, 95, 104, 117, 126, 139, 143, 147, 151, 155, 159, 163, 182, 199, 212, 225, 236, 250, 260}
+var _tt_index = [...]uint16{0, 9, 25, 42, 57, 73, 84, 94, 107, 118, 133, 149, 164, 173, 186, 195, 204, 222, 235, 239, 243, 247, 251, 255, 259, 264, 273, 277, 286, 298, 308, 318, 322, 328, 347, 358, 370, 383, 393, 406, 419, 429, 440, 452, 472, 487, 492, 502, 512, 520, 528, 539, 552, 569, 581, 592, 604, 621, 635, 645, 657}
 
 func (i tt) String() string {
 	if i+1 >= tt(len(_tt_index)) {
@@ -1,7 +1,12 @@
 package query
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"time"
+
+	"github.com/obeattie/sase/domain"
 )
 
 type tEventImpl struct {
@@ -21,3 +26,112 @@ func (e *tEventImpl) Attributes() map[string]interface{} {
 func (e *tEventImpl) When() time.Time {
 	return e.ts
 }
+
+// A tValueEvent is an event held by value rather than by pointer, which (holding a map) isn't comparable
+type tValueEvent tEventImpl
+
+func (e tValueEvent) Type() string {
+	return e.typ
+}
+
+func (e tValueEvent) Attributes() map[string]interface{} {
+	return e.attrs
+}
+
+func (e tValueEvent) When() time.Time {
+	return e.ts
+}
+
+// tValues holds the events of a stream (see tStream) by value
+func tValues(stream []domain.Event) []domain.Event {
+	result := make([]domain.Event, len(stream))
+	for i, ev := range stream {
+		result[i] = tValueEvent(*ev.(*tEventImpl))
+	}
+	return result
+}
+
+// A tPredicate always evaluates to a fixed result (or error)
+type tPredicate struct {
+	result  Result
+	err     error
+	aliases []string
+}
+
+func (p tPredicate) Evaluate(evs domain.CapturedEvents) Result {
+	return evaluateOrLog("tPredicate", p, evs)
+}
+
+func (p tPredicate) EvaluateErr(evs domain.CapturedEvents) (Result, error) {
+	return p.EvaluateContext(context.Background(), evs)
+}
+
+func (p tPredicate) EvaluateContext(ctx context.Context, evs domain.CapturedEvents) (Result, error) {
+	if p.err != nil {
+		return Negative, p.err
+	}
+	return p.result, nil
+}
+
+func (p tPredicate) compile() compiledPredicate {
+	return uncompiled(p)
+}
+
+func (p tPredicate) QueryText() string {
+	return "[" + p.result.String() + "]"
+}
+
+func (p tPredicate) usedAliases() []string {
+	return p.aliases
+}
+
+func (p tPredicate) Equal(other Predicate) bool {
+	return reflect.DeepEqual(p, other)
+}
+
+func (p tPredicate) Hash() uint64 {
+	return hashPredicate(p)
+}
+
+func (p tPredicate) Clone() Predicate {
+	p.aliases = append([]string(nil), p.aliases...)
+	return p
+}
+
+func (p tPredicate) children() []interface{} {
+	return nil
+}
+
+func (p tPredicate) Validate(declared map[string]struct{}) error {
+	return validateAliases(p, declared)
+}
+
+// A tValue always resolves to a fixed value (or error)
+type tValue struct {
+	v   interface{}
+	err error
+}
+
+func (v tValue) QueryText() string {
+	return fmt.Sprintf("[%v]", v.v)
+}
+
+func (v tValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.v, v.err
+}
+
+func (v tValue) usedAliases() []string {
+	return []string{}
+}
+
+func (v tValue) Equal(other value) bool {
+	return reflect.DeepEqual(v, other)
+}
+
+func (v tValue) Clone() Value {
+	return v
+}
+
+func (v tValue) children() []interface{} {
+	return nil
+}
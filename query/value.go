@@ -1,35 +1,247 @@
 package query
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
 
 	"github.com/obeattie/sase/domain"
 )
 
 var ErrEventNotFound = errors.New("Cannot find event")
 
-type value interface {
+// ErrAttributeNotFound is wrapped by the error looking up an attribute of a captured event through a part of its path
+// which is missing (eg. "a.customer.id" of an event without a customer). Since it is also ErrEventNotFound (see
+// errors.Is), it is Uncertain wherever a missing event is, and comparisons are Uncertain too rather than Positive: the
+// event won't be captured again, so once nothing more can be, the candidate is Negative.
+var ErrAttributeNotFound error = attributeNotFound{}
+
+type attributeNotFound struct{}
+
+func (attributeNotFound) Error() string {
+	return "Cannot find attribute"
+}
+
+func (attributeNotFound) Is(target error) bool {
+	return target == ErrEventNotFound
+}
+
+// A Value is an operand within a predicate, eg. an attribute lookup or a literal. It is resolved against each set of
+// captured events. (See NewAttribute and NewLiteral.)
+type Value interface {
 	Representable
 	Value(domain.CapturedEvents) (interface{}, error)
+	// Equal reports whether other is structurally identical to the value
+	Equal(other Value) bool
+	// Clone returns a deep copy of the value (see Predicate.Clone)
+	Clone() Value
 	usedAliases() []string
+	// children returns the value's operands (see Walk)
+	children() []interface{}
+}
+
+// The name used internally
+type value = Value
+
+// cloneValue clones a value, which may be missing
+func cloneValue(v value) value {
+	if v == nil {
+		return nil
+	}
+	return v.Clone()
+}
+
+func cloneValues(vs []value) []value {
+	if vs == nil {
+		return nil
+	}
+	result := make([]value, len(vs))
+	for i, v := range vs {
+		result[i] = cloneValue(v)
+	}
+	return result
+}
+
+// NewAttribute returns a value which looks up an attribute (or, with a longer path, a nested attribute) of the event
+// captured as alias. It panics if path is empty.
+func NewAttribute(alias string, path ...string) Value {
+	if len(path) == 0 {
+		panic("sase: NewAttribute " + alias + " has no attribute path")
+	}
+	return newAttributeLookup(alias, path)
+}
+
+// NewLiteral returns a constant value. It must be a number, time.Duration, string, bool or nil, so that it can be
+// written as query text; any other numeric type is stored as a float64, as it would be if it were parsed. It panics if
+// v is of another type.
+func NewLiteral(v interface{}) Value {
+	switch v := v.(type) {
+	case string, bool, nil:
+		return literalValue{v}
+	case time.Duration:
+		return durationLiteralValue(v)
+	}
+	if f, ok := numericValue(v); ok {
+		return literalValue{f}
+	}
+	panic(fmt.Sprintf("sase: NewLiteral cannot represent %T", v))
+}
+
+// A contextValue is a value which may be expensive to resolve (eg. an aggregate over a Kleene closure), and so can be
+// abandoned part-way through when its context is done
+type contextValue interface {
+	valueContext(context.Context, domain.CapturedEvents) (interface{}, error)
+}
+
+// resolve returns the value of v, passing ctx along if it is a contextValue. If ctx carries a valueCache for evs, the
+// result is looked up there first (and remembered for next time).
+func resolve(ctx context.Context, v value, evs domain.CapturedEvents) (interface{}, error) {
+	cache := valueCacheFor(ctx, evs)
+	key, cacheable := cacheKey(v)
+	if cache != nil && cacheable {
+		if cached, ok := cache.entries[key]; ok {
+			return cached.v, cached.err
+		}
+	}
+
+	var (
+		result interface{}
+		err    error
+	)
+	if cv, ok := v.(contextValue); ok {
+		result, err = cv.valueContext(ctx, evs)
+	} else {
+		result, err = v.Value(evs)
+	}
+	if cache != nil && cacheable {
+		if cache.entries == nil {
+			cache.entries = make(map[interface{}]cachedValue)
+		}
+		cache.entries[key] = cachedValue{result, err}
+	}
+	return result, err
 }
 
 // A literalValue is a simple value that always returns a constant
-// NOTE: This only, at present, supports strings and float64's
+// NOTE: This only, at present, supports strings, float64's, bools and nil
 type literalValue struct {
 	v interface{}
 }
 
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// quoteString renders a string as a (double-quoted) string literal
+func quoteString(s string) string {
+	return `"` + stringEscaper.Replace(s) + `"`
+}
+
+// stringEscapes maps the characters which follow a backslash in a string literal to the characters they stand for.
+// Any other escaped character (eg. a quote, or a backslash) stands for itself.
+var stringEscapes = map[rune]rune{
+	'n': '\n',
+	't': '\t',
+	'r': '\r',
+	'b': '\b',
+	'f': '\f',
+	'0': 0,
+}
+
+// unescapeString returns the content of a string literal with its escapes resolved. As well as those in stringEscapes,
+// \uXXXX stands for the Unicode character with that (hexadecimal) code point.
+func unescapeString(s string) (string, error) {
+	if !strings.ContainsRune(s, '\\') {
+		return s, nil
+	}
+	buf := new(strings.Builder)
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r != '\\' || i == len(runes)-1 {
+			buf.WriteRune(r)
+			continue
+		}
+		i++
+		if escaped, ok := stringEscapes[runes[i]]; ok {
+			buf.WriteRune(escaped)
+		} else if runes[i] == 'u' {
+			if i+4 >= len(runes) {
+				return "", fmt.Errorf("Invalid escape \\%s: expected 4 hex digits", string(runes[i:]))
+			}
+			code, err := strconv.ParseUint(string(runes[i+1:i+5]), 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("Invalid escape \\%s: expected 4 hex digits", string(runes[i:i+5]))
+			}
+			buf.WriteRune(rune(code))
+			i += 4
+		} else {
+			buf.WriteRune(runes[i])
+		}
+	}
+	return buf.String(), nil
+}
+
+// formatNumber renders a number literal. Six decimal places are used where that's exact; otherwise as many as are
+// needed for the number to parse back to the same value. Very large numbers are written in scientific notation.
+func formatNumber(f float64) string {
+	if math.Abs(f) >= 1e21 && !math.IsInf(f, 0) { // Too long to write out in full
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	s := strconv.FormatFloat(f, 'f', 6, 64)
+	if parsed, err := strconv.ParseFloat(s, 64); err == nil && parsed == f {
+		return s
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseNumber parses a number literal, which may be signed: either a decimal (eg. 1.5e3) or a hexadecimal integer (eg.
+// 0xFF). Groups of digits may be separated by underscores (eg. 1_000_000), but each underscore must be between digits.
+func parseNumber(s string) (float64, error) {
+	unsigned := strings.TrimLeft(s, "+-")
+	digits, isDigit := unsigned, func(r byte) bool { return r >= '0' && r <= '9' }
+	hex := len(unsigned) > 1 && unsigned[0] == '0' && (unsigned[1] == 'x' || unsigned[1] == 'X')
+	if hex {
+		digits = unsigned[2:]
+		isDigit = func(r byte) bool { return strings.IndexByte("0123456789abcdefABCDEF", r) >= 0 }
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] == '_' && (i == 0 || i == len(digits)-1 || !isDigit(digits[i-1]) || !isDigit(digits[i+1])) {
+			return 0, fmt.Errorf("Invalid number %s: underscores may only separate digits", s)
+		}
+	}
+	digits = strings.Replace(digits, "_", "", -1)
+
+	if !hex {
+		return strconv.ParseFloat(s[:len(s)-len(unsigned)]+digits, 64)
+	} else if digits == "" {
+		return 0, fmt.Errorf("Invalid number %s: expected hex digits", s)
+	}
+	n, err := strconv.ParseUint(digits, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid number %s: %w", s, err)
+	} else if strings.HasPrefix(s, "-") {
+		return -float64(n), nil
+	}
+	return float64(n), nil
+}
+
 func (v literalValue) QueryText() string {
 	switch val := v.v.(type) {
 	case string:
-		return fmt.Sprintf("%q", val)
+		return quoteString(val)
 	case float64:
-		return fmt.Sprintf("%f", val)
+		return formatNumber(val)
+	case bool:
+		return strconv.FormatBool(val)
+	case nil:
+		return "null"
 	default:
 		return ""
 	}
@@ -40,65 +252,761 @@ func (v literalValue) Value(evs domain.CapturedEvents) (interface{}, error) {
 }
 
 func (v literalValue) usedAliases() []string {
+	return []string{}
+}
+
+func (v literalValue) Equal(other value) bool {
+	o, ok := other.(literalValue)
+	return ok && reflect.DeepEqual(v.v, o.v)
+}
+
+func (v literalValue) Clone() Value {
+	return v // Its value is immutable
+}
+
+func (v literalValue) children() []interface{} {
 	return nil
 }
 
-// An attributeLookup represents the lookup of an attribute from an event (it handles nested key paths)
+// A durationLiteralValue is a constant time.Duration (eg. "1h30m"). Where it is used as a number (eg. in arithmetic or
+// compared with one), it is a number of seconds.
+type durationLiteralValue time.Duration
+
+func (v durationLiteralValue) QueryText() string {
+	return formatDuration(time.Duration(v))
+}
+
+// formatDuration renders a duration as it is written in a query: as time.Duration.String, but omitting zero units which
+// aren't needed to mark the ones before them (eg. 1h0m0s is 1h), and with microseconds as "us"
+func formatDuration(d time.Duration) string {
+	s := strings.Replace(d.String(), "µs", "us", 1)
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// parseDuration parses a duration as it is written in a query (its units are case-insensitive)
+func parseDuration(s string) (time.Duration, error) {
+	return time.ParseDuration(strings.ToLower(s))
+}
+
+func (v durationLiteralValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return time.Duration(v), nil
+}
+
+func (v durationLiteralValue) usedAliases() []string {
+	return []string{}
+}
+
+func (v durationLiteralValue) Equal(other value) bool {
+	o, ok := other.(durationLiteralValue)
+	return ok && v == o
+}
+
+func (v durationLiteralValue) Clone() Value {
+	return v
+}
+
+func (v durationLiteralValue) children() []interface{} {
+	return nil
+}
+
+// An attributeLookup represents the lookup of an attribute from an event (it handles nested key paths). It is the path
+// as it is written in a query, beginning with the alias (see joinPath).
 type attributeLookup string
 
+// newAttributeLookup returns the lookup of a path of attributes from the event captured as alias
+func newAttributeLookup(alias string, path []string) attributeLookup {
+	if len(path) == 1 && (path[0] == "LEN" || path[0] == "TS") { // Which would otherwise be a length or timestamp
+		return attributeLookup(joinPath(alias) + "." + quote(path[0]))
+	}
+	return attributeLookup(joinPath(append([]string{alias}, path...)...))
+}
+
 func (p attributeLookup) QueryText() string {
 	return string(p)
 }
 
 func (p attributeLookup) Value(evs domain.CapturedEvents) (interface{}, error) {
-	parts := strings.Split(string(p), ".")
+	parts := splitPath(string(p))
 
 	if len(parts) > 1 {
-		var result interface{}
-
 		if ev, ok := evs[parts[0]]; !ok {
 			return nil, ErrEventNotFound
 		} else {
-			result = ev.Attributes()
-		}
-
-		for _, part := range parts[1:] {
-			val := reflect.ValueOf(result)
-			typ := val.Type()
-
-			switch typ.Kind() {
-			case reflect.Map:
-				reflectResult := val.MapIndex(reflect.ValueOf(part))
-				if !reflectResult.IsValid() {
-					return nil, fmt.Errorf("Attribute lookup failed for %s: cannot find map field %s", p, part)
-				}
-				result = reflectResult.Interface()
-
-			case reflect.Array, reflect.Slice:
-				if idx, err := strconv.Atoi(part); err != nil {
-					return nil, fmt.Errorf("Attribute lookup failed for %s: %s", p, err.Error())
-				} else if idx >= val.Len() {
-					return nil, fmt.Errorf("Attribute lookup failed for %s: %d is beyond array/slice bounds", p,
-						idx)
-				} else {
-					result = val.Index(idx).Interface()
-				}
-
-			default:
-				return nil, fmt.Errorf("Attribute lookup failed for %s: cannot index type %s", p, typ.String())
-			}
+			return lookupEvent(string(p), ev, parts[1:])
 		}
-
-		return result, nil
 	} else {
 		return nil, fmt.Errorf("Attribute lookup failed for %s: lookup has too few parts", p)
 	}
 }
 
+// lookupPath resolves a key path within an event's attributes (desc describes the lookup, for errors). Each part of the
+// path indexes a map (by key), a slice or array (by index) or a struct (by field name, ignoring case, or by the name in
+// its json tag), following any pointers on the way. Since events may omit optional structures, a missing (or nil) part
+// which the path passes through is Uncertain, wrapping ErrAttributeNotFound; a nil leaf resolves to nil.
+func lookupPath(desc string, attrs map[string]interface{}, path []string) (interface{}, error) {
+	return followPath(desc, reflect.ValueOf(attrs), path, false)
+}
+
+// followPath follows a key path from a value (see lookupPath). indexed says whether the value was itself looked up (as
+// opposed to being an event's attributes), in which case the path passes through it.
+func followPath(desc string, val reflect.Value, path []string, indexed bool) (interface{}, error) {
+	for i, part := range path {
+		val = indirect(val)
+		if !val.IsValid() || (val.Kind() == reflect.Map && val.IsNil() && (i > 0 || indexed)) {
+			return nil, fmt.Errorf("Attribute lookup failed for %s: cannot find field %s of nil: %w", desc, part,
+				ErrAttributeNotFound)
+		}
+
+		next, missing, err := lookupPart(val, part)
+		if err != nil {
+			return nil, fmt.Errorf("Attribute lookup failed for %s: %w", desc, err)
+		} else if missing != nil && i < len(path)-1 {
+			return nil, fmt.Errorf("Attribute lookup failed for %s: %s: %w", desc, missing.Error(), ErrAttributeNotFound)
+		} else if missing != nil {
+			return nil, fmt.Errorf("Attribute lookup failed for %s: %w", desc, missing)
+		}
+		val = next
+	}
+
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface { // Leaves are resolved to what they point to
+		if val.IsNil() {
+			return nil, nil
+		}
+		val = val.Elem()
+	}
+	if !val.IsValid() {
+		return nil, nil
+	}
+	return val.Interface(), nil
+}
+
+// indirect follows pointers and interfaces to the value they hold (which is invalid if any of them is nil)
+func indirect(val reflect.Value) reflect.Value {
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+	return val
+}
+
+// A missingPart describes a part of a key path which wasn't found
+type missingPart struct {
+	msg string
+}
+
+func (e *missingPart) Error() string {
+	return e.msg
+}
+
+// isMissing reports whether the error looking up a key path is because some part of it is missing
+func isMissing(err error) bool {
+	var missing *missingPart
+	return errors.As(err, &missing) || errors.Is(err, ErrEventNotFound)
+}
+
+// lookupPart indexes a map, slice, array or struct by part, which is a string or (to index a slice or array) an int.
+// missing describes why there is no such element, if there isn't.
+func lookupPart(val reflect.Value, part interface{}) (next reflect.Value, missing *missingPart, err error) {
+	switch val.Kind() {
+	case reflect.Map:
+		key, keyType := reflect.ValueOf(part), val.Type().Key()
+		// Ints are convertible to strings (as runes), but aren't keys of them
+		if (key.Kind() == reflect.String) != (keyType.Kind() == reflect.String) || !key.Type().ConvertibleTo(keyType) {
+			return next, nil, fmt.Errorf("cannot index type %s with %v", val.Type().String(), part)
+		}
+		if next = val.MapIndex(key.Convert(keyType)); !next.IsValid() {
+			missing = &missingPart{fmt.Sprintf("cannot find map field %v", part)}
+		}
+
+	case reflect.Array, reflect.Slice:
+		idx, ok := part.(int)
+		if s, isString := part.(string); isString {
+			if idx, err = strconv.Atoi(s); err != nil {
+				return next, nil, err
+			}
+		} else if !ok {
+			return next, nil, fmt.Errorf("cannot index type %s with %v", val.Type().String(), part)
+		}
+		if idx < 0 || idx >= val.Len() {
+			missing = &missingPart{fmt.Sprintf("%d is beyond array/slice bounds", idx)}
+		} else {
+			next = val.Index(idx)
+		}
+
+	case reflect.Struct:
+		name, ok := part.(string)
+		if !ok {
+			return next, nil, fmt.Errorf("cannot index type %s with %v", val.Type().String(), part)
+		} else if next = structField(val, name); !next.IsValid() {
+			missing = &missingPart{"cannot find struct field " + name}
+		}
+
+	default:
+		return next, nil, fmt.Errorf("cannot index type %s", val.Type().String())
+	}
+	return next, missing, nil
+}
+
+// structField finds the exported field of a struct with the given name (ignoring case) or json name
+func structField(val reflect.Value, name string) reflect.Value {
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" { // Unexported, so can't be read
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == name || (tag == "" && strings.EqualFold(field.Name, name)) {
+			return val.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
 func (p attributeLookup) usedAliases() []string {
-	parts := strings.SplitN(string(p), ".", 2)
-	if len(parts) < 1 {
-		return nil
+	return splitPath(string(p))[:1]
+}
+
+func (p attributeLookup) Equal(other value) bool {
+	o, ok := other.(attributeLookup)
+	return ok && p == o
+}
+
+func (p attributeLookup) Clone() Value {
+	return p
+}
+
+func (p attributeLookup) children() []interface{} {
+	return nil
+}
+
+// A subscriptLookup indexes into a map or slice (or array) which is the value of an attribute, by a key (which is
+// evaluated, so needn't be a literal), and then follows a key path from the element (eg. a.tags["env"] or
+// a.items[0].sku). Maps are indexed by strings and slices by whole numbers. A missing key or an index out of range
+// wraps ErrAttributeNotFound, as does a missing part the path passes through (see lookupPath).
+type subscriptLookup struct {
+	operand value // An attributeLookup, indexLookup or another subscriptLookup
+	key     value
+	path    []string
+}
+
+func (v *subscriptLookup) QueryText() string {
+	buf := new(bytes.Buffer)
+	if v.operand != nil {
+		buf.WriteString(v.operand.QueryText())
+	}
+	buf.WriteRune('[')
+	if lit, ok := v.key.(literalValue); ok && isIntegral(lit.v) {
+		buf.WriteString(fmt.Sprintf("%d", int(lit.v.(float64))))
+	} else if v.key != nil {
+		buf.WriteString(v.key.QueryText())
 	}
-	return parts[:1]
+	buf.WriteRune(']')
+	if len(v.path) > 0 {
+		buf.WriteRune('.')
+		buf.WriteString(joinPath(v.path...))
+	}
+	return buf.String()
+}
+
+func (v *subscriptLookup) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.valueContext(context.Background(), evs)
+}
+
+func (v *subscriptLookup) valueContext(ctx context.Context, evs domain.CapturedEvents) (interface{}, error) {
+	if v.operand == nil || v.key == nil {
+		return nil, fmt.Errorf("Could not evaluate %s: operands must not be nil", v.QueryText())
+	}
+	container, err := resolve(ctx, v.operand, evs)
+	var missing *missingPart
+	if errors.As(err, &missing) { // The key is looked up through it, so it's treated as missing
+		return nil, fmt.Errorf("%s: %w", err.Error(), ErrAttributeNotFound)
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := resolve(ctx, v.key, evs)
+	if err != nil {
+		return nil, err
+	}
+	var part interface{}
+	if s, ok := key.(string); ok {
+		part = s
+	} else if i, ok := wholeNumber(key); ok {
+		part = i
+	} else {
+		return nil, fmt.Errorf("Subscript of %s must be a string or whole number, got %v", v.QueryText(), key)
+	}
+
+	val := indirect(reflect.ValueOf(container))
+	if !val.IsValid() {
+		return nil, fmt.Errorf("Cannot subscript %s, which is nil: %w", v.operand.QueryText(), ErrAttributeNotFound)
+	}
+	element, missing, err := lookupPart(val, part)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot subscript %s: %w", v.operand.QueryText(), err)
+	} else if missing != nil {
+		return nil, fmt.Errorf("Attribute lookup failed for %s: %s: %w", v.QueryText(), missing.Error(), ErrAttributeNotFound)
+	}
+	return followPath(v.QueryText(), element, v.path, true)
+}
+
+func (v *subscriptLookup) usedAliases() []string {
+	var result []string
+	for _, operand := range []value{v.operand, v.key} {
+		if operand != nil {
+			result = append(result, operand.usedAliases()...)
+		}
+	}
+	return dedupeAliases(result)
+}
+
+func (v *subscriptLookup) Equal(other value) bool {
+	o, ok := other.(*subscriptLookup)
+	return ok && sameValue(v.operand, o.operand) && sameValue(v.key, o.key) && samePath(v.path, o.path)
+}
+
+func (v *subscriptLookup) Clone() Value {
+	return &subscriptLookup{operand: cloneValue(v.operand), key: cloneValue(v.key), path: append([]string(nil), v.path...)}
+}
+
+func (v *subscriptLookup) children() []interface{} {
+	return valueNodes(v.operand, v.key)
+}
+
+// A timestampValue is the time at which the event captured under an alias occurred, as a time.Time (eg. "a.TS"). For a
+// Kleene closure, it is that of the last event captured.
+type timestampValue string // Holds the alias
+
+func (v timestampValue) QueryText() string {
+	return joinPath(string(v)) + ".TS"
+}
+
+func (v timestampValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	ev, ok := evs[string(v)]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+	return ev.When(), nil
+}
+
+func (v timestampValue) usedAliases() []string {
+	return []string{string(v)}
+}
+
+func (v timestampValue) Equal(other value) bool {
+	o, ok := other.(timestampValue)
+	return ok && v == o
+}
+
+func (v timestampValue) Clone() Value {
+	return v
+}
+
+func (v timestampValue) children() []interface{} {
+	return nil
+}
+
+// An eventValue is the whole event captured under an alias, as a domain.Event (eg. the "a" of "score(a) > 0.9"), so
+// that a function may inspect as many of its attributes as it likes. For a Kleene closure, it is the domain.EventList
+// of the events captured.
+type eventValue string // Holds the alias
+
+func (v eventValue) QueryText() string {
+	return quoteName(string(v))
+}
+
+func (v eventValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	ev, ok := evs[string(v)]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+	return ev, nil
+}
+
+func (v eventValue) usedAliases() []string {
+	return []string{string(v)}
+}
+
+func (v eventValue) Equal(other value) bool {
+	o, ok := other.(eventValue)
+	return ok && v == o
+}
+
+func (v eventValue) Clone() Value {
+	return v
+}
+
+func (v eventValue) children() []interface{} {
+	return nil
+}
+
+type arithmeticOp uint8
+
+const (
+	aoAdd       arithmeticOp = iota // addition (+)
+	aoSubtract                      // subtraction (-)
+	aoMultiply                      // multiplication (*)
+	aoDivide                        // division (/)
+	aoModulo                        // remainder of integer division (%)
+	aoIntDivide                     // integer division, truncated towards zero (\)
+	aoBitAnd                        // bitwise AND (&)
+	aoBitOr                         // bitwise OR (|)
+	aoBitXor                        // bitwise XOR (^)
+)
+
+func (o arithmeticOp) String() string {
+	switch o {
+	case aoAdd:
+		return "+"
+	case aoSubtract:
+		return "-"
+	case aoMultiply:
+		return "*"
+	case aoDivide:
+		return "/"
+	case aoModulo:
+		return "%"
+	case aoIntDivide:
+		return "\\"
+	case aoBitAnd:
+		return "&"
+	case aoBitOr:
+		return "|"
+	case aoBitXor:
+		return "^"
+	default:
+		return ""
+	}
+}
+
+// precedence returns how tightly the operator binds (higher values bind more tightly). Bitwise operators bind less
+// tightly than the others, but more tightly than comparisons (so "a.flags & 4 != 0" tests a bit).
+func (o arithmeticOp) precedence() int {
+	switch o {
+	case aoMultiply, aoDivide, aoModulo, aoIntDivide:
+		return 5
+	case aoBitAnd:
+		return 3
+	case aoBitXor:
+		return 2
+	case aoBitOr:
+		return 1
+	default:
+		return 4
+	}
+}
+
+// bitwise reports whether the operator is &, | or ^
+func (o arithmeticOp) bitwise() bool {
+	return o == aoBitAnd || o == aoBitOr || o == aoBitXor
+}
+
+// An arithmeticValue applies an arithmetic operator to two numeric values
+type arithmeticValue struct {
+	left  value
+	right value
+	op    arithmeticOp
+}
+
+func (v *arithmeticValue) QueryText() string {
+	buf := new(bytes.Buffer)
+	if left, ok := v.left.(*arithmeticValue); ok && left.op.precedence() < v.op.precedence() {
+		buf.WriteString("(" + left.QueryText() + ")")
+	} else if v.left != nil {
+		buf.WriteString(v.left.QueryText())
+	}
+	buf.WriteString(" " + v.op.String() + " ")
+	// Operators are left-associative, so an equal-precedence operation on the right must be parenthesised too
+	if right, ok := v.right.(*arithmeticValue); ok && right.op.precedence() <= v.op.precedence() {
+		buf.WriteString("(" + right.QueryText() + ")")
+	} else if v.right != nil {
+		buf.WriteString(v.right.QueryText())
+	}
+	return buf.String()
+}
+
+func (v *arithmeticValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.valueContext(context.Background(), evs)
+}
+
+func (v *arithmeticValue) valueContext(ctx context.Context, evs domain.CapturedEvents) (interface{}, error) {
+	leftVal, rightVal, err := leftRightVals(ctx, evs, v.left, v.right)
+	if err != nil {
+		return nil, err
+	}
+	return v.apply(leftVal, rightVal)
+}
+
+// apply performs the arithmetic on resolved operands
+func (v *arithmeticValue) apply(leftVal, rightVal interface{}) (interface{}, error) {
+	if left, right, ok := decimalOperands(leftVal, rightVal); ok {
+		return v.applyDecimal(left, right)
+	}
+	if _, ok := leftVal.(time.Time); ok {
+		return v.applyTime(leftVal, rightVal)
+	} else if _, ok := rightVal.(time.Time); ok {
+		return v.applyTime(leftVal, rightVal)
+	}
+	left, leftOk := numericValue(leftVal)
+	right, rightOk := numericValue(rightVal)
+	if !leftOk || !rightOk {
+		return nil, fmt.Errorf("Cannot apply %s to %T and %T", v.op.String(), leftVal, rightVal)
+	} else if v.op == aoModulo || v.op == aoIntDivide || v.op.bitwise() {
+		return v.applyInteger(leftVal, rightVal)
+	}
+
+	switch v.op {
+	case aoAdd:
+		return left + right, nil
+	case aoSubtract:
+		return left - right, nil
+	case aoMultiply:
+		return left * right, nil
+	case aoDivide:
+		if right == 0 {
+			return nil, fmt.Errorf("Division by zero in %s", v.QueryText())
+		}
+		return left / right, nil
+	default:
+		return nil, fmt.Errorf("Unhandled arithmetic op %v", v.op)
+	}
+}
+
+// applyInteger performs integer division, finds its remainder, or applies a bitwise operator. Both operands must be
+// whole numbers (as int64s, see integerValue); rather than truncating any which aren't, which would hide mistakes (eg.
+// dividing by a price), that is an error. As in Go, the quotient is truncated towards zero, so the remainder has the
+// sign of the dividend (eg. -7 % 2 is -1), and bitwise operators apply to the two's complement of negative numbers.
+func (v *arithmeticValue) applyInteger(leftVal, rightVal interface{}) (interface{}, error) {
+	l, leftOk := integerValue(leftVal)
+	r, rightOk := integerValue(rightVal)
+	if !leftOk || !rightOk {
+		return nil, fmt.Errorf("Cannot apply %s to %v and %v, which must be whole numbers: %s", v.op.String(), leftVal,
+			rightVal, v.QueryText())
+	}
+	switch v.op {
+	case aoBitAnd:
+		return l & r, nil
+	case aoBitOr:
+		return l | r, nil
+	case aoBitXor:
+		return l ^ r, nil
+	}
+	if r == 0 {
+		return nil, fmt.Errorf("Division by zero in %s", v.QueryText())
+	} else if v.op == aoModulo {
+		return l % r, nil
+	}
+	return l / r, nil
+}
+
+// isInt64 reports whether f is a whole number within the range of an int64
+func isInt64(f float64) bool {
+	return f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64
+}
+
+// integerValue coerces a whole number to an int64. Integers are converted directly, so those beyond the precision of a
+// float64 (2^53) aren't rounded; other numbers (see numericValue) only if they are whole and within range. ok is false
+// if v is neither.
+func integerValue(v interface{}) (i int64, ok bool) {
+	switch val := v.(type) {
+	case int:
+		return int64(val), true
+	case int64:
+		return val, true
+	case decimal.Decimal:
+		if val.IsInteger() && val.BigInt().IsInt64() {
+			return val.IntPart(), true
+		}
+		return 0, false
+	case time.Duration: // In seconds, as for numericValue
+	default:
+		switch rv := reflect.ValueOf(v); rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return rv.Int(), true
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return int64(rv.Uint()), rv.Uint() <= math.MaxInt64
+		}
+	}
+	if f, ok := numericValue(v); ok && isInt64(f) {
+		return int64(f), true
+	}
+	return 0, false
+}
+
+// applyTime performs arithmetic involving times: subtracting one from another gives the difference in seconds, and
+// adding or subtracting a number of seconds moves a time
+func (v *arithmeticValue) applyTime(leftVal, rightVal interface{}) (interface{}, error) {
+	left, leftIsTime := leftVal.(time.Time)
+	right, rightIsTime := rightVal.(time.Time)
+	switch {
+	case leftIsTime && rightIsTime:
+		if v.op == aoSubtract {
+			return left.Sub(right).Seconds(), nil
+		}
+	case leftIsTime:
+		if secs, ok := numericValue(rightVal); ok && (v.op == aoAdd || v.op == aoSubtract) {
+			if v.op == aoSubtract {
+				secs = -secs
+			}
+			return left.Add(time.Duration(secs * float64(time.Second))), nil
+		}
+	default:
+		if secs, ok := numericValue(leftVal); ok && v.op == aoAdd {
+			return right.Add(time.Duration(secs * float64(time.Second))), nil
+		}
+	}
+	return nil, fmt.Errorf("Cannot apply %s to %T and %T", v.op.String(), leftVal, rightVal)
+}
+
+func (v *arithmeticValue) usedAliases() []string {
+	result := make([]string, 0)
+	if v.left != nil {
+		result = append(result, v.left.usedAliases()...)
+	}
+	if v.right != nil {
+		result = append(result, v.right.usedAliases()...)
+	}
+	return dedupeAliases(result)
+}
+
+func (v *arithmeticValue) Equal(other value) bool {
+	o, ok := other.(*arithmeticValue)
+	return ok && v.op == o.op && sameValue(v.left, o.left) && sameValue(v.right, o.right)
+}
+
+func (v *arithmeticValue) Clone() Value {
+	return &arithmeticValue{left: cloneValue(v.left), right: cloneValue(v.right), op: v.op}
+}
+
+func (v *arithmeticValue) children() []interface{} {
+	return valueNodes(v.left, v.right)
+}
+
+// A bitwiseNotValue is the bitwise complement of a whole number (eg. "~a.flags"). As for the binary bitwise operators,
+// its operand must be a whole number.
+type bitwiseNotValue struct {
+	operand value
+}
+
+func (v *bitwiseNotValue) QueryText() string {
+	if _, ok := v.operand.(*arithmeticValue); ok {
+		return "~(" + v.operand.QueryText() + ")"
+	}
+	return "~" + valueText(v.operand)
+}
+
+func (v *bitwiseNotValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.valueContext(context.Background(), evs)
+}
+
+func (v *bitwiseNotValue) valueContext(ctx context.Context, evs domain.CapturedEvents) (interface{}, error) {
+	if v.operand == nil {
+		return nil, fmt.Errorf("Could not evaluate %s: operand must not be nil", v.QueryText())
+	}
+	val, err := resolve(ctx, v.operand, evs)
+	if err != nil {
+		return nil, err
+	}
+	i, ok := integerValue(val)
+	if _, numeric := numericValue(val); !numeric {
+		return nil, fmt.Errorf("Cannot apply ~ to %T: %s", val, v.QueryText())
+	} else if !ok {
+		return nil, fmt.Errorf("Cannot apply ~ to %v, which must be a whole number: %s", val, v.QueryText())
+	} else if _, ok := val.(decimal.Decimal); ok {
+		return decimal.NewFromInt(^i), nil
+	}
+	return ^i, nil
+}
+
+func (v *bitwiseNotValue) usedAliases() []string {
+	if v.operand == nil {
+		return []string{}
+	}
+	return v.operand.usedAliases()
+}
+
+func (v *bitwiseNotValue) Equal(other value) bool {
+	o, ok := other.(*bitwiseNotValue)
+	return ok && sameValue(v.operand, o.operand)
+}
+
+func (v *bitwiseNotValue) Clone() Value {
+	return &bitwiseNotValue{operand: cloneValue(v.operand)}
+}
+
+func (v *bitwiseNotValue) children() []interface{} {
+	return valueNodes(v.operand)
+}
+
+// A conditionalValue resolves to one of two values, depending on a condition (eg. "(a.vip ? a.priceVip : a.price)"). As
+// in a WHERE clause, the condition holds only if it is Positive. If it can't be settled yet, because it refers to
+// events which haven't been captured (see EvaluatePartial), which value applies isn't known either: it resolves to
+// ErrEventNotFound, so whatever compares it treats it as it would a value of a missing event.
+type conditionalValue struct {
+	condition Predicate
+	then      value
+	otherwise value
+}
+
+func (v *conditionalValue) QueryText() string {
+	condition := ""
+	if v.condition != nil {
+		condition = v.condition.QueryText()
+	}
+	return "(" + joinText(condition, "?", valueText(v.then), ":", valueText(v.otherwise)) + ")"
+}
+
+func (v *conditionalValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.valueContext(context.Background(), evs)
+}
+
+func (v *conditionalValue) valueContext(ctx context.Context, evs domain.CapturedEvents) (interface{}, error) {
+	if v.condition == nil || v.then == nil || v.otherwise == nil {
+		return nil, fmt.Errorf("Could not evaluate %s: operands must not be nil", v.QueryText())
+	}
+	r, missing := evaluatePartial(ctx, v.condition, evs)
+	if r.Err != nil {
+		return nil, fmt.Errorf("Could not evaluate the condition of %s: %w", v.QueryText(), r.Err)
+	} else if len(missing) > 0 || r.Result == Uncertain {
+		return nil, fmt.Errorf("The condition of %s is uncertain: %w", v.QueryText(), ErrEventNotFound)
+	} else if r.Result == Positive {
+		return resolve(ctx, v.then, evs)
+	}
+	return resolve(ctx, v.otherwise, evs)
+}
+
+func (v *conditionalValue) usedAliases() []string {
+	var result []string
+	if v.condition != nil {
+		result = append(result, v.condition.usedAliases()...)
+	}
+	for _, branch := range []value{v.then, v.otherwise} {
+		if branch != nil {
+			result = append(result, branch.usedAliases()...)
+		}
+	}
+	return dedupeAliases(result)
+}
+
+func (v *conditionalValue) Equal(other value) bool {
+	o, ok := other.(*conditionalValue)
+	return ok && samePredicate(v.condition, o.condition) && sameValue(v.then, o.then) &&
+		sameValue(v.otherwise, o.otherwise)
+}
+
+func (v *conditionalValue) Clone() Value {
+	result := &conditionalValue{then: cloneValue(v.then), otherwise: cloneValue(v.otherwise)}
+	if v.condition != nil {
+		result.condition = v.condition.Clone()
+	}
+	return result
+}
+
+func (v *conditionalValue) children() []interface{} {
+	return append(predicateNodes(v.condition), valueNodes(v.then, v.otherwise)...)
 }
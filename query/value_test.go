@@ -1,9 +1,12 @@
 package query
 
 import (
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/require"
 
 	"github.com/obeattie/sase/domain"
@@ -61,3 +64,598 @@ func TestAttributeLookup(t *testing.T) {
 		}
 	}
 }
+
+type tCustomer struct {
+	ID   string
+	Name *string `json:"full_name"`
+	tier int
+}
+
+type tOrder struct {
+	Total    float64
+	Customer *tCustomer
+	Tags     map[string]interface{}
+	Lines    []tCustomer
+}
+
+func TestNestedAttributeLookup(t *testing.T) {
+	name := "Ada"
+	e := &tEventImpl{
+		typ: "a",
+		attrs: map[string]interface{}{
+			"order":     tOrder{Total: 3.5, Customer: &tCustomer{ID: "c1", Name: &name}, Tags: map[string]interface{}{"env": "prod"}},
+			"pending":   &tOrder{Total: 1},
+			"cancelled": nil,
+		}}
+	evs := domain.CapturedEvents{"a": e}
+
+	lookups := map[string]interface{}{
+		"a.order.total":              3.5,
+		"a.order.Total":              3.5,
+		"a.order.customer.id":        "c1",
+		"a.order.customer.full_name": "Ada", // Pointers are followed, and fields found by their json names
+		"a.order.tags.env":           "prod",
+		"a.pending.total":            1.0,
+		"a.pending.customer":         nil, // A nil leaf resolves to nil
+		"a.pending.tags":             map[string]interface{}(nil),
+		"a.cancelled":                nil,
+	}
+	for keyPath, expected := range lookups {
+		result, err := attributeLookup(keyPath).Value(evs)
+		require.NoError(t, err, keyPath)
+		require.Equal(t, expected, result, keyPath)
+	}
+
+	// Passing through a part which is missing (or nil) is like the event being missing
+	for _, keyPath := range []string{"a.missing.total", "a.order.missing.id", "a.pending.customer.id",
+		"a.cancelled.total", "a.pending.tags.env", "a.order.lines.0.id"} {
+		_, err := attributeLookup(keyPath).Value(evs)
+		require.True(t, errors.Is(err, ErrEventNotFound), "%s: %v", keyPath, err)
+	}
+	// but a missing leaf, or one which can't be indexed, is an error
+	for _, keyPath := range []string{"a.order.missing", "a.order.customer.tier", "a.order.total.x"} {
+		_, err := attributeLookup(keyPath).Value(evs)
+		require.Error(t, err, keyPath)
+		require.False(t, errors.Is(err, ErrEventNotFound), "%s: %v", keyPath, err)
+	}
+
+	cases := map[string]Result{
+		"a.order.customer.id == 'c1' AND a.order.total > 3": Positive,
+		"a.pending.customer IS NULL":                        Positive,
+		"a.order.customer.full_name IS NOT NULL":            Positive,
+	}
+	for predicate, expected := range cases {
+		q, err := Parse("EVENT SEQ(A a, B b) WHERE " + predicate)
+		require.NoError(t, err, predicate)
+		require.Equal(t, expected, q.predicate.Evaluate(evs), predicate)
+	}
+	// Predicates over missing parts are Uncertain (even comparisons, which are Positive while an event is missing), so a
+	// candidate which can't capture anything more doesn't match
+	for _, predicate := range []string{"%s == 'c1'", "%s > 'a'", "%s IS NULL", "%s IN ('c1')", "%s BETWEEN 'a' AND 'z'",
+		"NOT (%s == 'c1')"} {
+		for _, keyPath := range []string{"a.pending.customer.id", "a.missing.id", "a.cancelled.id"} {
+			where := fmt.Sprintf(predicate, keyPath)
+			q, err := Parse("EVENT A a WHERE " + where)
+			require.NoError(t, err)
+			require.Equal(t, Uncertain, q.predicate.Evaluate(evs), where)
+			require.Equal(t, Uncertain, Compile(q.predicate)(evs), where)
+			require.Equal(t, Negative, q.Evaluate(evs), where)
+		}
+	}
+	require.Equal(t, "a.order.customer.id", attributeLookup("a.order.customer.id").QueryText())
+}
+
+func TestSubscriptLookup(t *testing.T) {
+	e := &tEventImpl{
+		typ: "A",
+		attrs: map[string]interface{}{
+			"tags":  map[string]interface{}{"env": "prod", "dotted.key": 1, "nested": map[string]string{"x": "y"}},
+			"items": []map[string]interface{}{{"sku": "s1"}, {"sku": "s2", "qty": 3}},
+			"order": tOrder{Lines: []tCustomer{{ID: "c1"}}},
+			"key":   "env",
+			"n":     int(1),
+		}}
+	evs := domain.CapturedEvents{"a": e, "b": domain.EventList{e, e}}
+
+	cases := map[string]interface{}{
+		`a.tags["env"]`:                             "prod",
+		`a.tags["dotted.key"]`:                      1,
+		`a.tags[a.key]`:                             "prod",
+		`a.tags["nested"]["x"]`:                     "y",
+		`a.tags["nested"].x`:                        "y",
+		`a.items[0].sku`:                            "s1",
+		`a.items[a.items[1].qty - 2.000000].qty`:    3,
+		`a.items[a.items[1].qty - 2.000000]["sku"]`: "s2",
+		`a.items[a.n].sku`:                          "s2", // Whole numbers of any type are indices
+		`a.order.lines[0].id`:                       "c1",
+		`b[i-1].tags["env"]`:                        "prod",
+		`b[0].items[1].sku`:                         "s2",
+	}
+	for text, expected := range cases {
+		q, err := Parse("EVENT SEQ(A a, A+ b[]) WHERE " + text + " IS NOT NULL")
+		require.NoError(t, err, text)
+		operand := q.predicate.(*nullCheckPredicate).operand
+		require.Equal(t, text, operand.QueryText())
+		val, err := operand.Value(evs)
+		require.NoError(t, err, text)
+		require.Equal(t, expected, val, text)
+	}
+
+	// Missing keys and out-of-range indices are like missing events
+	for _, text := range []string{`a.tags["missing"]`, `a.items[2].sku`, `a.items[-1]`, `a.tags["missing"]["x"]`,
+		`a.missing["x"]`, `a.items[0]["missing"].x`, `c.tags["env"]`} {
+		q, err := Parse("EVENT SEQ(A a, A+ b[], C c) WHERE " + text + " IS NULL")
+		require.NoError(t, err, text)
+		_, err = q.predicate.(*nullCheckPredicate).operand.Value(evs)
+		require.True(t, errors.Is(err, ErrEventNotFound), "%s: %v", text, err)
+		require.Equal(t, Uncertain, q.predicate.Evaluate(evs), text)
+	}
+	// of a captured event, so a comparison with one is Uncertain, and fails once the candidate is complete
+	for _, text := range []string{`a.tags["missing"]`, `a.items[2].sku`, `a.items[-1]`, `a.tags["missing"]["x"]`,
+		`a.missing["x"]`, `a.items[0]["missing"].x`} {
+		q, err := Parse("EVENT A a WHERE " + text + ` == "prod"`)
+		require.NoError(t, err, text)
+		_, err = q.predicate.(*operatorPredicate).left.Value(evs)
+		require.True(t, errors.Is(err, ErrAttributeNotFound), "%s: %v", text, err)
+		require.Equal(t, Uncertain, q.predicate.Evaluate(evs), text)
+		require.Equal(t, Uncertain, Compile(q.predicate)(evs), text)
+		require.Equal(t, Negative, q.Evaluate(evs), text)
+	}
+	// but subscripts of the wrong type are errors
+	for _, text := range []string{`a.tags[0]`, `a.items["sku"]`, `a.key["x"]`, `a.items[0.5]`, `a.tags[true]`} {
+		q, err := Parse("EVENT A a WHERE " + text + " IS NULL")
+		require.NoError(t, err, text)
+		_, err = q.predicate.(*nullCheckPredicate).operand.Value(evs)
+		require.Error(t, err, text)
+		require.False(t, errors.Is(err, ErrEventNotFound), "%s: %v", text, err)
+	}
+
+	q, err := Parse(`EVENT SEQ(A a, B b) WHERE a.tags["env"] == "prod" AND a.items[0].sku == b.sku`)
+	require.NoError(t, err)
+	require.Equal(t, `(a.tags["env"] == "prod" AND a.items[0].sku == b.sku)`, q.predicate.QueryText())
+	require.Equal(t, []string{"a", "b"}, Aliases(q.predicate))
+	require.Equal(t, Positive, q.Evaluate(domain.CapturedEvents{"a": e, "b": &tEventImpl{typ: "B",
+		attrs: map[string]interface{}{"sku": "s1"}}}))
+
+	for _, text := range []string{`a.tags[]`, `a.tags["x"`, `b[]["x"]`} {
+		_, err := Parse("EVENT SEQ(A a, A+ b[]) WHERE " + text + " IS NULL")
+		require.Error(t, err, text)
+	}
+}
+
+func TestArithmeticValue(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "a",
+			attrs: map[string]interface{}{
+				"x":   float64(1.5),
+				"qty": int(4),
+				"str": "str",
+			},
+		},
+		"b": &tEventImpl{
+			typ: "b",
+			attrs: map[string]interface{}{
+				"y": uint8(2),
+			},
+		},
+	}
+	lit := func(f float64) value { return literalValue{f} }
+
+	cases := map[string]struct {
+		v        value
+		expected interface{}
+	}{
+		"(a.x + b.y) * 2.000000": {
+			&arithmeticValue{
+				left:  &arithmeticValue{attributeLookup("a.x"), attributeLookup("b.y"), aoAdd},
+				right: lit(2),
+				op:    aoMultiply,
+			},
+			float64(7),
+		},
+		"a.x + b.y * 2.000000": {
+			&arithmeticValue{
+				left:  attributeLookup("a.x"),
+				right: &arithmeticValue{attributeLookup("b.y"), lit(2), aoMultiply},
+				op:    aoAdd,
+			},
+			float64(5.5),
+		},
+		"a.qty - (b.y - 1.000000)": {
+			&arithmeticValue{
+				left:  attributeLookup("a.qty"),
+				right: &arithmeticValue{attributeLookup("b.y"), lit(1), aoSubtract},
+				op:    aoSubtract,
+			},
+			float64(3),
+		},
+		"a.qty / b.y / 2.000000": {
+			&arithmeticValue{
+				left:  &arithmeticValue{attributeLookup("a.qty"), attributeLookup("b.y"), aoDivide},
+				right: lit(2),
+				op:    aoDivide,
+			},
+			float64(1),
+		},
+	}
+
+	for queryText, c := range cases {
+		require.Equal(t, queryText, c.v.QueryText())
+		result, err := c.v.Value(evs)
+		require.NoError(t, err, queryText)
+		require.Equal(t, c.expected, result, queryText)
+	}
+
+	// Division by zero and non-numeric operands are errors
+	_, err := (&arithmeticValue{attributeLookup("a.x"), lit(0), aoDivide}).Value(evs)
+	require.Error(t, err)
+	_, err = (&arithmeticValue{attributeLookup("a.str"), lit(1), aoAdd}).Value(evs)
+	require.Error(t, err)
+
+	// Missing events propagate
+	v := &arithmeticValue{
+		left:  &arithmeticValue{attributeLookup("a.x"), attributeLookup("c.z"), aoAdd},
+		right: attributeLookup("b.y"),
+		op:    aoMultiply,
+	}
+	_, err = v.Value(evs)
+	require.Equal(t, ErrEventNotFound, err)
+	require.Equal(t, []string{"a", "c", "b"}, v.usedAliases())
+}
+
+func TestIntegerArithmetic(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "a",
+			attrs: map[string]interface{}{
+				"seq":   int(7),
+				"total": float64(17),
+				"count": uint8(5),
+				"price": decimal.RequireFromString("10.00"),
+				"x":     float64(1.5),
+				"big":   int64(1<<53 + 1), // Which a float64 can't hold
+			},
+		},
+	}
+	cases := map[string]interface{}{
+		"a.big % 2 == 1":                        Positive,
+		"a.big % 10 == 3":                       Positive,
+		"a.seq % 2 == 1":                        Positive,
+		"a.seq % 2 == 0":                        Negative,
+		`a.total \ a.count == 3`:                Positive,
+		`0 - a.seq \ 2 == -3`:                   Positive, // Truncated towards zero
+		"1 + a.seq % 4 == 4":                    Positive, // Precedence: this is 1 + (7 % 4)
+		"(0 - a.seq) % 2 == -1":                 Positive, // The remainder has the sign of the dividend
+		`a.total % a.count + a.total \ 4 == 6`:  Positive, // Binding as tightly as * and /
+		`a.price % 3 == 1 AND a.price \ 3 == 3`: Positive, // Decimals are whole numbers too, if they have no fraction
+		"a.seq % 0 > 1":                         "Division by zero in a.seq % 0.000000",
+		`a.seq \ 0 > 1`:                         `Division by zero in a.seq \ 0.000000`,
+		"a.x % 2 > 1":                           "Cannot apply % to 1.5 and 2, which must be whole numbers",
+		`a.price \ 1.5 > 1`:                     `Cannot apply \ to 10 and 1.5, which must be whole numbers`,
+	}
+	for where, expected := range cases {
+		q, err := Parse("EVENT a a WHERE " + where)
+		require.NoError(t, err, where)
+		result, err := q.predicate.EvaluateErr(evs)
+		if msg, ok := expected.(string); ok {
+			require.Error(t, err, where)
+			require.Contains(t, err.Error(), msg, where)
+		} else {
+			require.NoError(t, err, where)
+			require.Equal(t, expected, result, where)
+		}
+	}
+
+	q, err := Parse(`EVENT a a WHERE a.seq % 2 + a.total \ (a.count % 3) == 1`)
+	require.NoError(t, err)
+	require.Equal(t, `a.seq % 2.000000 + a.total \ (a.count % 3.000000) == 1.000000`, q.predicate.QueryText())
+}
+
+func TestBitwiseArithmetic(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{
+			typ: "a",
+			attrs: map[string]interface{}{
+				"flags": int(0x6),
+				"mask":  uint16(0xFF),
+				"price": decimal.RequireFromString("12.00"),
+				"x":     float64(1.5),
+				"s":     "foo",
+				"big":   int64(1<<60 | 1), // Which a float64 can't hold
+			},
+		},
+		"b": &tEventImpl{typ: "b", attrs: map[string]interface{}{"flags": int(0x3)}},
+	}
+	cases := map[string]interface{}{
+		"a.big & 1 == 1":                      Positive,
+		"~a.big & 1 == 0":                     Positive,
+		"a.flags & 0x4 != 0":                  Positive, // The mask check: this is (a.flags & 4) != 0
+		"a.flags & 0x1 != 0":                  Negative,
+		"a.flags & 0x1 == 0":                  Positive,
+		"a.flags | b.flags == 7":              Positive,
+		"a.flags ^ b.flags == 5":              Positive,
+		"~a.flags == -7":                      Positive,
+		"~a.flags & a.mask == 0xF9":           Positive,
+		"a.flags & 3 + 1 == 4":                Positive, // Arithmetic binds more tightly: this is 6 & (3 + 1)
+		"a.flags | 1 & 2 == 6":                Positive, // & binds more tightly than |: this is 6 | (1 & 2)
+		"a.flags ^ 6 | 1 == 1":                Positive, // ^ binds more tightly than |: this is (6 ^ 6) | 1
+		"a.price & 0xF == 12":                 Positive, // Decimals are whole numbers too, if they have no fraction
+		"1 == a.flags ^ 7":                    Positive, // XOR, as nothing follows which could be ANDed
+		"a.flags == 6 ^ b.flags == 3":         Positive, // AND, as "^" always has been between predicates
+		"a.flags == 6 ^ b.flags & 1 == 0":     Negative,
+		"a.flags BETWEEN 5 ^ 7":               Positive, // BETWEEN 5 AND 7
+		"a.flags BETWEEN (5 ^ 1) AND (4 ^ 3)": Positive,
+		"a.flags IN (2 ^ 4, 0)":               Positive,
+		"a.x & 1 > 0":                         "Cannot apply & to 1.5 and 1, which must be whole numbers",
+		"~a.x > 0":                            "Cannot apply ~ to 1.5, which must be a whole number",
+		"~a.s > 0":                            "Cannot apply ~ to string",
+		"a.s | 1 > 0":                         "Cannot apply | to string and float64",
+	}
+	for where, expected := range cases {
+		q, err := Parse("EVENT SEQ(a a, b b) WHERE " + where)
+		require.NoError(t, err, where)
+		result, err := q.predicate.EvaluateErr(evs)
+		if msg, ok := expected.(string); ok {
+			require.Error(t, err, where)
+			require.Contains(t, err.Error(), msg, where)
+		} else {
+			require.NoError(t, err, where)
+			require.Equal(t, expected, result, where)
+		}
+	}
+
+	// The results are whole numbers too, so aren't rounded either
+	q, err := Parse("EVENT a a WHERE a.big & ~1 == 0")
+	require.NoError(t, err)
+	v, err := q.predicate.(*operatorPredicate).left.Value(evs)
+	require.NoError(t, err)
+	require.Equal(t, int64(1<<60), v)
+	q, err = Parse("EVENT a a WHERE a.price | 1 == 0")
+	require.NoError(t, err)
+	v, err = q.predicate.(*operatorPredicate).left.Value(evs)
+	require.NoError(t, err)
+	require.Equal(t, "13", v.(decimal.Decimal).String())
+
+	rendered := map[string]string{
+		"a.flags & 0x4 != 0":              "a.flags & 4.000000 != 0.000000",
+		"(a.flags | 1) & ~(b.x + 1) > 0":  "(a.flags | 1.000000) & ~(b.x + 1.000000) > 0.000000",
+		"a.flags & b.x ^ 1 | 2 > 0":       "a.flags & b.x ^ 1.000000 | 2.000000 > 0.000000",
+		"a.flags BETWEEN (1 ^ b.x) AND 7": "a.flags BETWEEN (1.000000 ^ b.x) AND 7.000000",
+		"a.x > 1 ^ b.x < 2":               "(a.x > 1.000000 AND b.x < 2.000000)",
+	}
+	for where, expected := range rendered {
+		q, err := Parse("EVENT SEQ(a a, b b) WHERE " + where)
+		require.NoError(t, err, where)
+		require.Equal(t, expected, q.predicate.QueryText(), where)
+	}
+}
+
+func TestConditionalValue(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A a, B b, C c) WHERE (a.vip ? a.priceVip : a.price) < b.budget")
+	require.NoError(t, err)
+	require.Equal(t, "(a.vip == true ? a.priceVip : a.price) < b.budget", q.predicate.QueryText())
+	v := q.predicate.(*operatorPredicate).left
+	require.Equal(t, []string{"a"}, v.usedAliases())
+
+	a := func(vip bool) *tEventImpl {
+		return &tEventImpl{typ: "A", attrs: map[string]interface{}{"vip": vip, "priceVip": 9.0, "price": 10.0}}
+	}
+	result, err := v.Value(domain.CapturedEvents{"a": a(true)})
+	require.NoError(t, err)
+	require.Equal(t, 9.0, result)
+	result, err = v.Value(domain.CapturedEvents{"a": a(false)})
+	require.NoError(t, err)
+	require.Equal(t, 10.0, result)
+
+	// The aliases used are those of the condition and of both values
+	q, err = Parse("EVENT SEQ(A a, B b, C c) WHERE (c.x > 1 ? b.y : a.z) IN (1, 2)")
+	require.NoError(t, err)
+	require.Equal(t, []string{"c", "b", "a"}, q.predicate.usedAliases())
+
+	// Until the condition's events are captured, which value applies isn't known, so what compares it is Uncertain
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{typ: "A", attrs: map[string]interface{}{"z": 1.0}},
+		"b": &tEventImpl{typ: "B", attrs: map[string]interface{}{"y": 3.0}},
+	}
+	_, err = q.predicate.(*inPredicate).left.Value(evs)
+	require.True(t, errors.Is(err, ErrEventNotFound), "%v", err)
+	r, err := q.predicate.EvaluateErr(evs)
+	require.NoError(t, err)
+	require.Equal(t, Uncertain, r)
+	r, err = compilePredicate(q.predicate)(evs)
+	require.NoError(t, err)
+	require.Equal(t, Uncertain, r)
+	evs["c"] = &tEventImpl{typ: "C", attrs: map[string]interface{}{"x": 0.0}}
+	r, err = q.predicate.EvaluateErr(evs)
+	require.NoError(t, err)
+	require.Equal(t, Positive, r)
+
+	// A condition which is already settled applies, even if it refers to events which haven't been captured
+	q, err = Parse("EVENT SEQ(A a, B b, C c) WHERE (a.z > 1 AND c.x > 1 ? b.y : a.z) == 1")
+	require.NoError(t, err)
+	delete(evs, "c")
+	r, err = q.predicate.EvaluateErr(evs)
+	require.NoError(t, err)
+	require.Equal(t, Positive, r)
+
+	// An error evaluating the condition is an error resolving the value
+	q, err = Parse("EVENT SEQ(A a, B b) WHERE ('x' > a.z ? 1 : 2) == 1")
+	require.NoError(t, err)
+	_, err = q.predicate.EvaluateErr(evs)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Could not evaluate the condition of (\"x\" > a.z ? 1.000000 : 2.000000)")
+
+	for query, msg := range map[string]string{
+		"EVENT A a WHERE (a.x ? 1) == 1":        "Expected : after a.x == true ? 1.000000, got ttGroupClose",
+		"EVENT A a WHERE (a.x > 1 ? 1 : 2 == 1": "Unbalanced parentheses",
+		"EVENT A a WHERE (a.x > ? 1 : 2) == 1":  "Unhandled token type: ttConditional",
+	} {
+		_, err := Parse(query)
+		require.Error(t, err, query)
+		require.Contains(t, err.Error(), msg, query)
+	}
+}
+
+func TestLiteralValue(t *testing.T) {
+	cases := map[string]interface{}{
+		`"foo"`:                   "foo",
+		`""`:                      "",
+		`"say \"hi\""`:            `say "hi"`,
+		`"C:\\path\\"`:            `C:\path\`,
+		`"it's"`:                  "it's",
+		`"line\nbreak"`:           "line\nbreak",
+		`"tab\tand\rreturn"`:      "tab\tand\rreturn",
+		`1.500000`:                float64(1.5),
+		`-2.000000`:               float64(-2),
+		`0.100000`:                float64(0.1), // Not representable as a float32
+		`0.0000001234`:            float64(0.0000001234),
+		`1234567.123456789`:       float64(1234567.123456789),
+		`true`:                    true,
+		`false`:                   false,
+		`null`:                    nil,
+		`"\\\"\\"`:                `\"\`,
+		`"unicode ✓"`:             "unicode ✓",
+		`"quotes ' and \" mixed"`: `quotes ' and " mixed`,
+	}
+
+	for queryText, v := range cases {
+		lit := literalValue{v}
+		require.Equal(t, queryText, lit.QueryText())
+		result, err := lit.Value(nil)
+		require.NoError(t, err)
+		require.Equal(t, v, result)
+		require.Equal(t, []string{}, lit.usedAliases())
+
+		// The literal must survive a round-trip through the parser
+		q, err := Parse("EVENT a b WHERE b.x == " + queryText)
+		require.NoError(t, err, queryText)
+		require.Equal(t, lit, q.predicate.(*operatorPredicate).right, queryText)
+	}
+}
+
+func TestTimestampValue(t *testing.T) {
+	stream := tStream("A1 x=1", "B1", "B2")
+	evs := domain.CapturedEvents{"a": stream[0], "b": stream[2]}
+	require.Equal(t, "a.TS", timestampValue("a").QueryText())
+	ts, err := timestampValue("a").Value(evs)
+	require.NoError(t, err)
+	require.Equal(t, stream[0].When(), ts)
+	_, err = timestampValue("c").Value(evs)
+	require.Equal(t, ErrEventNotFound, err)
+
+	cases := map[string]Result{
+		"b.TS - a.TS == 2":            Positive,
+		"b.TS - a.TS < 1":             Negative,
+		"b.TS > a.TS":                 Positive,
+		"a.TS + 2 == b.TS":            Positive,
+		"2.5 + a.TS > b.TS":           Positive,
+		"b.TS - 1.5 < a.TS":           Negative,
+		"b.TS + a.TS > 1":             Negative, // Times can't be added to each other
+		"a.TS * 2 > b.TS":             Negative, // Nor multiplied
+		"a.TS - a.x.y > 1":            Negative,
+		"b.TS - a.TS BETWEEN 1 AND 3": Positive,
+	}
+	for predicate, expected := range cases {
+		q, err := Parse("EVENT SEQ(A a, B b) WHERE " + predicate)
+		require.NoError(t, err, predicate)
+		require.Equal(t, expected, q.Evaluate(evs), predicate)
+	}
+	// A part of a path which is missing leaves the result uncertain, as a missing event would
+	q, err := Parse("EVENT SEQ(A a, B b) WHERE b.TS - a.y.z BETWEEN 1 AND 3")
+	require.NoError(t, err)
+	result, err := q.predicate.EvaluateErr(evs)
+	require.NoError(t, err)
+	require.Equal(t, Uncertain, result)
+
+	// A Kleene closure occurs when its last event did
+	evs["b"] = domain.EventList{stream[1], stream[2]}
+	ts, err = timestampValue("b").Value(evs)
+	require.NoError(t, err)
+	require.Equal(t, stream[2].When(), ts)
+}
+
+func TestDurationLiteral(t *testing.T) {
+	cases := map[string]string{
+		"5s":       "5s",
+		"10m":      "10m",
+		"1h30m":    "1h30m",
+		"90s":      "1m30s",
+		"2h":       "2h",
+		"1h0m5s":   "1h0m5s",
+		"1.5ms":    "1.5ms",
+		"0s":       "0s",
+		"-1m":      "-1m",
+		"1H2M3S":   "1h2m3s",
+		"250us":    "250us",
+		"1h59m60s": "2h",
+	}
+	for queryText, expected := range cases {
+		q, err := Parse("EVENT SEQ(A a, B b) WHERE a.x == " + queryText)
+		require.NoError(t, err, queryText)
+		d := q.predicate.(*operatorPredicate).right
+		require.Equal(t, expected, d.QueryText(), queryText)
+		require.Equal(t, "EVENT SEQ(A a, B b) WHERE a.x == "+expected, q.QueryText())
+	}
+	require.Equal(t, durationLiteralValue(time.Minute), NewLiteral(time.Minute))
+
+	stream := tStream("A1 x=30", "B1")
+	evs := domain.CapturedEvents{"a": stream[0], "b": stream[1]}
+	predicates := map[string]Result{
+		"b.TS - a.TS < 30s":     Positive,
+		"b.TS - a.TS > 1s":      Negative,
+		"b.TS - a.TS == 1000ms": Positive,
+		"a.TS + 1s == b.TS":     Positive,
+		"a.TS < b.TS - 1h":      Negative,
+		"a.x == 30s":            Positive, // As a number of seconds
+		"a.x < 1m / 2 + 1":      Positive,
+	}
+	for predicate, expected := range predicates {
+		q, err := Parse("EVENT SEQ(A a, B b) WHERE " + predicate)
+		require.NoError(t, err, predicate)
+		require.Equal(t, expected, q.Evaluate(evs), predicate)
+		require.Equal(t, expected, q.Compile()(evs), predicate)
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	cases := map[string]string{
+		`'it\'s'`:           "it's",
+		`"he said \"hi\""`:  `he said "hi"`,
+		`'say "hi"'`:        `say "hi"`,
+		`"a\nb\tc\rd"`:      "a\nb\tc\rd",
+		`"\b\f\0"`:          "\b\f\x00",
+		`'\u00e9t\u00C9'`:   "étÉ",
+		`"back\\slash"`:     `back\slash`,
+		`"\d"`:              "d", // Other escaped characters stand for themselves
+		"'raw\nnewline'":    "raw\nnewline",
+		`"trailing \\"`:     `trailing \`,
+		`'mixed \' and \"'`: `mixed ' and "`,
+	}
+	for queryText, expected := range cases {
+		q, err := Parse("EVENT a b WHERE b.x == " + queryText)
+		require.NoError(t, err, queryText)
+		lit := q.predicate.(*operatorPredicate).right
+		require.Equal(t, literalValue{expected}, lit, queryText)
+
+		// It is re-emitted such that it parses back to the same string
+		q, err = Parse("EVENT a b WHERE b.x == " + lit.QueryText())
+		require.NoError(t, err, lit.QueryText())
+		require.Equal(t, lit, q.predicate.(*operatorPredicate).right, lit.QueryText())
+	}
+
+	for _, bad := range []string{`"\u12"`, `"\u12zz"`, `'\u'`} {
+		_, err := Parse("EVENT a b WHERE b.x == " + bad)
+		require.Error(t, err, bad)
+		require.Contains(t, err.Error(), "Invalid escape", bad)
+	}
+
+	_, err := Parse("EVENT a b WHERE b.x == 'foo AND\nb.y == 1")
+	perr, ok := err.(*ParseError)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, "Error tokenizing: Unterminated string literal", perr.Msg)
+	require.Equal(t, 1, perr.Line)
+	require.Equal(t, 24, perr.Column)
+	_, err = Parse(`EVENT a b WHERE b.x == "foo\"`)
+	require.Contains(t, err.Error(), "Unterminated string literal")
+}
@@ -0,0 +1,76 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/obeattie/sase/domain"
+)
+
+// ErrVariableNotSet is returned (wrapped) when a predicate refers to a variable which isn't set for the evaluation
+var ErrVariableNotSet = errors.New("Variable is not set")
+
+type variablesKey struct{}
+
+// WithVariables returns a context carrying variables (keyed by name, without the "$") which the predicates it is used
+// to evaluate may refer to (eg. "a.region == $deployRegion"). Unlike parameters, which are bound once, variables are
+// resolved each time a predicate is evaluated, so they may be supplied afresh with each set of events. The map must not
+// be modified while it is in use.
+func WithVariables(ctx context.Context, vars map[string]interface{}) context.Context {
+	return context.WithValue(ctx, variablesKey{}, vars)
+}
+
+// A variableValue resolves to a variable which the context of an evaluation carries (see WithVariables). It is an error
+// for the variable not to be set: it isn't an event, so isn't Uncertain for being missing.
+type variableValue string // Holds the name
+
+func (v variableValue) QueryText() string {
+	return "$" + string(v)
+}
+
+func (v variableValue) Value(evs domain.CapturedEvents) (interface{}, error) {
+	return v.valueContext(context.Background(), evs)
+}
+
+func (v variableValue) valueContext(ctx context.Context, evs domain.CapturedEvents) (interface{}, error) {
+	vars, _ := ctx.Value(variablesKey{}).(map[string]interface{})
+	val, ok := vars[string(v)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrVariableNotSet, v.QueryText())
+	}
+	return val, nil
+}
+
+func (v variableValue) usedAliases() []string {
+	return []string{}
+}
+
+func (v variableValue) Equal(other value) bool {
+	o, ok := other.(variableValue)
+	return ok && v == o
+}
+
+func (v variableValue) Clone() Value {
+	return v
+}
+
+func (v variableValue) children() []interface{} {
+	return nil
+}
+
+// Variables returns the names of the variables a predicate refers to (without their "$"), sorted
+func Variables(p Predicate) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	Walk(p, func(node interface{}) bool {
+		if v, ok := node.(variableValue); ok && !seen[string(v)] {
+			seen[string(v)] = true
+			result = append(result, string(v))
+		}
+		return true
+	})
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,46 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/obeattie/sase/domain"
+)
+
+func TestVariables(t *testing.T) {
+	evs := domain.CapturedEvents{
+		"a": &tEventImpl{typ: "A", attrs: map[string]interface{}{"region": "eu-west-1", "n": float64(3)}},
+	}
+	q, err := Parse("EVENT A a WHERE a.region == $deployRegion AND a.n < $limit * 2")
+	require.NoError(t, err)
+	require.Equal(t, `(a.region == $deployRegion AND a.n < $limit * 2.000000)`, q.predicate.QueryText())
+	require.Equal(t, []string{"deployRegion", "limit"}, Variables(q.predicate))
+
+	// Variables are resolved afresh with each evaluation
+	ctx := WithVariables(context.Background(), map[string]interface{}{"deployRegion": "eu-west-1", "limit": 2.0})
+	r, err := q.EvaluateContext(ctx, evs)
+	require.NoError(t, err)
+	require.Equal(t, Positive, r)
+	ctx = WithVariables(context.Background(), map[string]interface{}{"deployRegion": "us-east-1", "limit": 2.0})
+	r, err = q.EvaluateContext(ctx, evs)
+	require.NoError(t, err)
+	require.Equal(t, Negative, r)
+
+	// A missing variable is an error, not a missing event
+	ctx = WithVariables(context.Background(), map[string]interface{}{"deployRegion": "eu-west-1"})
+	_, err = q.EvaluateContext(ctx, evs)
+	require.True(t, errors.Is(err, ErrVariableNotSet), "%v", err)
+	require.False(t, errors.Is(err, ErrEventNotFound))
+	require.Contains(t, err.Error(), "$limit")
+	_, err = q.EvaluateErr(evs)
+	require.True(t, errors.Is(err, ErrVariableNotSet), "%v", err)
+
+	// Built programmatically, and with an event missing
+	p := Attr("a", "region").Eq(Var("deployRegion")).And(Attr("b", "region").Eq(Var("deployRegion")))
+	r, err = p.EvaluateContext(ctx, evs)
+	require.NoError(t, err)
+	require.Equal(t, Positive, r)
+}
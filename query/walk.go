@@ -0,0 +1,82 @@
+package query
+
+import (
+	"sort"
+	"time"
+)
+
+// Walk visits every predicate and value in the tree rooted at p, depth-first and in the order they appear in the query
+// text. fn is called with each node (a Predicate or a value); if it returns false, the node's children are skipped.
+func Walk(p Predicate, fn func(node interface{}) bool) {
+	if p != nil {
+		walk(unwrapCondition(p), fn)
+	}
+}
+
+// Literals returns the values of the literals in a predicate, in the order they appear in the query text: numbers (as
+// float64), strings, bools, nil for null and time.Duration for durations
+func Literals(p Predicate) []interface{} {
+	result := make([]interface{}, 0)
+	Walk(p, func(node interface{}) bool {
+		switch v := node.(type) {
+		case literalValue:
+			result = append(result, v.v)
+		case durationLiteralValue:
+			result = append(result, time.Duration(v))
+		}
+		return true
+	})
+	return result
+}
+
+// Aliases returns the aliases of the events a predicate refers to, sorted and without duplicates
+func Aliases(p Predicate) []string {
+	if p == nil {
+		return []string{}
+	}
+	result := append([]string{}, unwrapCondition(p).usedAliases()...)
+	sort.Strings(result)
+	return result
+}
+
+func walk(node interface{}, fn func(node interface{}) bool) {
+	if !fn(node) {
+		return
+	}
+	for _, child := range nodeChildren(node) {
+		walk(child, fn)
+	}
+}
+
+// nodeChildren returns the children of a predicate or value
+func nodeChildren(node interface{}) []interface{} {
+	switch n := node.(type) {
+	case Predicate:
+		return n.children()
+	case value:
+		return n.children()
+	}
+	return nil
+}
+
+// valueNodes returns the non-nil values as children
+func valueNodes(vs ...value) []interface{} {
+	result := make([]interface{}, 0, len(vs))
+	for _, v := range vs {
+		if v != nil {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// predicateNodes returns the non-nil predicates as children
+func predicateNodes(ps ...Predicate) []interface{} {
+	result := make([]interface{}, 0, len(ps))
+	for _, p := range ps {
+		if p != nil {
+			result = append(result, p)
+		}
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalk(t *testing.T) {
+	q, err := Parse("EVENT SEQ(a b, a c) WHERE b.x + 1 > avg(c[].y) AND NOT (b.z IN (1, c.z) OR [foo])")
+	require.NoError(t, err)
+
+	visited := make([]string, 0)
+	Walk(q.predicate, func(node interface{}) bool {
+		visited = append(visited, node.(Representable).QueryText())
+		return true
+	})
+	require.Equal(t, []string{
+		"(b.x + 1.000000 > avg(c[].y) AND NOT (b.z IN (1.000000, c.z) OR [foo]))",
+		"b.x + 1.000000 > avg(c[].y)",
+		"b.x + 1.000000",
+		"b.x",
+		"1.000000",
+		"avg(c[].y)",
+		"c[].y",
+		"NOT (b.z IN (1.000000, c.z) OR [foo])",
+		"(b.z IN (1.000000, c.z) OR [foo])",
+		"b.z IN (1.000000, c.z)",
+		"b.z",
+		"1.000000",
+		"c.z",
+		"[foo]",
+	}, visited)
+
+	// Returning false prunes the node's children, but not its siblings
+	visited = visited[:0]
+	Walk(q.predicate, func(node interface{}) bool {
+		visited = append(visited, node.(Representable).QueryText())
+		_, isOp := node.(*operatorPredicate)
+		_, isNeg := node.(*negationPredicate)
+		return !isOp && !isNeg
+	})
+	require.Equal(t, []string{
+		"(b.x + 1.000000 > avg(c[].y) AND NOT (b.z IN (1.000000, c.z) OR [foo]))",
+		"b.x + 1.000000 > avg(c[].y)",
+		"NOT (b.z IN (1.000000, c.z) OR [foo])",
+	}, visited)
+
+	// Nil predicates and operands are skipped
+	Walk(nil, func(node interface{}) bool {
+		t.Fatal("Should not visit anything")
+		return true
+	})
+	count := 0
+	Walk(&operatorPredicate{left: attributeLookup("a.x"), op: opEq}, func(node interface{}) bool {
+		count++
+		return true
+	})
+	require.Equal(t, 2, count)
+}
+
+func TestLiterals(t *testing.T) {
+	q, err := Parse(`EVENT SEQ(A a, B+ b[]) WHERE a.x + 1 > b[0].y AND a.s IN ("p", null, true) AND ` +
+		`b.TS - a.TS < 1m30s AND a.z BETWEEN -2 AND :high AND [foo]`)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{1.0, 0.0, "p", nil, true, 90 * time.Second, -2.0}, Literals(q.predicate))
+	require.Equal(t, []interface{}{}, Literals(nil))
+}
+
+func TestAliases(t *testing.T) {
+	q, err := Parse("EVENT SEQ(A c, B+ b[], C a) WHERE a.x + c.x > b[c.i].y AND NOT (avg(b[].y) > 1 OR c.TS < a.TS)")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, Aliases(q.predicate))
+	require.Equal(t, []string{"a"}, Aliases(Attr("a", "x").Eq(Lit(1))))
+	require.Equal(t, []string{}, Aliases(nil))
+}